@@ -81,6 +81,31 @@ func (vv *VectorisedView) TrimFront(count int) {
 		vv.RemoveFirst()
 	}
 }
+
+// CapLength irreversibly reduces the length of the vectorised view
+func (vv *VectorisedView) CapLength(length int) {
+	if length < 0 {
+		length = 0
+	}
+	if vv.size < length {
+		return
+	}
+	vv.size = length
+	for i := range vv.views {
+		v := &vv.views[i]
+		if len(*v) >= length {
+			if length == 0 {
+				vv.views = vv.views[:i]
+			} else {
+				v.CapLength(length)
+				vv.views = vv.views[:i + 1]
+			}
+			return
+		}
+		length -= len(*v)
+	}
+}
+
 // RemoveFirst removes the first view of the vectorised view
 func (vv *VectorisedView) RemoveFirst() {
 	if len(vv.views) == 0 {
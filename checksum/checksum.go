@@ -1,5 +1,9 @@
 package checksum
 
+import (
+	"github.com/YaoZengzeng/yustack/buffer"
+)
+
 // Checksum calculates the checksum of the bytes in the given byte array
 func Checksum(buf []byte, initial uint16) uint16 {
 	v := uint32(initial)
@@ -17,6 +21,27 @@ func Checksum(buf []byte, initial uint16) uint16 {
 	return ChecksumCombine(uint16(v), uint16(v >> 16))
 }
 
+// ChecksumVV calculates the checksum of the bytes of the given vectorised
+// view, taken as a whole
+func ChecksumVV(vv *buffer.VectorisedView, initial uint16) uint16 {
+	xsum := initial
+	odd := false
+	for _, v := range vv.Views() {
+		c := Checksum(v, 0)
+		if odd {
+			// The view starts in the middle of a 16-bit word, and the
+			// one's complement sum is byte order independent
+			c = c << 8 | c >> 8
+		}
+		xsum = ChecksumCombine(xsum, c)
+		if len(v) & 1 != 0 {
+			odd = !odd
+		}
+	}
+
+	return xsum
+}
+
 // PseudoHeaderChecksum calculates the pseudo header checksum for the
 // given destination protocol and network address, ignoring the length
 // field. Pseudo headers are needed by transport layer when calculating
@@ -0,0 +1,632 @@
+// Package gonet provides adapters which make the endpoints of the network stack
+// usable through the interfaces of the net package (net.Conn, net.Listener and
+// net.PacketConn), so that code written for the host network (e.g., net/http,
+// crypto/tls) can run on top of yustack
+package gonet
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/transport/tcp"
+	"github.com/YaoZengzeng/yustack/transport/udp"
+	"github.com/YaoZengzeng/yustack/types"
+	"github.com/YaoZengzeng/yustack/waiter"
+)
+
+// listenBacklog is the backlog of the endpoints created by ListenTCP
+const listenBacklog = 10
+
+// errClosed is returned by the operations on closed connections, as by the
+// ones of the net package
+var errClosed = net.ErrClosed
+
+// timeoutError is returned when an operation doesn't complete before its
+// deadline. It implements net.Error
+type timeoutError struct{}
+
+func (*timeoutError) Error() string   { return "i/o timeout" }
+func (*timeoutError) Timeout() bool   { return true }
+func (*timeoutError) Temporary() bool { return true }
+
+// deadlineTimer implements the deadline related methods of net.Conn. Each
+// deadline is represented by a channel which is closed once it expires, or
+// once the connection is closed
+type deadlineTimer struct {
+	mu sync.Mutex
+
+	readTimer     *time.Timer
+	readCancelCh  chan struct{}
+	writeTimer    *time.Timer
+	writeCancelCh chan struct{}
+
+	// closing is closed with the connection, the cancel channels are then
+	// closed for good
+	closing chan struct{}
+}
+
+func (d *deadlineTimer) init() {
+	d.readCancelCh = make(chan struct{})
+	d.writeCancelCh = make(chan struct{})
+	d.closing = make(chan struct{})
+}
+
+// close closes the cancel channels, so that the blocked operations return
+func (d *deadlineTimer) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	close(d.closing)
+	closeOnce(d.readCancelCh)
+	closeOnce(d.writeCancelCh)
+}
+
+// closeOnce closes ch unless it's already closed. The channels of a
+// deadlineTimer are only closed with its mutex held
+func closeOnce(ch chan struct{}) {
+	select {
+	case <-ch:
+	default:
+		close(ch)
+	}
+}
+
+// readContext returns a context which is done once the read deadline expires
+// or the connection is closed
+func (d *deadlineTimer) readContext() context.Context {
+	return cancelContext{d.readCancel()}
+}
+
+// writeContext returns a context which is done once the write deadline expires
+// or the connection is closed
+func (d *deadlineTimer) writeContext() context.Context {
+	return cancelContext{d.writeCancel()}
+}
+
+// opError translates the ErrAborted returned by the blocking endpoint methods
+// when their context is done into the error of the net package
+func (d *deadlineTimer) opError(err error) error {
+	if err != types.ErrAborted {
+		return err
+	}
+
+	select {
+	case <-d.closing:
+		return errClosed
+	default:
+		return &timeoutError{}
+	}
+}
+
+// readCancel returns a channel which is closed when the read deadline expires
+func (d *deadlineTimer) readCancel() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.readCancelCh
+}
+
+// writeCancel returns a channel which is closed when the write deadline
+// expires
+func (d *deadlineTimer) writeCancel() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.writeCancelCh
+}
+
+// setDeadline stops the timer, replaces the cancel channel if it has already
+// been closed, and arms the timer again for t. It must be called with mu held
+func (d *deadlineTimer) setDeadline(cancelCh *chan struct{}, timer **time.Timer, t time.Time) {
+	select {
+	case <-d.closing:
+		return
+	default:
+	}
+
+	if *timer != nil && !(*timer).Stop() {
+		*cancelCh = make(chan struct{})
+	}
+
+	// Create a new channel if we already closed it due to setting an
+	// already expired time
+	select {
+	case <-*cancelCh:
+		*cancelCh = make(chan struct{})
+	default:
+	}
+
+	// The zero value of t means no deadline
+	if t.IsZero() {
+		*timer = nil
+		return
+	}
+
+	timeout := t.Sub(time.Now())
+	if timeout <= 0 {
+		close(*cancelCh)
+		return
+	}
+
+	// Capture the current channel, so that the timer doesn't close one
+	// installed by a later call. It may have been closed with the
+	// connection meanwhile
+	ch := *cancelCh
+	*timer = time.AfterFunc(timeout, func() {
+		d.mu.Lock()
+		closeOnce(ch)
+		d.mu.Unlock()
+	})
+}
+
+// SetReadDeadline implements net.Conn.SetReadDeadline
+func (d *deadlineTimer) SetReadDeadline(t time.Time) error {
+	d.mu.Lock()
+	d.setDeadline(&d.readCancelCh, &d.readTimer, t)
+	d.mu.Unlock()
+
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn.SetWriteDeadline
+func (d *deadlineTimer) SetWriteDeadline(t time.Time) error {
+	d.mu.Lock()
+	d.setDeadline(&d.writeCancelCh, &d.writeTimer, t)
+	d.mu.Unlock()
+
+	return nil
+}
+
+// SetDeadline implements net.Conn.SetDeadline
+func (d *deadlineTimer) SetDeadline(t time.Time) error {
+	d.mu.Lock()
+	d.setDeadline(&d.readCancelCh, &d.readTimer, t)
+	d.setDeadline(&d.writeCancelCh, &d.writeTimer, t)
+	d.mu.Unlock()
+
+	return nil
+}
+
+// cancelContext is a context which is done once its channel is closed. It
+// lets the blocking endpoint methods wait for a deadline
+type cancelContext struct {
+	done <-chan struct{}
+}
+
+func (c cancelContext) Deadline() (time.Time, bool)   { return time.Time{}, false }
+func (c cancelContext) Done() <-chan struct{}         { return c.done }
+func (c cancelContext) Value(interface{}) interface{} { return nil }
+
+func (c cancelContext) Err() error {
+	select {
+	case <-c.done:
+		return context.Canceled
+	default:
+		return nil
+	}
+}
+
+// toNetIP converts a network layer address to a net.IP
+func toNetIP(a types.Address) net.IP {
+	if a == "" {
+		return nil
+	}
+
+	return net.IP(a)
+}
+
+// toAddress converts a net.IP to a network layer address, IPv4 addresses are
+// stored in their 4-byte form
+func toAddress(ip net.IP) types.Address {
+	if ip4 := ip.To4(); ip4 != nil {
+		return types.Address(ip4)
+	}
+
+	return types.Address(ip)
+}
+
+func fullToTCPAddr(addr types.FullAddress) *net.TCPAddr {
+	return &net.TCPAddr{IP: toNetIP(addr.Address), Port: int(addr.Port)}
+}
+
+func fullToUDPAddr(addr types.FullAddress) *net.UDPAddr {
+	return &net.UDPAddr{IP: toNetIP(addr.Address), Port: int(addr.Port)}
+}
+
+// A Listener is a wrapper around a listening TCP endpoint that implements
+// net.Listener
+type Listener struct {
+	stack   *stack.Stack
+	ep      types.Endpoint
+	wq      *waiter.Queue
+	closing chan struct{}
+	once    sync.Once
+}
+
+// NewListener creates a new Listener from a listening TCP endpoint
+func NewListener(s *stack.Stack, wq *waiter.Queue, ep types.Endpoint) *Listener {
+	return &Listener{
+		stack:   s,
+		ep:      ep,
+		wq:      wq,
+		closing: make(chan struct{}),
+	}
+}
+
+// ListenTCP creates a TCP endpoint bound to addr and returns a Listener
+// accepting connections on it
+func ListenTCP(s *stack.Stack, addr types.FullAddress, network types.NetworkProtocolNumber) (*Listener, error) {
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(tcp.ProtocolNumber, network, &wq)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ep.Bind(addr); err != nil {
+		ep.Close()
+		return nil, &net.OpError{Op: "bind", Net: "tcp", Addr: fullToTCPAddr(addr), Err: err}
+	}
+
+	if err := ep.Listen(listenBacklog); err != nil {
+		ep.Close()
+		return nil, &net.OpError{Op: "listen", Net: "tcp", Addr: fullToTCPAddr(addr), Err: err}
+	}
+
+	return NewListener(s, &wq, ep), nil
+}
+
+// Accept implements net.Listener.Accept. It blocks until a new connection is
+// available or the listener is closed
+func (l *Listener) Accept() (net.Conn, error) {
+	n, wq, err := l.ep.AcceptContext(cancelContext{l.closing})
+	if err == types.ErrAborted {
+		err = errClosed
+	}
+	if err != nil {
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: l.Addr(), Err: err}
+	}
+
+	return NewConn(wq, n), nil
+}
+
+// Close implements net.Listener.Close. Blocked Accept calls return an error
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		l.ep.Close()
+		close(l.closing)
+	})
+
+	return nil
+}
+
+// Addr implements net.Listener.Addr
+func (l *Listener) Addr() net.Addr {
+	a, err := l.ep.GetLocalAddress()
+	if err != nil {
+		return nil
+	}
+
+	return fullToTCPAddr(a)
+}
+
+// A Conn is a wrapper around a connected TCP endpoint that implements
+// net.Conn
+type Conn struct {
+	deadlineTimer
+
+	wq   *waiter.Queue
+	ep   types.Endpoint
+	once sync.Once
+
+	// readMu serializes reads and protects read, which holds the data
+	// received from the endpoint but not yet returned to the caller
+	readMu sync.Mutex
+	read   buffer.View
+}
+
+// NewConn creates a new Conn from a connected TCP endpoint
+func NewConn(wq *waiter.Queue, ep types.Endpoint) *Conn {
+	c := &Conn{
+		wq: wq,
+		ep: ep,
+	}
+	c.deadlineTimer.init()
+
+	return c
+}
+
+// DialTCP creates a TCP endpoint connected to addr and returns it as a Conn.
+// It blocks until the connection is established or fails
+func DialTCP(s *stack.Stack, addr types.FullAddress, network types.NetworkProtocolNumber) (*Conn, error) {
+	return DialContextTCP(context.Background(), s, addr, network)
+}
+
+// DialContextTCP is like DialTCP, but gives up the connection attempt when ctx
+// is done
+func DialContextTCP(ctx context.Context, s *stack.Stack, addr types.FullAddress, network types.NetworkProtocolNumber) (*Conn, error) {
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(tcp.ProtocolNumber, network, &wq)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ep.ConnectContext(ctx, addr); err != nil {
+		ep.Close()
+		return nil, &net.OpError{Op: "connect", Net: "tcp", Addr: fullToTCPAddr(addr), Err: err}
+	}
+
+	return NewConn(&wq, ep), nil
+}
+
+func (c *Conn) newOpError(op string, err error) *net.OpError {
+	return &net.OpError{Op: op, Net: "tcp", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: err}
+}
+
+// Read implements net.Conn.Read. It returns io.EOF once the peer has closed
+// its side of the connection and all data has been read
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if len(c.read) == 0 {
+		var err error
+		c.read, err = c.ep.ReadContext(c.readContext(), nil)
+		if err == types.ErrClosedForReceive {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, c.newOpError("read", c.opError(err))
+		}
+	}
+
+	n := copy(b, c.read)
+	c.read.TrimFront(n)
+	if len(c.read) == 0 {
+		c.read = nil
+	}
+
+	return n, nil
+}
+
+// Write implements net.Conn.Write. It blocks until all of b has been queued to
+// be sent, or an error happens
+func (c *Conn) Write(b []byte) (int, error) {
+	// The endpoint keeps a reference to the written view, so b must be
+	// copied
+	v := buffer.NewView(len(b))
+	copy(v, b)
+
+	ctx := c.writeContext()
+	nbytes := 0
+	for len(v) > 0 {
+		n, err := c.ep.WriteContext(ctx, v, nil)
+		if err != nil {
+			return nbytes, c.newOpError("write", c.opError(err))
+		}
+
+		nbytes += int(n)
+		v.TrimFront(int(n))
+	}
+
+	return nbytes, nil
+}
+
+// Close implements net.Conn.Close. Blocked Read and Write calls return an
+// error
+func (c *Conn) Close() error {
+	c.once.Do(func() {
+		c.ep.Close()
+		c.deadlineTimer.close()
+	})
+
+	return nil
+}
+
+// CloseRead shuts down the reading side of the TCP connection
+func (c *Conn) CloseRead() error {
+	if err := c.ep.Shutdown(types.ShutdownRead); err != nil {
+		return c.newOpError("close", err)
+	}
+
+	return nil
+}
+
+// CloseWrite shuts down the writing side of the TCP connection, the peer
+// sees the end of the stream
+func (c *Conn) CloseWrite() error {
+	if err := c.ep.Shutdown(types.ShutdownWrite); err != nil {
+		return c.newOpError("close", err)
+	}
+
+	return nil
+}
+
+// LocalAddr implements net.Conn.LocalAddr
+func (c *Conn) LocalAddr() net.Addr {
+	a, err := c.ep.GetLocalAddress()
+	if err != nil {
+		return nil
+	}
+
+	return fullToTCPAddr(a)
+}
+
+// RemoteAddr implements net.Conn.RemoteAddr
+func (c *Conn) RemoteAddr() net.Addr {
+	a, err := c.ep.GetRemoteAddress()
+	if err != nil {
+		return nil
+	}
+
+	return fullToTCPAddr(a)
+}
+
+// A PacketConn is a wrapper around a UDP endpoint that implements
+// net.PacketConn. If it's created by DialUDP with a remote address, it also
+// implements net.Conn
+type PacketConn struct {
+	deadlineTimer
+
+	wq   *waiter.Queue
+	ep   types.Endpoint
+	once sync.Once
+
+	// raddr is the default destination of the datagrams, and the only
+	// source of the datagrams returned by Read. It's nil if none was given
+	raddr *types.FullAddress
+}
+
+// NewPacketConn creates a new PacketConn from a bound UDP endpoint
+func NewPacketConn(wq *waiter.Queue, ep types.Endpoint) *PacketConn {
+	c := &PacketConn{
+		wq: wq,
+		ep: ep,
+	}
+	c.deadlineTimer.init()
+
+	return c
+}
+
+// DialUDP creates a UDP endpoint bound to laddr and returns it as a
+// PacketConn. If laddr is nil, an ephemeral port is picked. If raddr is not
+// nil, it becomes the default destination of the PacketConn
+func DialUDP(s *stack.Stack, laddr, raddr *types.FullAddress, network types.NetworkProtocolNumber) (*PacketConn, error) {
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, network, &wq)
+	if err != nil {
+		return nil, err
+	}
+
+	var bindAddr types.FullAddress
+	if laddr != nil {
+		bindAddr = *laddr
+	}
+
+	if err := ep.Bind(bindAddr); err != nil {
+		ep.Close()
+		return nil, &net.OpError{Op: "bind", Net: "udp", Addr: fullToUDPAddr(bindAddr), Err: err}
+	}
+
+	c := NewPacketConn(&wq, ep)
+	if raddr != nil {
+		a := *raddr
+		c.raddr = &a
+	}
+
+	return c, nil
+}
+
+func (c *PacketConn) newOpError(op string, err error) *net.OpError {
+	return &net.OpError{Op: op, Net: "udp", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: err}
+}
+
+// readFrom reads one datagram into b, which is truncated if b is too small
+func (c *PacketConn) readFrom(b []byte, addr *types.FullAddress) (int, error) {
+	// Datagram sockets have no end of stream, the endpoint is only closed
+	// for receiving once it's closed
+	v, err := c.ep.ReadContext(c.readContext(), addr)
+	if err == types.ErrClosedForReceive {
+		return 0, c.newOpError("read", errClosed)
+	}
+	if err != nil {
+		return 0, c.newOpError("read", c.opError(err))
+	}
+
+	return copy(b, v), nil
+}
+
+// ReadFrom implements net.PacketConn.ReadFrom
+func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	var addr types.FullAddress
+	n, err := c.readFrom(b, &addr)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return n, fullToUDPAddr(addr), nil
+}
+
+// Read implements net.Conn.Read. Datagrams which don't come from the remote
+// address given to DialUDP are discarded
+func (c *PacketConn) Read(b []byte) (int, error) {
+	for {
+		var addr types.FullAddress
+		n, err := c.readFrom(b, &addr)
+		if err != nil {
+			return 0, err
+		}
+
+		if c.raddr == nil || (addr.Address == c.raddr.Address && addr.Port == c.raddr.Port) {
+			return n, nil
+		}
+	}
+}
+
+// writeTo sends b as one datagram to addr
+func (c *PacketConn) writeTo(b []byte, addr *types.FullAddress) (int, error) {
+	v := buffer.NewView(len(b))
+	copy(v, b)
+
+	n, err := c.ep.WriteContext(c.writeContext(), v, addr)
+	if err != nil {
+		return 0, c.newOpError("write", c.opError(err))
+	}
+
+	return int(n), nil
+}
+
+// WriteTo implements net.PacketConn.WriteTo. addr must be a *net.UDPAddr
+func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, c.newOpError("write", types.ErrInvalidOptionValue)
+	}
+
+	return c.writeTo(b, &types.FullAddress{Address: toAddress(ua.IP), Port: uint16(ua.Port)})
+}
+
+// Write implements net.Conn.Write. The datagram is sent to the remote address
+// given to DialUDP
+func (c *PacketConn) Write(b []byte) (int, error) {
+	if c.raddr == nil {
+		return 0, c.newOpError("write", types.ErrDestinationRequired)
+	}
+
+	return c.writeTo(b, c.raddr)
+}
+
+// Close implements net.PacketConn.Close. Blocked Read and Write calls return
+// an error
+func (c *PacketConn) Close() error {
+	c.once.Do(func() {
+		c.ep.Close()
+		c.deadlineTimer.close()
+	})
+
+	return nil
+}
+
+// LocalAddr implements net.PacketConn.LocalAddr
+func (c *PacketConn) LocalAddr() net.Addr {
+	a, err := c.ep.GetLocalAddress()
+	if err != nil {
+		return nil
+	}
+
+	return fullToUDPAddr(a)
+}
+
+// RemoteAddr implements net.Conn.RemoteAddr. It returns nil if no remote
+// address was given to DialUDP
+func (c *PacketConn) RemoteAddr() net.Addr {
+	if c.raddr == nil {
+		return nil
+	}
+
+	return fullToUDPAddr(*c.raddr)
+}
@@ -0,0 +1,231 @@
+package gonet_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/YaoZengzeng/yustack/gonet"
+	"github.com/YaoZengzeng/yustack/link/loopback"
+	"github.com/YaoZengzeng/yustack/network/ipv4"
+	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/transport/tcp"
+	"github.com/YaoZengzeng/yustack/transport/udp"
+	"github.com/YaoZengzeng/yustack/types"
+)
+
+const (
+	localhost = "\x7f\x00\x00\x01"
+	port      = 1234
+)
+
+// newStack creates a stack with only a loopback NIC
+func newStack(t *testing.T) *stack.Stack {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName, udp.ProtocolName})
+
+	if err := s.CreateNic(1, loopback.New()); err != nil {
+		t.Fatalf("CreateNic failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, localhost); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	return s
+}
+
+// connect returns both ends of a new TCP connection
+func connect(t *testing.T, s *stack.Stack) (net.Conn, net.Conn) {
+	l, err := gonet.ListenTCP(s, types.FullAddress{Port: port}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("ListenTCP failed: %v", err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Errorf("Accept failed: %v", err)
+		}
+		accepted <- c
+	}()
+
+	c, err := gonet.DialTCP(s, types.FullAddress{Address: localhost, Port: port}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("DialTCP failed: %v", err)
+	}
+
+	return c, <-accepted
+}
+
+func TestTCPEcho(t *testing.T) {
+	s := newStack(t)
+	c, sc := connect(t, s)
+	defer c.Close()
+
+	if got, want := c.RemoteAddr().String(), "127.0.0.1:1234"; got != want {
+		t.Errorf("RemoteAddr() = %v, want %v", got, want)
+	}
+
+	go func() {
+		io.Copy(sc, sc)
+		sc.Close()
+	}()
+
+	// Send more than the send buffer can hold, so that the writer has to
+	// wait for the data to be acknowledged
+	want := make([]byte, 3 * tcp.DefaultBufferSize)
+	for i := range want {
+		want[i] = byte(i)
+	}
+
+	go func() {
+		if _, err := c.Write(want); err != nil {
+			t.Errorf("Write failed: %v", err)
+		}
+		c.(*gonet.Conn).CloseWrite()
+	}()
+
+	got, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %d bytes back, want the %d bytes sent", len(got), len(want))
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	s := newStack(t)
+	c, sc := connect(t, s)
+	defer c.Close()
+	defer sc.Close()
+
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := c.Read(make([]byte, 10))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("Read returned %v, want a timeout", err)
+	}
+
+	// Clearing the deadline makes the connection usable again
+	c.SetReadDeadline(time.Time{})
+	if _, err := sc.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	b := make([]byte, 10)
+	n, err := c.Read(b)
+	if err != nil || string(b[:n]) != "hello" {
+		t.Fatalf("Read = %q, %v, want %q", b[:n], err, "hello")
+	}
+}
+
+func TestCloseUnblocksRead(t *testing.T) {
+	s := newStack(t)
+	c, sc := connect(t, s)
+	defer sc.Close()
+
+	done := make(chan error)
+	go func() {
+		_, err := c.Read(make([]byte, 10))
+		done <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("Read succeeded on a closed connection")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Read was not unblocked by Close")
+	}
+}
+
+func TestUDP(t *testing.T) {
+	s := newStack(t)
+
+	server, err := gonet.DialUDP(s, &types.FullAddress{Port: port}, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("DialUDP failed: %v", err)
+	}
+	defer server.Close()
+
+	client, err := gonet.DialUDP(s, nil, &types.FullAddress{Address: localhost, Port: port}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("DialUDP failed: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	b := make([]byte, 100)
+	n, addr, err := server.ReadFrom(b)
+	if err != nil || string(b[:n]) != "ping" {
+		t.Fatalf("ReadFrom = %q, %v, want %q", b[:n], err, "ping")
+	}
+
+	if _, err := server.WriteTo([]byte("pong"), addr); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+
+	n, err = client.Read(b)
+	if err != nil || string(b[:n]) != "pong" {
+		t.Fatalf("Read = %q, %v, want %q", b[:n], err, "pong")
+	}
+
+	// A closed PacketConn returns an error instead of blocking, as
+	// net.UDPConn does
+	server.Close()
+	_, _, err = server.ReadFrom(b)
+	if _, ok := err.(*net.OpError); !ok || !errors.Is(err, net.ErrClosed) {
+		t.Errorf("ReadFrom on a closed PacketConn returned %v, want a *net.OpError wrapping net.ErrClosed", err)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	s := newStack(t)
+
+	l, err := gonet.ListenTCP(s, types.FullAddress{Port: 80}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("ListenTCP failed: %v", err)
+	}
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from "+r.URL.Path)
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return gonet.DialContextTCP(ctx, s, types.FullAddress{Address: localhost, Port: 80}, ipv4.ProtocolNumber)
+			},
+		},
+	}
+
+	resp, err := client.Get("http://yustack/test")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading the body failed: %v", err)
+	}
+	if got, want := string(body), "hello from /test"; got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+}
@@ -15,6 +15,15 @@ const (
 	// ICMPv4EchoMinimumSize is the minimum size of a valid ICMP echo packet
 	ICMPv4EchoMinimumSize = 6
 
+	// ICMPv4EchoHeaderSize is the size of the header of an ICMP echo
+	// packet, including the identifier and sequence number fields
+	ICMPv4EchoHeaderSize = 8
+
+	// ICMPv4ErrorHeaderSize is the size of the header of an ICMP error
+	// message (e.g., Time Exceeded), which is followed by the beginning
+	// of the packet that caused the error
+	ICMPv4ErrorHeaderSize = 8
+
 	// ICMPv4ProtocolNumber is the ICMP transport protocol number
 	ICMPv4ProtocolNumber types.TransportProtocolNumber = 1
 )
@@ -25,7 +34,16 @@ type ICMPv4Type byte
 // Typical values of ICMPv4Type defined in RFC 792
 const (
 	ICMPv4EchoReply			ICMPv4Type = 0
+	ICMPv4DstUnreachable	ICMPv4Type = 3
 	ICMPv4Echo 				ICMPv4Type = 8
+	ICMPv4TimeExceeded		ICMPv4Type = 11
+)
+
+// Values of the ICMP code field of Destination Unreachable messages
+const (
+	ICMPv4NetUnreachable	= 0
+	ICMPv4HostUnreachable	= 1
+	ICMPv4PortUnreachable	= 3
 )
 
 // Type is the ICMP type field
@@ -42,6 +60,21 @@ func (b ICMPv4) Code() byte { return b[1] }
 // SetCode sets the ICMP code field
 func (b ICMPv4) SetCode(c byte) { b[1] = c }
 
+// Checksum is the ICMP checksum field
+func (b ICMPv4) Checksum() uint16 {
+	return binary.BigEndian.Uint16(b[2:])
+}
+
+// Ident is the ICMP identifier field of echo packets
+func (b ICMPv4) Ident() uint16 {
+	return binary.BigEndian.Uint16(b[4:])
+}
+
+// Sequence is the ICMP sequence number field of echo packets
+func (b ICMPv4) Sequence() uint16 {
+	return binary.BigEndian.Uint16(b[6:])
+}
+
 // SetChecksum sets the ICMP checksum field
 func (b ICMPv4) SetChecksum(checksum uint16) {
 	binary.BigEndian.PutUint16(b[2:], checksum)
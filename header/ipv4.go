@@ -75,6 +75,15 @@ const (
 
 	// IPv4 version is the version of the ipv4 protocol
 	IPv4Version = 4
+
+	// IPv4Any is the non-routable IPv4 "any" meta address
+	IPv4Any types.Address = "\x00\x00\x00\x00"
+)
+
+// Flags that may be set in an IPv4 packet
+const (
+	IPv4FlagMoreFragments = 1 << iota
+	IPv4FlagDontFragment
 )
 
 // IPVersion returns the version of IP used in the given packet. It returns -1
@@ -92,6 +101,11 @@ func (b IPv4) HeaderLength() uint8 {
 	return (b[versIHL] & 0xf) * 4
 }
 
+// TOS returns the "type of service" field of the ipv4 header
+func (b IPv4) TOS() uint8 {
+	return b[tos]
+}
+
 // TotalLength returns the "total length" field of the ipv4 header
 func (b IPv4) TotalLength() uint16 {
 	return binary.BigEndian.Uint16(b[totalLen:])
@@ -107,6 +121,22 @@ func (b IPv4) ID() uint16 {
 	return binary.BigEndian.Uint16(b[id:])
 }
 
+// Flags returns the "flags" field of the ipv4 header
+func (b IPv4) Flags() uint8 {
+	return uint8(binary.BigEndian.Uint16(b[flagsFO:]) >> 13)
+}
+
+// FragmentOffset returns the "fragment offset" field of the ipv4 header, in
+// bytes
+func (b IPv4) FragmentOffset() uint16 {
+	return binary.BigEndian.Uint16(b[flagsFO:]) << 3
+}
+
+// TTL returns the "TTL" field of the ipv4 header
+func (b IPv4) TTL() uint8 {
+	return b[ttl]
+}
+
 // SourceAddress returns the "source address" field of the ipv4 header
 func (b IPv4) SourceAddress() types.Address {
 	return types.Address(b[srcAddr : srcAddr + IPv4AddressSize])
@@ -161,6 +191,11 @@ func (b IPv4) SetTotalLength(totalLength uint16) {
 	binary.BigEndian.PutUint16(b[totalLen:], totalLength)
 }
 
+// SetSourceAddress sets the "source address" field of the ipv4 header
+func (b IPv4) SetSourceAddress(addr types.Address) {
+	copy(b[srcAddr : srcAddr + IPv4AddressSize], addr)
+}
+
 // SetChecksum sets the checksum field of the ipv4 field header
 func (b IPv4) SetChecksum(v uint16) {
 	binary.BigEndian.PutUint16(b[ipChecksum:], v)
@@ -1,7 +1,6 @@
 package header
 
 import (
-	"log"
 	"encoding/binary"
 
 	"github.com/YaoZengzeng/yustack/types"
@@ -44,10 +43,6 @@ const (
 	TCPOptionTS	 = 8
 )
 
-const (
-	debug = true
-)
-
 // TCPFields contains the fields of a TCP packet. It is used to describe the
 // fields of a packet that needs to be encoded
 type TCPFields struct {
@@ -110,6 +105,10 @@ const (
 
 	// TCPProtocolNumber is TCP's transport protocol number
 	TCPProtocolNumber types.TransportProtocolNumber	= 6
+
+	// TCPChecksumOffset is the offset of the checksum field in the tcp
+	// header
+	TCPChecksumOffset = tcpChecksum
 )
 
 func (b TCP) SourcePort() uint16 {
@@ -152,6 +151,11 @@ func (b TCP) Options() []byte {
 	return b[TCPMinimumSize:b.DataOffset()]
 }
 
+// SetFlags sets the flags field of the tcp header
+func (b TCP) SetFlags(flags uint8) {
+	b[tcpFlags] = flags
+}
+
 // SetChecksum sets the checksum field of the tcp header
 func (b TCP) SetChecksum(checksum uint16) {
 	binary.BigEndian.PutUint16(b[tcpChecksum:], checksum)
@@ -221,9 +225,6 @@ func ParseSynOptions(opts []byte, isAck bool) TCPSynOptions {
 			}
 			synOpts.MSS = mss
 			i += 4
-			if debug {
-				log.Printf("ParseSynOptions: TCPOptionMSS mss is %v\n", mss)
-			}
 		case TCPOptionWS:
 			// Window Scale -> length is 3
 			if i + 3 > limit || opts[i + 1] != 3 {
@@ -235,9 +236,6 @@ func ParseSynOptions(opts []byte, isAck bool) TCPSynOptions {
 			}
 			synOpts.WS = ws
 			i += 3
-			if debug {
-				log.Printf("ParseSynOptions: TCPOptionWS window scale is %v\n", ws)
-			}
 		case TCPOptionTS:
 			// TimeStamp -> length is 10
 			if i + 10 > limit || opts[i + 1] != 10 {
@@ -251,9 +249,6 @@ func ParseSynOptions(opts []byte, isAck bool) TCPSynOptions {
 			}
 			synOpts.TS = true
 			i += 10
-			if debug {
-				log.Printf("ParseSynOptions: TCPOptionTS\n")
-			}
 		default:
 			// We don't recognize this option, just skip over it
 			if i + 2 > limit {
@@ -288,9 +283,6 @@ func ParseTCPOptions(b []byte) TCPOptions {
 			if i + 10 > limit || b[i + 1] != 10 {
 				return opts
 			}
-			if debug {
-				log.Printf("ParseTCPOptions: TCPOptionTS\n")
-			}
 			opts.TS = true
 			opts.TSVal = binary.BigEndian.Uint32(b[i + 2:])
 			opts.TSEcr = binary.BigEndian.Uint32(b[i + 6:])
@@ -36,6 +36,10 @@ const (
 
 	// UDPProtocolNumber is UDP's transport protocol number
 	UDPProtocolNumber types.TransportProtocolNumber = 17
+
+	// UDPChecksumOffset is the offset of the checksum field in the udp
+	// header
+	UDPChecksumOffset = udpChecksum
 )
 
 // UDP represents a UDP header stored in a byte array
@@ -56,6 +60,11 @@ func (b UDP) Length() uint16 {
 	return binary.BigEndian.Uint16(b[udpLength:])
 }
 
+// Checksum returns the "checksum" field of the udp header
+func (b UDP) Checksum() uint16 {
+	return binary.BigEndian.Uint16(b[udpChecksum:])
+}
+
 // SetChecksum sets the "checksum" field of the udp header
 func (b UDP) SetChecksum(checksum uint16) {
 	binary.BigEndian.PutUint16(b[udpChecksum:], checksum)
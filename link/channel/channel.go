@@ -1,6 +1,8 @@
 package channel
 
 import (
+	"sync"
+
 	"github.com/YaoZengzeng/yustack/buffer"
 	"github.com/YaoZengzeng/yustack/types"
 	"github.com/YaoZengzeng/yustack/stack"
@@ -11,37 +13,60 @@ type PacketInfo struct {
 	Header		buffer.View
 	Payload		buffer.View
 	Protocol	types.NetworkProtocolNumber
+
+	// GSOSize is the segment size of the route the packet was written
+	// through, used by endpoints with CapabilityGSO
+	GSOSize		uint16
 }
 
 // Endpoint is link layer endpoint that stores outbound packets in a channel
 // and allows injection of inbound packets
 type Endpoint struct {
+	mu			sync.RWMutex
 	dispatcher	types.NetworkDispatcher
 	mtu			uint32
+	caps		types.LinkEndpointCapabilities
 
 	C chan PacketInfo
 }
 
 // New creates a new channel endpoint
 func New(size int, mtu uint32) (types.LinkEndpointID, *Endpoint) {
+	return NewWithCapabilities(size, mtu, 0)
+}
+
+// NewWithCapabilities creates a new channel endpoint reporting the given
+// capabilities, e.g., to have the stack write GSO packets to it
+func NewWithCapabilities(size int, mtu uint32, caps types.LinkEndpointCapabilities) (types.LinkEndpointID, *Endpoint) {
 	e := &Endpoint{
 		C:		make(chan PacketInfo, size),
 		mtu:	mtu,
+		caps:	caps,
 	}
 
 	return stack.RegisterLinkEndpoint(e), e
 }
 
-// Inject injects an inbound packet
+// Inject injects an inbound packet, it's dropped if the endpoint isn't
+// attached
 func (e *Endpoint) Inject(protocol types.NetworkProtocolNumber, vv *buffer.VectorisedView) {
+	e.mu.RLock()
+	d := e.dispatcher
+	e.mu.RUnlock()
+	if d == nil {
+		return
+	}
+
 	uu := vv.Clone(nil)
-	e.dispatcher.DeliverNetworkPacket(e, "", protocol, &uu)
+	d.DeliverNetworkPacket(e, "", protocol, &uu)
 }
 
 // Attach saves the stack network layer dispatcher for use later when packets
 // are injected
 func (e *Endpoint) Attach(dispatcher types.NetworkDispatcher) {
+	e.mu.Lock()
 	e.dispatcher = dispatcher
+	e.mu.Unlock()
 }
 
 // MTU implements types.LinkEndpoint.MTU. It returns the value initialized
@@ -56,16 +81,22 @@ func (e *Endpoint) MaxHeaderLength() uint16 {
 	return 0
 }
 
+// Capabilities implements types.LinkEndpoint.Capabilities
+func (e *Endpoint) Capabilities() types.LinkEndpointCapabilities {
+	return e.caps
+}
+
 // LinkAddress returns the link address of this endpoint
 func (e *Endpoint) LinkAddress() types.LinkAddress {
 	return ""
 }
 
 // WritePacket stores outbound packets into the channel
-func (e *Endpoint) WritePacket(_ *types.Route, hdr *buffer.Prependable, payload buffer.View, protocol types.NetworkProtocolNumber) error {
+func (e *Endpoint) WritePacket(r *types.Route, hdr *buffer.Prependable, payload buffer.View, protocol types.NetworkProtocolNumber) error {
 	p := PacketInfo{
 		Header:		hdr.View(),
 		Protocol:	protocol,
+		GSOSize:	r.GSOSize,
 	}
 
 	if payload != nil {
@@ -0,0 +1,420 @@
+// Package fdbased provides the implementation of data-link layer endpoints
+// backed by boundary-preserving file descriptors (e.g., TUN devices, AF_PACKET
+// sockets bound to a veth, or SOCK_SEQPACKET socketpairs).
+//
+// Endpoints created by this package read packets from the file descriptors in
+// their own goroutines and write packets to them directly from the caller
+package fdbased
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/header"
+	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/types"
+)
+
+// BufConfig defines the shape of the vectorized view used to read packets from the Nic
+var BufConfig = []int{128, 256, 512, 1024}
+
+// vnetBufConfig is the shape of the vectorized view used to read packets from
+// file descriptors carrying virtio-net headers, which may be up to 64KB long
+var vnetBufConfig = []int{128, 256, 512, 1024, 65536}
+
+// HeaderMode specifies which link layer header, if any, the packets carried by
+// the file descriptors have
+type HeaderMode int
+
+const (
+	// HeaderNone means packets start directly with the network layer
+	// header. Only IPv4 packets are recognized
+	HeaderNone HeaderMode = iota
+
+	// HeaderEthernet means packets are ethernet frames
+	HeaderEthernet
+)
+
+// Options specify the details about the fd-based endpoint to be created
+type Options struct {
+	// FDs are the file descriptors used to send and receive packets. Each
+	// of them is served by its own dispatch goroutine; they must preserve
+	// packet boundaries. The endpoint takes ownership of them once New
+	// succeeds, they're left to the caller to close if it fails
+	FDs []int
+
+	// MTU is the maximum size of the network layer packets
+	MTU uint32
+
+	// Header is the link layer header mode of the packets
+	Header HeaderMode
+
+	// LinkAddress is the link address of the endpoint. With
+	// HeaderEthernet, inbound frames addressed to another unicast address
+	// are dropped unless it's empty
+	LinkAddress types.LinkAddress
+
+	// VirtioNetHeader means packets are preceded by a struct
+	// virtio_net_hdr, as the ones of tun devices opened with IFF_VNET_HDR.
+	// The checksums of outbound packets and the segmentation of the TCP
+	// ones larger than the MTU are then left to the kernel, which also
+	// tells whether the inbound ones were verified
+	VirtioNetHeader bool
+
+	// GRO coalesces the inbound TCP segments of a connection read in a
+	// row, whose checksums are then verified by the endpoint
+	GRO bool
+}
+
+// queue holds the state used to read packets from one file descriptor
+type queue struct {
+	// fd is the file descriptor used to send and receive packets
+	fd int
+
+	// The sizes of the views
+	bufConfig []int
+	// Buffer used for system call, the virtio-net header, if any, coming
+	// first
+	iovecs []syscall.Iovec
+	// Buffer used to store raw data
+	views []buffer.View
+	// Buffer used to store the virtio-net header
+	vnetHdr [VirtioNetHeaderSize]byte
+
+	// gro holds the packets read in a row, with GRO
+	gro gro
+}
+
+func newQueue(fd int, vnetHdr bool) *queue {
+	q := &queue{
+		fd:			fd,
+		bufConfig:	BufConfig,
+	}
+	if vnetHdr {
+		q.bufConfig = vnetBufConfig
+		q.iovecs = append(q.iovecs, syscall.Iovec{
+			Base:	&q.vnetHdr[0],
+			Len:	VirtioNetHeaderSize,
+		})
+	}
+	q.views = make([]buffer.View, len(q.bufConfig))
+	q.iovecs = append(q.iovecs, make([]syscall.Iovec, len(q.bufConfig))...)
+
+	return q
+}
+
+type endpoint struct {
+	// queues holds one entry per file descriptor
+	queues []*queue
+
+	// mtu (maximum transmission unit) is the maximum size of a packets
+	mtu uint32
+
+	// hdrSize is the size of the link layer header
+	hdrSize int
+
+	// addr is the link address of the endpoint
+	addr types.LinkAddress
+
+	// vnetHdr tells whether packets are preceded by a virtio-net header
+	vnetHdr bool
+
+	// gro tells whether inbound TCP segments are coalesced
+	gro bool
+
+	// mu protects dispatcher, which is nil while the endpoint is detached,
+	// and reading, which tells whether the dispatch goroutines were
+	// started
+	mu			sync.RWMutex
+	dispatcher	types.NetworkDispatcher
+	reading		bool
+}
+
+// New creates a new fd-based endpoint. On errors, the file descriptors are
+// left open for the caller to close, some of them may be non-blocking already
+func New(opts *Options) (types.LinkEndpointID, error) {
+	if len(opts.FDs) == 0 {
+		return 0, types.ErrBadLinkEndpoint
+	}
+
+	e := &endpoint{
+		mtu:		opts.MTU,
+		addr:		opts.LinkAddress,
+		vnetHdr:	opts.VirtioNetHeader,
+		gro:		opts.GRO,
+	}
+
+	switch opts.Header {
+	case HeaderNone:
+	case HeaderEthernet:
+		e.hdrSize = header.EthernetMinimumSize
+	default:
+		return 0, types.ErrInvalidOptionValue
+	}
+
+	for _, fd := range opts.FDs {
+		if err := syscall.SetNonblock(fd, true); err != nil {
+			return 0, err
+		}
+		e.queues = append(e.queues, newQueue(fd, e.vnetHdr))
+	}
+
+	return stack.RegisterLinkEndpoint(e), nil
+}
+
+// MTU implements types.LinkEndpoint.MTU. It returns the value initialized
+// during construction
+func (e *endpoint) MTU() uint32 {
+	return e.mtu
+}
+
+// MaxHeaderLength returns the maximum size of the link layer header, which
+// depends on the header mode, and of the virtio-net header
+func (e *endpoint) MaxHeaderLength() uint16 {
+	if e.vnetHdr {
+		return uint16(e.hdrSize + VirtioNetHeaderSize)
+	}
+	return uint16(e.hdrSize)
+}
+
+// Capabilities implements types.LinkEndpoint.Capabilities. With virtio-net
+// headers the kernel computes and verifies the checksums, segments the large
+// TCP packets and may hand coalesced ones; with GRO the endpoint verifies the
+// checksums of the inbound packets
+func (e *endpoint) Capabilities() types.LinkEndpointCapabilities {
+	var caps types.LinkEndpointCapabilities
+	if e.vnetHdr {
+		caps |= types.CapabilityTXChecksumOffload | types.CapabilityRXChecksumOffload | types.CapabilityGSO | types.CapabilityGRO
+	}
+	if e.gro {
+		caps |= types.CapabilityRXChecksumOffload | types.CapabilityGRO
+	}
+	return caps
+}
+
+// LinkAddress returns the link address of this endpoint
+func (e *endpoint) LinkAddress() types.LinkAddress {
+	return e.addr
+}
+
+// WritePacket writes outbound packets to the file descriptor. If it is not writable
+// right now, drop the packet
+func (e *endpoint) WritePacket(r *types.Route, hdr *buffer.Prependable, payload buffer.View, protocol types.NetworkProtocolNumber) error {
+	if e.hdrSize > 0 {
+		// Without ARP we only know the peer's MAC address if it sent
+		// us a packet first, otherwise fall back to broadcast
+		dst := r.RemoteLinkAddress
+		if dst == "" {
+			dst = header.EthernetBroadcastAddress
+		}
+
+		eth := header.Ethernet(hdr.Prepend(header.EthernetMinimumSize))
+		eth.Encode(&header.EthernetFields{
+			DstAddr:	dst,
+			SrcAddr:	e.addr,
+			Type:		protocol,
+		})
+	}
+
+	if e.vnetHdr {
+		var h virtioNetHeader
+		if protocol == header.IPv4ProtocolNumber {
+			pkt := hdr.UsedBytes()[e.hdrSize:]
+			offloadIPv4(&h, pkt, len(pkt) + len(payload), e.hdrSize, r, e.mtu)
+		}
+		h.encode(hdr.Prepend(VirtioNetHeaderSize))
+	}
+
+	return NonBlockingWrite2(e.pickQueue(r).fd, hdr.UsedBytes(), payload)
+}
+
+// pickQueue selects the queue used to send packets of the given route. All
+// packets between a pair of addresses leave through the same queue so that
+// they are not reordered
+func (e *endpoint) pickQueue(r *types.Route) *queue {
+	if len(e.queues) == 1 {
+		return e.queues[0]
+	}
+
+	h := uint32(2166136261)
+	for _, a := range []types.Address{r.LocalAddress, r.RemoteAddress} {
+		for i := 0; i < len(a); i++ {
+			h ^= uint32(a[i])
+			h *= 16777619
+		}
+	}
+
+	return e.queues[h % uint32(len(e.queues))]
+}
+
+// Attach launches one goroutine per file descriptor that reads packets from it
+// and dispatches them via the provided dispatcher, the first time. The file
+// descriptors are still read while the endpoint is detached, and the packets
+// dropped
+func (e *endpoint) Attach(dispatcher types.NetworkDispatcher) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.dispatcher = dispatcher
+	if dispatcher != nil && !e.reading {
+		e.reading = true
+		for _, q := range e.queues {
+			go e.dispatchLoop(q)
+		}
+	}
+}
+
+// currentDispatcher returns the dispatcher of e, nil if it's detached
+func (e *endpoint) currentDispatcher() types.NetworkDispatcher {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.dispatcher
+}
+
+// dispatchLoop reads packets from the file descriptor of q in a loop and
+// dispatches them to the network stack
+func (e *endpoint) dispatchLoop(q *queue) error {
+	for {
+		ok, err := e.dispatch(q)
+		if err != nil || !ok {
+			return err
+		}
+	}
+}
+
+// dispatch reads one packet from the file descriptor of q and dispatches it.
+// With GRO, it reads the packets available right after it too, and dispatches
+// them once coalesced
+func (e *endpoint) dispatch(q *queue) (bool, error) {
+	n, err := q.read(blockingReadv)
+	if err != nil {
+		return false, err
+	}
+
+	if n <= 0 {
+		return false, nil
+	}
+
+	d := e.currentDispatcher()
+	if d == nil {
+		return true, nil
+	}
+
+	p := e.parse(q, n)
+	if !e.gro {
+		if p != nil {
+			d.DeliverNetworkPacket(e, p.remoteLinkAddr, p.protocol, &p.vv)
+		}
+		return true, nil
+	}
+
+	if p != nil {
+		q.gro.add(p)
+	}
+	for i := 1; i < groBatchSize; i++ {
+		n, err := q.read(nonBlockingReadv)
+		if err != nil || n <= 0 {
+			break
+		}
+		if p := e.parse(q, n); p != nil {
+			q.gro.add(p)
+		}
+	}
+	q.gro.flush(func(p *inbound) {
+		d.DeliverNetworkPacket(e, p.remoteLinkAddr, p.protocol, &p.vv)
+	})
+
+	return true, nil
+}
+
+// read reads one packet from the file descriptor of q into its views with the
+// given function
+func (q *queue) read(readv func(int, []syscall.Iovec) (int, error)) (int, error) {
+	q.allocateViews()
+	return readv(q.fd, q.iovecs)
+}
+
+// parse returns the packet of n bytes read in the views of q, nil if it must be
+// dropped. The views holding it are handed to the packet
+func (e *endpoint) parse(q *queue, n int) *inbound {
+	var vnet virtioNetHeader
+	if e.vnetHdr {
+		if n < VirtioNetHeaderSize {
+			return nil
+		}
+		vnet.decode(q.vnetHdr[:])
+		n -= VirtioNetHeaderSize
+	}
+
+	if n <= e.hdrSize {
+		// Runt frame, ignore it
+		return nil
+	}
+
+	used := q.capViews(n)
+	p := &inbound{vv: buffer.NewVectorisedView(append([]buffer.View(nil), q.views[:used]...), n)}
+
+	// Prepare q.views for another packet: release used views
+	for i := 0; i < used; i++ {
+		q.views[i] = nil
+	}
+
+	if e.hdrSize > 0 {
+		eth := header.Ethernet(p.vv.First())
+		if dst := eth.DestinationAddress(); e.addr != "" && dst != e.addr && dst[0] & 1 == 0 {
+			// Unicast frame for somebody else, e.g., one sent by
+			// the host and seen by an AF_PACKET socket
+			return nil
+		}
+		p.protocol = eth.Type()
+		p.remoteLinkAddr = eth.SourceAddress()
+		p.vv.TrimFront(e.hdrSize)
+	} else {
+		// We don't get any indication of what the packet is, so try to guess
+		// if it's an IPv4 packet. Other packets are left without protocol
+		// for the stack to drop and account for
+		p.protocol = 0
+		if header.IPVersion(p.vv.First()) == header.IPv4Version {
+			p.protocol = header.IPv4ProtocolNumber
+		}
+	}
+
+	// The checksums are verified here if the stack was told they were, and
+	// the kernel didn't
+	verified := e.vnetHdr && vnet.flags & (virtioNetHdrFNeedsCsum | virtioNetHdrFDataValid) != 0
+	if e.Capabilities() & types.CapabilityRXChecksumOffload != 0 && !verified && p.protocol == header.IPv4ProtocolNumber && !validChecksums(&p.vv) {
+		return nil
+	}
+
+	return p
+}
+
+// allocateViews allocates the views released since the last read
+func (q *queue) allocateViews() {
+	base := len(q.iovecs) - len(q.views)
+	for i := range q.views {
+		if q.views[i] != nil {
+			continue
+		}
+		b := buffer.NewView(q.bufConfig[i])
+		q.views[i] = b
+		q.iovecs[base + i] = syscall.Iovec{
+			Base:	&b[0],
+			Len:	uint64(len(b)),
+		}
+	}
+}
+
+func (q *queue) capViews(n int) int {
+	c := 0
+	for i, s := range q.bufConfig {
+		c += s
+		if c >= n {
+			q.views[i].CapLength(s - (c - n))
+			return i + 1
+		}
+	}
+	return len(q.bufConfig)
+}
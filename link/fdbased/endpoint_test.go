@@ -0,0 +1,149 @@
+package fdbased
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/header"
+	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/types"
+)
+
+const (
+	laddr = types.LinkAddress("\x02\x02\x03\x04\x05\x06")
+	raddr = types.LinkAddress("\x02\x02\x03\x04\x05\x07")
+)
+
+type packetInfo struct {
+	raddr    types.LinkAddress
+	proto    types.NetworkProtocolNumber
+	contents buffer.View
+}
+
+type fakeDispatcher struct {
+	ch chan packetInfo
+}
+
+func (d *fakeDispatcher) DeliverNetworkPacket(linkEp types.LinkEndpoint, remoteLinkAddr types.LinkAddress, protocol types.NetworkProtocolNumber, vv *buffer.VectorisedView) {
+	d.ch <- packetInfo{remoteLinkAddr, protocol, vv.ToView()}
+}
+
+// newPair creates two endpoints connected by a socketpair and attaches the
+// second one to a fake dispatcher
+func newPair(t *testing.T, mode HeaderMode) (types.LinkEndpoint, *fakeDispatcher) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair failed: %v", err)
+	}
+
+	id1, err := New(&Options{FDs: fds[:1], MTU: 1500, Header: mode, LinkAddress: laddr})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	id2, err := New(&Options{FDs: fds[1:], MTU: 1500, Header: mode, LinkAddress: raddr})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	d := &fakeDispatcher{ch: make(chan packetInfo, 10)}
+	stack.FindLinkEndpoint(id2).Attach(d)
+
+	return stack.FindLinkEndpoint(id1), d
+}
+
+func newIPv4Packet(size int) (buffer.Prependable, buffer.View) {
+	hdr := buffer.NewPrependable(header.IPv4MinimumSize + header.EthernetMinimumSize)
+	ip := header.IPv4(hdr.Prepend(header.IPv4MinimumSize))
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(header.IPv4MinimumSize + size),
+		TTL:         64,
+		SrcAddr:     "\x0a\x00\x00\x01",
+		DstAddr:     "\x0a\x00\x00\x02",
+	})
+
+	payload := buffer.NewView(size)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	return hdr, payload
+}
+
+func receive(t *testing.T, d *fakeDispatcher) packetInfo {
+	select {
+	case p := <-d.ch:
+		return p
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timed out waiting for packet")
+	}
+	return packetInfo{}
+}
+
+func TestWriteAndDispatch(t *testing.T) {
+	for _, test := range []struct {
+		mode  HeaderMode
+		raddr types.LinkAddress
+	}{
+		{HeaderNone, ""},
+		{HeaderEthernet, laddr},
+	} {
+		ep, d := newPair(t, test.mode)
+		if got, want := ep.MaxHeaderLength(), uint16(0); test.mode == HeaderNone && got != want {
+			t.Errorf("MaxHeaderLength() = %v, want %v", got, want)
+		}
+
+		for _, size := range []int{0, 100, 1400} {
+			hdr, payload := newIPv4Packet(size)
+			want := append(append([]byte{}, hdr.UsedBytes()...), payload...)
+			r := types.Route{RemoteLinkAddress: raddr}
+			if err := ep.WritePacket(&r, &hdr, payload, header.IPv4ProtocolNumber); err != nil {
+				t.Fatalf("WritePacket failed: %v", err)
+			}
+
+			p := receive(t, d)
+			if p.proto != header.IPv4ProtocolNumber {
+				t.Errorf("mode %v: protocol = %x, want %x", test.mode, p.proto, header.IPv4ProtocolNumber)
+			}
+			if p.raddr != test.raddr {
+				t.Errorf("mode %v: remote link address = %x, want %x", test.mode, p.raddr, test.raddr)
+			}
+			if !bytes.Equal(p.contents, want) {
+				t.Errorf("mode %v: contents mismatch for size %d", test.mode, size)
+			}
+		}
+	}
+}
+
+func TestEthernetFiltersOtherHosts(t *testing.T) {
+	ep, d := newPair(t, HeaderEthernet)
+
+	// A frame for another station must be dropped, a broadcast one must not
+	for _, test := range []struct {
+		dst  types.LinkAddress
+		want bool
+	}{
+		{"\x02\x00\x00\x00\x00\x09", false},
+		{"", true},
+	} {
+		hdr, payload := newIPv4Packet(10)
+		r := types.Route{RemoteLinkAddress: test.dst}
+		if err := ep.WritePacket(&r, &hdr, payload, header.IPv4ProtocolNumber); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+
+		select {
+		case <-d.ch:
+			if !test.want {
+				t.Errorf("frame for %x was delivered", test.dst)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if test.want {
+				t.Errorf("frame for %x was not delivered", test.dst)
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package fdbased
+
+import (
+	"bytes"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/header"
+	"github.com/YaoZengzeng/yustack/types"
+)
+
+// groBatchSize is the max number of packets read in a row, and coalesced, by a
+// queue doing GRO
+const groBatchSize = 64
+
+// inbound is a packet read from a file descriptor, the link header removed
+type inbound struct {
+	protocol		types.NetworkProtocolNumber
+	remoteLinkAddr	types.LinkAddress
+	vv				buffer.VectorisedView
+
+	// mss is the size of the payload of the TCP segments coalesced in the
+	// packet, 0 if no more segment can be
+	mss int
+
+	// last is the size of the payload of the last segment coalesced
+	last int
+}
+
+// gro coalesces the TCP segments of a connection read in a row, as linux's
+// generic receive offload does. The segments are merged while they're in
+// sequence and have the same headers, except for the PSH flag ending a burst,
+// and the coalesced packets are larger than the MTU. The checksums of their
+// TCP headers are not updated, the ones of the segments having been verified
+type gro struct {
+	pkts []*inbound
+}
+
+// tcpHeaders returns the IPv4 and TCP headers of p, if it's a TCP segment
+// which can be coalesced with others
+func (p *inbound) tcpHeaders() (header.IPv4, header.TCP, bool) {
+	if p.protocol != header.IPv4ProtocolNumber {
+		return nil, nil, false
+	}
+
+	ip := header.IPv4(p.vv.First())
+	if !ip.IsValid(p.vv.Size()) || int(ip.HeaderLength()) != header.IPv4MinimumSize || int(ip.TotalLength()) != p.vv.Size() {
+		return nil, nil, false
+	}
+	if ip.Protocol() != uint8(header.TCPProtocolNumber) || ip.Flags() & 0x1 != 0 || ip.FragmentOffset() != 0 {
+		return nil, nil, false
+	}
+
+	if len(ip) < header.IPv4MinimumSize + header.TCPMinimumSize {
+		return nil, nil, false
+	}
+	tcp := header.TCP(ip[header.IPv4MinimumSize:])
+	if off := int(tcp.DataOffset()); off < header.TCPMinimumSize || len(tcp) < off {
+		return nil, nil, false
+	}
+
+	return ip, tcp, true
+}
+
+// coalesce appends the payload of the TCP segment q to the one of p if q
+// follows p. ip and tcp are the headers of p, qip and qtcp the ones of q
+func (p *inbound) coalesce(ip header.IPv4, tcp header.TCP, q *inbound, qip header.IPv4, qtcp header.TCP) bool {
+	payload := int(qip.TotalLength()) - header.IPv4MinimumSize - int(qtcp.DataOffset())
+	if p.mss == 0 || p.last != p.mss || payload == 0 || payload > p.mss || p.vv.Size() + payload > 0xffff {
+		return false
+	}
+	if tcp.Flags() != header.TCPFlagAck || qtcp.Flags() &^ header.TCPFlagPsh != header.TCPFlagAck {
+		return false
+	}
+	if qtcp.SequenceNumber() != tcp.SequenceNumber() + uint32(p.vv.Size() - header.IPv4MinimumSize - int(tcp.DataOffset())) {
+		return false
+	}
+
+	// The source and destination, ports and addresses, the acknowledgement
+	// and the window, and the options, e.g., timestamps, must match
+	if qip.TOS() != ip.TOS() || qip.TTL() != ip.TTL() || qip.SourceAddress() != ip.SourceAddress() || qip.DestinationAddress() != ip.DestinationAddress() {
+		return false
+	}
+	if qtcp.SourcePort() != tcp.SourcePort() || qtcp.DestinationPort() != tcp.DestinationPort() || qtcp.AckNumber() != tcp.AckNumber() || qtcp.WindowSize() != tcp.WindowSize() {
+		return false
+	}
+	if !bytes.Equal(qtcp.Options(), tcp.Options()) {
+		return false
+	}
+
+	q.vv.TrimFront(header.IPv4MinimumSize + int(qtcp.DataOffset()))
+	p.vv.SetViews(append(p.vv.Views(), q.vv.Views()...))
+	p.vv.SetSize(p.vv.Size() + payload)
+	ip.SetTotalLength(uint16(p.vv.Size()))
+	ip.SetChecksum(0)
+	ip.SetChecksum(^ip.CalculateChecksum())
+	tcp.SetFlags(qtcp.Flags())
+
+	// A PSH ends the burst
+	p.last = payload
+	if qtcp.Flags() & header.TCPFlagPsh != 0 {
+		p.mss = 0
+	}
+
+	return true
+}
+
+// add coalesces p with the last packet of its connection, or queues it
+func (g *gro) add(p *inbound) {
+	qip, qtcp, ok := p.tcpHeaders()
+	if !ok {
+		g.pkts = append(g.pkts, p)
+		return
+	}
+
+	for i := len(g.pkts) - 1; i >= 0; i-- {
+		prev := g.pkts[i]
+		ip, tcp, ok := prev.tcpHeaders()
+		if !ok || ip.SourceAddress() != qip.SourceAddress() || ip.DestinationAddress() != qip.DestinationAddress() || tcp.SourcePort() != qtcp.SourcePort() || tcp.DestinationPort() != qtcp.DestinationPort() {
+			continue
+		}
+		if prev.coalesce(ip, tcp, p, qip, qtcp) {
+			return
+		}
+		break
+	}
+
+	// The packet may start a burst
+	payload := int(qip.TotalLength()) - header.IPv4MinimumSize - int(qtcp.DataOffset())
+	if qtcp.Flags() == header.TCPFlagAck && payload > 0 {
+		p.mss = payload
+		p.last = payload
+	}
+	g.pkts = append(g.pkts, p)
+}
+
+// flush hands the queued packets to deliver, in order
+func (g *gro) flush(deliver func(p *inbound)) {
+	for i, p := range g.pkts {
+		deliver(p)
+		g.pkts[i] = nil
+	}
+	g.pkts = g.pkts[:0]
+}
@@ -0,0 +1,141 @@
+package fdbased
+
+import (
+	"encoding/binary"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/checksum"
+	"github.com/YaoZengzeng/yustack/header"
+	"github.com/YaoZengzeng/yustack/types"
+)
+
+// VirtioNetHeaderSize is the size of the struct virtio_net_hdr preceding the
+// packets of tun devices opened with IFF_VNET_HDR
+const VirtioNetHeaderSize = 10
+
+// Flags and GSO types of struct virtio_net_hdr
+const (
+	virtioNetHdrFNeedsCsum	= 1
+	virtioNetHdrFDataValid	= 2
+
+	virtioNetHdrGSONone		= 0
+	virtioNetHdrGSOTCPv4	= 1
+)
+
+// virtioNetHeader is a struct virtio_net_hdr. Its fields are in the native byte
+// order of the host, little endian on the architectures supported
+type virtioNetHeader struct {
+	flags		uint8
+	gsoType		uint8
+	hdrLen		uint16
+	gsoSize		uint16
+	csumStart	uint16
+	csumOffset	uint16
+}
+
+func (h *virtioNetHeader) encode(b []byte) {
+	b[0] = h.flags
+	b[1] = h.gsoType
+	binary.LittleEndian.PutUint16(b[2:], h.hdrLen)
+	binary.LittleEndian.PutUint16(b[4:], h.gsoSize)
+	binary.LittleEndian.PutUint16(b[6:], h.csumStart)
+	binary.LittleEndian.PutUint16(b[8:], h.csumOffset)
+}
+
+func (h *virtioNetHeader) decode(b []byte) {
+	h.flags = b[0]
+	h.gsoType = b[1]
+	h.hdrLen = binary.LittleEndian.Uint16(b[2:])
+	h.gsoSize = binary.LittleEndian.Uint16(b[4:])
+	h.csumStart = binary.LittleEndian.Uint16(b[6:])
+	h.csumOffset = binary.LittleEndian.Uint16(b[8:])
+}
+
+// offloadIPv4 completes an outbound IPv4 packet whose checksums were left to
+// the endpoint, and describes what's left to the kernel in h. pkt holds the
+// network header of the packet, and as many bytes after it as are available,
+// size is the size of the whole packet and linkHdrSize the size of the link
+// header before it
+func offloadIPv4(h *virtioNetHeader, pkt []byte, size, linkHdrSize int, r *types.Route, mtu uint32) {
+	ip := header.IPv4(pkt)
+	if len(pkt) < header.IPv4MinimumSize || int(ip.HeaderLength()) > len(pkt) {
+		return
+	}
+	ip.SetChecksum(0)
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	// Header included packets come with their transport checksum, and
+	// without their transport header in pkt
+	hlen := int(ip.HeaderLength())
+	var xsumOffset, l4HdrSize int
+	switch types.TransportProtocolNumber(ip.Protocol()) {
+	case header.TCPProtocolNumber:
+		if len(pkt) < hlen + header.TCPMinimumSize {
+			return
+		}
+		xsumOffset = header.TCPChecksumOffset
+		l4HdrSize = int(header.TCP(pkt[hlen:]).DataOffset())
+	case header.UDPProtocolNumber:
+		xsumOffset = header.UDPChecksumOffset
+		l4HdrSize = header.UDPMinimumSize
+	default:
+		return
+	}
+	if l4HdrSize < xsumOffset + 2 || len(pkt) < hlen + l4HdrSize {
+		return
+	}
+
+	// The kernel adds the checksum of the transport header and payload to
+	// the one of the pseudo-header, which must not be inverted
+	xsum := checksum.PseudoHeaderChecksum(uint32(ip.Protocol()), string(ip.SourceAddress()), string(ip.DestinationAddress()))
+	xsum = checksum.ChecksumCombine(xsum, uint16(size - hlen))
+	binary.BigEndian.PutUint16(pkt[hlen + xsumOffset:], xsum)
+
+	h.flags = virtioNetHdrFNeedsCsum
+	h.csumStart = uint16(linkHdrSize + hlen)
+	h.csumOffset = uint16(xsumOffset)
+
+	if ip.Protocol() == uint8(header.TCPProtocolNumber) && size > int(mtu) {
+		h.gsoType = virtioNetHdrGSOTCPv4
+		h.hdrLen = uint16(linkHdrSize + hlen + l4HdrSize)
+		h.gsoSize = r.GSOSize
+		if max := int(mtu) - hlen - l4HdrSize; h.gsoSize == 0 || int(h.gsoSize) > max {
+			h.gsoSize = uint16(max)
+		}
+	}
+}
+
+// validChecksums tells whether the checksums of the given IPv4 packet, and of
+// the TCP or UDP packet it carries, are right. Malformed packets are left to
+// the stack
+func validChecksums(vv *buffer.VectorisedView) bool {
+	ip := header.IPv4(vv.First())
+	if !ip.IsValid(vv.Size()) || int(ip.HeaderLength()) > len(ip) {
+		return true
+	}
+	if ip.CalculateChecksum() != 0xffff {
+		return false
+	}
+
+	switch types.TransportProtocolNumber(ip.Protocol()) {
+	case header.TCPProtocolNumber:
+	case header.UDPProtocolNumber:
+		if len(ip) < int(ip.HeaderLength()) + header.UDPMinimumSize || header.UDP(ip[ip.HeaderLength():]).Checksum() == 0 {
+			return true
+		}
+	default:
+		return true
+	}
+
+	// The packet is cloned, as its views are trimmed
+	hlen := int(ip.HeaderLength())
+	var views [8]buffer.View
+	payload := vv.Clone(views[:])
+	payload.CapLength(int(ip.TotalLength()))
+	payload.TrimFront(hlen)
+
+	xsum := checksum.PseudoHeaderChecksum(uint32(ip.Protocol()), string(ip.SourceAddress()), string(ip.DestinationAddress()))
+	xsum = checksum.ChecksumCombine(xsum, uint16(payload.Size()))
+
+	return checksum.ChecksumVV(&payload, xsum) == 0xffff
+}
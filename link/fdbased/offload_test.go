@@ -0,0 +1,208 @@
+package fdbased
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/checksum"
+	"github.com/YaoZengzeng/yustack/header"
+	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/types"
+)
+
+// newRawPair creates an endpoint with the given options on one end of a
+// socketpair, and returns it with the other end
+func newRawPair(t *testing.T, opts Options) (types.LinkEndpoint, int) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair failed: %v", err)
+	}
+
+	opts.FDs = fds[:1]
+	opts.MTU = 1500
+	id, err := New(&opts)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	return stack.FindLinkEndpoint(id), fds[1]
+}
+
+// tcpSegment returns an IPv4 packet carrying a TCP segment from the given
+// port, with its checksums
+func tcpSegment(srcPort uint16, seq uint32, flags uint8, size int) buffer.View {
+	pkt := buffer.NewView(header.IPv4MinimumSize + header.TCPMinimumSize + size)
+	ip := header.IPv4(pkt)
+	ip.Encode(&header.IPv4Fields{
+		IHL:			header.IPv4MinimumSize,
+		TotalLength:	uint16(len(pkt)),
+		TTL:			64,
+		Protocol:		uint8(header.TCPProtocolNumber),
+		SrcAddr:		"\x0a\x00\x00\x01",
+		DstAddr:		"\x0a\x00\x00\x02",
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	tcp := header.TCP(pkt[header.IPv4MinimumSize:])
+	tcp.Encode(&header.TCPFields{
+		SrcPort:	srcPort,
+		DstPort:	80,
+		SeqNum:		seq,
+		AckNum:		1,
+		DataOffset:	header.TCPMinimumSize,
+		Flags:		flags,
+		WindowSize:	1000,
+	})
+	for i := range tcp.Payload() {
+		tcp.Payload()[i] = byte(seq) + byte(i)
+	}
+	xsum := checksum.PseudoHeaderChecksum(uint32(header.TCPProtocolNumber), string(ip.SourceAddress()), string(ip.DestinationAddress()))
+	xsum = checksum.Checksum(tcp.Payload(), xsum)
+	tcp.SetChecksum(^tcp.CalculateChecksum(xsum, uint16(len(tcp))))
+
+	return pkt
+}
+
+func TestVirtioNetHeaderWrite(t *testing.T) {
+	ep, fd := newRawPair(t, Options{VirtioNetHeader: true})
+	if got, want := ep.Capabilities(), types.CapabilityTXChecksumOffload | types.CapabilityRXChecksumOffload | types.CapabilityGSO | types.CapabilityGRO; got != want {
+		t.Errorf("Capabilities() = %b, want %b", got, want)
+	}
+
+	for _, test := range []struct {
+		size int
+		want virtioNetHeader
+	}{
+		{100, virtioNetHeader{flags: virtioNetHdrFNeedsCsum, csumStart: 20, csumOffset: 16}},
+		{3000, virtioNetHeader{flags: virtioNetHdrFNeedsCsum, gsoType: virtioNetHdrGSOTCPv4, hdrLen: 40, gsoSize: 1448, csumStart: 20, csumOffset: 16}},
+	} {
+		// The stack leaves both checksums to the endpoint
+		seg := tcpSegment(1000, 1, header.TCPFlagAck, test.size)
+		want := append(buffer.View(nil), seg...)
+		header.IPv4(seg).SetChecksum(0)
+		header.TCP(seg[header.IPv4MinimumSize:]).SetChecksum(0)
+
+		hdr := buffer.NewPrependable(int(ep.MaxHeaderLength()) + 40)
+		copy(hdr.Prepend(40), seg)
+		r := types.Route{GSOSize: 1448}
+		if err := ep.WritePacket(&r, &hdr, seg[40:], header.IPv4ProtocolNumber); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+
+		buf := make([]byte, 65536)
+		n, err := syscall.Read(fd, buf)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		var got virtioNetHeader
+		got.decode(buf)
+		if got != test.want {
+			t.Errorf("size %d: got virtio-net header %+v, want %+v", test.size, got, test.want)
+		}
+
+		// The kernel completes the checksum from the one of the
+		// pseudo-header
+		pkt := buf[VirtioNetHeaderSize:n]
+		tcp := header.TCP(pkt[got.csumStart:])
+		tcp.SetChecksum(^checksum.Checksum(tcp, 0))
+		if !bytes.Equal(pkt, want) {
+			t.Errorf("size %d: the packet written differs from the one expected", test.size)
+		}
+	}
+}
+
+func TestVirtioNetHeaderRead(t *testing.T) {
+	ep, fd := newRawPair(t, Options{VirtioNetHeader: true})
+	d := &fakeDispatcher{ch: make(chan packetInfo, 10)}
+	ep.Attach(d)
+
+	bad := tcpSegment(1000, 1, header.TCPFlagAck, 100)
+	bad[len(bad) - 1] ^= 1
+	for _, test := range []struct {
+		flags	uint8
+		pkt		buffer.View
+		want	bool
+	}{
+		{0, tcpSegment(1000, 1, header.TCPFlagAck, 100), true},
+		{0, bad, false},
+		{virtioNetHdrFDataValid, bad, true},
+		{virtioNetHdrFNeedsCsum, bad, true},
+	} {
+		buf := make([]byte, VirtioNetHeaderSize)
+		h := virtioNetHeader{flags: test.flags}
+		h.encode(buf)
+		if _, err := syscall.Write(fd, append(buf, test.pkt...)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+
+		select {
+		case p := <-d.ch:
+			if !test.want {
+				t.Errorf("flags %d: the packet was delivered", test.flags)
+			} else if !bytes.Equal(p.contents, test.pkt) {
+				t.Errorf("flags %d: contents mismatch", test.flags)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if test.want {
+				t.Errorf("flags %d: the packet was not delivered", test.flags)
+			}
+		}
+	}
+}
+
+func TestGRO(t *testing.T) {
+	ep, fd := newRawPair(t, Options{GRO: true})
+
+	// The segments are queued before the endpoint reads them, so that they
+	// are read in a row
+	bad := tcpSegment(2000, 1, header.TCPFlagAck, 100)
+	bad[len(bad) - 1] ^= 1
+	segs := []buffer.View{
+		tcpSegment(1000, 1, header.TCPFlagAck, 1000),
+		tcpSegment(2000, 1, header.TCPFlagAck, 100),
+		tcpSegment(1000, 1001, header.TCPFlagAck, 1000),
+		bad,
+		tcpSegment(1000, 2001, header.TCPFlagAck | header.TCPFlagPsh, 500),
+		tcpSegment(1000, 2501, header.TCPFlagAck, 1000),
+	}
+	for _, seg := range segs {
+		if _, err := syscall.Write(fd, seg); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	d := &fakeDispatcher{ch: make(chan packetInfo, 10)}
+	ep.Attach(d)
+
+	// The first burst ends with the PSH, the bad segment is dropped
+	p := receive(t, d)
+	ip := header.IPv4(p.contents)
+	if got, want := len(p.contents), 40 + 2500; got != want || int(ip.TotalLength()) != want {
+		t.Fatalf("got a packet of %d bytes, with a total length of %d, want %d", got, ip.TotalLength(), want)
+	}
+	if ip.CalculateChecksum() != 0xffff {
+		t.Errorf("the ipv4 checksum of the coalesced packet is wrong")
+	}
+	tcp := header.TCP(ip.Payload())
+	if got, want := tcp.Flags(), uint8(header.TCPFlagAck | header.TCPFlagPsh); got != want {
+		t.Errorf("flags = %x, want %x", got, want)
+	}
+	for i, seg := range []buffer.View{segs[0], segs[2], segs[4]} {
+		if !bytes.HasPrefix(tcp.Payload()[i * 1000:], header.TCP(seg[header.IPv4MinimumSize:]).Payload()) {
+			t.Errorf("the payload of segment %d is missing", i)
+		}
+	}
+
+	for _, want := range []buffer.View{segs[1], segs[5]} {
+		if p := receive(t, d); !bytes.Equal(p.contents, want) {
+			t.Errorf("got a packet of %d bytes, want the segment of %d bytes", len(p.contents), len(want))
+		}
+	}
+	select {
+	case <-d.ch:
+		t.Errorf("the segment with a bad checksum was delivered")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
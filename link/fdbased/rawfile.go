@@ -0,0 +1,164 @@
+package fdbased
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// Placed here to avoid breakage caused by coverage
+// instrumentation. Any, even unrelated, changes to this file should ensure
+// that coverage still work
+func blockingPoll(fds unsafe.Pointer, nfds int, timeout int64) (n int, err syscall.Errno)
+
+// blockingReadv reads from a file descriptor that is set up as non-blocking and
+// stores the data in a list of iovecs buffers. If no data is available, it will
+// block in a poll() syscall until the file descriptor becomes readable.
+func blockingReadv(fd int, iovecs []syscall.Iovec) (int, error) {
+	for {
+		n, _, e := syscall.RawSyscall(syscall.SYS_READV, uintptr(fd), uintptr(unsafe.Pointer(&iovecs[0])), uintptr(len(iovecs)))
+		if e == 0 {
+			return int(n), nil
+		}
+
+		event := struct {
+			fd		uint32
+			events	int16
+			revents	int16
+		}{
+			fd:		uint32(fd),
+			events:	1, // POLLIN
+		}
+
+		_, e = blockingPoll(unsafe.Pointer(&event), 1, -1)
+		if e != 0 && e != syscall.EINTR {
+			return 0, TranslateErrno(e)
+		}
+	}
+}
+
+// nonBlockingReadv reads from a file descriptor that is set up as non-blocking
+// and stores the data in a list of iovecs buffers. It fails with
+// types.ErrWouldBlock if no data is available
+func nonBlockingReadv(fd int, iovecs []syscall.Iovec) (int, error) {
+	n, _, e := syscall.RawSyscall(syscall.SYS_READV, uintptr(fd), uintptr(unsafe.Pointer(&iovecs[0])), uintptr(len(iovecs)))
+	if e != 0 {
+		return 0, TranslateErrno(e)
+	}
+
+	return int(n), nil
+}
+
+// NonBlockingWrite writes the given buffer to a file descriptor. It fails if
+// partial data is written
+func NonBlockingWrite(fd int, buf []byte) error {
+	var ptr unsafe.Pointer
+	if len(buf) > 0 {
+		ptr = unsafe.Pointer(&buf[0])
+	}
+
+	_, _, e := syscall.RawSyscall(syscall.SYS_WRITE, uintptr(fd), uintptr(ptr), uintptr(len(buf)))
+	if e != 0 {
+		return TranslateErrno(e)
+	}
+
+	return nil
+}
+
+// NonBlockingWrite2 writes up to two byte slices to a file descriptor in a
+// single syscall. It fails if partial data is written
+func NonBlockingWrite2(fd int, b1, b2 []byte) error {
+	// If there is no second buffer, issue a regular write
+	if len(b2) == 0 {
+		return NonBlockingWrite(fd, b1)
+	}
+
+	// We have tow buffers. Build the iovec that represents them and issue
+	// a writev syscall
+	iovec := [...]syscall.Iovec{
+		{
+			Base:	(*byte)(unsafe.Pointer(&b1[0])),
+			Len:	uint64(len(b1)),
+		},
+		{
+			Base:	(*byte)(unsafe.Pointer(&b2[0])),
+			Len:	uint64(len(b2)),
+		},
+	}
+
+	_, _, e := syscall.RawSyscall(syscall.SYS_WRITEV, uintptr(fd), uintptr(unsafe.Pointer(&iovec[0])), 2)
+	if e != 0 {
+		return TranslateErrno(e)
+	}
+
+	return nil
+}
+
+// GetMTU determines the MTU of a network interface device
+func GetMTU(name string) (uint32, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer syscall.Close(fd)
+
+	var ifreq struct {
+		name	[16]byte
+		mtu		int32
+		_		[20]byte
+	}
+
+	copy(ifreq.name[:], name)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFMTU, uintptr(unsafe.Pointer(&ifreq)))
+	if errno != 0 {
+		return 0, errno
+	}
+
+	return uint32(ifreq.mtu), nil
+}
+
+// OpenPacketSocket opens an AF_PACKET raw socket bound to the named network
+// interface (e.g., one end of a veth pair). The returned file descriptor
+// carries whole ethernet frames and is meant to be used with HeaderEthernet
+func OpenPacketSocket(name string) (int, error) {
+	// The protocol is given in network byte order
+	proto := int(htons(syscall.ETH_P_ALL))
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, proto)
+	if err != nil {
+		return -1, err
+	}
+
+	ifindex, err := getIfIndex(fd, name)
+	if err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ALL), Ifindex: ifindex}); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+
+	return fd, nil
+}
+
+// getIfIndex determines the index of a network interface device
+func getIfIndex(fd int, name string) (int, error) {
+	var ifreq struct {
+		name	[16]byte
+		index	int32
+		_		[20]byte
+	}
+
+	copy(ifreq.name[:], name)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFINDEX, uintptr(unsafe.Pointer(&ifreq)))
+	if errno != 0 {
+		return 0, errno
+	}
+
+	return int(ifreq.index), nil
+}
+
+func htons(v uint16) uint16 {
+	return v << 8 | v >> 8
+}
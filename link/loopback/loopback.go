@@ -0,0 +1,84 @@
+// Package loopback provides the implementation of a loopback data-link layer
+// endpoint. The endpoint hands every packet written to it straight back to the
+// dispatcher it is attached to, without any link layer header.
+//
+// Once a NIC is created with this endpoint, the stack routes 127.0.0.0/8 to it
+// automatically; an address (e.g., 127.0.0.1) still has to be added to the NIC
+package loopback
+
+import (
+	"sync"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/types"
+)
+
+// defaultMTU is the MTU of the loopback endpoint, it matches the MTU of the
+// loopback interface on linux systems
+const defaultMTU = 65536
+
+type endpoint struct {
+	mu			sync.RWMutex
+	dispatcher	types.NetworkDispatcher
+}
+
+// New creates a new loopback endpoint
+func New() types.LinkEndpointID {
+	return stack.RegisterLinkEndpoint(&endpoint{})
+}
+
+// Attach implements types.LinkEndpoint.Attach. It just saves the stack network
+// layer dispatcher for later use when packets need to be dispatched
+func (e *endpoint) Attach(dispatcher types.NetworkDispatcher) {
+	e.mu.Lock()
+	e.dispatcher = dispatcher
+	e.mu.Unlock()
+}
+
+// MTU implements types.LinkEndpoint.MTU. It returns a constant that matches the
+// linux loopback interface
+func (*endpoint) MTU() uint32 {
+	return defaultMTU
+}
+
+// Capabilities implements types.LinkEndpoint.Capabilities. Packets never leave
+// the process, so their checksums can't be wrong, and computing or verifying
+// them can be skipped
+func (*endpoint) Capabilities() types.LinkEndpointCapabilities {
+	return types.CapabilityTXChecksumOffload | types.CapabilityRXChecksumOffload | types.CapabilityLoopback
+}
+
+// MaxHeaderLength implements types.LinkEndpoint.MaxHeaderLength. Given that
+// the loopback interface doesn't have a header, it just returns 0
+func (*endpoint) MaxHeaderLength() uint16 {
+	return 0
+}
+
+// LinkAddress returns the link address of this endpoint
+func (*endpoint) LinkAddress() types.LinkAddress {
+	return ""
+}
+
+// WritePacket implements types.LinkEndpoint.WritePacket. It delivers outbound
+// packets to the network layer dispatcher
+func (e *endpoint) WritePacket(_ *types.Route, hdr *buffer.Prependable, payload buffer.View, protocol types.NetworkProtocolNumber) error {
+	e.mu.RLock()
+	d := e.dispatcher
+	e.mu.RUnlock()
+	if d == nil {
+		return nil
+	}
+
+	// The receiver may hold on to the packet, e.g., in a receive queue,
+	// while the caller is free to reuse the payload once we return, so we
+	// hand over a copy
+	v := buffer.NewView(hdr.UsedLength() + len(payload))
+	copy(v, hdr.UsedBytes())
+	copy(v[hdr.UsedLength():], payload)
+
+	vv := v.ToVectorisedView([1]buffer.View{})
+	d.DeliverNetworkPacket(e, "", protocol, &vv)
+
+	return nil
+}
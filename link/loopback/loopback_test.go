@@ -0,0 +1,156 @@
+package loopback_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/link/loopback"
+	"github.com/YaoZengzeng/yustack/network/ipv4"
+	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/transport/tcp"
+	"github.com/YaoZengzeng/yustack/transport/udp"
+	"github.com/YaoZengzeng/yustack/types"
+	"github.com/YaoZengzeng/yustack/waiter"
+)
+
+const (
+	localhost = "\x7f\x00\x00\x01"
+	otherHost = "\x7f\x00\x00\x02"
+	port      = 1234
+)
+
+// newStack creates a stack with only a loopback NIC, and no route table
+func newStack(t *testing.T) *stack.Stack {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName, udp.ProtocolName})
+
+	if err := s.CreateNic(1, loopback.New()); err != nil {
+		t.Fatalf("CreateNic failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, localhost); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	return s
+}
+
+func TestUDP(t *testing.T) {
+	s := newStack(t)
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := ep.Bind(types.FullAddress{Port: port}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	waitEntry, notifyCh := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&waitEntry, waiter.EventIn)
+	defer wq.EventUnregister(&waitEntry)
+
+	for _, dst := range []types.Address{localhost, otherHost} {
+		payload := buffer.View("hello " + dst.String())
+		if _, err := ep.Write(payload, &types.FullAddress{Address: dst, Port: port}); err != nil {
+			t.Fatalf("Write to %v failed: %v", dst, err)
+		}
+
+		select {
+		case <-notifyCh:
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for datagram to %v", dst)
+		}
+
+		var from types.FullAddress
+		v, err := ep.Read(&from)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if !bytes.Equal(v, payload) {
+			t.Errorf("Read() = %q, want %q", v, payload)
+		}
+		if from.Port != port {
+			t.Errorf("sender port = %v, want %v", from.Port, port)
+		}
+	}
+}
+
+func TestTCP(t *testing.T) {
+	s := newStack(t)
+
+	var lwq waiter.Queue
+	l, err := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &lwq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := l.Bind(types.FullAddress{Port: port}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := l.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	acceptEntry, acceptCh := waiter.NewChannelEntry(nil)
+	lwq.EventRegister(&acceptEntry, waiter.EventIn)
+	defer lwq.EventUnregister(&acceptEntry)
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+
+	connectEntry, connectCh := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&connectEntry, waiter.EventOut)
+	if err := ep.Connect(types.FullAddress{Address: otherHost, Port: port}); err != types.ErrConnectStarted {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	select {
+	case <-connectCh:
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for connection")
+	}
+	wq.EventUnregister(&connectEntry)
+	if err := ep.GetSockOpt(types.ErrorOption{}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	select {
+	case <-acceptCh:
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for accept")
+	}
+	n, nwq, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+
+	readEntry, readCh := waiter.NewChannelEntry(nil)
+	nwq.EventRegister(&readEntry, waiter.EventIn)
+	defer nwq.EventUnregister(&readEntry)
+
+	payload := buffer.View("hello over loopback")
+	if _, err := ep.Write(payload, nil); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	v, err := n.Read(nil)
+	if err == types.ErrWouldBlock {
+		select {
+		case <-readCh:
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for data")
+		}
+		v, err = n.Read(nil)
+	}
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(v, payload) {
+		t.Errorf("Read() = %q, want %q", v, payload)
+	}
+}
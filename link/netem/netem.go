@@ -0,0 +1,451 @@
+// Package netem provides a link-layer endpoint which emulates the impairments
+// of real networks, as linux's netem qdisc does: loss, burst loss, delay and
+// jitter, reordering, duplication, corruption and bandwidth limits. It wraps
+// another endpoint, and impairs the packets sent and received through it
+package netem
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/types"
+)
+
+// defaultLimit is the default number of packets delayed at a time in each
+// direction, as with netem
+const defaultLimit = 1000
+
+// GilbertElliott is the two-state Markov model of burst loss. The channel
+// moves from the good state to the bad one with probability P, and back with
+// probability R, at every packet
+type GilbertElliott struct {
+	P			float64
+	R			float64
+
+	// LossGood and LossBad are the loss probabilities in each state,
+	// e.g., 0 and 1 for the simple Gilbert model
+	LossGood	float64
+	LossBad		float64
+}
+
+// Impairments describe how the packets going in one direction are impaired.
+// Probabilities are between 0 and 1, and the zero value impairs nothing
+type Impairments struct {
+	// Loss is the probability of dropping a packet at random
+	Loss		float64
+
+	// BurstLoss, if not nil, drops packets in bursts, on top of Loss
+	BurstLoss	*GilbertElliott
+
+	// Delay is the time every packet is delayed by, give or take a random
+	// Jitter. Jitter reorders the packets by itself
+	Delay		time.Duration
+	Jitter		time.Duration
+
+	// Reorder is the probability of sending a packet right away, ahead of
+	// the delayed ones. It needs a Delay
+	Reorder		float64
+
+	// Duplicate is the probability of sending a packet twice
+	Duplicate	float64
+
+	// Corrupt is the probability of flipping a random bit of a packet
+	Corrupt		float64
+
+	// Rate is the bandwidth in bytes per second, 0 for no limit. Bursts of
+	// up to RateBurst bytes, the MTU if 0, are sent at once
+	Rate		uint64
+	RateBurst	uint64
+
+	// Limit is the number of packets delayed at a time, the ones beyond
+	// are dropped. It defaults to 1000
+	Limit		int
+}
+
+// Options specify the impairments of a netem endpoint
+type Options struct {
+	// Send applies to the packets written by the stack, Receive to the
+	// ones delivered to it
+	Send		Impairments
+	Receive		Impairments
+
+	// Seed seeds the random number generators: the same seed draws the
+	// same losses, delays... for the same sequence of packets
+	Seed		int64
+}
+
+// DirectionStats counts what happened to the packets going in one direction
+type DirectionStats struct {
+	Packets		types.StatCounter
+	Dropped		types.StatCounter
+	Duplicated	types.StatCounter
+	Corrupted	types.StatCounter
+	Reordered	types.StatCounter
+}
+
+// Stats are the counters of a netem endpoint
+type Stats struct {
+	Send		DirectionStats
+	Receive		DirectionStats
+}
+
+type endpoint struct {
+	// dispatchMu protects dispatcher, which is nil while the endpoint is
+	// detached
+	dispatchMu	sync.RWMutex
+	dispatcher	types.NetworkDispatcher
+	lower		types.LinkEndpoint
+
+	send		direction
+	recv		direction
+	stats		Stats
+}
+
+// New creates a new netem link-layer endpoint. It wraps around lower and
+// impairs the packets traversing it as specified by opts
+func New(lower types.LinkEndpointID, opts Options) types.LinkEndpointID {
+	e := &endpoint{
+		lower:	stack.FindLinkEndpoint(lower),
+	}
+	e.send.init(opts.Send, opts.Seed, &e.stats.Send, e.lower.MTU())
+	e.recv.init(opts.Receive, opts.Seed + 1, &e.stats.Receive, e.lower.MTU())
+
+	return stack.RegisterLinkEndpoint(e)
+}
+
+// SetOptions changes the impairments of the netem endpoint with the given id,
+// the random number generators are kept. The packets already delayed aren't
+// affected
+func SetOptions(id types.LinkEndpointID, opts Options) error {
+	e, ok := stack.FindLinkEndpoint(id).(*endpoint)
+	if !ok {
+		return types.ErrBadLinkEndpoint
+	}
+
+	e.send.setImpairments(opts.Send)
+	e.recv.setImpairments(opts.Receive)
+
+	return nil
+}
+
+// Close stops the netem endpoint with the given id: the packets it delays are
+// discarded, and so are the ones it would delay from now on
+func Close(id types.LinkEndpointID) error {
+	e, ok := stack.FindLinkEndpoint(id).(*endpoint)
+	if !ok {
+		return types.ErrBadLinkEndpoint
+	}
+
+	e.send.queue.close()
+	e.recv.queue.close()
+
+	return nil
+}
+
+// GetStats returns the counters of the netem endpoint with the given id
+func GetStats(id types.LinkEndpointID) (*Stats, error) {
+	e, ok := stack.FindLinkEndpoint(id).(*endpoint)
+	if !ok {
+		return nil, types.ErrBadLinkEndpoint
+	}
+
+	return &e.stats, nil
+}
+
+// direction impairs the packets going in one direction
+type direction struct {
+	stats	*DirectionStats
+	mtu		uint32
+
+	// mu protects the impairments and the state drawn from the random
+	// number generator, the order packets take it in decides what
+	// happens to them
+	mu		sync.Mutex
+	imp		Impairments
+	rand	*rand.Rand
+	bad		bool
+
+	// tat is the theoretical arrival time of the next packet under the
+	// rate limit, the token bucket being run as the equivalent GCRA
+	tat		time.Time
+
+	queue	queue
+}
+
+func (d *direction) init(imp Impairments, seed int64, stats *DirectionStats, mtu uint32) {
+	d.imp = imp
+	d.rand = rand.New(rand.NewSource(seed))
+	d.stats = stats
+	d.mtu = mtu
+	d.queue.init()
+}
+
+func (d *direction) setImpairments(imp Impairments) {
+	d.mu.Lock()
+	d.imp = imp
+	d.mu.Unlock()
+}
+
+// chance draws an event of probability p
+func (d *direction) chance(p float64) bool {
+	return p > 0 && d.rand.Float64() < p
+}
+
+// lost tells whether the next packet is lost. d.mu must be held
+func (d *direction) lost() bool {
+	lost := d.chance(d.imp.Loss)
+
+	if ge := d.imp.BurstLoss; ge != nil {
+		if d.bad {
+			d.bad = !d.chance(ge.R)
+		} else {
+			d.bad = d.chance(ge.P)
+		}
+		p := ge.LossGood
+		if d.bad {
+			p = ge.LossBad
+		}
+		if d.chance(p) {
+			lost = true
+		}
+	}
+
+	return lost
+}
+
+// releaseTime returns when a packet of the given size may go under the
+// delays and the rate limit. d.mu must be held
+func (d *direction) releaseTime(now time.Time, size int) (time.Time, bool) {
+	at := now
+	if d.imp.Rate > 0 {
+		burst := d.imp.RateBurst
+		if burst == 0 {
+			burst = uint64(d.mtu)
+		}
+		tau := time.Duration(burst * uint64(time.Second) / d.imp.Rate)
+
+		if d.tat.Before(now) {
+			d.tat = now
+		}
+		if t := d.tat.Add(-tau); t.After(at) {
+			at = t
+		}
+		d.tat = d.tat.Add(time.Duration(uint64(size) * uint64(time.Second) / d.imp.Rate))
+	}
+
+	if d.imp.Delay > 0 && d.chance(d.imp.Reorder) {
+		return at, true
+	}
+
+	delay := d.imp.Delay
+	if d.imp.Jitter > 0 {
+		delay += time.Duration(d.rand.Int63n(int64(2 * d.imp.Jitter) + 1)) - d.imp.Jitter
+	}
+	if delay > 0 {
+		at = at.Add(delay)
+	}
+
+	return at, false
+}
+
+// release tells when a copy of a packet goes, and which of its bits is flipped,
+// -1 if none
+type release struct {
+	at		time.Time
+	flip	int
+}
+
+// process decides what happens to a packet of the given size. It returns when
+// each copy of it goes, none if it's lost, and whether any is delayed
+func (d *direction) process(size int) ([]release, bool) {
+	d.stats.Packets.Increment()
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.lost() {
+		d.stats.Dropped.Increment()
+		return nil, false
+	}
+
+	copies := 1
+	if d.chance(d.imp.Duplicate) {
+		copies = 2
+		d.stats.Duplicated.Increment()
+	}
+
+	releases := make([]release, copies)
+	delayed := false
+	for i := range releases {
+		flip := -1
+		if d.chance(d.imp.Corrupt) && size > 0 {
+			flip = d.rand.Intn(size * 8)
+			d.stats.Corrupted.Increment()
+		}
+
+		at, reordered := d.releaseTime(now, size)
+		if reordered {
+			d.stats.Reordered.Increment()
+		}
+		if at.After(now) {
+			delayed = true
+		}
+		releases[i] = release{at, flip}
+	}
+
+	return releases, delayed
+}
+
+// schedule calls send at the given time, unless too many packets are delayed
+// already
+func (d *direction) schedule(at time.Time, send func()) {
+	d.mu.Lock()
+	limit := d.imp.Limit
+	d.mu.Unlock()
+	if limit == 0 {
+		limit = defaultLimit
+	}
+
+	if !d.queue.push(at, limit, send) {
+		d.stats.Dropped.Increment()
+	}
+}
+
+// flipBit flips the given bit of the bytes of bufs, taken as a whole
+func flipBit(flip int, bufs ...[]byte) {
+	for _, b := range bufs {
+		if flip < len(b) * 8 {
+			b[flip / 8] ^= 1 << uint(flip % 8)
+			return
+		}
+		flip -= len(b) * 8
+	}
+}
+
+// DeliverNetworkPacket implements the types.NetworkDispatcher interface. It is
+// called by the link-layer endpoint being wrapped when a packet arrives, and
+// forwards the packet to the actual dispatcher once impaired
+func (e *endpoint) DeliverNetworkPacket(linkEp types.LinkEndpoint, remoteLinkAddr types.LinkAddress, protocol types.NetworkProtocolNumber, vv *buffer.VectorisedView) {
+	d := e.currentDispatcher()
+	if d == nil {
+		return
+	}
+
+	releases, delayed := e.recv.process(vv.Size())
+	if len(releases) == 1 && !delayed && releases[0].flip < 0 {
+		d.DeliverNetworkPacket(e, remoteLinkAddr, protocol, vv)
+		return
+	}
+
+	for _, r := range releases {
+		v := vv.ToView()
+		if r.flip >= 0 {
+			flipBit(r.flip, v)
+		}
+		deliver := func() {
+			// The endpoint may be detached while the packet is
+			// delayed
+			d := e.currentDispatcher()
+			if d == nil {
+				return
+			}
+			uu := v.ToVectorisedView([1]buffer.View{})
+			d.DeliverNetworkPacket(e, remoteLinkAddr, protocol, &uu)
+		}
+
+		if delayed {
+			e.recv.schedule(r.at, deliver)
+		} else {
+			deliver()
+		}
+	}
+}
+
+// Attach implements the types.LinkEndpoint interface. It saves the dispatcher
+// and registers with lower endpoint as its dispatcher so that "e" is called
+// for inbound packets. A nil dispatcher detaches the lower endpoint too
+func (e *endpoint) Attach(dispatcher types.NetworkDispatcher) {
+	e.dispatchMu.Lock()
+	e.dispatcher = dispatcher
+	e.dispatchMu.Unlock()
+
+	if dispatcher == nil {
+		e.lower.Attach(nil)
+		return
+	}
+	e.lower.Attach(e)
+}
+
+// currentDispatcher returns the dispatcher of e, nil if it's detached
+func (e *endpoint) currentDispatcher() types.NetworkDispatcher {
+	e.dispatchMu.RLock()
+	defer e.dispatchMu.RUnlock()
+
+	return e.dispatcher
+}
+
+func (e *endpoint) MTU() uint32 {
+	return e.lower.MTU()
+}
+
+func (e *endpoint) MaxHeaderLength() uint16 {
+	return e.lower.MaxHeaderLength()
+}
+
+func (e *endpoint) Capabilities() types.LinkEndpointCapabilities {
+	return e.lower.Capabilities()
+}
+
+func (e *endpoint) LinkAddress() types.LinkAddress {
+	return e.lower.LinkAddress()
+}
+
+// WritePacket implements the types.LinkEndpoint interface. It is called by
+// higher-level protocols to write packets, which are impaired before being
+// written to the lower endpoint. Errors of delayed packets are lost, as they
+// would be on a real network
+func (e *endpoint) WritePacket(r *types.Route, hdr *buffer.Prependable, payload buffer.View, protocol types.NetworkProtocolNumber) error {
+	releases, delayed := e.send.process(hdr.UsedLength() + len(payload))
+	if len(releases) == 1 && !delayed && releases[0].flip < 0 {
+		return e.lower.WritePacket(r, hdr, payload, protocol)
+	}
+
+	// The copies are made before any is written, as the lower endpoint
+	// prepends its header to hdr
+	type packet struct {
+		route	types.Route
+		hdr		buffer.Prependable
+		payload	buffer.View
+	}
+	pkts := make([]*packet, len(releases))
+	for i, rel := range releases {
+		pkt := &packet{
+			route:		*r,
+			hdr:		buffer.NewPrependable(int(e.lower.MaxHeaderLength()) + hdr.UsedLength()),
+			payload:	append(buffer.View(nil), payload...),
+		}
+		copy(pkt.hdr.Prepend(hdr.UsedLength()), hdr.UsedBytes())
+		if rel.flip >= 0 {
+			flipBit(rel.flip, pkt.hdr.UsedBytes(), pkt.payload)
+		}
+		pkts[i] = pkt
+	}
+
+	var err error
+	for i, pkt := range pkts {
+		if delayed {
+			pkt := pkt
+			e.send.schedule(releases[i].at, func() {
+				e.lower.WritePacket(&pkt.route, &pkt.hdr, pkt.payload, protocol)
+			})
+		} else if e := e.lower.WritePacket(&pkt.route, &pkt.hdr, pkt.payload, protocol); e != nil {
+			err = e
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,349 @@
+package netem_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/gonet"
+	"github.com/YaoZengzeng/yustack/link/channel"
+	"github.com/YaoZengzeng/yustack/link/netem"
+	"github.com/YaoZengzeng/yustack/network/ipv4"
+	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/transport/tcp"
+	"github.com/YaoZengzeng/yustack/types"
+)
+
+// recorder is a dispatcher recording the packets delivered to it, with the
+// time they arrived at
+type recorder struct {
+	mu		sync.Mutex
+	pkts	[]buffer.View
+	times	[]time.Time
+}
+
+func (r *recorder) DeliverNetworkPacket(_ types.LinkEndpoint, _ types.LinkAddress, _ types.NetworkProtocolNumber, vv *buffer.VectorisedView) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pkts = append(r.pkts, vv.ToView())
+	r.times = append(r.times, time.Now())
+}
+
+// wait waits for n packets to be recorded, and returns them
+func (r *recorder) wait(t *testing.T, n int) ([]buffer.View, []time.Time) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		r.mu.Lock()
+		if len(r.pkts) >= n {
+			defer r.mu.Unlock()
+			return r.pkts, r.times
+		}
+		r.mu.Unlock()
+	}
+	t.Fatalf("got %d packets, want %d", len(r.pkts), n)
+	return nil, nil
+}
+
+// newEndpoint wraps a channel endpoint with a netem endpoint, whose received
+// packets go to the returned recorder
+func newEndpoint(opts netem.Options) (types.LinkEndpointID, *channel.Endpoint, *recorder) {
+	lowerId, lower := channel.New(2048, 1500)
+	id := netem.New(lowerId, opts)
+	r := &recorder{}
+	stack.FindLinkEndpoint(id).Attach(r)
+
+	return id, lower, r
+}
+
+// numbered returns a packet holding i
+func numbered(i int) buffer.View {
+	v := buffer.NewView(100)
+	binary.BigEndian.PutUint32(v, uint32(i))
+	return v
+}
+
+// receive injects count numbered packets, and returns the numbers of the ones
+// which got through
+func receive(t *testing.T, opts netem.Options, count int) []int {
+	id, lower, r := newEndpoint(opts)
+	for i := 0; i < count; i++ {
+		v := numbered(i)
+		vv := v.ToVectorisedView([1]buffer.View{})
+		lower.Inject(ipv4.ProtocolNumber, &vv)
+	}
+
+	stats, err := netem.GetStats(id)
+	if err != nil {
+		t.Fatalf("GetStats failed: %v", err)
+	}
+	pkts, _ := r.wait(t, count - int(stats.Receive.Dropped.Value()))
+
+	var got []int
+	for _, p := range pkts {
+		got = append(got, int(binary.BigEndian.Uint32(p)))
+	}
+	return got
+}
+
+func TestLoss(t *testing.T) {
+	const count = 1000
+	opts := netem.Options{Receive: netem.Impairments{Loss: 0.3}, Seed: 1}
+	got := receive(t, opts, count)
+	if len(got) < 650 || len(got) > 750 {
+		t.Errorf("%d packets out of %d got through, want about 700", len(got), count)
+	}
+
+	// The same seed loses the same packets
+	again := receive(t, opts, count)
+	if len(again) != len(got) {
+		t.Fatalf("%d packets got through the second time, want %d", len(again), len(got))
+	}
+	for i := range got {
+		if got[i] != again[i] {
+			t.Fatalf("packet %d is %d the second time, want %d", i, again[i], got[i])
+		}
+	}
+
+	opts.Seed = 2
+	if other := receive(t, opts, count); len(other) == len(got) {
+		same := true
+		for i := range got {
+			same = same && got[i] == other[i]
+		}
+		if same {
+			t.Errorf("seeds 1 and 2 lost the same packets")
+		}
+	}
+}
+
+func TestBurstLoss(t *testing.T) {
+	const count = 10000
+	got := receive(t, netem.Options{
+		Receive:	netem.Impairments{BurstLoss: &netem.GilbertElliott{P: 0.05, R: 0.25, LossBad: 1}},
+		Seed:		1,
+	}, count)
+
+	// The bad state lasts 1/R packets on average, and the channel is in it
+	// P/(P+R) of the time
+	bursts, lost, next := 0, 0, 0
+	for _, i := range append(got, count) {
+		if i > next {
+			bursts++
+			lost += i - next
+		}
+		next = i + 1
+	}
+	if f := float64(lost) / count; f < 0.12 || f > 0.22 {
+		t.Errorf("lost %v of the packets, want about %v", f, 0.05 / 0.3)
+	}
+	if l := float64(lost) / float64(bursts); l < 3 || l > 5 {
+		t.Errorf("bursts of %v packets on average, want about 4", l)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	const delay = 30 * time.Millisecond
+	_, lower, r := newEndpoint(netem.Options{Receive: netem.Impairments{Delay: delay, Jitter: 5 * time.Millisecond}})
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		v := numbered(i)
+		vv := v.ToVectorisedView([1]buffer.View{})
+		lower.Inject(ipv4.ProtocolNumber, &vv)
+	}
+	_, times := r.wait(t, 10)
+	for i, at := range times {
+		if d := at.Sub(start); d < delay - 5 * time.Millisecond {
+			t.Errorf("packet %d arrived after %v, want at least %v", i, d, delay - 5 * time.Millisecond)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	base := runtime.NumGoroutine()
+	id, lower, r := newEndpoint(netem.Options{Receive: netem.Impairments{Delay: time.Hour}})
+
+	// The first delayed packet starts the goroutine of the queue
+	v := numbered(0)
+	vv := v.ToVectorisedView([1]buffer.View{})
+	lower.Inject(ipv4.ProtocolNumber, &vv)
+	if n := runtime.NumGoroutine(); n <= base {
+		t.Fatalf("got %d goroutines, want more than %d", n, base)
+	}
+
+	if err := netem.Close(id); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > base; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d goroutines after Close, want %d", runtime.NumGoroutine(), base)
+		}
+	}
+
+	// The packets are dropped from now on
+	lower.Inject(ipv4.ProtocolNumber, &vv)
+	stats, err := netem.GetStats(id)
+	if err != nil {
+		t.Fatalf("GetStats failed: %v", err)
+	}
+	if got := stats.Receive.Dropped.Value(); got != 1 {
+		t.Errorf("Dropped = %d, want 1", got)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.pkts) != 0 {
+		t.Errorf("got %d packets after Close, want none", len(r.pkts))
+	}
+}
+
+func TestRate(t *testing.T) {
+	id, lower, _ := newEndpoint(netem.Options{Send: netem.Impairments{Rate: 100000, RateBurst: 1000}})
+	ep := stack.FindLinkEndpoint(id)
+
+	// 10 packets of 1000 bytes at 100kB/s, the first one going at once
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		hdr := buffer.NewPrependable(0)
+		if err := ep.WritePacket(&types.Route{}, &hdr, buffer.NewView(1000), ipv4.ProtocolNumber); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		<-lower.C
+	}
+	if d := time.Since(start); d < 80 * time.Millisecond || d > 500 * time.Millisecond {
+		t.Errorf("sending took %v, want about 90ms", d)
+	}
+}
+
+func TestDuplicateCorruptReorder(t *testing.T) {
+	const count = 100
+	id, lower, r := newEndpoint(netem.Options{
+		Receive:	netem.Impairments{Duplicate: 1, Corrupt: 1, Delay: 20 * time.Millisecond, Reorder: 0.3},
+		Seed:		1,
+	})
+	for i := 0; i < count; i++ {
+		v := numbered(i)
+		vv := v.ToVectorisedView([1]buffer.View{})
+		lower.Inject(ipv4.ProtocolNumber, &vv)
+	}
+	pkts, _ := r.wait(t, 2 * count)
+
+	reordered := false
+	for i, p := range pkts {
+		// Each copy has one bit flipped, which may be in the number
+		diff := 0
+		for j := range p {
+			want := byte(0)
+			if j < 4 {
+				want = p[j]
+			}
+			for b := p[j] ^ want; b != 0; b &= b - 1 {
+				diff++
+			}
+		}
+		if diff > 1 {
+			t.Errorf("packet %d has %d flipped bits outside its number, want at most 1", i, diff)
+		}
+		if i > 0 && bytes.Compare(p[:4], pkts[i - 1][:4]) < 0 {
+			reordered = true
+		}
+	}
+	if !reordered {
+		t.Errorf("no packet was reordered")
+	}
+
+	stats, _ := netem.GetStats(id)
+	if got := stats.Receive.Duplicated.Value(); got != count {
+		t.Errorf("Duplicated = %d, want %d", got, count)
+	}
+	if got := stats.Receive.Corrupted.Value(); got != 2 * count {
+		t.Errorf("Corrupted = %d, want %d", got, 2 * count)
+	}
+	if got := stats.Receive.Reordered.Value(); got == 0 {
+		t.Errorf("Reordered = 0, want some")
+	}
+}
+
+// pipe delivers the packets written to a to the stack of b
+func pipe(a, b *channel.Endpoint) {
+	for pkt := range a.C {
+		vv := buffer.NewVectorisedView([]buffer.View{pkt.Header, pkt.Payload}, len(pkt.Header) + len(pkt.Payload))
+		b.Inject(pkt.Protocol, &vv)
+	}
+}
+
+// newImpairedStack creates a stack with the given address, whose Nic goes
+// through a netem endpoint impairing the packets it sends. TCP doesn't
+// retransmit data nor queue out of order segments yet, so the packets are
+// neither lost nor reordered
+func newImpairedStack(t *testing.T, addr types.Address, seed int64) (*stack.Stack, *channel.Endpoint) {
+	lowerId, lower := channel.New(2048, 1500)
+	id := netem.New(lowerId, netem.Options{
+		Send:	netem.Impairments{
+			Delay:		2 * time.Millisecond,
+			Duplicate:	0.05,
+			Rate:		10 * 1000 * 1000,
+			RateBurst:	16 * 1024,
+		},
+		Seed:	seed,
+	})
+
+	s := stack.New([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName})
+	if err := s.CreateNic(1, id); err != nil {
+		t.Fatalf("CreateNic failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, addr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]types.RouteEntry{{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", Nic: 1}})
+
+	return s, lower
+}
+
+func TestTCPTransfer(t *testing.T) {
+	const serverAddr = "\x0a\x00\x00\x01"
+	server, serverEp := newImpairedStack(t, serverAddr, 1)
+	client, clientEp := newImpairedStack(t, "\x0a\x00\x00\x02", 2)
+	go pipe(serverEp, clientEp)
+	go pipe(clientEp, serverEp)
+
+	l, err := gonet.ListenTCP(server, types.FullAddress{Port: 80}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("ListenTCP failed: %v", err)
+	}
+	defer l.Close()
+
+	data := make([]byte, 256 * 1024)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(data)
+	}()
+
+	conn, err := gonet.DialTCP(client, types.FullAddress{Address: serverAddr, Port: 80}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("DialTCP failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	got, err := ioutil.ReadAll(io.LimitReader(conn, int64(len(data))))
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("received %d bytes which differ from the %d sent", len(got), len(data))
+	}
+}
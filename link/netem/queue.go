@@ -0,0 +1,138 @@
+package netem
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// delayedPacket is a packet waiting in a queue, send sends it
+type delayedPacket struct {
+	at		time.Time
+	seq		uint64
+	send	func()
+}
+
+// packetHeap orders the packets by release time, then by arrival
+type packetHeap []*delayedPacket
+
+func (h packetHeap) Len() int {
+	return len(h)
+}
+
+func (h packetHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+
+func (h packetHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *packetHeap) Push(x interface{}) {
+	*h = append(*h, x.(*delayedPacket))
+}
+
+func (h *packetHeap) Pop() interface{} {
+	old := *h
+	p := old[len(old) - 1]
+	*h = old[:len(old) - 1]
+	return p
+}
+
+// queue holds the delayed packets of a direction, and sends them in order
+// from a goroutine started with the first one
+type queue struct {
+	mu		sync.Mutex
+	pkts	packetHeap
+	seq		uint64
+	started	bool
+	closed	bool
+
+	// wake is signaled when a packet is pushed, done is closed with the
+	// queue to stop the goroutine
+	wake	chan struct{}
+	done	chan struct{}
+}
+
+func (q *queue) init() {
+	q.wake = make(chan struct{}, 1)
+	q.done = make(chan struct{})
+}
+
+// close stops the goroutine of the queue, the packets queued are discarded and
+// the ones pushed later are refused
+func (q *queue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.pkts = nil
+	close(q.done)
+}
+
+// push queues send to be called at the given time. It returns false if limit
+// packets are queued already, or if the queue is closed
+func (q *queue) push(at time.Time, limit int, send func()) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed || len(q.pkts) >= limit {
+		return false
+	}
+	heap.Push(&q.pkts, &delayedPacket{at: at, seq: q.seq, send: send})
+	q.seq++
+
+	if !q.started {
+		q.started = true
+		go q.run()
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+// run sends the packets as their time comes, until the queue is closed
+func (q *queue) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		q.mu.Lock()
+		var wait time.Duration
+		var p *delayedPacket
+		if len(q.pkts) == 0 {
+			wait = time.Hour
+		} else if wait = time.Until(q.pkts[0].at); wait <= 0 {
+			p = heap.Pop(&q.pkts).(*delayedPacket)
+		}
+		q.mu.Unlock()
+
+		if p != nil {
+			p.send()
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-q.wake:
+		case <-q.done:
+			return
+		}
+	}
+}
@@ -1,49 +1,332 @@
 package sniffer
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io"
 	"log"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/YaoZengzeng/yustack/logger"
 	"github.com/YaoZengzeng/yustack/stack"
 	"github.com/YaoZengzeng/yustack/types"
 	"github.com/YaoZengzeng/yustack/buffer"
 	"github.com/YaoZengzeng/yustack/header"
 )
 
-var LogPackets uint32 = 1
+// Filter reports whether the given packet should be logged. prefix is either
+// "send" or "recv", and b holds the whole packet starting at its network layer
+// header
+type Filter func(prefix string, protocol types.NetworkProtocolNumber, b []byte) bool
+
+// Options specify how a sniffer endpoint logs the packets traversing it
+type Options struct {
+	// Disabled, if true, creates the endpoint with logging turned off. It
+	// can be turned on later with SetEnabled
+	Disabled bool
+
+	// Filter selects the packets to be logged. If it's nil, all packets
+	// are logged
+	Filter Filter
+}
 
 type endpoint struct {
+	// dispatchMu protects dispatcher, which is nil while the endpoint is
+	// detached
+	dispatchMu	sync.RWMutex
 	dispatcher	types.NetworkDispatcher
 	lower		types.LinkEndpoint
+
+	// logging is 1 if packets are logged, it is accessed atomically
+	logging		uint32
+	filter		Filter
+
+	// The following fields are only used when writing a pcap file, the
+	// mutex serializes the records written by concurrent goroutines. The
+	// write errors are reported to logger
+	mu			sync.Mutex
+	writer		io.Writer
+	maxPCAPLen	uint32
+	ethernet	bool
+	logger		logger.Logger
 }
 
 // New creates a new sniffer link-layer endpoint. It wraps around
 // endpoint and logs packets and they traverse the endpoint
 func New(lower types.LinkEndpointID) types.LinkEndpointID {
-	return stack.RegisterLinkEndpoint(&endpoint{
+	return NewWithOptions(lower, Options{})
+}
+
+// NewWithOptions creates a new sniffer link-layer endpoint which logs the
+// packets traversing it as specified by opts
+func NewWithOptions(lower types.LinkEndpointID, opts Options) types.LinkEndpointID {
+	e := &endpoint{
 		lower:	stack.FindLinkEndpoint(lower),
-	})
+		filter:	opts.Filter,
+		logger:	logger.Discard,
+	}
+	if !opts.Disabled {
+		e.logging = 1
+	}
+
+	return stack.RegisterLinkEndpoint(e)
+}
+
+// SetEnabled turns logging on or off on the sniffer endpoint with the given id
+func SetEnabled(id types.LinkEndpointID, enabled bool) error {
+	e, ok := stack.FindLinkEndpoint(id).(*endpoint)
+	if !ok {
+		return types.ErrBadLinkEndpoint
+	}
+
+	v := uint32(0)
+	if enabled {
+		v = 1
+	}
+	atomic.StoreUint32(&e.logging, v)
+
+	return nil
+}
+
+// SetLogger sets the logger the sniffer endpoint with the given id reports the
+// errors writing its pcap file to. A nil logger, the default, discards them
+func SetLogger(id types.LinkEndpointID, l logger.Logger) error {
+	e, ok := stack.FindLinkEndpoint(id).(*endpoint)
+	if !ok {
+		return types.ErrBadLinkEndpoint
+	}
+
+	if l == nil {
+		l = logger.Discard
+	}
+	e.mu.Lock()
+	e.logger = l
+	e.mu.Unlock()
+
+	return nil
+}
+
+// TransportFilter returns a Filter which only selects IPv4 packets carrying
+// one of the given transport protocols
+func TransportFilter(protocols ...types.TransportProtocolNumber) Filter {
+	return func(_ string, protocol types.NetworkProtocolNumber, b []byte) bool {
+		if protocol != header.IPv4ProtocolNumber || len(b) < header.IPv4MinimumSize {
+			return false
+		}
+
+		p := header.IPv4(b).TransportProtocol()
+		for _, want := range protocols {
+			if p == want {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// logPacket logs the packet if logging is enabled and the filter selects it
+func (e *endpoint) logPacket(prefix string, protocol types.NetworkProtocolNumber, b []byte) {
+	if atomic.LoadUint32(&e.logging) == 0 {
+		return
+	}
+
+	if e.filter != nil && !e.filter(prefix, protocol, b) {
+		return
+	}
+
+	LogPacket(prefix, protocol, b, nil)
+}
+
+// The link types written in the pcap file header, see
+// http://www.tcpdump.org/linktypes.html
+const (
+	pcapLinkTypeEthernet = 1
+	pcapLinkTypeRaw		 = 101
+)
+
+type pcapHeader struct {
+	// MagicNumber is the file magic number
+	MagicNumber uint32
+
+	// VersionMajor is the major version number
+	VersionMajor uint16
+
+	// VersionMinor is the minor version number
+	VersionMinor uint16
+
+	// Thiszone is the GMT to local correction
+	Thiszone int32
+
+	// Sigfigs is the accuracy of timestamps
+	Sigfigs uint32
+
+	// Snaplen is the max length of captured packets, in octets
+	Snaplen uint32
+
+	// Network is the data link type
+	Network uint32
+}
+
+type pcapPacketHeader struct {
+	// Seconds is the timestamp seconds
+	Seconds uint32
+
+	// Microseconds is the timestamp microseconds
+	Microseconds uint32
+
+	// IncludedLength is the number of octets of packet saved in file
+	IncludedLength uint32
+
+	// OriginalLength is the actual length of packet
+	OriginalLength uint32
+}
+
+// NewWithPCAP creates a new sniffer link-layer endpoint. It wraps around
+// endpoint and writes the packets that traverse it, in both directions, to
+// writer in the libpcap file format. Packets longer than snapLen are truncated.
+// Logging is disabled on the returned endpoint
+//
+// The capture uses the ethernet link type if the lower endpoint has an
+// ethernet address, in which case the ethernet headers are rebuilt from the
+// route and the link addresses; otherwise it uses the raw IP link type
+func NewWithPCAP(lower types.LinkEndpointID, writer io.Writer, snapLen uint32) (types.LinkEndpointID, error) {
+	e := &endpoint{
+		lower:		stack.FindLinkEndpoint(lower),
+		writer:		writer,
+		maxPCAPLen:	snapLen,
+		logger:		logger.Discard,
+	}
+	if e.lower == nil {
+		return 0, types.ErrBadLinkEndpoint
+	}
+
+	network := uint32(pcapLinkTypeRaw)
+	if len(e.lower.LinkAddress()) == header.EthernetAddressSize {
+		e.ethernet = true
+		network = pcapLinkTypeEthernet
+	}
+
+	hdr := pcapHeader{
+		MagicNumber:	0xa1b2c3d4,
+		VersionMajor:	2,
+		VersionMinor:	4,
+		Snaplen:		snapLen,
+		Network:		network,
+	}
+	if err := binary.Write(writer, binary.BigEndian, hdr); err != nil {
+		return 0, err
+	}
+
+	return stack.RegisterLinkEndpoint(e), nil
+}
+
+// dumpPacket writes a pcap record made of the given byte slices, which are
+// concatenated, and prefixed with an ethernet header in ethernet captures
+func (e *endpoint) dumpPacket(src, dst types.LinkAddress, protocol types.NetworkProtocolNumber, bufs ...[]byte) {
+	if e.writer == nil {
+		return
+	}
+
+	if e.ethernet {
+		eth := header.Ethernet(make([]byte, header.EthernetMinimumSize))
+		eth.Encode(&header.EthernetFields{
+			SrcAddr:	src,
+			DstAddr:	dst,
+			Type:		protocol,
+		})
+		bufs = append([][]byte{eth}, bufs...)
+	}
+
+	length := 0
+	for _, b := range bufs {
+		length += len(b)
+	}
+
+	// The timestamp is taken holding the lock for the records to be written
+	// in chronological order
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	hdr := pcapPacketHeader{
+		Seconds:		uint32(now.Unix()),
+		Microseconds:	uint32(now.Nanosecond() / 1000),
+		IncludedLength:	uint32(length),
+		OriginalLength:	uint32(length),
+	}
+	if hdr.IncludedLength > e.maxPCAPLen {
+		hdr.IncludedLength = e.maxPCAPLen
+	}
+
+	if err := binary.Write(e.writer, binary.BigEndian, hdr); err != nil {
+		e.logger.Log(logger.LevelWarning, "sniffer: writing a pcap record header failed", "err", err)
+		return
+	}
+
+	left := int(hdr.IncludedLength)
+	for _, b := range bufs {
+		if left == 0 {
+			break
+		}
+		if len(b) > left {
+			b = b[:left]
+		}
+		if _, err := e.writer.Write(b); err != nil {
+			e.logger.Log(logger.LevelWarning, "sniffer: writing a pcap record failed", "err", err)
+			return
+		}
+		left -= len(b)
+	}
 }
 
 // DeliverNetworkPacket implements the types.NetworkDispatcher interface. It is
 // called by the link-layer endpoint being wrapped when a packet arrives, and
 // logs the packet before forwarding to the actual dispatcher
 func (e *endpoint) DeliverNetworkPacket(linkEp types.LinkEndpoint, remoteLinkAddr types.LinkAddress, protocol types.NetworkProtocolNumber, vv *buffer.VectorisedView) {
-	if atomic.LoadUint32(&LogPackets) == 1 {
-		LogPacket("recv", protocol, vv.First(), nil)
+	d := e.currentDispatcher()
+	if d == nil {
+		return
+	}
+
+	if atomic.LoadUint32(&e.logging) == 1 {
+		e.logPacket("recv", protocol, vv.ToView())
 	}
-	e.dispatcher.DeliverNetworkPacket(e, remoteLinkAddr, protocol, vv)
+	if e.writer != nil {
+		views := vv.Views()
+		bufs := make([][]byte, len(views))
+		for i := range views {
+			bufs[i] = views[i]
+		}
+		e.dumpPacket(remoteLinkAddr, e.lower.LinkAddress(), protocol, bufs...)
+	}
+	d.DeliverNetworkPacket(e, remoteLinkAddr, protocol, vv)
 }
 
 // Attach implements the types.LinkEndpoint interface. It saves the dispatcher
 // and registers with lower endpoint as its dispatcher so that "e" is called
-// for inbound packets
+// for inbound packets. A nil dispatcher detaches the lower endpoint too
 func (e *endpoint) Attach(dispatcher types.NetworkDispatcher) {
+	e.dispatchMu.Lock()
 	e.dispatcher = dispatcher
+	e.dispatchMu.Unlock()
+
+	if dispatcher == nil {
+		e.lower.Attach(nil)
+		return
+	}
 	e.lower.Attach(e)
 }
 
+// currentDispatcher returns the dispatcher of e, nil if it's detached
+func (e *endpoint) currentDispatcher() types.NetworkDispatcher {
+	e.dispatchMu.RLock()
+	defer e.dispatchMu.RUnlock()
+
+	return e.dispatcher
+}
+
 func (e *endpoint) MTU() uint32 {
 	return e.lower.MTU()
 }
@@ -52,6 +335,10 @@ func (e *endpoint) MaxHeaderLength() uint16 {
 	return e.lower.MaxHeaderLength()
 }
 
+func (e *endpoint) Capabilities() types.LinkEndpointCapabilities {
+	return e.lower.Capabilities()
+}
+
 func (e *endpoint) LinkAddress() types.LinkAddress {
 	return e.lower.LinkAddress()
 }
@@ -60,32 +347,62 @@ func (e *endpoint) LinkAddress() types.LinkAddress {
 // higher-level protocols to write packets; it just logs the packet and forwards
 // the request to the lower endpoint
 func (e *endpoint) WritePacket(r *types.Route, hdr *buffer.Prependable, payload buffer.View, protocol types.NetworkProtocolNumber) error {
-	if atomic.LoadUint32(&LogPackets) == 1 {
-		LogPacket("send", protocol, hdr.UsedBytes(), payload)
+	if atomic.LoadUint32(&e.logging) == 1 {
+		b := make([]byte, 0, hdr.UsedLength() + len(payload))
+		b = append(append(b, hdr.UsedBytes()...), payload...)
+		e.logPacket("send", protocol, b)
+	}
+	if e.writer != nil {
+		dst := r.RemoteLinkAddress
+		if dst == "" {
+			dst = header.EthernetBroadcastAddress
+		}
+		e.dumpPacket(e.lower.LinkAddress(), dst, protocol, hdr.UsedBytes(), payload)
 	}
 	return e.lower.WritePacket(r, hdr, payload, protocol)
 }
 
-// LogPacket logs the given packet
+// LogPacket logs the given packet, whose headers are in b and payload in plb
 func LogPacket(prefix string, protocol types.NetworkProtocolNumber, b, plb []byte) {
+	if len(plb) > 0 {
+		b = append(append(make([]byte, 0, len(b) + len(plb)), b...), plb...)
+	}
+
 	// Figure out the network layer info
 	var transProto uint8
-	src := types.Address("unknown")
-	dst := types.Address("unknown")
+	var src, dst types.Address
 	id := 0
 	size := uint16(0)
+	fragment := ""
 	switch protocol {
 	case header.IPv4ProtocolNumber:
 		ipv4 := header.IPv4(b)
+		if !ipv4.IsValid(len(b)) {
+			log.Printf("%s malformed ipv4 packet len:%d", prefix, len(b))
+			return
+		}
 		src = ipv4.SourceAddress()
 		dst = ipv4.DestinationAddress()
 		transProto = ipv4.Protocol()
 		size = ipv4.TotalLength() - uint16(ipv4.HeaderLength())
-		b = b[ipv4.HeaderLength():]
 		id = int(ipv4.ID())
 
+		offset := ipv4.FragmentOffset()
+		more := ipv4.Flags() & header.IPv4FlagMoreFragments != 0
+		if offset != 0 || more {
+			fragment = fmt.Sprintf(" frag offset:%d more:%v", offset, more)
+		}
+
+		// Only the first fragment carries the transport header
+		if offset != 0 {
+			log.Printf("%s %v -> %v proto:%d len:%d id:%04x ttl:%d%s", prefix, src, dst, transProto, size, id, ipv4.TTL(), fragment)
+			return
+		}
+		b = b[ipv4.HeaderLength():ipv4.TotalLength()]
+
 	default:
-		log.Printf("%s unknown network protocol", prefix)
+		// TODO: decode ARP and IPv6 once their headers are supported
+		log.Printf("%s unknown network protocol: %x", prefix, protocol)
 		return
 	}
 
@@ -98,6 +415,10 @@ func LogPacket(prefix string, protocol types.NetworkProtocolNumber, b, plb []byt
 	case header.TCPProtocolNumber:
 		transName = "tcp"
 		tcp := header.TCP(b)
+		if len(tcp) < header.TCPMinimumSize || int(tcp.DataOffset()) > len(tcp) {
+			log.Printf("%s %v -> %v malformed tcp segment len:%d id:%04x%s", prefix, src, dst, size, id, fragment)
+			return
+		}
 		srcPort = tcp.SourcePort()
 		dstPort = tcp.DestinationPort()
 		size -= uint16(tcp.DataOffset())
@@ -117,9 +438,38 @@ func LogPacket(prefix string, protocol types.NetworkProtocolNumber, b, plb []byt
 			details += fmt.Sprintf(" options: %+v", tcp.ParsedOptions())
 		}
 
+	case header.UDPProtocolNumber:
+		transName = "udp"
+		udp := header.UDP(b)
+		if len(udp) < header.UDPMinimumSize {
+			log.Printf("%s %v -> %v malformed udp datagram len:%d id:%04x%s", prefix, src, dst, size, id, fragment)
+			return
+		}
+		srcPort = udp.SourcePort()
+		dstPort = udp.DestinationPort()
+		size -= header.UDPMinimumSize
+		details = fmt.Sprintf("udplen:%d xsum:0x%x", udp.Length(), udp.Checksum())
+
+	case header.ICMPv4ProtocolNumber:
+		icmp := header.ICMPv4(b)
+		if len(icmp) < header.ICMPv4MinimumSize {
+			log.Printf("%s %v -> %v malformed icmp packet len:%d id:%04x%s", prefix, src, dst, size, id, fragment)
+			return
+		}
+		details = fmt.Sprintf("type:%d code:%d xsum:0x%x", icmp.Type(), icmp.Code(), icmp.Checksum())
+		switch icmp.Type() {
+		case header.ICMPv4Echo, header.ICMPv4EchoReply:
+			if len(icmp) >= header.ICMPv4EchoHeaderSize {
+				details += fmt.Sprintf(" ident:%d seq:%d", icmp.Ident(), icmp.Sequence())
+			}
+		}
+		log.Printf("%s icmp %v -> %v len:%d id:%04x %s%s", prefix, src, dst, size, id, details, fragment)
+		return
+
 	default:
-		log.Printf("%s %v -> %v unknown transport protocol: %d", prefix, src, dst, transProto)
+		log.Printf("%s %v -> %v unknown transport protocol: %d len:%d id:%04x%s", prefix, src, dst, transProto, size, id, fragment)
+		return
 	}
 
-	log.Printf("%s %s %v:%v -> %v:%v len:%d id:%04x %s", prefix, transName, src, srcPort, dst, dstPort, size, id, details)
+	log.Printf("%s %s %v:%v -> %v:%v len:%d id:%04x %s%s", prefix, transName, src, srcPort, dst, dstPort, size, id, details, fragment)
 }
@@ -0,0 +1,180 @@
+package sniffer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/header"
+	"github.com/YaoZengzeng/yustack/link/channel"
+	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/types"
+)
+
+type nullDispatcher struct{}
+
+func (nullDispatcher) DeliverNetworkPacket(types.LinkEndpoint, types.LinkAddress, types.NetworkProtocolNumber, *buffer.VectorisedView) {
+}
+
+// ethEndpoint is a channel endpoint with an ethernet address
+type ethEndpoint struct {
+	*channel.Endpoint
+}
+
+func (ethEndpoint) LinkAddress() types.LinkAddress {
+	return "\x02\x00\x00\x00\x00\x01"
+}
+
+// readRecords parses a pcap file and returns its link type and packets
+func readRecords(t *testing.T, b []byte) (uint32, [][]byte) {
+	var hdr pcapHeader
+	r := bytes.NewReader(b)
+	if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+		t.Fatalf("reading pcap header failed: %v", err)
+	}
+	if hdr.MagicNumber != 0xa1b2c3d4 || hdr.VersionMajor != 2 || hdr.VersionMinor != 4 {
+		t.Fatalf("bad pcap header: %+v", hdr)
+	}
+
+	var pkts [][]byte
+	for r.Len() > 0 {
+		var ph pcapPacketHeader
+		if err := binary.Read(r, binary.BigEndian, &ph); err != nil {
+			t.Fatalf("reading packet header failed: %v", err)
+		}
+		if ph.IncludedLength > hdr.Snaplen || ph.IncludedLength > ph.OriginalLength {
+			t.Fatalf("bad packet header: %+v", ph)
+		}
+		p := make([]byte, ph.IncludedLength)
+		if _, err := r.Read(p); err != nil {
+			t.Fatalf("reading packet failed: %v", err)
+		}
+		pkts = append(pkts, p)
+	}
+
+	return hdr.Network, pkts
+}
+
+func TestPCAP(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		ethernet bool
+		snapLen  uint32
+		linkType uint32
+	}{
+		{"raw", false, 65536, pcapLinkTypeRaw},
+		{"raw truncated", false, 10, pcapLinkTypeRaw},
+		{"ethernet", true, 65536, pcapLinkTypeEthernet},
+	} {
+		_, ch := channel.New(10, 1500)
+		var lower types.LinkEndpoint = ch
+		if test.ethernet {
+			lower = ethEndpoint{ch}
+		}
+
+		var w bytes.Buffer
+		id, err := NewWithPCAP(stack.RegisterLinkEndpoint(lower), &w, test.snapLen)
+		if err != nil {
+			t.Fatalf("%s: NewWithPCAP failed: %v", test.name, err)
+		}
+		ep := stack.FindLinkEndpoint(id)
+		ep.Attach(nullDispatcher{})
+
+		// One packet in each direction
+		hdr := buffer.NewPrependable(4)
+		copy(hdr.Prepend(4), "\x45\x00\x00\x08")
+		sent := []byte("\x45\x00\x00\x08abcd")
+		if err := ep.WritePacket(&types.Route{}, &hdr, buffer.View("abcd"), header.IPv4ProtocolNumber); err != nil {
+			t.Fatalf("%s: WritePacket failed: %v", test.name, err)
+		}
+		<-ch.C
+
+		rcvd := buffer.View("\x45\x00\x00\x06xy")
+		vv := rcvd.ToVectorisedView([1]buffer.View{})
+		ch.Inject(header.IPv4ProtocolNumber, &vv)
+
+		linkType, pkts := readRecords(t, w.Bytes())
+		if linkType != test.linkType {
+			t.Errorf("%s: link type = %d, want %d", test.name, linkType, test.linkType)
+		}
+		if len(pkts) != 2 {
+			t.Fatalf("%s: got %d packets, want 2", test.name, len(pkts))
+		}
+
+		for i, want := range [][]byte{sent, rcvd} {
+			got := pkts[i]
+			if test.ethernet {
+				eth := header.Ethernet(got)
+				if eth.Type() != header.IPv4ProtocolNumber {
+					t.Errorf("%s: packet %d ethertype = %x", test.name, i, eth.Type())
+				}
+				got = got[header.EthernetMinimumSize:]
+			}
+			if uint32(len(want)) > test.snapLen {
+				want = want[:test.snapLen]
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s: packet %d = %q, want %q", test.name, i, got, want)
+			}
+		}
+	}
+}
+
+// ipv4Packet builds an ipv4 packet carrying a transport header of the given
+// protocol and size
+func ipv4Packet(protocol types.TransportProtocolNumber, size int) []byte {
+	b := make([]byte, header.IPv4MinimumSize + size)
+	header.IPv4(b).Encode(&header.IPv4Fields{
+		IHL:		header.IPv4MinimumSize,
+		TotalLength:	uint16(len(b)),
+		TTL:		64,
+		Protocol:	uint8(protocol),
+		SrcAddr:	"\x0a\x00\x00\x01",
+		DstAddr:	"\x0a\x00\x00\x02",
+	})
+	return b
+}
+
+func TestFilterAndSetEnabled(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	_, ch := channel.New(10, 1500)
+	id := NewWithOptions(stack.RegisterLinkEndpoint(ch), Options{Filter: TransportFilter(header.UDPProtocolNumber)})
+	ep := stack.FindLinkEndpoint(id)
+	ep.Attach(nullDispatcher{})
+
+	inject := func(b []byte) {
+		v := buffer.View(b)
+		vv := v.ToVectorisedView([1]buffer.View{})
+		ch.Inject(header.IPv4ProtocolNumber, &vv)
+	}
+
+	inject(ipv4Packet(header.TCPProtocolNumber, header.TCPMinimumSize))
+	if out.Len() != 0 {
+		t.Errorf("tcp packet was logged: %q", out.String())
+	}
+
+	inject(ipv4Packet(header.UDPProtocolNumber, header.UDPMinimumSize))
+	if !strings.Contains(out.String(), "recv udp") {
+		t.Errorf("udp packet was not logged: %q", out.String())
+	}
+
+	out.Reset()
+	if err := SetEnabled(id, false); err != nil {
+		t.Fatalf("SetEnabled failed: %v", err)
+	}
+	inject(ipv4Packet(header.UDPProtocolNumber, header.UDPMinimumSize))
+	if out.Len() != 0 {
+		t.Errorf("packet was logged while disabled: %q", out.String())
+	}
+
+	if err := SetEnabled(stack.RegisterLinkEndpoint(ch), true); err != types.ErrBadLinkEndpoint {
+		t.Errorf("SetEnabled on a non-sniffer endpoint = %v, want %v", err, types.ErrBadLinkEndpoint)
+	}
+}
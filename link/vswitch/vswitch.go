@@ -0,0 +1,350 @@
+// Package vswitch provides an in-process virtual switch connecting stacks to
+// each other. Every stack gets a port of the switch as the link endpoint of a
+// Nic, and the switch forwards the packets written to a port to the ports
+// behind which their destination was seen, or floods them to every port
+package vswitch
+
+import (
+	"io"
+	"sync"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/header"
+	"github.com/YaoZengzeng/yustack/link/netem"
+	"github.com/YaoZengzeng/yustack/link/sniffer"
+	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/types"
+)
+
+const (
+	defaultMTU		= 1500
+	defaultQueueLen	= 1024
+	defaultSnapLen	= 65536
+)
+
+// Mode selects how a Switch learns where the destinations of the packets are
+type Mode int
+
+const (
+	// ForwardIP learns the IPv4 source addresses of the packets written
+	// to each port, and forwards by IPv4 destination address
+	ForwardIP Mode = iota
+
+	// ForwardMAC learns the link address of each port, and forwards by
+	// the remote link address of the routes. The stack has no address
+	// resolution, so the packets of routes without one, as the stacks
+	// find them, are flooded. Replies, sent to the link address their
+	// request came from, aren't
+	ForwardMAC
+)
+
+// Options specify how a Switch forwards packets
+type Options struct {
+	Mode		Mode
+
+	// MTU is the MTU of the ports, it defaults to 1500
+	MTU			uint32
+
+	// QueueLen is the number of packets queued on a port for delivery to
+	// its stack, the ones beyond are dropped. It defaults to 1024
+	QueueLen	int
+}
+
+// PortOptions specify a port of a Switch
+type PortOptions struct {
+	// LinkAddress is the link address of the port. In ForwardMAC mode, an
+	// ethernet address is generated for the ports which don't have one
+	LinkAddress	types.LinkAddress
+
+	// Impairments, if not nil, impair the packets sent and received by the
+	// stack of the port, see the netem package
+	Impairments	*netem.Options
+
+	// PCAP, if not nil, gets a capture of the packets going through the
+	// port, as the switch sees them: the ones sent by the stack after the
+	// impairments, the ones it receives before them. Packets longer than
+	// SnapLen, which defaults to 65536, are truncated
+	PCAP		io.Writer
+	SnapLen		uint32
+}
+
+// Stats are the counters of a Switch
+type Stats struct {
+	// Forwarded counts the packets sent to the port of their destination,
+	// Flooded the ones sent to all the ports
+	Forwarded	types.StatCounter
+	Flooded		types.StatCounter
+
+	// Dropped counts the copies of packets dropped as the queue of their
+	// port was full
+	Dropped		types.StatCounter
+}
+
+// A Switch forwards the packets between its ports
+type Switch struct {
+	mode		Mode
+	mtu			uint32
+	queueLen	int
+
+	// table maps the addresses learnt, IP or link ones depending on the
+	// mode, to the port they're behind. The queues of the ports are
+	// closed with the switch, packets are only queued holding mu
+	mu			sync.RWMutex
+	ports		[]*port
+	table		map[types.Address]*port
+	closed		bool
+
+	stats		Stats
+}
+
+// New creates a new Switch
+func New(opts Options) *Switch {
+	s := &Switch{
+		mode:		opts.Mode,
+		mtu:		opts.MTU,
+		queueLen:	opts.QueueLen,
+		table:		make(map[types.Address]*port),
+	}
+	if s.mtu == 0 {
+		s.mtu = defaultMTU
+	}
+	if s.queueLen == 0 {
+		s.queueLen = defaultQueueLen
+	}
+
+	return s
+}
+
+// Port adds a new port to the switch, and returns its link endpoint
+func (s *Switch) Port() types.LinkEndpointID {
+	// Without a pcap writer, nothing can fail
+	id, _ := s.PortWithOptions(PortOptions{})
+	return id
+}
+
+// PortWithOptions adds a new port to the switch as specified by opts, and
+// returns its link endpoint
+func (s *Switch) PortWithOptions(opts PortOptions) (types.LinkEndpointID, error) {
+	s.mu.Lock()
+	p := &port{
+		sw:			s,
+		linkAddr:	opts.LinkAddress,
+		queue:		make(chan frame, s.queueLen),
+	}
+	if p.linkAddr == "" && s.mode == ForwardMAC {
+		// A locally administered unicast address
+		n := len(s.ports) + 1
+		p.linkAddr = types.LinkAddress([]byte{0x02, 0, 0, byte(n >> 16), byte(n >> 8), byte(n)})
+	}
+	if s.closed {
+		close(p.queue)
+	}
+	s.ports = append(s.ports, p)
+	s.mu.Unlock()
+
+	// The sniffer is closest to the switch, so that it captures the
+	// packets as they are on the wire
+	id := stack.RegisterLinkEndpoint(p)
+	if opts.PCAP != nil {
+		snapLen := opts.SnapLen
+		if snapLen == 0 {
+			snapLen = defaultSnapLen
+		}
+		var err error
+		if id, err = sniffer.NewWithPCAP(id, opts.PCAP, snapLen); err != nil {
+			return 0, err
+		}
+	}
+	if opts.Impairments != nil {
+		id = netem.New(id, *opts.Impairments)
+
+		s.mu.Lock()
+		p.netem = id
+		if s.closed {
+			netem.Close(id)
+		}
+		s.mu.Unlock()
+	}
+
+	return id, nil
+}
+
+// Close stops the switch: the packets written to its ports are dropped from
+// now on, and the goroutines delivering the packets to the stacks, and the
+// ones of the impairments, exit
+func (s *Switch) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for _, p := range s.ports {
+		close(p.queue)
+		if p.netem != 0 {
+			netem.Close(p.netem)
+		}
+	}
+}
+
+// Stats returns the counters of the switch
+func (s *Switch) Stats() *Stats {
+	return &s.stats
+}
+
+// frame is a packet going through the switch
+type frame struct {
+	src			types.LinkAddress
+	protocol	types.NetworkProtocolNumber
+	v			buffer.View
+}
+
+// addresses returns the addresses the switch learns and forwards by for a
+// packet written to port from with the given remote link address, empty if
+// there are none
+func (s *Switch) addresses(from *port, remoteLinkAddr types.LinkAddress, protocol types.NetworkProtocolNumber, v buffer.View) (src, dst types.Address) {
+	if s.mode == ForwardMAC {
+		if remoteLinkAddr == header.EthernetBroadcastAddress {
+			remoteLinkAddr = ""
+		}
+		return types.Address(from.linkAddr), types.Address(remoteLinkAddr)
+	}
+
+	if protocol != header.IPv4ProtocolNumber || len(v) < header.IPv4MinimumSize {
+		return "", ""
+	}
+	ip := header.IPv4(v)
+
+	return ip.SourceAddress(), ip.DestinationAddress()
+}
+
+// forward sends the packet written to port from to the port of its
+// destination, or to all the other ports if it's unknown
+func (s *Switch) forward(from *port, remoteLinkAddr types.LinkAddress, protocol types.NetworkProtocolNumber, v buffer.View) {
+	src, dst := s.addresses(from, remoteLinkAddr, protocol, v)
+
+	s.mu.RLock()
+	learnt := src == "" || s.table[src] == from
+	s.mu.RUnlock()
+
+	if !learnt {
+		s.mu.Lock()
+		s.table[src] = from
+		s.mu.Unlock()
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return
+	}
+
+	f := frame{src: from.linkAddr, protocol: protocol, v: v}
+	if to := s.table[dst]; dst != "" && to != nil {
+		if to != from {
+			s.stats.Forwarded.Increment()
+			to.enqueue(f)
+		}
+		return
+	}
+
+	s.stats.Flooded.Increment()
+	for _, p := range s.ports {
+		if p != from {
+			// Every stack gets its own copy
+			p.enqueue(frame{src: f.src, protocol: f.protocol, v: append(buffer.View(nil), v...)})
+		}
+	}
+}
+
+// port is the link endpoint of a port of a switch. The packets for its stack
+// are queued, and delivered by a goroutine of its own, as a real link would
+type port struct {
+	sw			*Switch
+	linkAddr	types.LinkAddress
+	queue		chan frame
+
+	// mu protects dispatcher, which is nil while the port is detached, and
+	// delivering, which tells whether the delivery goroutine was started
+	mu			sync.RWMutex
+	dispatcher	types.NetworkDispatcher
+	delivering	bool
+
+	// netem is the netem endpoint impairing the packets of the port, if
+	// any. It's protected by the mutex of the switch
+	netem		types.LinkEndpointID
+}
+
+// enqueue queues f for delivery to the stack of p. It must be called with the
+// mutex of the switch held
+func (p *port) enqueue(f frame) {
+	select {
+	case p.queue <- f:
+	default:
+		p.sw.stats.Dropped.Increment()
+	}
+}
+
+// deliver delivers the queued packets to the stack of p, they're dropped while
+// it's detached
+func (p *port) deliver() {
+	for f := range p.queue {
+		p.mu.RLock()
+		d := p.dispatcher
+		p.mu.RUnlock()
+		if d == nil {
+			continue
+		}
+
+		vv := f.v.ToVectorisedView([1]buffer.View{})
+		d.DeliverNetworkPacket(p, f.src, f.protocol, &vv)
+	}
+}
+
+// Attach implements types.LinkEndpoint.Attach. It starts delivering the
+// packets queued for the stack the first time
+func (p *port) Attach(dispatcher types.NetworkDispatcher) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.dispatcher = dispatcher
+	if dispatcher != nil && !p.delivering {
+		p.delivering = true
+		go p.deliver()
+	}
+}
+
+// MTU implements types.LinkEndpoint.MTU
+func (p *port) MTU() uint32 {
+	return p.sw.mtu
+}
+
+// MaxHeaderLength implements types.LinkEndpoint.MaxHeaderLength. The packets
+// are passed around without link layer header
+func (*port) MaxHeaderLength() uint16 {
+	return 0
+}
+
+// Capabilities implements types.LinkEndpoint.Capabilities
+func (*port) Capabilities() types.LinkEndpointCapabilities {
+	return 0
+}
+
+// LinkAddress implements types.LinkEndpoint.LinkAddress
+func (p *port) LinkAddress() types.LinkAddress {
+	return p.linkAddr
+}
+
+// WritePacket implements types.LinkEndpoint.WritePacket. It hands a copy of
+// the packet to the switch
+func (p *port) WritePacket(r *types.Route, hdr *buffer.Prependable, payload buffer.View, protocol types.NetworkProtocolNumber) error {
+	v := buffer.NewView(hdr.UsedLength() + len(payload))
+	copy(v, hdr.UsedBytes())
+	copy(v[hdr.UsedLength():], payload)
+
+	p.sw.forward(p, r.RemoteLinkAddress, protocol, v)
+
+	return nil
+}
@@ -0,0 +1,270 @@
+package vswitch_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/YaoZengzeng/yustack/gonet"
+	"github.com/YaoZengzeng/yustack/link/netem"
+	"github.com/YaoZengzeng/yustack/link/vswitch"
+	"github.com/YaoZengzeng/yustack/network/ipv4"
+	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/transport/tcp"
+	"github.com/YaoZengzeng/yustack/transport/udp"
+	"github.com/YaoZengzeng/yustack/types"
+)
+
+// newHost creates a stack with the given address on the given port
+func newHost(t *testing.T, port types.LinkEndpointID, addr types.Address) *stack.Stack {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName, udp.ProtocolName, ipv4.PingProtocolName})
+	if err := s.CreateNic(1, port); err != nil {
+		t.Fatalf("CreateNic failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, addr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]types.RouteEntry{{Destination: "\x0a\x00\x00\x00", Mask: "\xff\xff\xff\x00", Nic: 1}})
+
+	return s
+}
+
+// waitFor waits for cond to hold
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+// echoTCP has a client on one stack send data to an echo server on another,
+// and checks it comes back
+func echoTCP(t *testing.T, server, client *stack.Stack, serverAddr types.Address) {
+	l, err := gonet.ListenTCP(server, types.FullAddress{Port: 7}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("ListenTCP failed: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := gonet.DialTCP(client, types.FullAddress{Address: serverAddr, Port: 7}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("DialTCP failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	data := make([]byte, 64 * 1024)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	go conn.Write(data)
+	got, err := ioutil.ReadAll(io.LimitReader(conn, int64(len(data))))
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("received %d bytes which differ from the %d sent", len(got), len(data))
+	}
+}
+
+func TestTCP(t *testing.T) {
+	for _, mode := range []vswitch.Mode{vswitch.ForwardIP, vswitch.ForwardMAC} {
+		sw := vswitch.New(vswitch.Options{Mode: mode})
+		server := newHost(t, sw.Port(), "\x0a\x00\x00\x01")
+		client := newHost(t, sw.Port(), "\x0a\x00\x00\x02")
+
+		echoTCP(t, server, client, "\x0a\x00\x00\x01")
+		if sw.Stats().Forwarded.Value() == 0 {
+			t.Errorf("mode %d: no packet was forwarded", mode)
+		}
+	}
+}
+
+func TestUDP(t *testing.T) {
+	sw := vswitch.New(vswitch.Options{})
+	a := newHost(t, sw.Port(), "\x0a\x00\x00\x01")
+	b := newHost(t, sw.Port(), "\x0a\x00\x00\x02")
+	c := newHost(t, sw.Port(), "\x0a\x00\x00\x03")
+
+	aConn, err := gonet.DialUDP(a, &types.FullAddress{Port: 1000}, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("DialUDP failed: %v", err)
+	}
+	defer aConn.Close()
+	bConn, err := gonet.DialUDP(b, &types.FullAddress{Port: 2000}, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("DialUDP failed: %v", err)
+	}
+	defer bConn.Close()
+
+	// b replies to every datagram
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := bConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			bConn.WriteTo(buf[:n], from)
+		}
+	}()
+
+	to := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2000}
+	for i := 0; i < 3; i++ {
+		if _, err := aConn.WriteTo([]byte("ping"), to); err != nil {
+			t.Fatalf("WriteTo failed: %v", err)
+		}
+		aConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 16)
+		n, _, err := aConn.ReadFrom(buf)
+		if err != nil || string(buf[:n]) != "ping" {
+			t.Fatalf("ReadFrom returned %q, %v, want %q", buf[:n], err, "ping")
+		}
+	}
+
+	// b was unknown for the first datagram only, which c got too and
+	// dropped
+	waitFor(t, "c to drop the flooded datagram", func() bool {
+		return c.Stats().DroppedPackets[types.DropNoNetworkEndpoint].Value() == 1
+	})
+	if got := sw.Stats().Flooded.Value(); got != 1 {
+		t.Errorf("Flooded = %d, want 1", got)
+	}
+	if got := sw.Stats().Forwarded.Value(); got != 5 {
+		t.Errorf("Forwarded = %d, want 5", got)
+	}
+}
+
+func TestICMP(t *testing.T) {
+	for _, mode := range []vswitch.Mode{vswitch.ForwardIP, vswitch.ForwardMAC} {
+		sw := vswitch.New(vswitch.Options{Mode: mode})
+		a := newHost(t, sw.Port(), "\x0a\x00\x00\x01")
+		newHost(t, sw.Port(), "\x0a\x00\x00\x02")
+		newHost(t, sw.Port(), "\x0a\x00\x00\x03")
+
+		p := ipv4.Pinger{
+			Stack:		a,
+			NicId:		1,
+			Address:	"\x0a\x00\x00\x03",
+			Wait:		10 * time.Millisecond,
+			Count:		3,
+			Timeout:	time.Second,
+		}
+		stats, err := p.Run(make(chan ipv4.PingReply, 3))
+		if err != nil {
+			t.Fatalf("mode %d: Run failed: %v", mode, err)
+		}
+		if stats.Received != 3 {
+			t.Errorf("mode %d: got %d replies, want 3", mode, stats.Received)
+		}
+
+		// The replies go back to the port the requests came from
+		if got := sw.Stats().Forwarded.Value(); got < 3 {
+			t.Errorf("mode %d: Forwarded = %d, want at least 3", mode, got)
+		}
+	}
+}
+
+func TestPortOptions(t *testing.T) {
+	sw := vswitch.New(vswitch.Options{})
+	var pcap bytes.Buffer
+	const delay = 20 * time.Millisecond
+	port, err := sw.PortWithOptions(vswitch.PortOptions{
+		Impairments:	&netem.Options{Send: netem.Impairments{Delay: delay}},
+		PCAP:			&pcap,
+	})
+	if err != nil {
+		t.Fatalf("PortWithOptions failed: %v", err)
+	}
+	a := newHost(t, port, "\x0a\x00\x00\x01")
+	newHost(t, sw.Port(), "\x0a\x00\x00\x02")
+
+	p := ipv4.Pinger{
+		Stack:		a,
+		NicId:		1,
+		Address:	"\x0a\x00\x00\x02",
+		Wait:		50 * time.Millisecond,
+		Count:		2,
+		Timeout:	time.Second,
+	}
+	stats, err := p.Run(make(chan ipv4.PingReply, 2))
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stats.Received != 2 {
+		t.Fatalf("got %d replies, want 2", stats.Received)
+	}
+	if stats.MinRTT < delay {
+		t.Errorf("MinRTT = %v, want at least %v", stats.MinRTT, delay)
+	}
+
+	// The global header, then a record header and an IPv4 packet of 36
+	// bytes for each request and reply
+	if got, want := pcap.Len(), 24 + 4 * (16 + 36); got != want {
+		t.Errorf("the capture has %d bytes, want %d", got, want)
+	}
+}
+
+func TestClose(t *testing.T) {
+	sw := vswitch.New(vswitch.Options{})
+	port, err := sw.PortWithOptions(vswitch.PortOptions{
+		Impairments:	&netem.Options{Send: netem.Impairments{Delay: time.Millisecond}},
+	})
+	if err != nil {
+		t.Fatalf("PortWithOptions failed: %v", err)
+	}
+	a := newHost(t, port, "\x0a\x00\x00\x01")
+	newHost(t, sw.Port(), "\x0a\x00\x00\x02")
+
+	// A request and its reply start the goroutine delaying the packets
+	// sent by a
+	p := ipv4.Pinger{
+		Stack:		a,
+		NicId:		1,
+		Address:	"\x0a\x00\x00\x02",
+		Count:		1,
+		Timeout:	time.Second,
+	}
+	stats, err := p.Run(make(chan ipv4.PingReply, 1))
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stats.Received != 1 {
+		t.Fatalf("got %d replies, want 1", stats.Received)
+	}
+
+	// The goroutines of both ports and of the impairments exit
+	base := runtime.NumGoroutine()
+	sw.Close()
+	sw.Close()
+	waitFor(t, "the ports to stop", func() bool {
+		return runtime.NumGoroutine() <= base - 3
+	})
+
+	// The packets written once the switch is closed are dropped
+	p.Timeout = 50 * time.Millisecond
+	stats, err = p.Run(make(chan ipv4.PingReply, 1))
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stats.Received != 0 {
+		t.Errorf("got %d replies, want none", stats.Received)
+	}
+
+	// The ports added later don't deliver anything either
+	newHost(t, sw.Port(), "\x0a\x00\x00\x03")
+}
@@ -0,0 +1,174 @@
+// Package logger defines the leveled logger used by the stack to report
+// dropped packets and unusual events. Nothing is logged unless a logger is set
+// on the stack with Stack.SetLogger. Since a flood of packets can cause a flood
+// of messages, loggers can be rate limited with NewRateLimited
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Level is the importance of a message
+type Level int
+
+// Levels of the messages, in increasing order of importance
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+// String returns the name of the level
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarning:
+		return "WARNING"
+	case LevelError:
+		return "ERROR"
+	}
+
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// Logger is the interface of the loggers used by the stack. Messages come with
+// a list of alternating keys and values, as in log/slog
+type Logger interface {
+	// Enabled reports whether messages of the given level are logged. It
+	// lets callers skip building expensive messages
+	Enabled(level Level) bool
+
+	// Log logs a message with the given level
+	Log(level Level, msg string, keyvals ...interface{})
+}
+
+// Discard is a logger which logs nothing, it's the default logger of a stack
+var Discard Logger = discard{}
+
+type discard struct{}
+
+func (discard) Enabled(Level) bool { return false }
+
+func (discard) Log(Level, string, ...interface{}) {}
+
+// std adapts a log.Logger
+type std struct {
+	l	*log.Logger
+	min	Level
+}
+
+// NewStd creates a logger writing the messages of at least the given level to
+// l, or to the standard logger if l is nil
+func NewStd(l *log.Logger, min Level) Logger {
+	return &std{l: l, min: min}
+}
+
+// Enabled implements Logger.Enabled
+func (s *std) Enabled(level Level) bool {
+	return level >= s.min
+}
+
+// Log implements Logger.Log
+func (s *std) Log(level Level, msg string, keyvals ...interface{}) {
+	if !s.Enabled(level) {
+		return
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s", level, msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		if i+1 < len(keyvals) {
+			fmt.Fprintf(&b, " %v=%v", keyvals[i], keyvals[i+1])
+		} else {
+			fmt.Fprintf(&b, " %v", keyvals[i])
+		}
+	}
+
+	if s.l == nil {
+		log.Print(b.String())
+	} else {
+		s.l.Print(b.String())
+	}
+}
+
+// rateLimited drops the messages exceeding a rate, using a token bucket
+type rateLimited struct {
+	l	Logger
+
+	// interval is the time needed to earn a token
+	interval	time.Duration
+	burst		int
+
+	// now is time.Now, it's replaced by tests
+	now	func() time.Time
+
+	mu			sync.Mutex
+	tokens		int
+	last		time.Time
+	suppressed	int
+}
+
+// NewRateLimited wraps l so that at most perSecond messages are logged per
+// second, with bursts of up to burst messages. The number of messages dropped
+// is reported with the next message logged, under the "suppressed" key
+func NewRateLimited(l Logger, perSecond float64, burst int) Logger {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimited{
+		l:			l,
+		interval:	time.Duration(float64(time.Second) / perSecond),
+		burst:		burst,
+		now:		time.Now,
+		tokens:		burst,
+	}
+}
+
+// Enabled implements Logger.Enabled
+func (r *rateLimited) Enabled(level Level) bool {
+	return r.l.Enabled(level)
+}
+
+// Log implements Logger.Log
+func (r *rateLimited) Log(level Level, msg string, keyvals ...interface{}) {
+	if !r.l.Enabled(level) {
+		return
+	}
+
+	r.mu.Lock()
+	now := r.now()
+	if r.last.IsZero() {
+		r.last = now
+	}
+	if earned := int(now.Sub(r.last) / r.interval); earned > 0 {
+		r.tokens += earned
+		if r.tokens > r.burst {
+			r.tokens = r.burst
+		}
+		r.last = r.last.Add(time.Duration(earned) * r.interval)
+	}
+
+	if r.tokens == 0 {
+		r.suppressed++
+		r.mu.Unlock()
+		return
+	}
+	r.tokens--
+	suppressed := r.suppressed
+	r.suppressed = 0
+	r.mu.Unlock()
+
+	if suppressed > 0 {
+		keyvals = append(keyvals[:len(keyvals):len(keyvals)], "suppressed", suppressed)
+	}
+	r.l.Log(level, msg, keyvals...)
+}
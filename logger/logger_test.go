@@ -0,0 +1,85 @@
+package logger
+
+import (
+	"bytes"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recorder records the messages logged
+type recorder struct {
+	msgs	[]string
+	keyvals	[][]interface{}
+}
+
+func (r *recorder) Enabled(level Level) bool {
+	return level >= LevelInfo
+}
+
+func (r *recorder) Log(level Level, msg string, keyvals ...interface{}) {
+	r.msgs = append(r.msgs, msg)
+	r.keyvals = append(r.keyvals, keyvals)
+}
+
+func TestStd(t *testing.T) {
+	var b bytes.Buffer
+	l := NewStd(log.New(&b, "", 0), LevelInfo)
+
+	if l.Enabled(LevelDebug) {
+		t.Errorf("Enabled(LevelDebug) = true, want false")
+	}
+	l.Log(LevelDebug, "hidden")
+	l.Log(LevelWarning, "packet dropped", "reason", "unsupported", "nic", 1)
+
+	if got, want := b.String(), "WARNING packet dropped reason=unsupported nic=1\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSlog(t *testing.T) {
+	var b bytes.Buffer
+	l := NewSlog(slog.New(slog.NewTextHandler(&b, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	if l.Enabled(LevelInfo) || !l.Enabled(LevelError) {
+		t.Errorf("the levels aren't mapped to the slog ones")
+	}
+	l.Log(LevelError, "packet dropped", "nic", 1)
+
+	if got := b.String(); !strings.Contains(got, "level=ERROR") || !strings.Contains(got, `msg="packet dropped" nic=1`) {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	r := &recorder{}
+	l := NewRateLimited(r, 10, 2).(*rateLimited)
+
+	now := time.Unix(0, 0)
+	l.now = func() time.Time { return now }
+
+	if l.Enabled(LevelDebug) {
+		t.Errorf("Enabled doesn't forward to the wrapped logger")
+	}
+
+	// The burst is logged, the rest is suppressed
+	for i := 0; i < 5; i++ {
+		l.Log(LevelInfo, "msg")
+	}
+	if len(r.msgs) != 2 {
+		t.Fatalf("got %d messages, want 2", len(r.msgs))
+	}
+
+	// A token is earned every 100ms
+	now = now.Add(150 * time.Millisecond)
+	l.Log(LevelInfo, "msg", "k", "v")
+	l.Log(LevelInfo, "msg")
+	if len(r.msgs) != 3 {
+		t.Fatalf("got %d messages, want 3", len(r.msgs))
+	}
+	if got := r.keyvals[2]; len(got) != 4 || got[2] != "suppressed" || got[3] != 3 {
+		t.Errorf("got keyvals %v, want the 3 suppressed messages to be reported", got)
+	}
+}
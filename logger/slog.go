@@ -0,0 +1,44 @@
+package logger
+
+import (
+	"context"
+	"log/slog"
+)
+
+// slogLogger adapts a slog.Logger
+type slogLogger struct {
+	l	*slog.Logger
+}
+
+// NewSlog creates a logger writing to l, or to slog.Default() if l is nil
+func NewSlog(l *slog.Logger) Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+
+	return &slogLogger{l: l}
+}
+
+// slogLevel maps the levels to the slog ones
+func slogLevel(level Level) slog.Level {
+	switch level {
+	case LevelDebug:
+		return slog.LevelDebug
+	case LevelInfo:
+		return slog.LevelInfo
+	case LevelWarning:
+		return slog.LevelWarn
+	}
+
+	return slog.LevelError
+}
+
+// Enabled implements Logger.Enabled
+func (s *slogLogger) Enabled(level Level) bool {
+	return s.l.Enabled(context.Background(), slogLevel(level))
+}
+
+// Log implements Logger.Log
+func (s *slogLogger) Log(level Level, msg string, keyvals ...interface{}) {
+	s.l.Log(context.Background(), slogLevel(level), msg, keyvals...)
+}
@@ -1,7 +1,7 @@
 package ipv4
 
 import (
-	"log"
+	"context"
 	"time"
 	"encoding/binary"
 
@@ -17,10 +17,11 @@ import (
 // Use it when constructing a stack that intends to use ipv4.Ping
 const PingProtocolName = "icmpv4ping"
 
-// pingProtocolNumber is a fake transport protocol used to
+// PingProtocolNumber is a fake transport protocol used to
 // deliver incoming ICMP echo replies. The ICMP identifier
-// number is used as a port number for multiplexing
-const pingProtocolNumber types.TransportProtocolNumber = 256 + 11
+// number is used as a port number for multiplexing. Pass it
+// to Stack.NewEndpoint to create ICMP echo endpoints
+const PingProtocolNumber types.TransportProtocolNumber = 256 + 11
 
 type echoRequest struct {
 	r *types.Route
@@ -41,24 +42,38 @@ func sendICMPv4(r *types.Route, typ header.ICMPv4Type, code byte, data buffer.Vi
 	icmpv4.SetCode(code)
 	icmpv4.SetChecksum(^checksum.Checksum(icmpv4, checksum.Checksum(data, 0)))
 
-	return r.WritePacket(&hdr, data, header.ICMPv4ProtocolNumber)
+	sent := &r.Stats.ICMP.V4PacketsSent
+	if err := r.WritePacket(&hdr, data, header.ICMPv4ProtocolNumber); err != nil {
+		sent.Dropped.Increment()
+		return err
+	}
+	if c := sent.ForType(uint8(typ)); c != nil {
+		c.Increment()
+	}
+
+	return nil
 }
 
 func (e *endpoint) handleICMP(r *types.Route, vv *buffer.VectorisedView) {
+	received := &r.Stats.ICMP.V4PacketsReceived
 	v := vv.First()
 	if len(v) < header.ICMPv4MinimumSize {
-		log.Printf("handleICMP: the packet is not big enough\n")
+		received.Invalid.Increment()
+		e.dispatcher.DropPacket(r, types.DropTransportPacketTooSmall)
 		return
 	}
 
 	h := header.ICMPv4(v)
+	if c := received.ForType(uint8(h.Type())); c != nil {
+		c.Increment()
+	}
 
 	switch h.Type() {
 	case header.ICMPv4Echo:
 		vv.TrimFront(header.ICMPv4MinimumSize)
 		e.echoRequests <- echoRequest{r: r, v: vv.ToView()}
 	case header.ICMPv4EchoReply:
-		e.dispatcher.DeliverTransportPacket(r, pingProtocolNumber, vv)
+		e.dispatcher.DeliverTransportPacket(r, PingProtocolNumber, vv)
 	}
 }
 
@@ -68,13 +83,27 @@ type Pinger struct {
 	NicId			types.NicId
 	Address 		types.Address
 	LocalAddress	types.Address // optional
+	Ident			uint16		  // if zero, picked by the stack
 	Wait 			time.Duration // if zero, defaults to 1 second
 	Count			uint16		  // if zero, defaults to MaxUint16
+	Timeout			time.Duration // time to wait for replies after the last request, defaults to Wait
 }
 
+// pingPayloadSize is the size of the payload of the echo requests sent by a
+// Pinger, which holds their send time
+const pingPayloadSize = 8
+
 // Ping sends echo requests to an ICMPv4 endpoint
-// Response are streamed to the channel ch
+// Response are streamed to the channel ch, which must either have room for
+// all of them or be drained concurrently
 func (p *Pinger) Ping(ch chan<- PingReply) error {
+	_, err := p.Run(ch)
+	return err
+}
+
+// Run is like Ping, and returns the statistics of the run once the replies
+// to all the requests arrived or Timeout expired. ch may be nil
+func (p *Pinger) Run(ch chan<- PingReply) (PingStats, error) {
 	count := p.Count
 	if count == 0 {
 		count = 1<<16 - 1
@@ -83,72 +112,110 @@ func (p *Pinger) Ping(ch chan<- PingReply) error {
 	if wait == 0 {
 		wait = 1 * time.Second
 	}
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = wait
+	}
 
-	r, err := p.Stack.FindRoute(p.NicId, p.LocalAddress, p.Address, ProtocolNumber)
+	var wq waiter.Queue
+	ep, err := p.Stack.NewEndpoint(PingProtocolNumber, ProtocolNumber, &wq)
 	if err != nil {
-		return err
+		return PingStats{}, err
 	}
+	defer ep.Close()
 
-	netProtos := []types.NetworkProtocolNumber{ProtocolNumber}
-	ep := &pingEndpoint{
-		stack:	p.Stack,
-		pktCh:	make(chan buffer.View, 1),
+	if err := ep.Bind(types.FullAddress{Nic: p.NicId, Address: p.LocalAddress, Port: p.Ident}); err != nil {
+		return PingStats{}, err
 	}
-	id := types.TransportEndpointId{
-		LocalAddress:		r.LocalAddress,
-		RemoteAddress:		p.Address,
-		// Hardcode local port for simplicity
-		LocalPort:			1111,
+	if err := ep.Connect(types.FullAddress{Nic: p.NicId, Address: p.Address}); err != nil {
+		return PingStats{}, err
 	}
 
-	err = p.Stack.RegisterTransportEndpoint(p.NicId, netProtos, pingProtocolNumber, id, ep)
-	if err != nil {
-		return err
-	}
-	defer p.Stack.UnregisterTransportEndpoint(p.NicId, netProtos, pingProtocolNumber, id)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	v := buffer.NewView(4)
-	binary.BigEndian.PutUint16(v[0:], id.LocalPort)
+	// The receiver reports every valid reply on replied, so that we know
+	// when to stop waiting. It owns stats until it's done
+	var stats PingStats
+	replied := make(chan struct{}, count)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		seen := make(map[uint16]bool)
+		for {
+			v, err := ep.ReadContext(ctx, nil)
+			if err != nil {
+				return
+			}
 
-	start := time.Now()
+			h := header.ICMPv4(v)
+			if len(v) < header.ICMPv4EchoHeaderSize + pingPayloadSize || h.Type() != header.ICMPv4EchoReply {
+				continue
+			}
+			seq := h.Sequence()
+			if seq >= count || seen[seq] {
+				continue
+			}
+			seen[seq] = true
 
-	done := make(chan struct{})
-	go func(count int) {
-		for ; count > 0; count-- {
-			// Maybe block here?
-			select {
-			case v := <-ep.pktCh:
-				seq := binary.BigEndian.Uint16(v[header.ICMPv4MinimumSize + 2 :])
+			sent := time.Unix(0, int64(binary.BigEndian.Uint64(v[header.ICMPv4EchoHeaderSize:])))
+			rtt := time.Since(sent)
+			stats.addReply(rtt)
+			replied <- struct{}{}
+
+			if ch != nil {
 				ch <- PingReply{
-					Duration:	time.Since(start) - time.Duration(seq) * wait,
+					Duration:	rtt,
 					SeqNumber:	seq,
 				}
 			}
 		}
-		close(done)
-	}(int(count))
-	defer func() { <-done }()
+	}()
 
 	t := time.NewTicker(wait)
 	defer t.Stop()
 
+	v := buffer.NewView(header.ICMPv4EchoHeaderSize + pingPayloadSize)
+	header.ICMPv4(v).SetType(header.ICMPv4Echo)
+	sent := 0
 	for seq := uint16(0); seq < count; seq++ {
-		select {
-		case <-t.C:
+		if seq != 0 {
+			<-t.C
 		}
 
-		binary.BigEndian.PutUint16(v[2:], seq)
-		sent := time.Now()
-		if err := sendICMPv4(r, header.ICMPv4Echo, 0, v); err != nil {
-			ch <- PingReply{
-				Error:		err,
-				Duration:	time.Since(sent),
-				SeqNumber:	seq,
+		binary.BigEndian.PutUint16(v[6:], seq)
+		now := time.Now()
+		binary.BigEndian.PutUint64(v[header.ICMPv4EchoHeaderSize:], uint64(now.UnixNano()))
+		if _, err := ep.Write(v, nil); err != nil {
+			if ch != nil {
+				ch <- PingReply{
+					Error:		err,
+					Duration:	time.Since(now),
+					SeqNumber:	seq,
+				}
 			}
+			continue
 		}
+		sent++
 	}
 
-	return nil
+	// Wait for the missing replies
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+replies:
+	for received := 0; received < sent; received++ {
+		select {
+		case <-replied:
+		case <-deadline.C:
+			break replies
+		}
+	}
+
+	cancel()
+	<-done
+	stats.Sent = sent
+
+	return stats, nil
 }
 
 // PingReply summarizes an ICMP echo reply
@@ -158,14 +225,53 @@ type PingReply struct {
 	SeqNumber	uint16
 }
 
+// PingStats summarizes a run of a Pinger
+type PingStats struct {
+	// Sent is the number of echo requests sent
+	Sent		int
+
+	// Received is the number of echo requests which got a reply,
+	// duplicates aren't counted
+	Received	int
+
+	// MinRTT, MaxRTT and AvgRTT are computed over the replies received
+	MinRTT		time.Duration
+	MaxRTT		time.Duration
+	AvgRTT		time.Duration
+}
+
+// Loss returns the fraction of the echo requests which got no reply
+func (s *PingStats) Loss() float64 {
+	if s.Sent == 0 {
+		return 0
+	}
+
+	return float64(s.Sent - s.Received) / float64(s.Sent)
+}
+
+func (s *PingStats) addReply(rtt time.Duration) {
+	if s.Received == 0 || rtt < s.MinRTT {
+		s.MinRTT = rtt
+	}
+	if rtt > s.MaxRTT {
+		s.MaxRTT = rtt
+	}
+	s.AvgRTT = (s.AvgRTT * time.Duration(s.Received) + rtt) / time.Duration(s.Received + 1)
+	s.Received++
+}
+
 type pingProtocol struct{}
 
 func (*pingProtocol) NewEndpoint(stack *stack.Stack, netProtocol types.NetworkProtocolNumber, waiterQueue *waiter.Queue) (types.Endpoint, error) {
-	return nil, types.ErrNotSupported
+	if netProtocol != ProtocolNumber {
+		return nil, types.ErrUnknownProtocol
+	}
+
+	return newPingEndpoint(stack, waiterQueue), nil
 }
 
 func (*pingProtocol) Number() types.TransportProtocolNumber {
-	return pingProtocolNumber
+	return PingProtocolNumber
 }
 
 func (*pingProtocol) MinimumPacketSize() int {
@@ -177,17 +283,12 @@ func (*pingProtocol) ParsePorts(v buffer.View) (src, dst uint16, err error) {
 	return 0, ident, nil
 }
 
+func (*pingProtocol) HandleUnknownDestinationPacket(r *types.Route, id types.TransportEndpointId, vv *buffer.VectorisedView) {
+	// Echo replies nobody is waiting for are silently dropped
+}
+
 func init() {
 	stack.RegisterTransportProtocolFactory(PingProtocolName, func() stack.TransportProtocol {
 		return &pingProtocol{}
 	})
 }
-
-type pingEndpoint struct {
-	stack 		*stack.Stack
-	pktCh 		chan buffer.View
-}
-
-func (e *pingEndpoint) HandlePacket(r *types.Route, id types.TransportEndpointId, vv *buffer.VectorisedView) {
-	e.pktCh <- vv.ToView()
-}
@@ -1,6 +1,9 @@
 package ipv4_test
 
 import (
+	"context"
+	"encoding/binary"
+	"sync"
 	"time"
 	"testing"
 
@@ -9,6 +12,8 @@ import (
 	"github.com/YaoZengzeng/yustack/link/channel"
 	"github.com/YaoZengzeng/yustack/types"
 	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/header"
+	"github.com/YaoZengzeng/yustack/waiter"
 )
 
 const stackAddr = "\x0a\x00\x00\x01"
@@ -54,8 +59,17 @@ func (c *testContext) cleanup() {
 }
 
 func (c *testContext) loopback() {
+	c.lossyLoopback(nil)
+}
+
+// lossyLoopback is like loopback, but drops the packets for which drop returns
+// true
+func (c *testContext) lossyLoopback(drop func(pkt channel.PacketInfo) bool) {
 	go func() {
 		for pkt := range c.linkEp.C {
+			if drop != nil && drop(pkt) {
+				continue
+			}
 			v := make(buffer.View, len(pkt.Header) + len(pkt.Payload))
 			copy(v, pkt.Header)
 			copy(v[len(pkt.Header):], pkt.Payload)
@@ -117,3 +131,114 @@ func TestEchoSequence(t *testing.T) {
 		}
 	}
 }
+
+func TestPingEndpoints(t *testing.T) {
+	c := newTestContext(t)
+	defer c.cleanup()
+	c.loopback()
+
+	// Concurrent endpoints with their own identifiers get their own replies
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(ident uint16) {
+			defer wg.Done()
+
+			var wq waiter.Queue
+			ep, err := c.s.NewEndpoint(ipv4.PingProtocolNumber, ipv4.ProtocolNumber, &wq)
+			if err != nil {
+				t.Errorf("NewEndpoint failed: %v", err)
+				return
+			}
+			defer ep.Close()
+
+			if err := ep.Bind(types.FullAddress{Port: ident}); err != nil {
+				t.Errorf("Bind failed: %v", err)
+				return
+			}
+			if err := ep.Connect(types.FullAddress{Nic: 1, Address: stackAddr}); err != nil {
+				t.Errorf("Connect failed: %v", err)
+				return
+			}
+
+			payload := []byte{byte(ident), 1, 2, 3, 4, 5}
+			req := make(buffer.View, header.ICMPv4EchoHeaderSize + len(payload))
+			header.ICMPv4(req).SetType(header.ICMPv4Echo)
+			binary.BigEndian.PutUint16(req[6:], 42)
+			copy(req[header.ICMPv4EchoHeaderSize:], payload)
+			if _, err := ep.Write(req, nil); err != nil {
+				t.Errorf("Write failed: %v", err)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			var from types.FullAddress
+			v, err := ep.ReadContext(ctx, &from)
+			if err != nil {
+				t.Errorf("ident %d: ReadContext failed: %v", ident, err)
+				return
+			}
+
+			h := header.ICMPv4(v)
+			if h.Type() != header.ICMPv4EchoReply || h.Ident() != ident || h.Sequence() != 42 || string(v[header.ICMPv4EchoHeaderSize:]) != string(payload) || from.Address != stackAddr {
+				t.Errorf("ident %d: got reply %x from %v, want the reply to our request", ident, []byte(v), from.Address)
+			}
+		}(uint16(1000 + i))
+	}
+	wg.Wait()
+
+	// Only echo requests can be written
+	var wq waiter.Queue
+	ep, err := c.s.NewEndpoint(ipv4.PingProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	if _, err := ep.Write(make(buffer.View, header.ICMPv4EchoHeaderSize), &types.FullAddress{Address: stackAddr}); err != types.ErrInvalidOptionValue {
+		t.Errorf("Write of an echo reply returned %v, want %v", err, types.ErrInvalidOptionValue)
+	}
+}
+
+func TestPingLoss(t *testing.T) {
+	c := newTestContext(t)
+	defer c.cleanup()
+
+	// Drop the odd echo requests
+	c.lossyLoopback(func(pkt channel.PacketInfo) bool {
+		icmp := header.ICMPv4(pkt.Header[header.IPv4MinimumSize:])
+		return icmp.Type() == header.ICMPv4Echo && binary.BigEndian.Uint16(pkt.Payload[2:]) % 2 == 1
+	})
+
+	const numPings = 4
+	p := ipv4.Pinger{
+		Stack:		c.s,
+		NicId:		1,
+		Address:	stackAddr,
+		Ident:		4321,
+		Wait:		10 * time.Millisecond,
+		Count:		numPings,
+		Timeout:	200 * time.Millisecond,
+	}
+	ch := make(chan ipv4.PingReply, numPings)
+	stats, err := p.Run(ch)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	close(ch)
+
+	var seqs []uint16
+	for reply := range ch {
+		seqs = append(seqs, reply.SeqNumber)
+	}
+	if len(seqs) != 2 || seqs[0] != 0 || seqs[1] != 2 {
+		t.Errorf("got replies to %v, want replies to 0 and 2", seqs)
+	}
+
+	if stats.Sent != numPings || stats.Received != 2 || stats.Loss() != 0.5 {
+		t.Errorf("got stats %+v with loss %v, want half of %d requests lost", stats, stats.Loss(), numPings)
+	}
+	if stats.MinRTT <= 0 || stats.MinRTT > stats.AvgRTT || stats.AvgRTT > stats.MaxRTT {
+		t.Errorf("got inconsistent RTTs in %+v", stats)
+	}
+}
@@ -6,8 +6,6 @@
 package ipv4
 
 import (
-	"log"
-
 	"github.com/YaoZengzeng/yustack/header"
 	"github.com/YaoZengzeng/yustack/stack"
 	"github.com/YaoZengzeng/yustack/types"
@@ -21,6 +19,10 @@ const (
 	// ProtocolNumber is the ipv4 protocol number.
 	ProtocolNumber = header.IPv4ProtocolNumber
 
+	// DefaultTTL is the TTL of the packets sent through routes which don't
+	// set one
+	DefaultTTL = 64
+
 	// maxTotalSize is the maximum size that can be encoded in the 16-bit
 	// TotalLength field of the ipv4 header
 	maxTotalSize = 0xffff
@@ -60,19 +62,34 @@ func (e *endpoint) Id() *types.NetworkEndpointId {
 // HandlePacket is called by the link layer when new ipv4 packets arrive for
 // this endpoint
 func (e *endpoint) HandlePacket(r *types.Route, vv *buffer.VectorisedView) {
+	r.Stats.IP.PacketsReceived.Increment()
+
 	h := header.IPv4(vv.First())
-	if !h.IsValid(vv.Size()) {
-		log.Printf("HandlePacket for IPv4: header is invalid\n")
+	if !h.IsValid(vv.Size()) || int(h.HeaderLength()) > len(h) {
+		r.Stats.IP.MalformedPacketsReceived.Increment()
+		e.dispatcher.DropPacket(r, types.DropInvalidNetworkHeader)
 		return
 	}
+	if r.Capabilities() & types.CapabilityRXChecksumOffload == 0 && h.CalculateChecksum() != 0xffff {
+		r.Stats.IP.MalformedPacketsReceived.Increment()
+		e.dispatcher.DropPacket(r, types.DropBadChecksum)
+		return
+	}
+
+	// Drop the link layer padding, e.g., of short ethernet frames
+	vv.CapLength(int(h.TotalLength()))
+
+	// Raw endpoints get the packet with its header
+	p := types.TransportProtocolNumber(h.Protocol())
+	e.dispatcher.DeliverRawPacket(r, p, vv)
 
 	hlen := int(h.HeaderLength())
 	vv.TrimFront(hlen)
 
-	p := types.TransportProtocolNumber(h.Protocol())
 	if p == header.ICMPv4ProtocolNumber {
 		e.handleICMP(r, vv)
 	}
+	r.Stats.IP.PacketsDelivered.Increment()
 	e.dispatcher.DeliverTransportPacket(r, p, vv)
 }
 
@@ -81,19 +98,66 @@ func (e *endpoint) WritePacket(r *types.Route, hdr *buffer.Prependable, payload
 	ip := header.IPv4(hdr.Prepend(header.IPv4MinimumSize))
 	length := uint16(hdr.UsedLength() + len(payload))
 	id := uint32(0)
+	ttl := r.TTL
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
 
 	ip.Encode(&header.IPv4Fields{
 		IHL:			header.IPv4MinimumSize,
 		TotalLength:	length,
 		ID:				uint16(id),
-		TTL:			64,
+		TTL:			ttl,
 		Protocol:		uint8(protocol),
-		SrcAddr:		types.Address(e.address[:]),
+		SrcAddr:		r.LocalAddress,
 		DstAddr:		r.RemoteAddress,
 	})
+	if r.Capabilities() & types.CapabilityTXChecksumOffload == 0 {
+		ip.SetChecksum(^ip.CalculateChecksum())
+	}
+
+	if err := e.linkEp.WritePacket(r, hdr, payload, ProtocolNumber); err != nil {
+		r.Stats.IP.OutgoingPacketErrors.Increment()
+		return err
+	}
+	r.Stats.IP.PacketsSent.Increment()
+
+	return nil
+}
+
+// WriteHeaderIncludedPacket writes a packet which already holds its ipv4 header,
+// as written by raw endpoints in IP_HDRINCL mode
+func (e *endpoint) WriteHeaderIncludedPacket(r *types.Route, payload buffer.View) error {
+	if len(payload) < header.IPv4MinimumSize || len(payload) > maxTotalSize {
+		return types.ErrInvalidOptionValue
+	}
+
+	ip := header.IPv4(payload)
+	if ip.HeaderLength() < header.IPv4MinimumSize || int(ip.HeaderLength()) > len(payload) {
+		return types.ErrInvalidOptionValue
+	}
+
+	// Like linux, fill the fields the user can't be expected to compute
+	ip.SetTotalLength(uint16(len(payload)))
+	if ip.SourceAddress() == header.IPv4Any {
+		ip.SetSourceAddress(r.LocalAddress)
+	}
+	ip.SetChecksum(0)
 	ip.SetChecksum(^ip.CalculateChecksum())
 
-	return e.linkEp.WritePacket(r, hdr, payload, ProtocolNumber)
+	hdr := buffer.NewPrependable(int(e.linkEp.MaxHeaderLength()))
+	if err := e.linkEp.WritePacket(r, &hdr, payload, ProtocolNumber); err != nil {
+		r.Stats.IP.OutgoingPacketErrors.Increment()
+		return err
+	}
+	r.Stats.IP.PacketsSent.Increment()
+
+	return nil
+}
+
+// Close stops the endpoint from replying to echo requests
+func (e *endpoint) Close() {
+	close(e.echoRequests)
 }
 
 // NicId returns the Id of the Nic this endpoint belongs to
@@ -107,6 +171,11 @@ func (e *endpoint) MaxHeaderLength() uint16 {
 	return e.linkEp.MaxHeaderLength() + header.IPv4MinimumSize
 }
 
+// Capabilities implements types.NetworkEndpoint.Capabilities
+func (e *endpoint) Capabilities() types.LinkEndpointCapabilities {
+	return e.linkEp.Capabilities()
+}
+
 // MTU implements types.NetworkEndpoint.MTU. It returns the link-layer MTU minus
 // the network layer max header length
 func (e *endpoint) MTU() uint32 {
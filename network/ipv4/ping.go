@@ -0,0 +1,413 @@
+package ipv4
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/header"
+	"github.com/YaoZengzeng/yustack/ilist"
+	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/types"
+	"github.com/YaoZengzeng/yustack/waiter"
+)
+
+type pingEndpointState int
+
+const (
+	pingStateInitial	pingEndpointState = iota
+	pingStateBound
+	pingStateConnected
+	pingStateClosed
+)
+
+// pingPacket is an echo reply waiting to be read
+type pingPacket struct {
+	ilist.Entry
+	senderAddress	types.FullAddress
+	data			buffer.View
+}
+
+// pingEndpoint is an ICMP echo endpoint of the ping protocol, the counterpart
+// of linux's SOCK_DGRAM ICMP sockets. The identifier of the echo requests is
+// the port of the endpoint, so that the replies are demultiplexed like UDP
+// datagrams. The messages written and read start with the ICMP echo header
+type pingEndpoint struct {
+	// The following fields are initialized at creation time and do not
+	// change throughout the lifetime of the endpoint
+	stack			*stack.Stack
+	waiterQueue		*waiter.Queue
+
+	// The following fields are used to manage the receive, and are
+	// protected by rcvMu
+	rcvMu			sync.Mutex
+	rcvList			ilist.List
+	rcvBufSizeMax	int
+	rcvBufSize		int
+	rcvClosed		bool
+
+	// The following fields are protected by the mu mutex
+	mu				sync.RWMutex
+	id				types.TransportEndpointId
+	state			pingEndpointState
+	bindNicId		types.NicId
+	remote			types.FullAddress
+	ttl				uint8
+}
+
+func newPingEndpoint(stack *stack.Stack, waiterQueue *waiter.Queue) *pingEndpoint {
+	return &pingEndpoint{
+		stack:			stack,
+		waiterQueue:	waiterQueue,
+		rcvBufSizeMax:	32 * 1024,
+	}
+}
+
+// registerWithStack registers the endpoint for the identifier id.LocalPort, or
+// for an identifier picked by the stack if it's 0
+func (e *pingEndpoint) registerWithStack(nicid types.NicId, id types.TransportEndpointId) (types.TransportEndpointId, error) {
+	netProtos := []types.NetworkProtocolNumber{ProtocolNumber}
+	if id.LocalPort != 0 {
+		err := e.stack.RegisterTransportEndpoint(nicid, netProtos, PingProtocolNumber, id, e, false)
+		return id, err
+	}
+
+	_, err := e.stack.PickEphemeralPort(func(p uint16) (bool, error) {
+		id.LocalPort = p
+		err := e.stack.RegisterTransportEndpoint(nicid, netProtos, PingProtocolNumber, id, e, false)
+		if err == types.ErrPortInUse {
+			return false, nil
+		}
+
+		return err == nil, err
+	})
+
+	return id, err
+}
+
+func (e *pingEndpoint) bindLocked(address types.FullAddress) error {
+	// Don't allow binding once endpoint is not in the initial state anymore
+	if e.state != pingStateInitial {
+		return types.ErrInvalidEndpointState
+	}
+
+	id, err := e.registerWithStack(address.Nic, types.TransportEndpointId{
+		LocalPort:		address.Port,
+		LocalAddress:	address.Address,
+	})
+	if err != nil {
+		return err
+	}
+	e.id = id
+	e.bindNicId = address.Nic
+	e.state = pingStateBound
+
+	return nil
+}
+
+// Bind binds the endpoint to a local address and to the identifier
+// address.Port, both optional. Specifying a Nic is optional
+func (e *pingEndpoint) Bind(address types.FullAddress) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.bindLocked(address)
+}
+
+// Connect sets the default destination of the echo requests, and restricts the
+// replies received to the ones sent by that address. The endpoint is bound to
+// an identifier picked by the stack if needed
+func (e *pingEndpoint) Connect(address types.FullAddress) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch e.state {
+	case pingStateClosed:
+		return types.ErrInvalidEndpointState
+	case pingStateInitial:
+		if err := e.bindLocked(types.FullAddress{Nic: address.Nic}); err != nil {
+			return err
+		}
+	}
+
+	e.remote = types.FullAddress{Nic: address.Nic, Address: address.Address}
+	e.state = pingStateConnected
+
+	return nil
+}
+
+// ConnectContext is like Connect, which never blocks for ping endpoints
+func (e *pingEndpoint) ConnectContext(ctx context.Context, address types.FullAddress) error {
+	if ctx.Err() != nil {
+		return types.ErrAborted
+	}
+
+	return e.Connect(address)
+}
+
+// Write sends the echo request v to the given address, or to the address the
+// endpoint is connected to if to is nil. v starts with the ICMP echo header,
+// whose identifier and checksum are filled by the endpoint
+func (e *pingEndpoint) Write(v buffer.View, to *types.FullAddress) (uintptr, error) {
+	if len(v) < header.ICMPv4EchoHeaderSize || header.ICMPv4(v).Type() != header.ICMPv4Echo {
+		return 0, types.ErrInvalidOptionValue
+	}
+
+	// Like linux, bind the endpoint to an identifier on the first write
+	e.mu.Lock()
+	if e.state == pingStateInitial {
+		if err := e.bindLocked(types.FullAddress{}); err != nil {
+			e.mu.Unlock()
+			return 0, err
+		}
+	}
+	e.mu.Unlock()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.state == pingStateClosed {
+		return 0, types.ErrClosedForSend
+	}
+
+	if to == nil {
+		if e.state != pingStateConnected {
+			return 0, types.ErrDestinationRequired
+		}
+		to = &e.remote
+	}
+
+	nicid := to.Nic
+	if nicid == 0 {
+		nicid = e.bindNicId
+	}
+
+	r, err := e.stack.FindRoute(nicid, e.id.LocalAddress, to.Address, ProtocolNumber)
+	if err != nil {
+		return 0, err
+	}
+
+	r.TTL = e.ttl
+
+	// Don't touch the caller's buffer, sendICMPv4 computes the checksum
+	msg := append(buffer.View(nil), v...)
+	binary.BigEndian.PutUint16(msg[4:], e.id.LocalPort)
+	if err := sendICMPv4(r, header.ICMPv4Echo, msg[1], msg[header.ICMPv4MinimumSize:]); err != nil {
+		return 0, err
+	}
+
+	return uintptr(len(v)), nil
+}
+
+// HandlePacket is called by the stack when an echo reply arrives for the
+// identifier of the endpoint
+func (e *pingEndpoint) HandlePacket(r *types.Route, id types.TransportEndpointId, vv *buffer.VectorisedView) {
+	e.mu.RLock()
+	accept := e.state != pingStateConnected || e.remote.Address == r.RemoteAddress
+	e.mu.RUnlock()
+
+	if !accept {
+		return
+	}
+
+	data := vv.ToView()
+
+	e.rcvMu.Lock()
+
+	// Drop the reply if our buffer is currently full
+	if e.rcvClosed || e.rcvBufSize >= e.rcvBufSizeMax {
+		e.rcvMu.Unlock()
+		e.stack.DropPacket(types.DropReceiveBufferFull, stack.NewPacketInfo(r, PingProtocolNumber, id, len(data)))
+		return
+	}
+
+	wasEmpty := e.rcvBufSize == 0
+
+	e.rcvList.PushBack(&pingPacket{
+		senderAddress:	types.FullAddress{
+			Nic:		r.NicId(),
+			Address:	r.RemoteAddress,
+		},
+		data:			data,
+	})
+	e.rcvBufSize += len(data)
+
+	e.rcvMu.Unlock()
+
+	// Notify any waiters that there's data to be read now
+	if wasEmpty {
+		e.waiterQueue.Notify(waiter.EventIn)
+	}
+}
+
+// Read reads an echo reply, starting with its ICMP header, from the endpoint.
+// This method does not block if there is no reply pending
+func (e *pingEndpoint) Read(address *types.FullAddress) (buffer.View, error) {
+	e.rcvMu.Lock()
+
+	if e.rcvList.Empty() {
+		err := types.ErrWouldBlock
+		if e.rcvClosed {
+			err = types.ErrClosedForReceive
+		}
+		e.rcvMu.Unlock()
+		return buffer.View{}, err
+	}
+
+	p := e.rcvList.Front().(*pingPacket)
+	e.rcvList.Remove(p)
+	e.rcvBufSize -= len(p.data)
+
+	e.rcvMu.Unlock()
+
+	if address != nil {
+		*address = p.senderAddress
+	}
+
+	return p.data, nil
+}
+
+// ReadContext reads an echo reply from the endpoint, blocking until one is
+// available
+func (e *pingEndpoint) ReadContext(ctx context.Context, address *types.FullAddress) (buffer.View, error) {
+	var v buffer.View
+	err := types.BlockingCall(ctx, e.waiterQueue, waiter.EventIn, func() error {
+		var err error
+		v, err = e.Read(address)
+		return err
+	})
+
+	return v, err
+}
+
+// WriteContext sends an echo request. Ping endpoints never block on writes, so
+// it only differs from Write by honouring an already cancelled ctx
+func (e *pingEndpoint) WriteContext(ctx context.Context, v buffer.View, to *types.FullAddress) (uintptr, error) {
+	var n uintptr
+	err := types.BlockingCall(ctx, e.waiterQueue, waiter.EventOut, func() error {
+		var err error
+		n, err = e.Write(v, to)
+		return err
+	})
+
+	return n, err
+}
+
+// Listen is not supported by ping endpoints, it just fails
+func (*pingEndpoint) Listen(int) error {
+	return types.ErrNotSupported
+}
+
+// Accept is not supported by ping endpoints, it just fails
+func (*pingEndpoint) Accept() (types.Endpoint, *waiter.Queue, error) {
+	return nil, nil, types.ErrNotSupported
+}
+
+// AcceptContext is not supported by ping endpoints, it just fails
+func (*pingEndpoint) AcceptContext(context.Context) (types.Endpoint, *waiter.Queue, error) {
+	return nil, nil, types.ErrNotSupported
+}
+
+// Shutdown is not supported by ping endpoints, it just fails
+func (*pingEndpoint) Shutdown(types.ShutdownFlags) error {
+	return types.ErrNotSupported
+}
+
+// Close puts the endpoint in a closed state and frees all resources
+// associated with it
+func (e *pingEndpoint) Close() {
+	e.mu.Lock()
+	if e.state == pingStateBound || e.state == pingStateConnected {
+		e.stack.UnregisterTransportEndpoint(e.bindNicId, []types.NetworkProtocolNumber{ProtocolNumber}, PingProtocolNumber, e.id, e)
+	}
+	e.state = pingStateClosed
+	e.mu.Unlock()
+
+	// Drop the pending replies, then wake up the waiters so that they see
+	// the endpoint is closed
+	e.rcvMu.Lock()
+	e.rcvClosed = true
+	e.rcvBufSize = 0
+	e.rcvList.Reset()
+	e.rcvMu.Unlock()
+
+	e.waiterQueue.Notify(waiter.EventIn | waiter.EventOut)
+}
+
+// Abort implements types.AbortableEndpoint.Abort. The endpoint
+// finds a route for every write, so there's none to release. The receive side
+// is shut down, and the waiters are woken up so that the blocked reads return
+func (e *pingEndpoint) Abort(error) {
+	e.rcvMu.Lock()
+	e.rcvClosed = true
+	e.rcvMu.Unlock()
+
+	e.waiterQueue.Notify(waiter.EventIn | waiter.EventOut)
+}
+
+// SetSockOpt implements types.Endpoint.SetSockOpt
+func (e *pingEndpoint) SetSockOpt(opt interface{}) error {
+	switch v := opt.(type) {
+	case types.TTLOption:
+		e.mu.Lock()
+		e.ttl = uint8(v)
+		e.mu.Unlock()
+		return nil
+
+	case types.ReceiveBufferSizeOption:
+		e.rcvMu.Lock()
+		e.rcvBufSizeMax = int(v)
+		e.rcvMu.Unlock()
+		return nil
+	}
+
+	return types.ErrUnknownProtocolOption
+}
+
+// GetSockOpt implements types.Endpoint.GetSockOpt
+func (e *pingEndpoint) GetSockOpt(opt interface{}) error {
+	switch v := opt.(type) {
+	case types.ErrorOption:
+		return nil
+
+	case *types.TTLOption:
+		e.mu.RLock()
+		*v = types.TTLOption(e.ttl)
+		e.mu.RUnlock()
+		return nil
+
+	case *types.ReceiveBufferSizeOption:
+		e.rcvMu.Lock()
+		*v = types.ReceiveBufferSizeOption(e.rcvBufSizeMax)
+		e.rcvMu.Unlock()
+		return nil
+	}
+
+	return types.ErrUnknownProtocolOption
+}
+
+// GetLocalAddress returns the address to which the endpoint is bound, its Port
+// is the identifier of the echo requests
+func (e *pingEndpoint) GetLocalAddress() (types.FullAddress, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return types.FullAddress{
+		Nic:		e.bindNicId,
+		Address:	e.id.LocalAddress,
+		Port:		e.id.LocalPort,
+	}, nil
+}
+
+// GetRemoteAddress returns the address to which the endpoint is connected
+func (e *pingEndpoint) GetRemoteAddress() (types.FullAddress, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.state != pingStateConnected {
+		return types.FullAddress{}, types.ErrNotConnected
+	}
+
+	return e.remote, nil
+}
@@ -0,0 +1,251 @@
+package ipv4
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/header"
+	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/types"
+	"github.com/YaoZengzeng/yustack/waiter"
+)
+
+// A Traceroute discovers the routers on the path to an address, by sending
+// probes with increasing TTLs and listening to the ICMP Time Exceeded messages
+// they trigger. The stack must have been created with udp, or with the ping
+// protocol for ICMP probes
+type Traceroute struct {
+	Stack			*stack.Stack
+	NicId			types.NicId
+	Address			types.Address
+	LocalAddress	types.Address					// optional
+	Protocol		types.TransportProtocolNumber	// header.UDPProtocolNumber (default) or header.ICMPv4ProtocolNumber
+	Port			uint16							// destination port of the first UDP probe, defaults to 33434
+	MaxHops			uint8							// if zero, defaults to 30
+	Probes			int								// probes per hop, defaults to 3
+	Wait			time.Duration					// time to wait for the reply to a probe, defaults to 1 second
+}
+
+// TracerouteHop reports the reply to a probe of a Traceroute
+type TracerouteHop struct {
+	Error		error			// reports any errors sending the probe
+	TTL			uint8
+	Probe		int				// index of the probe for its TTL
+
+	// Address is the address of the node which replied, it's empty if no
+	// reply arrived in time
+	Address		types.Address
+	Duration	time.Duration
+
+	// Type and Code are the ones of the ICMP reply, e.g., Time Exceeded
+	// from a router, or Port Unreachable from the destination
+	Type		header.ICMPv4Type
+	Code		byte
+
+	// Reached tells whether the reply came from the destination
+	Reached		bool
+}
+
+// icmpListener gets a copy of every ICMP packet received by the stack while a
+// Traceroute runs, through the raw endpoints machinery
+type icmpListener struct {
+	pkts	chan buffer.View
+}
+
+// HandlePacket implements types.RawTransportEndpoint.HandlePacket
+func (l *icmpListener) HandlePacket(r *types.Route, vv *buffer.VectorisedView) {
+	select {
+	case l.pkts <- vv.ToView():
+	default:
+		// Nobody is waiting for that many replies
+	}
+}
+
+// probe identifies a probe in the ICMP messages it triggers
+type probe struct {
+	protocol	types.TransportProtocolNumber
+	dst			types.Address
+
+	// srcPort and dstPort identify UDP probes, ident and seq ICMP ones
+	srcPort		uint16
+	dstPort		uint16
+	ident		uint16
+	seq			uint16
+}
+
+// match tells whether the ICMP message v, starting with its IP header, was
+// triggered by the probe. It returns the ICMP header of v if so
+func (p *probe) match(v buffer.View) (header.ICMPv4, bool) {
+	ip := header.IPv4(v)
+	if len(v) < header.IPv4MinimumSize || !ip.IsValid(len(v)) {
+		return nil, false
+	}
+	icmp := header.ICMPv4(v[ip.HeaderLength():])
+	if len(icmp) < header.ICMPv4EchoHeaderSize {
+		return nil, false
+	}
+
+	switch icmp.Type() {
+	case header.ICMPv4EchoReply:
+		ok := p.protocol == header.ICMPv4ProtocolNumber && ip.SourceAddress() == p.dst &&
+			icmp.Ident() == p.ident && icmp.Sequence() == p.seq
+		return icmp, ok
+
+	case header.ICMPv4TimeExceeded, header.ICMPv4DstUnreachable:
+		// The message quotes the IP header of the probe and the first 8
+		// bytes of its payload
+		inner := header.IPv4(icmp[header.ICMPv4ErrorHeaderSize:])
+		if len(inner) < header.IPv4MinimumSize || len(inner) < int(inner.HeaderLength()) + 8 {
+			return nil, false
+		}
+		if inner.DestinationAddress() != p.dst || inner.TransportProtocol() != p.protocol {
+			return nil, false
+		}
+
+		payload := inner[inner.HeaderLength():]
+		if p.protocol == header.UDPProtocolNumber {
+			u := header.UDP(payload)
+			return icmp, u.SourcePort() == p.srcPort && u.DestinationPort() == p.dstPort
+		}
+		e := header.ICMPv4(payload)
+		return icmp, e.Type() == header.ICMPv4Echo && e.Ident() == p.ident && e.Sequence() == p.seq
+	}
+
+	return nil, false
+}
+
+// Trace sends the probes one at a time, and streams the result of each of them
+// to the channel ch. It returns once the destination replied, or after MaxHops
+// hops
+func (t *Traceroute) Trace(ch chan<- TracerouteHop) error {
+	protocol := t.Protocol
+	if protocol == 0 {
+		protocol = header.UDPProtocolNumber
+	}
+	transport := protocol
+	if protocol == header.ICMPv4ProtocolNumber {
+		transport = PingProtocolNumber
+	} else if protocol != header.UDPProtocolNumber {
+		return types.ErrUnknownProtocol
+	}
+
+	port := t.Port
+	if port == 0 {
+		port = 33434
+	}
+	maxHops := t.MaxHops
+	if maxHops == 0 {
+		maxHops = 30
+	}
+	probes := t.Probes
+	if probes == 0 {
+		probes = 3
+	}
+	wait := t.Wait
+	if wait == 0 {
+		wait = 1 * time.Second
+	}
+
+	listener := &icmpListener{pkts: make(chan buffer.View, 16)}
+	if err := t.Stack.RegisterRawTransportEndpoint(ProtocolNumber, header.ICMPv4ProtocolNumber, listener); err != nil {
+		return err
+	}
+	defer t.Stack.UnregisterRawTransportEndpoint(ProtocolNumber, header.ICMPv4ProtocolNumber, listener)
+
+	var wq waiter.Queue
+	ep, err := t.Stack.NewEndpoint(transport, ProtocolNumber, &wq)
+	if err != nil {
+		return err
+	}
+	defer ep.Close()
+
+	if err := ep.Bind(types.FullAddress{Nic: t.NicId, Address: t.LocalAddress}); err != nil {
+		return err
+	}
+	local, err := ep.GetLocalAddress()
+	if err != nil {
+		return err
+	}
+
+	p := probe{
+		protocol:	protocol,
+		dst:		t.Address,
+		srcPort:	local.Port,
+		ident:		local.Port,
+	}
+	msg := buffer.NewView(header.ICMPv4EchoHeaderSize)
+	header.ICMPv4(msg).SetType(header.ICMPv4Echo)
+
+	for ttl := uint8(1); ttl <= maxHops; ttl++ {
+		if err := ep.SetSockOpt(types.TTLOption(ttl)); err != nil {
+			return err
+		}
+
+		reached := false
+		for i := 0; i < probes; i++ {
+			// Every probe has its own port or sequence number, so that
+			// late replies can't be mistaken for the current one
+			p.dstPort = port + uint16(int(ttl - 1) * probes + i)
+			p.seq = p.dstPort
+			to := &types.FullAddress{Nic: t.NicId, Address: t.Address, Port: p.dstPort}
+
+			v := buffer.View(nil)
+			if protocol == header.ICMPv4ProtocolNumber {
+				binary.BigEndian.PutUint16(msg[6:], p.seq)
+				v = msg
+			}
+
+			hop := TracerouteHop{TTL: ttl, Probe: i}
+			sent := time.Now()
+			if _, err := ep.Write(v, to); err != nil {
+				hop.Error = err
+				ch <- hop
+				continue
+			}
+
+			timer := time.NewTimer(wait)
+		replies:
+			for {
+				select {
+				case pkt := <-listener.pkts:
+					icmp, ok := p.match(pkt)
+					if !ok {
+						continue
+					}
+					hop.Duration = time.Since(sent)
+					hop.Address = header.IPv4(pkt).SourceAddress()
+					hop.Type = icmp.Type()
+					hop.Code = icmp.Code()
+					hop.Reached = hop.Address == t.Address
+					break replies
+				case <-timer.C:
+					break replies
+				}
+			}
+			timer.Stop()
+
+			// The echo replies are queued on the ping endpoint too
+			if protocol == header.ICMPv4ProtocolNumber {
+				for {
+					if _, err := ep.Read(nil); err != nil {
+						break
+					}
+				}
+			}
+
+			// Any Destination Unreachable ends the trace, as linux's
+			// traceroute does with !H, !N...
+			if hop.Reached || hop.Type == header.ICMPv4DstUnreachable {
+				reached = true
+			}
+			ch <- hop
+		}
+
+		if reached {
+			break
+		}
+	}
+
+	return nil
+}
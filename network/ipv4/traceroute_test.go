@@ -0,0 +1,157 @@
+package ipv4_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/checksum"
+	"github.com/YaoZengzeng/yustack/header"
+	"github.com/YaoZengzeng/yustack/network/ipv4"
+	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/link/channel"
+	"github.com/YaoZengzeng/yustack/transport/udp"
+	"github.com/YaoZengzeng/yustack/types"
+)
+
+const (
+	// traceDst is the destination of the traces, two routers away
+	traceDst = "\x0a\x00\x09\x09"
+	numHops  = 3
+)
+
+// routerAddr returns the address of the router at the given hop
+func routerAddr(hop uint8) types.Address {
+	return types.Address([]byte{10, 0, 1, hop})
+}
+
+// sendICMP injects an ICMP message of the given type from src, quoting the
+// packet pkt as an error message would
+func sendICMP(linkEp *channel.Endpoint, src types.Address, typ header.ICMPv4Type, code byte, body buffer.View) {
+	v := make(buffer.View, header.IPv4MinimumSize + header.ICMPv4MinimumSize + len(body))
+	header.IPv4(v).Encode(&header.IPv4Fields{
+		IHL:			header.IPv4MinimumSize,
+		TotalLength:	uint16(len(v)),
+		TTL:			64,
+		Protocol:		uint8(header.ICMPv4ProtocolNumber),
+		SrcAddr:		src,
+		DstAddr:		stackAddr,
+	})
+	header.IPv4(v).SetChecksum(^header.IPv4(v).CalculateChecksum())
+
+	icmp := header.ICMPv4(v[header.IPv4MinimumSize:])
+	icmp.SetType(typ)
+	icmp.SetCode(code)
+	copy(icmp[header.ICMPv4MinimumSize:], body)
+	icmp.SetChecksum(^checksum.Checksum(icmp, 0))
+
+	vv := v.ToVectorisedView([1]buffer.View{})
+	linkEp.Inject(ipv4.ProtocolNumber, &vv)
+}
+
+// fakeNetwork answers the probes as a path of routers would. The first probe
+// sent with a TTL of 2 is lost
+func fakeNetwork(linkEp *channel.Endpoint, ttls chan<- uint8) {
+	lost := false
+	for pkt := range linkEp.C {
+		v := make(buffer.View, len(pkt.Header) + len(pkt.Payload))
+		copy(v, pkt.Header)
+		copy(v[len(pkt.Header):], pkt.Payload)
+
+		ip := header.IPv4(v)
+		ttls <- ip.TTL()
+		if ip.TTL() == 2 && !lost {
+			lost = true
+			continue
+		}
+
+		// Errors quote the header and 8 bytes of the packet, after 4
+		// unused bytes
+		quote := make(buffer.View, 4 + header.IPv4MinimumSize + 8)
+		copy(quote[4:], v)
+
+		switch {
+		case ip.TTL() < numHops:
+			sendICMP(linkEp, routerAddr(ip.TTL()), header.ICMPv4TimeExceeded, 0, quote)
+		case ip.TransportProtocol() == udp.ProtocolNumber:
+			sendICMP(linkEp, traceDst, header.ICMPv4DstUnreachable, header.ICMPv4PortUnreachable, quote)
+		default:
+			// Echo the request back, header included
+			sendICMP(linkEp, traceDst, header.ICMPv4EchoReply, 0, ip.Payload()[header.ICMPv4MinimumSize:])
+		}
+	}
+}
+
+func TestTraceroute(t *testing.T) {
+	for _, protocol := range []types.TransportProtocolNumber{udp.ProtocolNumber, header.ICMPv4ProtocolNumber} {
+		s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName, ipv4.PingProtocolName})
+		id, linkEp := channel.New(256, 65536)
+		if err := s.CreateNic(1, id); err != nil {
+			t.Fatalf("CreateNic failed: %v", err)
+		}
+		if err := s.AddAddress(1, ipv4.ProtocolNumber, stackAddr); err != nil {
+			t.Fatalf("AddAddress failed: %v", err)
+		}
+		s.SetRouteTable([]types.RouteEntry{{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", Nic: 1}})
+
+		ttls := make(chan uint8, 16)
+		go fakeNetwork(linkEp, ttls)
+
+		tr := ipv4.Traceroute{
+			Stack:		s,
+			NicId:		1,
+			Address:	traceDst,
+			Protocol:	protocol,
+			MaxHops:	10,
+			Probes:		2,
+			Wait:		50 * time.Millisecond,
+		}
+		ch := make(chan ipv4.TracerouteHop, 32)
+		if err := tr.Trace(ch); err != nil {
+			t.Fatalf("protocol %d: Trace failed: %v", protocol, err)
+		}
+		close(ch)
+		close(linkEp.C)
+
+		var hops []ipv4.TracerouteHop
+		for hop := range ch {
+			if hop.Error != nil {
+				t.Errorf("protocol %d: probe %d of hop %d failed: %v", protocol, hop.Probe, hop.TTL, hop.Error)
+			}
+			hops = append(hops, hop)
+		}
+		if len(hops) != 2 * numHops {
+			t.Fatalf("protocol %d: got %d hops, want %d: %+v", protocol, len(hops), 2 * numHops, hops)
+		}
+
+		for i, hop := range hops {
+			ttl := uint8(i / 2 + 1)
+			want := routerAddr(ttl)
+			if ttl == numHops {
+				want = traceDst
+			}
+			if ttl == 2 && hop.Probe == 0 {
+				// Lost on the way
+				want = ""
+			}
+
+			if hop.TTL != ttl || hop.Probe != i % 2 || hop.Address != want || hop.Reached != (ttl == numHops) {
+				t.Errorf("protocol %d: hop %d is %+v, want ttl %d from %v", protocol, i, hop, ttl, want)
+			}
+		}
+
+		if last := hops[len(hops) - 1]; protocol == udp.ProtocolNumber && (last.Type != header.ICMPv4DstUnreachable || last.Code != header.ICMPv4PortUnreachable) {
+			t.Errorf("got last hop %+v, want a port unreachable", last)
+		}
+
+		// The probes were sent with increasing TTLs
+		close(ttls)
+		var got []uint8
+		for ttl := range ttls {
+			got = append(got, ttl)
+		}
+		if len(got) != 2 * numHops || got[0] != 1 || got[len(got) - 1] != numHops {
+			t.Errorf("protocol %d: probes sent with TTLs %v", protocol, got)
+		}
+	}
+}
@@ -6,13 +6,22 @@ import (
 	"sync"
 	"math"
 	"math/rand"
+	"crypto/sha256"
+	cryptorand "crypto/rand"
+	"encoding/binary"
 
 	"github.com/YaoZengzeng/yustack/types"
 )
 
 const (
-	// firstEphemeral is the first ephemeral port
+	// firstEphemeral and lastEphemeral bound the default range of
+	// ephemeral ports
 	firstEphemeral uint16 = 16000
+	lastEphemeral uint16 = math.MaxUint16
+
+	// portTableSize is the size of the perturbation table of the RFC 6056
+	// port selection
+	portTableSize = 4096
 
 	anyIPAddress = types.Address("")
 )
@@ -23,101 +32,238 @@ type portDescriptor struct {
 	port 		uint16
 }
 
-// bindAddresses is a set of IP addresses
-type bindAddresses map[types.Address]struct{}
+// Flags are the socket options which allow a port to be reserved by several
+// endpoints
+type Flags struct {
+	// ReuseAddress allows an endpoint to reserve a port which is already
+	// reserved by endpoints that set it too, e.g., a listener rebinding
+	// the port of connections which are still closing
+	ReuseAddress	bool
+
+	// ReusePort allows endpoints that all set it to share a port, the
+	// packets being spread across them by the demuxer
+	ReusePort		bool
+}
+
+// reservation counts the endpoints which reserved an address, in total and
+// for each flag
+type reservation struct {
+	total			int
+	reuseAddress	int
+	reusePort		int
+}
+
+// allows tells whether an endpoint with the given flags may share the address
+// with the endpoints which reserved it
+func (r reservation) allows(flags Flags) bool {
+	return (flags.ReuseAddress && r.reuseAddress == r.total) || (flags.ReusePort && r.reusePort == r.total)
+}
+
+// bindAddresses holds the reservations of the IP addresses of a port
+type bindAddresses map[types.Address]reservation
 
 // PortManager manages allocating, reserving and releasing ports
 type PortManager struct {
 	mu 				sync.RWMutex
 	allocatedPorts	map[portDescriptor]bindAddresses
+
+	// The following fields drive the selection of ephemeral ports. They
+	// have their own mutex as ReservePort picks ports while holding mu
+	ephemeralMu		sync.Mutex
+	firstEphemeral	uint16
+	lastEphemeral	uint16
+	rand			*rand.Rand
+	portTable		[portTableSize]uint32
+
+	// secret keys the hash of PickEphemeralPortStable, it's set at
+	// creation time and never changes
+	secret			[16]byte
 }
 
 // NewPortManager creates new PortManager
 func NewPortManager() *PortManager {
-	return &PortManager{
+	s := &PortManager{
 		allocatedPorts:	make(map[portDescriptor]bindAddresses),
+		firstEphemeral:	firstEphemeral,
+		lastEphemeral:	lastEphemeral,
+	}
+
+	// The secret and the seed must not be guessable, or the ports picked
+	// would be too
+	var seed [8]byte
+	cryptorand.Read(s.secret[:])
+	cryptorand.Read(seed[:])
+	s.rand = rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(seed[:]))))
+
+	return s
+}
+
+// SetPortRange sets the range of the ephemeral ports, bounds included
+func (s *PortManager) SetPortRange(first, last uint16) error {
+	if first == 0 || first > last {
+		return types.ErrInvalidOptionValue
 	}
+
+	s.ephemeralMu.Lock()
+	defer s.ephemeralMu.Unlock()
+
+	s.firstEphemeral = first
+	s.lastEphemeral = last
+
+	return nil
+}
+
+// PortRange returns the range of the ephemeral ports, bounds included
+func (s *PortManager) PortRange() (first, last uint16) {
+	s.ephemeralMu.Lock()
+	defer s.ephemeralMu.Unlock()
+
+	return s.firstEphemeral, s.lastEphemeral
 }
 
-// isAvailable checks whether an IP address is available to bind to
-func (b bindAddresses) isAvailable(addr types.Address) bool {
+// isAvailable checks whether an IP address is available to bind to for an
+// endpoint with the given flags
+func (b bindAddresses) isAvailable(addr types.Address, flags Flags) bool {
 	if addr == anyIPAddress {
-		return len(b) == 0
+		for _, r := range b {
+			if !r.allows(flags) {
+				return false
+			}
+		}
+		return true
 	}
 
 	// If all addresses for this portDescriptor are already bound, no
 	// address is available
-	if _, ok := b[anyIPAddress]; ok {
+	if r, ok := b[anyIPAddress]; ok && !r.allows(flags) {
 		return false
 	}
 
-	if _, ok := b[addr]; ok {
+	if r, ok := b[addr]; ok && !r.allows(flags) {
 		return false
 	}
 
 	return true
-} 
+}
 
 // PickEphemeralPort randomly chooses a starting point and iterates over all
 // possible ephemeral ports, allowing the caller to decided whether a given port
 // is suitable for its needs, and stopping when a port is found or an error occurs
 func (s *PortManager) PickEphemeralPort(testPort func(p uint16) (bool, error)) (port uint16, err error) {
-	count := uint16(math.MaxUint16 - firstEphemeral + 1)
-	offset := uint16(rand.Int31n(int32(count)))
+	s.ephemeralMu.Lock()
+	first, count := s.firstEphemeral, uint32(s.lastEphemeral - s.firstEphemeral) + 1
+	offset := s.rand.Uint32()
+	s.ephemeralMu.Unlock()
 
-	for i := uint16(0); i < count; i++ {
-		port = firstEphemeral + (offset + i) % count
+	port, _, err = pickEphemeralPort(first, count, offset, testPort)
+	return port, err
+}
+
+// PickEphemeralPortStable is like PickEphemeralPort for endpoints connecting to
+// a remote address, following the double-hash algorithm of RFC 6056: the
+// starting point is a keyed hash of the addresses and remote port, perturbed by
+// a table entry which is moved past each port picked. The successive ports picked
+// for a destination are thus sequential, so they can be reused as long as the
+// previous connections to that destination are gone, while they can't be
+// predicted from the ones picked for other destinations. A port is also free
+// to be picked for several destinations
+func (s *PortManager) PickEphemeralPortStable(localAddr, remoteAddr types.Address, remotePort uint16, testPort func(p uint16) (bool, error)) (port uint16, err error) {
+	h := sha256.New()
+	h.Write(s.secret[:])
+	for _, a := range []types.Address{localAddr, remoteAddr} {
+		h.Write([]byte{byte(len(a))})
+		h.Write([]byte(a))
+	}
+	h.Write([]byte{byte(remotePort >> 8), byte(remotePort)})
+	sum := h.Sum(nil)
+
+	// Different parts of the hash stand for the two hash functions of
+	// the algorithm
+	offset := binary.BigEndian.Uint32(sum)
+	index := binary.BigEndian.Uint32(sum[4:]) % portTableSize
+
+	s.ephemeralMu.Lock()
+	first, count := s.firstEphemeral, uint32(s.lastEphemeral - s.firstEphemeral) + 1
+	perturbation := s.portTable[index]
+	s.ephemeralMu.Unlock()
+
+	port, tries, err := pickEphemeralPort(first, count, offset + perturbation, testPort)
+	if err == nil {
+		s.ephemeralMu.Lock()
+		s.portTable[index] += tries
+		s.ephemeralMu.Unlock()
+	}
+
+	return port, err
+}
+
+// pickEphemeralPort iterates over the count ports starting at first, from the
+// given offset, until testPort accepts one. It returns the number of ports tried
+func pickEphemeralPort(first uint16, count uint32, offset uint32, testPort func(p uint16) (bool, error)) (port uint16, tries uint32, err error) {
+	for i := uint32(0); i < count; i++ {
+		port = first + uint16((uint64(offset) + uint64(i)) % uint64(count))
 		ok, err := testPort(port)
 		if err != nil {
-			return 0, err
+			return 0, 0, err
 		}
 
 		if ok {
-			return port, nil
+			return port, i + 1, nil
 		}
 
 		// The port has been used, try next one
 	}
 
-	return 0, types.ErrNoPortAvailable
+	return 0, 0, types.ErrNoPortAvailable
 }
 
 // ReservePort marks a port/IP combinataion as reserved so that it cannot be
-// reserved by another endpoint. If port is zero, ReservePort will search for
-// an unreserved ephemeral port and reserve it, returning its value in the
-// "port" return value
-func (s *PortManager) ReservePort(network []types.NetworkProtocolNumber, transport types.TransportProtocolNumber, addr types.Address, port uint16) (reservedPort uint16, err error) {
+// reserved by another endpoint, unless both set the flags allowing it. If port
+// is zero, ReservePort will search for an unreserved ephemeral port and reserve
+// it, returning its value in the "port" return value
+func (s *PortManager) ReservePort(network []types.NetworkProtocolNumber, transport types.TransportProtocolNumber, addr types.Address, port uint16, flags Flags) (reservedPort uint16, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	// If a port is specified, just try to reserve it for all network
 	if port != 0 {
-		if !s.reserveSpecifiedPort(network, transport, addr, port) {
+		if !s.isPortAvailable(network, transport, addr, port, flags) {
 			return 0, types.ErrPortInUse
 		}
+		s.reserveSpecifiedPort(network, transport, addr, port, flags)
 		return port, nil
 	}
 
-	// A port wasn't specified, so try to find one
+	// A port wasn't specified, so try to find one. Ephemeral ports are
+	// never shared, whatever the flags
 	return s.PickEphemeralPort(func(p uint16) (bool, error) {
-		return s.reserveSpecifiedPort(network, transport, addr, p), nil
+		if !s.isPortAvailable(network, transport, addr, p, Flags{}) {
+			return false, nil
+		}
+		s.reserveSpecifiedPort(network, transport, addr, p, flags)
+		return true, nil
 	})
 }
 
-// reserveSpecifiedPort tries to reserve the given port on all given protocols
-func (s *PortManager) reserveSpecifiedPort(networks []types.NetworkProtocolNumber, transport types.TransportProtocolNumber, addr types.Address, port uint16) bool {
-	// Check that the port is available on all network protocols
+// isPortAvailable checks that the given port is available on all given
+// protocols
+func (s *PortManager) isPortAvailable(networks []types.NetworkProtocolNumber, transport types.TransportProtocolNumber, addr types.Address, port uint16, flags Flags) bool {
 	desc := portDescriptor{0, transport, port}
 	for _, n := range networks {
 		desc.network = n
 		if addrs, ok := s.allocatedPorts[desc]; ok {
-			if !addrs.isAvailable(addr) {
+			if !addrs.isAvailable(addr, flags) {
 				return false
 			}
 		}
 	}
 
-	// Reserve port on all network protocols
+	return true
+}
+
+// reserveSpecifiedPort reserves the given port on all given protocols
+func (s *PortManager) reserveSpecifiedPort(networks []types.NetworkProtocolNumber, transport types.TransportProtocolNumber, addr types.Address, port uint16, flags Flags) {
+	desc := portDescriptor{0, transport, port}
 	for _, n := range networks {
 		desc.network = n
 		m, ok := s.allocatedPorts[desc]
@@ -125,24 +271,57 @@ func (s *PortManager) reserveSpecifiedPort(networks []types.NetworkProtocolNumbe
 			m = make(bindAddresses)
 			s.allocatedPorts[desc] = m
 		}
-		m[addr] = struct{}{}
-	}
 
-	return true
+		r := m[addr]
+		r.total++
+		if flags.ReuseAddress {
+			r.reuseAddress++
+		}
+		if flags.ReusePort {
+			r.reusePort++
+		}
+		m[addr] = r
+	}
 }
 
-// ReleasedPort releases the reservation on a port/IP combination so that it can
-// be reserved by other endpoints
-func (s *PortManager) ReleasePort(networks []types.NetworkProtocolNumber, transport types.TransportProtocolNumber, addr types.Address, port uint16) {
+// ReleasedPort releases a reservation on a port/IP combination, made with the
+// given flags, so that it can be reserved by other endpoints
+func (s *PortManager) ReleasePort(networks []types.NetworkProtocolNumber, transport types.TransportProtocolNumber, addr types.Address, port uint16, flags Flags) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	for _, n := range networks{
 		desc := portDescriptor{n, transport, port}
 		m := s.allocatedPorts[desc]
+		r, ok := m[addr]
+		if !ok {
+			continue
+		}
+
+		r.total--
+		if flags.ReuseAddress {
+			r.reuseAddress--
+		}
+		if flags.ReusePort {
+			r.reusePort--
+		}
+
+		if r.total > 0 {
+			m[addr] = r
+			continue
+		}
 		delete(m, addr)
 		if len(m) == 0 {
 			delete(s.allocatedPorts, desc)
 		}
 	}
 }
+
+// ReservedPorts returns the number of ports currently reserved, for any
+// network and transport protocol
+func (s *PortManager) ReservedPorts() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.allocatedPorts)
+}
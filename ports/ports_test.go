@@ -60,7 +60,7 @@ func TestPortReservation(t *testing.T) {
 			want:	nil,
 		},
 	} {
-		gotPort, err := pm.ReservePort(net, fakeTransNumber, test.ip, test.port)
+		gotPort, err := pm.ReservePort(net, fakeTransNumber, test.ip, test.port, Flags{})
 		if err != test.want {
 			t.Fatalf("ReservePort(..., ..., %s, %d) = %v, want %v", test.ip, test.port, err, test.want)
 		}
@@ -71,13 +71,85 @@ func TestPortReservation(t *testing.T) {
 
 	// Release port 22 from any IP address, then try to reserve fake IP
 	// address on 22
-	pm.ReleasePort(net, fakeTransNumber, anyIPAddress, 22)
+	pm.ReleasePort(net, fakeTransNumber, anyIPAddress, 22, Flags{})
 
-	if port, err := pm.ReservePort(net, fakeTransNumber, fakeIPAddress, 22); port != 22 || err != nil {
+	if port, err := pm.ReservePort(net, fakeTransNumber, fakeIPAddress, 22, Flags{}); port != 22 || err != nil {
 		t.Fatalf("ReservePort(..., ..., ..., %d) = (port %d, err %v), want (22, nil); failed to reserve port after it should have been released", 22, port, err)
 	}
 }
 
+func TestPortReuse(t *testing.T) {
+	pm := NewPortManager()
+	net := []types.NetworkProtocolNumber{fakeNetworkNumber}
+	reuseAddr := Flags{ReuseAddress: true}
+	reusePort := Flags{ReusePort: true}
+
+	for _, test := range []struct {
+		ip 		types.Address
+		flags	Flags
+		want 	error
+	}{
+		{
+			ip:		fakeIPAddress,
+			flags:	reusePort,
+			want:	nil,
+		},
+		{
+			ip:		fakeIPAddress,
+			flags:	reusePort,
+			want:	nil,
+		},
+		{
+			// Every endpoint sharing the port must set the flag
+			ip:		fakeIPAddress,
+			flags:	Flags{},
+			want:	types.ErrPortInUse,
+		},
+		{
+			ip:		anyIPAddress,
+			flags:	reuseAddr,
+			want:	types.ErrPortInUse,
+		},
+		{
+			ip:		anyIPAddress,
+			flags:	Flags{ReuseAddress: true, ReusePort: true},
+			want:	nil,
+		},
+	} {
+		if _, err := pm.ReservePort(net, fakeTransNumber, test.ip, 80, test.flags); err != test.want {
+			t.Fatalf("ReservePort(..., ..., %s, 80, %+v) = %v, want %v", test.ip, test.flags, err, test.want)
+		}
+	}
+
+	// A reservation made with ReuseAddress can be made again while it's
+	// still held, e.g., by a connection being closed
+	if _, err := pm.ReservePort(net, fakeTransNumber, fakeIPAddress, 22, reuseAddr); err != nil {
+		t.Fatalf("ReservePort(..., ..., ..., 22, %+v) = %v, want nil", reuseAddr, err)
+	}
+	if _, err := pm.ReservePort(net, fakeTransNumber, fakeIPAddress, 22, reuseAddr); err != nil {
+		t.Fatalf("ReservePort(..., ..., ..., 22, %+v) = %v, want nil; failed to reuse the address", reuseAddr, err)
+	}
+
+	// The port stays reserved until every endpoint released it
+	pm.ReleasePort(net, fakeTransNumber, fakeIPAddress, 22, reuseAddr)
+	if _, err := pm.ReservePort(net, fakeTransNumber, fakeIPAddress, 22, Flags{}); err != types.ErrPortInUse {
+		t.Fatalf("ReservePort(..., ..., ..., 22) = %v, want %v", err, types.ErrPortInUse)
+	}
+	pm.ReleasePort(net, fakeTransNumber, fakeIPAddress, 22, reuseAddr)
+	if _, err := pm.ReservePort(net, fakeTransNumber, fakeIPAddress, 22, Flags{}); err != nil {
+		t.Fatalf("ReservePort(..., ..., ..., 22) = %v, want nil; failed to reserve port after it should have been released", err)
+	}
+
+	// A port picked with ReusePort can then be shared by naming it
+	port, err := pm.ReservePort(net, fakeTransNumber, fakeIPAddress, 0, reusePort)
+	if err != nil {
+		t.Fatalf("ReservePort(..., ..., ..., 0, %+v) = %v, want nil", reusePort, err)
+	}
+	if _, err := pm.ReservePort(net, fakeTransNumber, fakeIPAddress, port, reusePort); err != nil {
+		t.Fatalf("ReservePort(..., ..., ..., %d, %+v) = %v, want nil", port, reusePort, err)
+	}
+}
+
 func TestPickEphemeralPort(t *testing.T) {
 	pm := NewPortManager()
 	customErr := &types.Error{}
@@ -130,3 +202,96 @@ func TestPickEphemeralPort(t *testing.T) {
 	}
 
 }
+
+func TestPortRange(t *testing.T) {
+	pm := NewPortManager()
+	if first, last := pm.PortRange(); first != firstEphemeral || last != lastEphemeral {
+		t.Fatalf("PortRange() = (%d, %d), want (%d, %d)", first, last, firstEphemeral, lastEphemeral)
+	}
+
+	for _, r := range [][2]uint16{{0, 100}, {200, 100}} {
+		if err := pm.SetPortRange(r[0], r[1]); err != types.ErrInvalidOptionValue {
+			t.Errorf("SetPortRange(%d, %d) = %v, want %v", r[0], r[1], err, types.ErrInvalidOptionValue)
+		}
+	}
+
+	if err := pm.SetPortRange(100, 109); err != nil {
+		t.Fatalf("SetPortRange(100, 109) = %v", err)
+	}
+
+	// Each picker sees the 10 ports of the range exactly once
+	pickers := map[string]func(func(uint16) (bool, error)) (uint16, error){
+		"random":	pm.PickEphemeralPort,
+		"stable":	func(f func(uint16) (bool, error)) (uint16, error) {
+			return pm.PickEphemeralPortStable(fakeIPAddress, fakeIPAddress1, 80, f)
+		},
+	}
+	for name, pick := range pickers {
+		seen := make(map[uint16]bool)
+		_, err := pick(func(port uint16) (bool, error) {
+			if port < 100 || port > 109 || seen[port] {
+				t.Errorf("%s: port %d tried, want each port of [100, 109] once", name, port)
+			}
+			seen[port] = true
+			return false, nil
+		})
+		if err != types.ErrNoPortAvailable || len(seen) != 10 {
+			t.Errorf("%s: tried %d ports, got err %v, want 10 ports and %v", name, len(seen), err, types.ErrNoPortAvailable)
+		}
+	}
+}
+
+func TestPickEphemeralPortStable(t *testing.T) {
+	pm := NewPortManager()
+	accept := func(uint16) (bool, error) {
+		return true, nil
+	}
+
+	// The ports picked for a destination are sequential
+	p1, err := pm.PickEphemeralPortStable(fakeIPAddress, fakeIPAddress1, 80, accept)
+	if err != nil {
+		t.Fatalf("PickEphemeralPortStable failed: %v", err)
+	}
+	p2, err := pm.PickEphemeralPortStable(fakeIPAddress, fakeIPAddress1, 80, accept)
+	if err != nil {
+		t.Fatalf("PickEphemeralPortStable failed: %v", err)
+	}
+	want := p1 + 1
+	if p1 == lastEphemeral {
+		want = firstEphemeral
+	}
+	if p2 != want {
+		t.Errorf("got ports %d then %d, want %d", p1, p2, want)
+	}
+
+	// Skipped ports aren't tried again for that destination
+	var tried []uint16
+	p3, err := pm.PickEphemeralPortStable(fakeIPAddress, fakeIPAddress1, 80, func(port uint16) (bool, error) {
+		tried = append(tried, port)
+		return len(tried) == 3, nil
+	})
+	if err != nil {
+		t.Fatalf("PickEphemeralPortStable failed: %v", err)
+	}
+	p4, _ := pm.PickEphemeralPortStable(fakeIPAddress, fakeIPAddress1, 80, accept)
+	for _, p := range tried {
+		if p == p4 {
+			t.Errorf("port %d picked after being tried, tried %v before picking %d", p4, tried, p3)
+		}
+	}
+
+	// Another manager has its own secret, so its ports can't be deduced
+	// from these ones. They may collide by chance, but not 8 times in a row
+	other := NewPortManager()
+	same := 0
+	for i := 0; i < 8; i++ {
+		p, _ := pm.PickEphemeralPortStable(fakeIPAddress, fakeIPAddress1, uint16(i), accept)
+		q, _ := other.PickEphemeralPortStable(fakeIPAddress, fakeIPAddress1, uint16(i), accept)
+		if p == q {
+			same++
+		}
+	}
+	if same == 8 {
+		t.Errorf("two managers picked the same ports")
+	}
+}
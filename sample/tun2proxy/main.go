@@ -0,0 +1,59 @@
+// tun2proxy accepts every TCP connection and UDP flow entering a tun device,
+// whatever their destination, and relays them to a SOCKS5 or HTTP CONNECT
+// proxy. HTTP proxies only relay TCP. Route the traffic to capture to the tun
+// device, e.g.:
+//
+//	ip tuntap add tun0 mode tun
+//	ip link set tun0 up
+//	ip route add 198.51.100.0/24 dev tun0
+//	tun2proxy -tun tun0 -proxy socks5://127.0.0.1:1080
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	"github.com/YaoZengzeng/yustack/link/tundev"
+)
+
+func main() {
+	tunName := flag.String("tun", "", "name of the tun device")
+	proxyURL := flag.String("proxy", "", "upstream proxy, socks5://[user:password@]host:port or http://[user:password@]host:port")
+	idleTimeout := flag.Duration("idle", 1 * time.Minute, "time after which idle flows are closed")
+	dialTimeout := flag.Duration("dial-timeout", 10 * time.Second, "timeout of the requests to the proxy")
+	statsInterval := flag.Duration("stats", 1 * time.Minute, "interval between the logs of the statistics, 0 disables them")
+	offload := flag.Bool("offload", false, "leave the checksums and the segmentation of TCP to the kernel, and coalesce the inbound TCP segments")
+	flag.Parse()
+
+	if *tunName == "" || *proxyURL == "" {
+		flag.Usage()
+		log.Fatal("-tun and -proxy are required")
+	}
+	if *idleTimeout < time.Millisecond {
+		log.Fatal("-idle must be at least 1ms")
+	}
+
+	up, err := newUpstream(*proxyURL, *dialTimeout)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	linkId, err := tundev.New(*tunName, &tundev.Options{Offload: *offload, GRO: *offload})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	p, err := newProxy(linkId, up, *idleTimeout)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *statsInterval == 0 {
+		select {}
+	}
+	for range time.Tick(*statsInterval) {
+		active, total, sent, received := p.tracker.stats()
+		log.Printf("%d flows active, %d in total, sent %d bytes, received %d bytes", active, total, sent, received)
+	}
+}
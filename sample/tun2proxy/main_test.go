@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/gonet"
+	"github.com/YaoZengzeng/yustack/link/channel"
+	"github.com/YaoZengzeng/yustack/network/ipv4"
+	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/transport/tcp"
+	"github.com/YaoZengzeng/yustack/transport/udp"
+	"github.com/YaoZengzeng/yustack/types"
+)
+
+const clientAddr = "\x0a\x00\x00\x02"
+
+// pipe delivers the packets written to a to the stack of b
+func pipe(a, b *channel.Endpoint) {
+	for pkt := range a.C {
+		vv := buffer.NewVectorisedView([]buffer.View{pkt.Header, pkt.Payload}, len(pkt.Header) + len(pkt.Payload))
+		b.Inject(pkt.Protocol, &vv)
+	}
+}
+
+// newTestProxy creates a proxy relaying to up, and the stack of a client whose
+// traffic all goes through the proxy
+func newTestProxy(t *testing.T, up upstream) (*proxy, *stack.Stack) {
+	proxyId, proxyEp := channel.New(256, 1500)
+	p, err := newProxy(proxyId, up, 1 * time.Second)
+	if err != nil {
+		t.Fatalf("newProxy failed: %v", err)
+	}
+
+	s := stack.New([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName, udp.ProtocolName})
+	clientId, clientEp := channel.New(256, 1500)
+	if err := s.CreateNic(1, clientId); err != nil {
+		t.Fatalf("CreateNic failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, clientAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]types.RouteEntry{{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", Nic: 1}})
+
+	go pipe(proxyEp, clientEp)
+	go pipe(clientEp, proxyEp)
+
+	return p, s
+}
+
+// serveSocks5 runs a SOCKS5 server standing in for a real proxy: it echoes
+// the data of the connections and the datagrams, and sends the addresses
+// asked for to requests
+func serveSocks5(t *testing.T, requests chan<- string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleSocks5(conn, requests)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func handleSocks5(conn net.Conn, requests chan<- string) {
+	defer conn.Close()
+
+	var greeting [3]byte
+	if _, err := io.ReadFull(conn, greeting[:]); err != nil {
+		return
+	}
+	conn.Write([]byte{socks5Version, socks5NoAuth})
+
+	var hdr [3]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return
+	}
+	addr, err := readSocks5Addr(conn, nil)
+	if err != nil {
+		return
+	}
+
+	switch hdr[1] {
+	case socks5Connect:
+		requests <- addr.String()
+		conn.Write(appendSocks5Addr([]byte{socks5Version, 0, 0}, net.IPv4zero, 0))
+		io.Copy(conn, conn)
+
+	case socks5UDPAssociate:
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		conn.Write(appendSocks5Addr([]byte{socks5Version, 0, 0}, net.IPv4zero, relay.LocalAddr().(*net.UDPAddr).Port))
+
+		// The datagrams are sent back as they are, their destination
+		// becoming their source
+		go func() {
+			buf := make([]byte, 65536)
+			for {
+				n, from, err := relay.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				if to, err := readSocks5Addr(bytes.NewReader(buf[3:n]), nil); err == nil {
+					requests <- to.String()
+				}
+				relay.WriteTo(buf[:n], from)
+			}
+		}()
+		io.Copy(ioutil.Discard, conn)
+	}
+}
+
+// serveHTTP runs an HTTP proxy standing in for a real one, it echoes the data
+// of the tunnels and sends their addresses to requests
+func serveHTTP(t *testing.T, requests chan<- string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				rd := bufio.NewReader(conn)
+				req, err := http.ReadRequest(rd)
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				requests <- req.Host
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				io.Copy(conn, rd)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// waitIdle waits for the proxy to have relayed the given number of bytes in
+// each direction, with no flow left
+func waitIdle(t *testing.T, p *proxy, bytes uint64) {
+	var active int
+	var total, sent, received uint64
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		active, total, sent, received = p.tracker.stats()
+		if active == 0 && sent == bytes && received == bytes {
+			return
+		}
+	}
+	t.Errorf("got %d active flows out of %d, %d bytes sent and %d received, want no active flow and %d bytes each way", active, total, sent, received, bytes)
+}
+
+func TestTCP(t *testing.T) {
+	for _, scheme := range []string{"socks5", "http"} {
+		t.Run(scheme, func(t *testing.T) {
+			requests := make(chan string, 16)
+			addr := serveSocks5(t, requests)
+			if scheme == "http" {
+				addr = serveHTTP(t, requests)
+			}
+			up, err := newUpstream(scheme + "://" + addr, 1 * time.Second)
+			if err != nil {
+				t.Fatalf("newUpstream failed: %v", err)
+			}
+			p, s := newTestProxy(t, up)
+
+			conn, err := gonet.DialTCP(s, types.FullAddress{Address: "\xc6\x33\x64\x01", Port: 80}, ipv4.ProtocolNumber)
+			if err != nil {
+				t.Fatalf("DialTCP failed: %v", err)
+			}
+			if _, err := conn.Write([]byte("hello")); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+				t.Fatalf("Read returned %q, %v, want %q", buf, err, "hello")
+			}
+			if got := <-requests; got != "198.51.100.1:80" {
+				t.Errorf("the proxy was asked for %v, want 198.51.100.1:80", got)
+			}
+			conn.Close()
+
+			waitIdle(t, p, 5)
+		})
+	}
+}
+
+func TestUDP(t *testing.T) {
+	requests := make(chan string, 16)
+	up, err := newUpstream("socks5://" + serveSocks5(t, requests), 1 * time.Second)
+	if err != nil {
+		t.Fatalf("newUpstream failed: %v", err)
+	}
+	p, s := newTestProxy(t, up)
+
+	dst := types.FullAddress{Address: "\xc6\x33\x64\x02", Port: 53}
+	conn, err := gonet.DialUDP(s, nil, &dst, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("DialUDP failed: %v", err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Write([]byte("query")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 16)
+		n, err := conn.Read(buf)
+		if err != nil || string(buf[:n]) != "query" {
+			t.Fatalf("Read returned %q, %v, want %q", buf[:n], err, "query")
+		}
+		if got := <-requests; got != "198.51.100.2:53" {
+			t.Errorf("the proxy was asked for %v, want 198.51.100.2:53", got)
+		}
+	}
+
+	// Both datagrams went through the same flow, which expires
+	waitIdle(t, p, 10)
+	if _, total, _, _ := p.tracker.stats(); total != 1 {
+		t.Errorf("got %d flows, want 1", total)
+	}
+}
+
+func TestClose(t *testing.T) {
+	requests := make(chan string, 16)
+	up, err := newUpstream("socks5://" + serveSocks5(t, requests), 1 * time.Second)
+	if err != nil {
+		t.Fatalf("newUpstream failed: %v", err)
+	}
+	p, s := newTestProxy(t, up)
+
+	dst := types.FullAddress{Address: "\xc6\x33\x64\x01", Port: 80}
+	conn, err := gonet.DialTCP(s, dst, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("DialTCP failed: %v", err)
+	}
+	conn.Close()
+
+	p.Close()
+	p.Close()
+	p.mu.Lock()
+	n := len(p.listeners)
+	p.mu.Unlock()
+	if n != 0 {
+		t.Errorf("got %d listeners after Close, want none", n)
+	}
+
+	// No connection is captured anymore
+	ctx, cancel := context.WithTimeout(context.Background(), 200 * time.Millisecond)
+	defer cancel()
+	if conn, err := gonet.DialContextTCP(ctx, s, dst, ipv4.ProtocolNumber); err == nil {
+		conn.Close()
+		t.Errorf("DialContextTCP succeeded after Close")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	id, _ := channel.New(1, 1500)
+	if _, err := newProxy(id, &httpUpstream{}, 0); err == nil {
+		t.Errorf("newProxy accepted a zero idle timeout")
+	}
+}
+
+func TestResolver(t *testing.T) {
+	res := make(resolver)
+	a, err := res.resolve("localhost", 53)
+	if err != nil {
+		t.Fatalf("resolve failed: %v", err)
+	}
+	b, err := res.resolve("localhost", 53)
+	if err != nil {
+		t.Fatalf("resolve failed: %v", err)
+	}
+	if a != b {
+		t.Errorf("localhost was resolved twice")
+	}
+}
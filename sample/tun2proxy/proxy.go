@@ -0,0 +1,490 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/gonet"
+	"github.com/YaoZengzeng/yustack/header"
+	"github.com/YaoZengzeng/yustack/network/ipv4"
+	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/transport/tcp"
+	"github.com/YaoZengzeng/yustack/transport/udp"
+	"github.com/YaoZengzeng/yustack/types"
+	"github.com/YaoZengzeng/yustack/waiter"
+)
+
+const (
+	nicId = 1
+
+	// listenBacklog is the backlog of the listeners created for the
+	// destinations of the captured connections
+	listenBacklog = 64
+
+	// udpQueueLen is the number of datagrams queued for a UDP flow while
+	// its association is set up, the ones beyond are dropped
+	udpQueueLen = 64
+)
+
+// flow is a TCP connection or a UDP flow relayed to the proxy
+type flow struct {
+	protocol	string
+	src			net.Addr
+	dst			net.Addr
+	start		time.Time
+
+	// lastActive is the time of the last packet in either direction, in
+	// nanoseconds since the epoch. sent counts the bytes relayed to the
+	// proxy, received the ones relayed back. They're accessed atomically
+	lastActive	int64
+	sent		uint64
+	received	uint64
+}
+
+// touch records activity on the flow
+func (f *flow) touch() {
+	atomic.StoreInt64(&f.lastActive, time.Now().UnixNano())
+}
+
+// idle returns how long the flow has been idle
+func (f *flow) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&f.lastActive)))
+}
+
+func (f *flow) String() string {
+	return fmt.Sprintf("%s %v -> %v", f.protocol, f.src, f.dst)
+}
+
+// tracker tracks the flows being relayed, and accounts for the bytes of the
+// ones which ended
+type tracker struct {
+	mu			sync.Mutex
+	flows		map[*flow]struct{}
+	total		uint64
+	sent		uint64
+	received	uint64
+}
+
+// add starts tracking a new flow
+func (t *tracker) add(protocol string, src, dst net.Addr) *flow {
+	f := &flow{protocol: protocol, src: src, dst: dst, start: time.Now()}
+	f.touch()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.flows == nil {
+		t.flows = make(map[*flow]struct{})
+	}
+	t.flows[f] = struct{}{}
+	t.total++
+
+	return f
+}
+
+// remove stops tracking f once it ended
+func (t *tracker) remove(f *flow) {
+	sent, received := atomic.LoadUint64(&f.sent), atomic.LoadUint64(&f.received)
+	log.Printf("%v closed after %v, sent %d bytes, received %d bytes", f, time.Since(f.start).Round(time.Millisecond), sent, received)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.flows, f)
+	t.sent += sent
+	t.received += received
+}
+
+// stats returns the number of flows being relayed and the total number of
+// flows, with the bytes relayed in each direction by all of them
+func (t *tracker) stats() (active int, total, sent, received uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sent, received = t.sent, t.received
+	for f := range t.flows {
+		sent += atomic.LoadUint64(&f.sent)
+		received += atomic.LoadUint64(&f.received)
+	}
+
+	return len(t.flows), t.total, sent, received
+}
+
+// proxy accepts every TCP connection and UDP flow entering a Nic, and relays
+// them to an upstream proxy
+type proxy struct {
+	stack		*stack.Stack
+	upstream	upstream
+	idleTimeout	time.Duration
+	tracker		tracker
+
+	// listeners and udpConns hold the endpoints created for the
+	// destinations of the captured traffic, none is created once the
+	// proxy is closed
+	mu			sync.Mutex
+	listeners	map[types.FullAddress]*listener
+	udpConns	map[types.FullAddress]*gonet.PacketConn
+	closed		bool
+
+	// done is closed with the proxy, it stops the expiry of the listeners
+	done		chan struct{}
+}
+
+// listener accepts the connections to a destination, it's closed once no
+// connection to it was accepted for the idle timeout
+type listener struct {
+	*gonet.Listener
+	lastAccept	time.Time
+	active		int
+}
+
+// newProxy creates a stack capturing everything entering the link endpoint,
+// and relays it to up. The flows are closed after being idle for idleTimeout,
+// which must be at least a millisecond
+func newProxy(linkId types.LinkEndpointID, up upstream, idleTimeout time.Duration) (*proxy, error) {
+	if idleTimeout < time.Millisecond {
+		return nil, errors.New("the idle timeout must be at least a millisecond")
+	}
+
+	p := &proxy{
+		stack:			stack.New([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName, udp.ProtocolName}),
+		upstream:		up,
+		idleTimeout:	idleTimeout,
+		listeners:		make(map[types.FullAddress]*listener),
+		udpConns:		make(map[types.FullAddress]*gonet.PacketConn),
+		done:			make(chan struct{}),
+	}
+	p.stack.SetTransportProtocolHandler(tcp.ProtocolNumber, p.handleTCP)
+	if up.RelaysUDP() {
+		p.stack.SetTransportProtocolHandler(udp.ProtocolNumber, p.handleUDP)
+	}
+
+	// The Nic needs no address: it accepts the packets to any address,
+	// and replies from their destination
+	if err := p.stack.CreateNic(nicId, linkId); err != nil {
+		return nil, err
+	}
+	if err := p.stack.SetPromiscuousMode(nicId, true); err != nil {
+		return nil, err
+	}
+	if err := p.stack.SetSpoofing(nicId, true); err != nil {
+		return nil, err
+	}
+	p.stack.SetRouteTable([]types.RouteEntry{{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", Nic: nicId}})
+
+	go p.expireListeners()
+
+	return p, nil
+}
+
+// Close stops capturing new flows: the listeners and the UDP endpoints are
+// closed. The connections being relayed are left to end
+func (p *proxy) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.done)
+
+	for addr, l := range p.listeners {
+		l.Close()
+		delete(p.listeners, addr)
+	}
+	for addr, conn := range p.udpConns {
+		conn.Close()
+		delete(p.udpConns, addr)
+	}
+}
+
+// handleTCP creates a listener for the destination of the SYNs nobody listens
+// to, the stack then delivers them to it
+func (p *proxy) handleTCP(r *types.Route, id types.TransportEndpointId, vv *buffer.VectorisedView) bool {
+	if header.TCP(vv.First()).Flags() & (header.TCPFlagSyn | header.TCPFlagAck) != header.TCPFlagSyn {
+		return false
+	}
+
+	addr := types.FullAddress{Address: id.LocalAddress, Port: id.LocalPort}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.listeners[addr]; ok || p.closed {
+		// Being closed
+		return false
+	}
+
+	var wq waiter.Queue
+	ep, err := p.stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		return false
+	}
+	if err := ep.Bind(addr); err != nil {
+		ep.Close()
+		return false
+	}
+	if err := ep.Listen(listenBacklog); err != nil {
+		ep.Close()
+		return false
+	}
+
+	l := &listener{Listener: gonet.NewListener(p.stack, &wq, ep), lastAccept: time.Now()}
+	p.listeners[addr] = l
+	go p.accept(l)
+
+	return true
+}
+
+// accept relays the connections accepted by l until it's closed
+func (p *proxy) accept(l *listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		p.mu.Lock()
+		l.lastAccept = time.Now()
+		l.active++
+		p.mu.Unlock()
+
+		go func() {
+			p.relayTCP(conn)
+
+			p.mu.Lock()
+			l.active--
+			p.mu.Unlock()
+		}()
+	}
+}
+
+// expireListeners closes the listeners which have no connection and accepted
+// none for the idle timeout. A SYN racing with the close is answered with a
+// reset, and the next one gets a new listener
+func (p *proxy) expireListeners() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+
+		p.mu.Lock()
+		for addr, l := range p.listeners {
+			if l.active == 0 && time.Since(l.lastAccept) > p.idleTimeout {
+				l.Close()
+				delete(p.listeners, addr)
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// relayTCP relays conn to the upstream proxy until either side closes it, or
+// it's idle for the idle timeout
+func (p *proxy) relayTCP(conn net.Conn) {
+	defer conn.Close()
+
+	// The local address of the connection is the destination the client
+	// asked for
+	dst := conn.LocalAddr().(*net.TCPAddr)
+	f := p.tracker.add("tcp", conn.RemoteAddr(), dst)
+	defer p.tracker.remove(f)
+
+	up, err := p.upstream.Dial(dst)
+	if err != nil {
+		log.Printf("%v: %v", f, err)
+		return
+	}
+	defer up.Close()
+
+	done := make(chan struct{})
+	go func() {
+		p.copy(f, up, conn, &f.sent)
+		close(done)
+	}()
+	p.copy(f, conn, up, &f.received)
+	<-done
+}
+
+// closeWriter is implemented by the connections which can be half-closed
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// copy copies from src to dst, counting the bytes in n, until src is closed or
+// the flow is idle for the idle timeout. It then closes dst for writing
+func (p *proxy) copy(f *flow, dst, src net.Conn, n *uint64) {
+	buf := make([]byte, 32 * 1024)
+	for {
+		src.SetReadDeadline(time.Now().Add(p.idleTimeout))
+		nr, err := src.Read(buf)
+		if nr > 0 {
+			if _, err := dst.Write(buf[:nr]); err != nil {
+				src.Close()
+				return
+			}
+			atomic.AddUint64(n, uint64(nr))
+			f.touch()
+		}
+		if err == nil {
+			continue
+		}
+
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			// The other direction may still be busy
+			if f.idle() < p.idleTimeout {
+				continue
+			}
+			src.Close()
+			dst.Close()
+			return
+		}
+
+		if cw, ok := dst.(closeWriter); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		return
+	}
+}
+
+// handleUDP creates an endpoint bound to the destination of the datagrams
+// nobody wants, the stack then delivers them to it
+func (p *proxy) handleUDP(r *types.Route, id types.TransportEndpointId, vv *buffer.VectorisedView) bool {
+	addr := types.FullAddress{Address: id.LocalAddress, Port: id.LocalPort}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.udpConns[addr]; ok || p.closed {
+		// Being closed
+		return false
+	}
+
+	conn, err := gonet.DialUDP(p.stack, &addr, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		return false
+	}
+	p.udpConns[addr] = conn
+	go p.serveUDP(addr, conn)
+
+	return true
+}
+
+// udpFlow is a UDP flow from a source to the destination of a UDP endpoint
+type udpFlow struct {
+	*flow
+	datagrams	chan []byte
+}
+
+// serveUDP dispatches the datagrams received by conn to their flow, keyed by
+// their source. The endpoint is closed once it has no flow left and received
+// nothing for the idle timeout
+func (p *proxy) serveUDP(addr types.FullAddress, conn *gonet.PacketConn) {
+	var mu sync.Mutex
+	flows := make(map[string]*udpFlow)
+
+	buf := make([]byte, 65536)
+	for {
+		conn.SetReadDeadline(time.Now().Add(p.idleTimeout))
+		n, from, err := conn.ReadFrom(buf)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			mu.Lock()
+			idle := len(flows) == 0
+			mu.Unlock()
+			if !idle {
+				continue
+			}
+
+			p.mu.Lock()
+			delete(p.udpConns, addr)
+			p.mu.Unlock()
+			conn.Close()
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		mu.Lock()
+		uf, ok := flows[from.String()]
+		if !ok {
+			uf = &udpFlow{
+				flow:		p.tracker.add("udp", from, conn.LocalAddr()),
+				datagrams:	make(chan []byte, udpQueueLen),
+			}
+			flows[from.String()] = uf
+			go func() {
+				p.relayUDP(conn, from.(*net.UDPAddr), uf)
+
+				mu.Lock()
+				delete(flows, from.String())
+				mu.Unlock()
+				p.tracker.remove(uf.flow)
+			}()
+		}
+		mu.Unlock()
+
+		select {
+		case uf.datagrams <- append([]byte(nil), buf[:n]...):
+		default:
+			// The association is too slow to set up
+		}
+	}
+}
+
+// relayUDP relays the datagrams of uf through a UDP association of the proxy,
+// until the association is idle for the idle timeout. The replies are sent
+// from the destination of the flow, whichever address they come from
+func (p *proxy) relayUDP(conn *gonet.PacketConn, src *net.UDPAddr, uf *udpFlow) {
+	a, err := p.upstream.Associate()
+	if err != nil {
+		log.Printf("%v: %v", uf.flow, err)
+		return
+	}
+	defer a.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		buf := make([]byte, 65536)
+		for {
+			a.SetReadDeadline(time.Now().Add(p.idleTimeout))
+			n, _, err := a.ReadFrom(buf)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && uf.idle() < p.idleTimeout {
+				continue
+			}
+			if err != nil {
+				return
+			}
+
+			if _, err := conn.WriteTo(buf[:n], src); err != nil {
+				continue
+			}
+			atomic.AddUint64(&uf.received, uint64(n))
+			uf.touch()
+		}
+	}()
+
+	dst := uf.dst.(*net.UDPAddr)
+	for {
+		select {
+		case b := <-uf.datagrams:
+			if _, err := a.WriteTo(b, dst); err != nil {
+				return
+			}
+			atomic.AddUint64(&uf.sent, uint64(len(b)))
+			uf.touch()
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// upstream opens the connections and UDP associations to the proxy which the
+// captured traffic is relayed to
+type upstream interface {
+	// Dial opens a TCP connection to addr through the proxy
+	Dial(addr *net.TCPAddr) (net.Conn, error)
+
+	// RelaysUDP tells whether the proxy can relay UDP
+	RelaysUDP() bool
+
+	// Associate opens a UDP association through the proxy
+	Associate() (*association, error)
+}
+
+// newUpstream returns the upstream of a proxy URL, either socks5://host:port
+// or http://host:port. Both may carry a user and a password
+func newUpstream(rawurl string, timeout time.Duration) (upstream, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no proxy address in %q", rawurl)
+	}
+
+	switch u.Scheme {
+	case "socks5":
+		return &socks5Upstream{addr: u.Host, user: u.User, timeout: timeout}, nil
+	case "http":
+		return &httpUpstream{addr: u.Host, user: u.User, timeout: timeout}, nil
+	}
+
+	return nil, fmt.Errorf("unknown proxy scheme %q", u.Scheme)
+}
+
+// maxResponseHeader is the maximum size of the header of the responses to the
+// CONNECT requests
+const maxResponseHeader = 8192
+
+// httpUpstream tunnels TCP connections with HTTP CONNECT
+type httpUpstream struct {
+	addr	string
+	user	*url.Userinfo
+	timeout	time.Duration
+}
+
+// Dial implements upstream.Dial
+func (h *httpUpstream) Dial(addr *net.TCPAddr) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", h.addr, h.timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(h.timeout))
+
+	req := &http.Request{
+		Method:	http.MethodConnect,
+		URL:	&url.URL{Opaque: addr.String()},
+		Host:	addr.String(),
+		Header:	make(http.Header),
+	}
+	if h.user != nil {
+		password, _ := h.user.Password()
+		req.SetBasicAuth(h.user.Username(), password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Read the response header a byte at a time, as whatever follows it
+	// comes from the server
+	var hdr []byte
+	for !bytes.HasSuffix(hdr, []byte("\r\n\r\n")) {
+		var b [1]byte
+		if len(hdr) == maxResponseHeader {
+			conn.Close()
+			return nil, fmt.Errorf("CONNECT %v: response header too long", addr)
+		}
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		hdr = append(hdr, b[0])
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(hdr)), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("CONNECT %v: %v", addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// RelaysUDP implements upstream.RelaysUDP
+func (*httpUpstream) RelaysUDP() bool {
+	return false
+}
+
+// Associate implements upstream.Associate, HTTP proxies don't relay UDP
+func (*httpUpstream) Associate() (*association, error) {
+	return nil, errors.New("HTTP proxies can't relay UDP")
+}
+
+// socks5Upstream relays TCP connections and UDP datagrams through a SOCKS5
+// proxy (RFC 1928), with the username/password authentication of RFC 1929
+type socks5Upstream struct {
+	addr	string
+	user	*url.Userinfo
+	timeout	time.Duration
+}
+
+const (
+	socks5Version		= 5
+	socks5NoAuth		= 0
+	socks5UserPass		= 2
+	socks5Connect		= 1
+	socks5UDPAssociate	= 3
+	socks5IPv4			= 1
+	socks5Domain		= 3
+	socks5IPv6			= 4
+)
+
+// Dial implements upstream.Dial
+func (s *socks5Upstream) Dial(addr *net.TCPAddr) (net.Conn, error) {
+	conn, _, err := s.request(socks5Connect, addr.IP, addr.Port)
+	return conn, err
+}
+
+// RelaysUDP implements upstream.RelaysUDP
+func (*socks5Upstream) RelaysUDP() bool {
+	return true
+}
+
+// Associate implements upstream.Associate
+func (s *socks5Upstream) Associate() (*association, error) {
+	ctrl, relay, err := s.request(socks5UDPAssociate, net.IPv4zero, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// An unspecified relay address stands for the address of the proxy
+	if relay.IP.IsUnspecified() {
+		relay.IP = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+	conn, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	a := &association{ctrl: ctrl, conn: conn}
+
+	// The association lasts as long as its TCP connection
+	go func() {
+		io.Copy(ioutil.Discard, ctrl)
+		a.Close()
+	}()
+
+	return a, nil
+}
+
+// request connects to the proxy, authenticates and sends it a request. It
+// returns the connection and the address in the reply of the proxy
+func (s *socks5Upstream) request(cmd byte, ip net.IP, port int) (net.Conn, *net.UDPAddr, error) {
+	conn, err := net.DialTimeout("tcp", s.addr, s.timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(s.timeout))
+
+	bound, err := s.handshake(conn, cmd, ip, port)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, bound, nil
+}
+
+func (s *socks5Upstream) handshake(conn net.Conn, cmd byte, ip net.IP, port int) (*net.UDPAddr, error) {
+	method := byte(socks5NoAuth)
+	if s.user != nil {
+		method = socks5UserPass
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return nil, err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return nil, err
+	}
+	if reply[0] != socks5Version || reply[1] != method {
+		return nil, fmt.Errorf("socks5: method %d refused", method)
+	}
+
+	if method == socks5UserPass {
+		password, _ := s.user.Password()
+		msg := []byte{1, byte(len(s.user.Username()))}
+		msg = append(msg, s.user.Username()...)
+		msg = append(msg, byte(len(password)))
+		msg = append(msg, password...)
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return nil, err
+		}
+		if reply[1] != 0 {
+			return nil, errors.New("socks5: authentication failed")
+		}
+	}
+
+	req := []byte{socks5Version, cmd, 0}
+	req = appendSocks5Addr(req, ip, port)
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	var hdr [3]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[1] != 0 {
+		return nil, fmt.Errorf("socks5: request failed with code %d", hdr[1])
+	}
+
+	return readSocks5Addr(conn, nil)
+}
+
+// appendSocks5Addr appends the SOCKS5 encoding of ip and port to b
+func appendSocks5Addr(b []byte, ip net.IP, port int) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socks5IPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socks5IPv6)
+		b = append(b, ip.To16()...)
+	}
+
+	return append(b, byte(port >> 8), byte(port))
+}
+
+// maxResolved is the number of domain names a resolver remembers
+const maxResolved = 16
+
+// resolver remembers the addresses of the domain names of the SOCKS5
+// addresses read, the ones of a flow seldom changing
+type resolver map[string]*net.UDPAddr
+
+// resolve returns the address of name and port, resolving it if it isn't
+// remembered. A nil resolver resolves every time
+func (res resolver) resolve(name string, port uint16) (*net.UDPAddr, error) {
+	hostport := net.JoinHostPort(name, strconv.Itoa(int(port)))
+	if addr, ok := res[hostport]; ok {
+		return addr, nil
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", hostport)
+	if err != nil || res == nil {
+		return addr, err
+	}
+	if len(res) == maxResolved {
+		for k := range res {
+			delete(res, k)
+		}
+	}
+	res[hostport] = addr
+
+	return addr, nil
+}
+
+// readSocks5Addr reads a SOCKS5 address, domain names are resolved by res
+func readSocks5Addr(r io.Reader, res resolver) (*net.UDPAddr, error) {
+	var typ [1]byte
+	if _, err := io.ReadFull(r, typ[:]); err != nil {
+		return nil, err
+	}
+
+	var ip net.IP
+	switch typ[0] {
+	case socks5IPv4:
+		ip = make(net.IP, net.IPv4len)
+	case socks5IPv6:
+		ip = make(net.IP, net.IPv6len)
+	case socks5Domain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return nil, err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, err
+		}
+		var port [2]byte
+		if _, err := io.ReadFull(r, port[:]); err != nil {
+			return nil, err
+		}
+		return res.resolve(string(name), binary.BigEndian.Uint16(port[:]))
+	default:
+		return nil, fmt.Errorf("socks5: unknown address type %d", typ[0])
+	}
+
+	if _, err := io.ReadFull(r, ip); err != nil {
+		return nil, err
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return nil, err
+	}
+
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(port[:]))}, nil
+}
+
+// association is a SOCKS5 UDP association, the datagrams it relays are
+// prefixed with the address of their destination or source
+type association struct {
+	ctrl	net.Conn
+	conn	*net.UDPConn
+
+	// buf receives the datagrams relayed by the proxy, names resolves
+	// their source addresses. They're only used by ReadFrom
+	buf		[]byte
+	names	resolver
+}
+
+// WriteTo sends b to addr through the proxy
+func (a *association) WriteTo(b []byte, addr *net.UDPAddr) (int, error) {
+	msg := appendSocks5Addr([]byte{0, 0, 0}, addr.IP, addr.Port)
+	if _, err := a.conn.Write(append(msg, b...)); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// ReadFrom reads a datagram relayed by the proxy, and returns the address it
+// comes from. Fragmented datagrams are discarded. It must not be called
+// concurrently
+func (a *association) ReadFrom(b []byte) (int, *net.UDPAddr, error) {
+	// The header of the datagrams is at most 262 bytes long
+	if len(a.buf) < len(b) + 262 {
+		a.buf = make([]byte, len(b) + 262)
+	}
+	if a.names == nil {
+		a.names = make(resolver)
+	}
+
+	for {
+		n, err := a.conn.Read(a.buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n < 4 || a.buf[2] != 0 {
+			continue
+		}
+
+		r := bytes.NewReader(a.buf[3:n])
+		from, err := readSocks5Addr(r, a.names)
+		if err != nil {
+			continue
+		}
+
+		return copy(b, a.buf[n - r.Len():n]), from, nil
+	}
+}
+
+// SetReadDeadline sets the deadline of ReadFrom
+func (a *association) SetReadDeadline(t time.Time) error {
+	return a.conn.SetReadDeadline(t)
+}
+
+// Close ends the association
+func (a *association) Close() error {
+	a.ctrl.Close()
+	return a.conn.Close()
+}
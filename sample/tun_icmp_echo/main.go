@@ -48,7 +48,7 @@ func main() {
 	// NIC and address.
 	s := stack.New([]string{ipv4.ProtocolName}, []string{ipv4.PingProtocolName})
 
-	linkId, err := tundev.New(tunName)
+	linkId, err := tundev.New(tunName, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
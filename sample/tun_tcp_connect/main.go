@@ -85,7 +85,7 @@ func main() {
 	// Nic and ipv4 address
 	s := stack.New([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName})
 
-	linkId, err := tundev.New(tunName)
+	linkId, err := tundev.New(tunName, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
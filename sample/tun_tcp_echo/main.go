@@ -8,7 +8,7 @@ import (
 
 	"github.com/YaoZengzeng/yustack/types"
 	"github.com/YaoZengzeng/yustack/link/tundev"
-	"github.com/YaoZengzeng/yustack/waiter"
+	"github.com/YaoZengzeng/yustack/gonet"
 	"github.com/YaoZengzeng/yustack/network/ipv4"
 	"github.com/YaoZengzeng/yustack/stack"
 	"github.com/YaoZengzeng/yustack/transport/tcp"
@@ -23,26 +23,18 @@ const (
 	nicId = 1
 )
 
-func echo(wq *waiter.Queue, ep types.Endpoint) {
-	// Create wait queue entry that notifies a channel
-	waitEntry, notifyCh := waiter.NewChannelEntry(nil)
-
-	wq.EventRegister(&waitEntry, waiter.EventIn)
-	defer wq.EventUnregister(&waitEntry)
+func echo(conn net.Conn) {
+	defer conn.Close()
 
+	buf := make([]byte, 1024)
 	for {
-		v, err := ep.Read(nil)
+		n, err := conn.Read(buf)
 		if err != nil {
-			if err == types.ErrWouldBlock {
-				<-notifyCh
-				continue
-			}
-
 			return
 		}
-		log.Printf("Read %s\n", string(v))
-		
-		ep.Write(v, nil)
+		log.Printf("Read %s\n", string(buf[:n]))
+
+		conn.Write(buf[:n])
 	}
 }
 
@@ -73,7 +65,7 @@ func main() {
 	// NIC and address.
 	s := stack.New([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName})
 
-	linkId, err := tundev.New(tunName)
+	linkId, err := tundev.New(tunName, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -96,41 +88,19 @@ func main() {
 		},
 	})
 
-	// Create tcp endpointm, bind it, then work as an echo server
-	var wq waiter.Queue
-	ep, err := s.NewEndpoint(tcp.ProtocolNumber, proto, &wq)
+	// Create tcp listener, then work as an echo server
+	l, err := gonet.ListenTCP(s, types.FullAddress{0, "", uint16(stackPort)}, proto)
 	if err != nil {
-		log.Fatalf("tun_udp_echo: NewEndpoint failed: %v\n", err)
+		log.Fatalf("ListenTCP failed: %v\n", err)
 	}
-
-	err = ep.Bind(types.FullAddress{0, "", uint16(stackPort)})
-	if err != nil {
-		log.Fatalf("Bind failed: %v\n", err)
-	}
-
-	err = ep.Listen(10);
-	if err != nil {
-		log.Fatalf("Listen failed: %v\n", err)
-	}
-
-	// Wait for connections to appear
-	waitEntry, notifyCh := waiter.NewChannelEntry(nil)
-	wq.EventRegister(&waitEntry, waiter.EventIn)
-	defer wq.EventUnregister(&waitEntry)
+	defer l.Close()
 
 	for {
-		n, wq, err := ep.Accept()
+		conn, err := l.Accept()
 		if err != nil {
-			if err == types.ErrWouldBlock {
-				<-notifyCh
-				continue
-			}
-
 			log.Fatalf("Accept() failed: %v", err)
 		}
 
-		go echo(wq, n)
+		go echo(conn)
 	}
-
 }
-
@@ -6,11 +6,11 @@ import (
 	"os"
 	"strings"
 
+	"github.com/YaoZengzeng/yustack/gonet"
 	"github.com/YaoZengzeng/yustack/network/ipv4"
 	"github.com/YaoZengzeng/yustack/stack"
 	"github.com/YaoZengzeng/yustack/types"
 	"github.com/YaoZengzeng/yustack/link/tundev"
-	"github.com/YaoZengzeng/yustack/waiter"
 	"github.com/YaoZengzeng/yustack/transport/udp"
 )
 
@@ -50,7 +50,7 @@ func main() {
 	// NIC and address.
 	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName})
 
-	linkId, err := tundev.New(tunName)
+	linkId, err := tundev.New(tunName, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -73,42 +73,23 @@ func main() {
 		},
 	})
 
-	// Create tcp endpointm, bind it, then work as an echo server
-	var wq waiter.Queue
-	ep, err := s.NewEndpoint(udp.ProtocolNumber, proto, &wq)
+	// Create udp endpoint, bind it, then work as an echo server
+	conn, err := gonet.DialUDP(s, &types.FullAddress{Port: uint16(stackPort)}, nil, proto)
 	if err != nil {
-		log.Fatalf("tun_udp_echo: NewEndpoint failed: %v\n", err)
+		log.Fatalf("tun_udp_echo: DialUDP failed: %v\n", err)
 	}
+	defer conn.Close()
 
-	err = ep.Bind(types.FullAddress{Port: uint16(stackPort)})
-	if err != nil {
-		log.Fatalf("tun_udp_echo: Bind failed: %v\n", err)
-	}
-
-	// Create wait queue entry that notifies a channel
-	waitEntry, notifyCh := waiter.NewChannelEntry(nil)
-
-	wq.EventRegister(&waitEntry, waiter.EventIn)
-	defer wq.EventUnregister(&waitEntry)
-
-	for  {
-		var fullAddr types.FullAddress
-		v, err := ep.Read(&fullAddr)
-		if err == types.ErrWouldBlock {
-			<- notifyCh
-			v, err = ep.Read(&fullAddr)
-			if err != nil {
-				log.Fatalf("tun_udp_echo: read failed\n")
-			}
-		} else {
-			log.Fatalf("tun_udp_echo: read failed\n")
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Fatalf("tun_udp_echo: read failed: %v\n", err)
 		}
 
-		_, err = ep.Write(v, &fullAddr)
+		_, err = conn.WriteTo(buf[:n], from)
 		if err != nil {
-			log.Fatalf("tun_udp_echo: write failed\n")
+			log.Fatalf("tun_udp_echo: write failed: %v\n", err)
 		}
 	}
-
-	log.Printf("tun_udp_echo finished......")
 }
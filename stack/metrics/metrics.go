@@ -0,0 +1,330 @@
+// Package metrics exports the statistics of one or more stacks, through expvar
+// and as an http.Handler serving the Prometheus text format. Stacks are
+// labelled by the name they were registered with:
+//
+//	metrics.Register("main", s)
+//	http.Handle("/metrics", metrics.Handler())
+//
+// The counters of the default registry are published in expvar under the
+// "yustack" variable, and are thus also served by /debug/vars
+package metrics
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/YaoZengzeng/yustack/header"
+	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/types"
+)
+
+// namespace prefixes the names of all the Prometheus metrics
+const namespace = "yustack"
+
+// ErrDuplicateName is returned by Register when a stack is already registered
+// with the same name
+var ErrDuplicateName = fmt.Errorf("metrics: a stack is already registered with this name")
+
+// DefaultRegistry is the registry used by Register and Handler, it is
+// published in expvar as "yustack"
+var DefaultRegistry = NewRegistry()
+
+func init() {
+	expvar.Publish(namespace, DefaultRegistry.Var())
+}
+
+// Register registers the stack with the default registry
+func Register(name string, s *stack.Stack) error {
+	return DefaultRegistry.Register(name, s)
+}
+
+// Unregister removes the stack with the given name from the default registry
+func Unregister(name string) {
+	DefaultRegistry.Unregister(name)
+}
+
+// Handler returns an http.Handler serving the metrics of the default registry
+// in the Prometheus text format
+func Handler() http.Handler {
+	return DefaultRegistry
+}
+
+// Registry holds a set of named stacks whose statistics are exported
+type Registry struct {
+	mu		sync.RWMutex
+	stacks	map[string]*stack.Stack
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		stacks:	make(map[string]*stack.Stack),
+	}
+}
+
+// Register adds the stack to the registry. Its metrics are labelled with the
+// given name, which must be unique in the registry
+func (r *Registry) Register(name string, s *stack.Stack) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.stacks[name]; ok {
+		return ErrDuplicateName
+	}
+	r.stacks[name] = s
+
+	return nil
+}
+
+// Unregister removes the stack with the given name from the registry
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.stacks, name)
+}
+
+// sample is a single value of a metric
+type sample struct {
+	// path is the name of the metric split in words, e.g., {"ip",
+	// "packets", "received"}
+	path	[]string
+	labels	[][2]string
+	value	uint64
+	counter	bool
+}
+
+// name returns the Prometheus name of the metric of the sample
+func (s *sample) name() string {
+	name := namespace + "_" + strings.Join(s.path, "_")
+	if s.counter {
+		name += "_total"
+	}
+	return name
+}
+
+// collect returns the samples of the stack
+func collect(s *stack.Stack) []sample {
+	var samples []sample
+
+	// The protocol counters are named after the fields of stack.Stats
+	stats := s.Stats()
+	walkStats(reflect.ValueOf(stats).Elem(), nil, func(path []string, c *types.StatCounter) {
+		samples = append(samples, sample{path: path, value: c.Value(), counter: true})
+	})
+
+	for reason := types.DropReason(0); reason < types.NumDropReasons; reason++ {
+		samples = append(samples, sample{
+			path:		[]string{"dropped_packets"},
+			labels:		[][2]string{{"reason", reason.String()}},
+			value:		stats.DroppedPackets[reason].Value(),
+			counter:	true,
+		})
+	}
+
+	for _, id := range s.NicIds() {
+		stats, err := s.NicStats(id)
+		if err != nil {
+			// The NIC has just been removed
+			continue
+		}
+
+		nic := [][2]string{{"nic", strconv.Itoa(int(id))}}
+		walkStats(reflect.ValueOf(stats).Elem(), []string{"nic"}, func(path []string, c *types.StatCounter) {
+			samples = append(samples, sample{path: path, labels: nic, value: c.Value(), counter: true})
+		})
+	}
+
+	for state, n := range tcpStates(s) {
+		samples = append(samples, sample{
+			path:	[]string{"tcp_endpoints"},
+			labels:	[][2]string{{"state", state}},
+			value:	uint64(n),
+		})
+	}
+
+	samples = append(samples, sample{
+		path:	[]string{"ports", "reserved"},
+		value:	uint64(s.ReservedPorts()),
+	})
+
+	return samples
+}
+
+// tcpStates counts the TCP endpoints registered with the stack by state
+func tcpStates(s *stack.Stack) map[string]int {
+	states := make(map[string]int)
+	for _, ep := range s.TransportEndpoints(header.TCPProtocolNumber) {
+		e, ok := ep.(types.Endpoint)
+		if !ok {
+			continue
+		}
+
+		var info types.TCPInfoOption
+		if err := e.GetSockOpt(&info); err != nil {
+			continue
+		}
+		states[info.State]++
+	}
+
+	return states
+}
+
+// walkStats calls f for each StatCounter found in v, a struct of counters,
+// with the path of field names leading to it. The names of embedded structs
+// are skipped
+func walkStats(v reflect.Value, path []string, f func(path []string, c *types.StatCounter)) {
+	if c, ok := v.Addr().Interface().(*types.StatCounter); ok {
+		f(append([]string(nil), path...), c)
+		return
+	}
+
+	if v.Kind() != reflect.Struct {
+		return
+	}
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		p := path
+		if !field.Anonymous {
+			p = append(p[:len(p):len(p)], splitWords(field.Name)...)
+		}
+		walkStats(v.Field(i), p, f)
+	}
+}
+
+// splitWords splits a CamelCase name in lower case words, keeping acronyms
+// and digits together, e.g., "V4PacketsSent" gives {"v4", "packets", "sent"}
+func splitWords(name string) []string {
+	var words []string
+	runes := []rune(name)
+	start := 0
+	for i := 1; i < len(runes); i++ {
+		if !unicode.IsUpper(runes[i]) {
+			continue
+		}
+		// An upper case letter starts a new word, unless it continues an
+		// acronym which isn't followed by a lower case letter
+		prevUpper := unicode.IsUpper(runes[i-1]) || unicode.IsDigit(runes[i-1])
+		nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+		if prevUpper && !nextLower {
+			continue
+		}
+		words = append(words, strings.ToLower(string(runes[start:i])))
+		start = i
+	}
+
+	return append(words, strings.ToLower(string(runes[start:])))
+}
+
+// labelEscaper escapes label values as required by the Prometheus text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// ServeHTTP serves the metrics of all the registered stacks in the Prometheus
+// text format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	type family struct {
+		counter	bool
+		lines	[]string
+	}
+	families := make(map[string]*family)
+
+	r.mu.RLock()
+	for name, s := range r.stacks {
+		for _, smp := range collect(s) {
+			var b bytes.Buffer
+			fmt.Fprintf(&b, `%s{stack="%s"`, smp.name(), labelEscaper.Replace(name))
+			for _, l := range smp.labels {
+				fmt.Fprintf(&b, `,%s="%s"`, l[0], labelEscaper.Replace(l[1]))
+			}
+			fmt.Fprintf(&b, "} %d\n", smp.value)
+
+			f := families[smp.name()]
+			if f == nil {
+				f = &family{counter: smp.counter}
+				families[smp.name()] = f
+			}
+			f.lines = append(f.lines, b.String())
+		}
+	}
+	r.mu.RUnlock()
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		f := families[name]
+		typ := "gauge"
+		if f.counter {
+			typ = "counter"
+		}
+		sort.Strings(f.lines)
+
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+		for _, l := range f.lines {
+			fmt.Fprint(w, l)
+		}
+	}
+}
+
+// Var returns an expvar.Var reporting the metrics of all the registered
+// stacks as a JSON object keyed by stack name
+func (r *Registry) Var() expvar.Var {
+	return expvar.Func(func() interface{} {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+
+		res := make(map[string]interface{})
+		for name, s := range r.stacks {
+			res[name] = snapshot(s)
+		}
+		return res
+	})
+}
+
+// snapshot returns the samples of the stack as nested maps, e.g.,
+// {"ip": {"packets_received": 1}, "nic": {"1": {"rx_packets": 1}}}
+func snapshot(s *stack.Stack) map[string]interface{} {
+	res := make(map[string]interface{})
+	for _, smp := range collect(s) {
+		// The labels, e.g., the NIC id, nest the values below the first
+		// word of the metric name
+		keys := []string{smp.path[0]}
+		for _, l := range smp.labels {
+			keys = append(keys, l[1])
+		}
+		if len(smp.path) > 1 {
+			keys = append(keys, strings.Join(smp.path[1:], "_"))
+		}
+
+		m := res
+		for _, k := range keys[:len(keys)-1] {
+			sub, ok := m[k].(map[string]interface{})
+			if !ok {
+				sub = make(map[string]interface{})
+				m[k] = sub
+			}
+			m = sub
+		}
+		m[keys[len(keys)-1]] = smp.value
+	}
+
+	return res
+}
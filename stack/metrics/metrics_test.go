@@ -0,0 +1,118 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/YaoZengzeng/yustack/gonet"
+	"github.com/YaoZengzeng/yustack/link/loopback"
+	"github.com/YaoZengzeng/yustack/network/ipv4"
+	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/transport/tcp"
+	"github.com/YaoZengzeng/yustack/transport/udp"
+	"github.com/YaoZengzeng/yustack/types"
+)
+
+const localhost = "\x7f\x00\x00\x01"
+
+func newStack(t *testing.T) *stack.Stack {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName, udp.ProtocolName})
+
+	if err := s.CreateNic(1, loopback.New()); err != nil {
+		t.Fatalf("CreateNic failed: %v", err)
+	}
+
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, localhost); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	return s
+}
+
+func TestSplitWords(t *testing.T) {
+	tests := map[string][]string{
+		"IP":                         {"ip"},
+		"PacketsReceived":            {"packets", "received"},
+		"V4PacketsSent":              {"v4", "packets", "sent"},
+		"HTTPServer":                 {"http", "server"},
+		"UnknownProtocolRcvdPackets": {"unknown", "protocol", "rcvd", "packets"},
+	}
+
+	for name, want := range tests {
+		if got := splitWords(name); !reflect.DeepEqual(got, want) {
+			t.Errorf("splitWords(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	a, b := newStack(t), newStack(t)
+
+	r := NewRegistry()
+	if err := r.Register("a", a); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if err := r.Register("b", b); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if err := r.Register("a", b); err != ErrDuplicateName {
+		t.Fatalf("Register returned %v, want %v", err, ErrDuplicateName)
+	}
+
+	// Only stack a sends a datagram and has a listening endpoint
+	c, err := gonet.DialUDP(a, nil, &types.FullAddress{Address: localhost, Port: 1234}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("DialUDP failed: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	l, err := gonet.ListenTCP(a, types.FullAddress{Port: 80}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("ListenTCP failed: %v", err)
+	}
+	defer l.Close()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	for _, want := range []string{
+		"# TYPE yustack_udp_packets_sent_total counter\n",
+		`yustack_udp_packets_sent_total{stack="a"} 1` + "\n",
+		`yustack_udp_packets_sent_total{stack="b"} 0` + "\n",
+		`yustack_udp_unknown_port_errors_total{stack="a"} 1` + "\n",
+		`yustack_dropped_packets_total{stack="a",reason="no_transport_endpoint"} 1` + "\n",
+		`yustack_nic_tx_packets_total{stack="a",nic="1"} 1` + "\n",
+		"# TYPE yustack_tcp_endpoints gauge\n",
+		`yustack_tcp_endpoints{stack="a",state="listen"} 1` + "\n",
+		`yustack_ports_reserved{stack="b"} 0` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics don't contain %q:\n%s", want, body)
+		}
+	}
+
+	var vars map[string]map[string]map[string]interface{}
+	if err := json.Unmarshal([]byte(r.Var().String()), &vars); err != nil {
+		t.Fatalf("the expvar isn't valid JSON: %v", err)
+	}
+	if got := vars["a"]["udp"]["packets_sent"]; got != float64(1) {
+		t.Errorf("expvar a.udp.packets_sent = %v, want 1", got)
+	}
+	if got := vars["b"]["udp"]["packets_sent"]; got != float64(0) {
+		t.Errorf("expvar b.udp.packets_sent = %v, want 0", got)
+	}
+
+	r.Unregister("b")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(w.Body.String(), `stack="b"`) {
+		t.Errorf("the metrics of an unregistered stack are still served")
+	}
+}
@@ -1,8 +1,9 @@
 package stack
 
 import (
-	"log"
+	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/YaoZengzeng/yustack/types"
 	"github.com/YaoZengzeng/yustack/buffer"
@@ -17,8 +18,69 @@ type Nic struct {
 
 	demux		*transportDemuxer
 
+	// enabled is 1 when the Nic is enabled, it's accessed atomically as
+	// it's checked for every packet
+	enabled		uint32
+
 	mu			sync.RWMutex
 	endpoints 	map[types.NetworkEndpointId]*referencedNetworkEndpoint
+	attached	bool
+
+	// addressLists holds the endpoints of each network protocol in the
+	// order their addresses were added, the first one which can be primary
+	// being the primary address
+	addressLists	map[types.NetworkProtocolNumber][]*referencedNetworkEndpoint
+
+	// promiscuous Nics accept the packets destined to any address, and
+	// spoofing ones send from any address. Both go through the temporary
+	// endpoints, which aren't addresses of the Nic
+	promiscuous		bool
+	spoofing		bool
+	tempEndpoints	map[tempEndpointKey]*referencedNetworkEndpoint
+
+	packetEndpoints	packetEndpoints
+
+	stats		types.NicStats
+}
+
+// tempEndpointKey identifies a temporary endpoint by its protocol and address
+type tempEndpointKey struct {
+	protocol	types.NetworkProtocolNumber
+	addr		types.Address
+}
+
+// nicLinkEndpoint is the link endpoint handed to the network endpoints of a
+// Nic. It counts the packets they write before passing them down
+type nicLinkEndpoint struct {
+	types.LinkEndpoint
+	nic	*Nic
+}
+
+// WritePacket implements types.LinkEndpoint.WritePacket
+func (e *nicLinkEndpoint) WritePacket(r *types.Route, hdr *buffer.Prependable, payload buffer.View, protocol types.NetworkProtocolNumber) error {
+	// Routes found before the Nic was disabled may still be in use
+	if !e.nic.isEnabled() {
+		return types.ErrNoRoute
+	}
+
+	size := hdr.UsedLength() + len(payload)
+	if t := e.nic.stack.Tracer(); t != nil {
+		t.Trace(TraceLinkSend, &PacketInfo{
+			Nic:				e.nic.id,
+			NetworkProtocol:	protocol,
+			Id:					types.TransportEndpointId{LocalAddress: r.LocalAddress, RemoteAddress: r.RemoteAddress},
+			Size:				size,
+		})
+	}
+
+	if err := e.LinkEndpoint.WritePacket(r, hdr, payload, protocol); err != nil {
+		return err
+	}
+
+	e.nic.stats.Tx.Packets.Increment()
+	e.nic.stats.Tx.Bytes.IncrementBy(uint64(size))
+
+	return nil
 }
 
 func newNic(stack *Stack, id types.NicId, ep types.LinkEndpoint) *Nic {
@@ -28,52 +90,360 @@ func newNic(stack *Stack, id types.NicId, ep types.LinkEndpoint) *Nic {
 		linkEp:		ep,
 		demux:		newTransportDemuxer(stack),
 		endpoints:	make(map[types.NetworkEndpointId]*referencedNetworkEndpoint),
+		addressLists:	make(map[types.NetworkProtocolNumber][]*referencedNetworkEndpoint),
+		tempEndpoints:	make(map[tempEndpointKey]*referencedNetworkEndpoint),
+	}
+}
+
+// setPromiscuousMode enables or disables the promiscuous mode of the Nic
+func (n *Nic) setPromiscuousMode(enable bool) {
+	n.mu.Lock()
+	n.promiscuous = enable
+	n.mu.Unlock()
+}
+
+// setSpoofing enables or disables the spoofing mode of the Nic
+func (n *Nic) setSpoofing(enable bool) {
+	n.mu.Lock()
+	n.spoofing = enable
+	n.mu.Unlock()
+}
+
+// tempEndpoint returns the temporary endpoint of the given protocol and
+// address with a reference taken, creating it if it's not in use. The Nic
+// holds no reference to it, so it's dropped once the last user releases it.
+// There's none once the Nic is disabled, so that none is left behind when
+// it's removed
+func (n *Nic) tempEndpoint(protocol types.NetworkProtocolNumber, addr types.Address) *referencedNetworkEndpoint {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !n.isEnabled() {
+		return nil
+	}
+
+	key := tempEndpointKey{protocol, addr}
+	if ref, ok := n.tempEndpoints[key]; ok && ref.tryIncRef() {
+		return ref
+	}
+
+	netProtocol, ok := n.stack.networkProtocols[protocol]
+	if !ok {
+		return nil
+	}
+	ep, err := netProtocol.NewEndpoint(n.id, addr, n, &nicLinkEndpoint{n.linkEp, n})
+	if err != nil {
+		return nil
+	}
+	ref := newReferencedNetworkEndpoint(ep, protocol, n)
+	ref.behavior = NeverPrimary
+	ref.temp = true
+	n.tempEndpoints[key] = ref
+
+	return ref
+}
+
+// removeTempEndpoint forgets the temporary endpoint ref once it's released,
+// unless it was already replaced by a new one
+func (n *Nic) removeTempEndpoint(ref *referencedNetworkEndpoint) {
+	n.mu.Lock()
+	key := tempEndpointKey{ref.protocol, ref.ep.Id().LocalAddress}
+	if n.tempEndpoints[key] == ref {
+		delete(n.tempEndpoints, key)
+	}
+	n.mu.Unlock()
+}
+
+// enable enables the Nic, attaching it to its link endpoint the first time so
+// that it starts delivering packets
+func (n *Nic) enable() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	atomic.StoreUint32(&n.enabled, 1)
+	if !n.attached {
+		n.attached = true
+		n.linkEp.Attach(n)
+	}
+}
+
+// disable disables the Nic. The link endpoint stays attached, the packets it
+// keeps delivering are dropped
+func (n *Nic) disable() {
+	atomic.StoreUint32(&n.enabled, 0)
+}
+
+// detach detaches the Nic from its link endpoint, once it's removed from its
+// stack
+func (n *Nic) detach() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.attached {
+		n.attached = false
+		n.linkEp.Attach(nil)
 	}
 }
 
-// attachLinkEndpoint attaches the Nic to the endpoint, which will enable it
-// to start delivering packets
-func (n *Nic) attachLinkEndpoint() {
-	n.linkEp.Attach(n)
+// isEnabled tells whether the Nic is enabled
+func (n *Nic) isEnabled() bool {
+	return atomic.LoadUint32(&n.enabled) != 0
+}
+
+// PrimaryEndpointBehavior tells whether an address of a Nic may be picked as
+// the source address of the routes going through it
+type PrimaryEndpointBehavior int
+
+const (
+	// CanBePrimary addresses are picked as the source of the routes, the
+	// first one added being the primary address
+	CanBePrimary PrimaryEndpointBehavior = iota
+
+	// NeverPrimary addresses only receive packets, they're the source of
+	// a route only when it's asked for, e.g., by an endpoint bound to them
+	NeverPrimary
+)
+
+// NicAddress is an address of a Nic
+type NicAddress struct {
+	Protocol	types.NetworkProtocolNumber
+	Address		types.Address
+	PrefixLen	int
+	Behavior	PrimaryEndpointBehavior
+}
+
+// NicInfo describes a Nic, as returned by Stack.NicInfo
+type NicInfo struct {
+	Enabled		bool
+	Loopback	bool
+	Promiscuous	bool
+	Spoofing	bool
+	MTU			uint32
+	LinkAddress	types.LinkAddress
+	Addresses	[]NicAddress
+}
+
+// info returns the description of the Nic
+func (n *Nic) info() NicInfo {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	info := NicInfo{
+		Enabled:		n.isEnabled(),
+		Loopback:		n.linkEp.Capabilities() & types.CapabilityLoopback != 0,
+		Promiscuous:	n.promiscuous,
+		Spoofing:		n.spoofing,
+		MTU:			n.linkEp.MTU(),
+		LinkAddress:	n.linkEp.LinkAddress(),
+	}
+
+	// Protocols in ascending order, then addresses in the order they were
+	// added
+	var protocols []types.NetworkProtocolNumber
+	for protocol := range n.addressLists {
+		protocols = append(protocols, protocol)
+	}
+	sort.Slice(protocols, func(i, j int) bool {
+		return protocols[i] < protocols[j]
+	})
+	for _, protocol := range protocols {
+		for _, ref := range n.addressLists[protocol] {
+			info.Addresses = append(info.Addresses, NicAddress{
+				Protocol:	protocol,
+				Address:	ref.ep.Id().LocalAddress,
+				PrefixLen:	ref.prefixLen,
+				Behavior:	ref.behavior,
+			})
+		}
+	}
+
+	return info
 }
 
 // AddAddress adds a new address to n, so that it starts to accepting packets
-// targeted at the given address (and network protocol)
+// targeted at the given address (and network protocol). The address is in a
+// subnet of its own, and can be primary
 func (n *Nic) AddAddress(protocol types.NetworkProtocolNumber, address types.Address) error {
+	return n.AddAddressWithPrefix(protocol, address, len(address) * 8, CanBePrimary)
+}
+
+// AddAddressWithPrefix adds a new address to n, in the subnet of the given
+// prefix length. The addresses which can be primary are used as the source
+// of the routes going through n in the order they were added, except that
+// an address in the subnet of the next hop is preferred
+func (n *Nic) AddAddressWithPrefix(protocol types.NetworkProtocolNumber, address types.Address, prefixLen int, behavior PrimaryEndpointBehavior) error {
+	if prefixLen < 0 || prefixLen > len(address) * 8 {
+		return types.ErrInvalidOptionValue
+	}
+
 	// Add the endpoint
 	n.mu.Lock()
 	defer n.mu.Unlock()
-	_, err := n.addAddressLocked(protocol, address, false)
+	_, err := n.addAddressLocked(protocol, address, prefixLen, behavior, false)
 
 	return err
 }
 
-func (n *Nic) addAddressLocked(protocol types.NetworkProtocolNumber, addr types.Address, replace bool) (*referencedNetworkEndpoint, error) {
+func (n *Nic) addAddressLocked(protocol types.NetworkProtocolNumber, addr types.Address, prefixLen int, behavior PrimaryEndpointBehavior, replace bool) (*referencedNetworkEndpoint, error) {
 	netProtocol, ok := n.stack.networkProtocols[protocol]
 	if !ok {
-		log.Printf("addAddressLocked: network protocol %x not exist\n", protocol)
 		return nil, types.ErrUnknownProtocol
 	}
 
+	if _, ok := n.endpoints[types.NetworkEndpointId{LocalAddress: addr}]; ok && !replace {
+		return nil, types.ErrDuplicateAddress
+	}
+
 	// Create the new network endpoint
-	ep, err := netProtocol.NewEndpoint(n.id, addr, n, n.linkEp)
+	ep, err := netProtocol.NewEndpoint(n.id, addr, n, &nicLinkEndpoint{n.linkEp, n})
 	if err != nil {
-		log.Printf("addAddressLocked: create network endpoint failed\n")
 		return nil, err
 	}
 
 	id := *ep.Id()
 	ref := newReferencedNetworkEndpoint(ep, protocol, n)
+	ref.prefixLen = prefixLen
+	ref.behavior = behavior
 
+	if old, ok := n.endpoints[id]; ok {
+		n.removeFromListLocked(old)
+		old.decRef()
+	}
 	n.endpoints[id] = ref
+	n.addressLists[protocol] = append(n.addressLists[protocol], ref)
 
 	return ref, nil
 }
 
+// RemoveAddress removes an address from n, so that it stops accepting packets
+// targeted at it. If it was the primary address, the next one which can be
+// primary takes over
+func (n *Nic) RemoveAddress(address types.Address) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	id := types.NetworkEndpointId{LocalAddress: address}
+	ref, ok := n.endpoints[id]
+	if !ok {
+		return types.ErrBadLocalAddress
+	}
+	delete(n.endpoints, id)
+	n.removeFromListLocked(ref)
+	ref.decRef()
+
+	return nil
+}
+
+// removeEndpoints removes all the addresses and temporary endpoints of n, once
+// it's removed from its stack
+func (n *Nic) removeEndpoints() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for id, ref := range n.endpoints {
+		delete(n.endpoints, id)
+		n.removeFromListLocked(ref)
+		ref.decRef()
+	}
+	// The temporary endpoints in use are closed by their last user
+	for key := range n.tempEndpoints {
+		delete(n.tempEndpoints, key)
+	}
+}
+
+// removeFromListLocked removes ref from the address list of its protocol
+func (n *Nic) removeFromListLocked(ref *referencedNetworkEndpoint) {
+	refs := n.addressLists[ref.protocol]
+	for i, r := range refs {
+		if r == ref {
+			refs = append(refs[:i:i], refs[i + 1:]...)
+			break
+		}
+	}
+
+	if len(refs) == 0 {
+		delete(n.addressLists, ref.protocol)
+	} else {
+		n.addressLists[ref.protocol] = refs
+	}
+}
+
+// addresses returns the set of addresses of n
+func (n *Nic) addresses() map[types.Address]bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	addrs := make(map[types.Address]bool)
+	for id := range n.endpoints {
+		addrs[id.LocalAddress] = true
+	}
+
+	return addrs
+}
+
 type referencedNetworkEndpoint struct {
 	ep 			types.NetworkEndpoint
 	nic 		*Nic
 	protocol 	types.NetworkProtocolNumber
+	prefixLen	int
+	behavior	PrimaryEndpointBehavior
+
+	// refs counts the references to the endpoint, the one of the Nic and
+	// one per packet being handled. It's accessed atomically, and the
+	// endpoint is closed when it drops to zero
+	refs		int32
+
+	// temp is true for the temporary endpoints, which the Nic forgets
+	// when they're closed
+	temp		bool
+}
+
+// tryIncRef takes a reference to r, unless it was closed or is being closed
+func (r *referencedNetworkEndpoint) tryIncRef() bool {
+	for {
+		v := atomic.LoadInt32(&r.refs)
+		if v == 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&r.refs, v, v + 1) {
+			return true
+		}
+	}
+}
+
+// decRef releases a reference to r, and closes its endpoint if it was the
+// last one
+func (r *referencedNetworkEndpoint) decRef() {
+	if atomic.AddInt32(&r.refs, -1) == 0 {
+		if r.temp {
+			r.nic.removeTempEndpoint(r)
+		}
+		r.ep.Close()
+	}
+}
+
+// inSubnet tells whether addr is in the subnet of the address of r
+func (r *referencedNetworkEndpoint) inSubnet(addr types.Address) bool {
+	local := r.ep.Id().LocalAddress
+	if len(addr) != len(local) {
+		return false
+	}
+
+	for i := 0; i < len(local); i++ {
+		bits := r.prefixLen - i * 8
+		if bits <= 0 {
+			break
+		}
+		mask := byte(0xff)
+		if bits < 8 {
+			mask <<= uint(8 - bits)
+		}
+		if addr[i] & mask != local[i] & mask {
+			return false
+		}
+	}
+
+	return true
 }
 
 func newReferencedNetworkEndpoint(ep types.NetworkEndpoint, protocol types.NetworkProtocolNumber, nic *Nic) *referencedNetworkEndpoint {
@@ -81,6 +451,7 @@ func newReferencedNetworkEndpoint(ep types.NetworkEndpoint, protocol types.Netwo
 		ep:			ep,
 		nic:		nic,
 		protocol:	protocol, 	
+		refs:		1,
 	}
 }
 
@@ -91,72 +462,200 @@ func newReferencedNetworkEndpoint(ep types.NetworkEndpoint, protocol types.Netwo
 // This rule applies only to the slice itself, not to the items of the slice
 // the ownership of the items is not retained by the caller
 func (n *Nic) DeliverNetworkPacket(linkEp types.LinkEndpoint, remoteLinkAddr types.LinkAddress, protocol types.NetworkProtocolNumber, vv *buffer.VectorisedView) {
+	n.stats.Rx.Packets.Increment()
+	n.stats.Rx.Bytes.IncrementBy(uint64(vv.Size()))
+
+	tracer := n.stack.Tracer()
+	if tracer != nil {
+		tracer.Trace(TraceLinkReceive, &PacketInfo{Nic: n.id, NetworkProtocol: protocol, Size: vv.Size()})
+	}
+
+	if !n.isEnabled() {
+		n.stack.DropPacket(types.DropNicDisabled, &PacketInfo{Nic: n.id, NetworkProtocol: protocol, Size: vv.Size()})
+		return
+	}
+
+	// Packet endpoints get a copy of every frame, even the ones the stack
+	// can't handle
+	captured := n.packetEndpoints.deliver(n.id, remoteLinkAddr, protocol, vv)
+	if n.stack.packetEndpoints.deliver(n.id, remoteLinkAddr, protocol, vv) {
+		captured = true
+	}
+
 	netProtocol, ok := n.stack.networkProtocols[protocol]
 	if !ok {
-		log.Printf("DeliverNetworkPacket: protocol %x not exist\n", protocol)
+		if captured {
+			return
+		}
+		n.stack.stats.UnknownProtocolRcvdPackets.Increment()
+		n.stack.DropPacket(types.DropUnknownNetworkProtocol, &PacketInfo{Nic: n.id, NetworkProtocol: protocol, Size: vv.Size()})
 		return
 	}
 
 	if len(vv.First()) < netProtocol.MinimumPacketSize() {
-		log.Printf("DeliverNetworkPacket: packet is not big enough\n")
+		n.stack.stats.MalformedRcvdPackets.Increment()
+		n.stack.DropPacket(types.DropNetworkPacketTooSmall, &PacketInfo{Nic: n.id, NetworkProtocol: protocol, Size: vv.Size()})
 		return
 	}
 
 	src, dst := netProtocol.ParseAddresses(vv.First())
 	id := types.NetworkEndpointId{types.Address(dst)}
+	info := func() *PacketInfo {
+		return &PacketInfo{
+			Nic:				n.id,
+			NetworkProtocol:	protocol,
+			Id:					types.TransportEndpointId{LocalAddress: dst, RemoteAddress: src},
+			Size:				vv.Size(),
+		}
+	}
 
-	// Lock here
+	// Addresses may be removed concurrently
+	n.mu.RLock()
 	ref, ok := n.endpoints[id]
+	if !ok && n.linkEp.Capabilities() & types.CapabilityLoopback != 0 {
+		// Packets looped back to us are destined to one of our
+		// addresses by construction, e.g., anything in 127.0.0.0/8
+		ref = n.primaryEndpoint(protocol, "")
+		ok = ref != nil
+	}
+	ok = ok && ref.tryIncRef()
+	promiscuous := n.promiscuous
+	n.mu.RUnlock()
+	if !ok && promiscuous {
+		ref = n.tempEndpoint(protocol, dst)
+		ok = ref != nil
+	}
 	if !ok {
-		log.Printf("DeliverNetworkPacket: network protocol endpoint not exist\n")
+		n.stack.stats.IP.InvalidAddressesReceived.Increment()
+		n.stack.DropPacket(types.DropNoNetworkEndpoint, info())
 		return
 	}
 
 	r := types.MakeRoute(protocol, dst, src, ref.ep)
+	r.Stats = &n.stack.stats
 	r.LocalLinkAddress = linkEp.LinkAddress()
 	r.RemoteLinkAddress = remoteLinkAddr
 
+	if tracer != nil {
+		tracer.Trace(TraceNetworkReceive, info())
+	}
+
 	// Corresponding network endpoint handling the packet
 	ref.ep.HandlePacket(r, vv)
+	ref.decRef()
 }
 
 // DeliverTransportPacket delivers the packets to the appropriate transport
 // protocol endpoint
 func (n *Nic) DeliverTransportPacket(r *types.Route, protocol types.TransportProtocolNumber, vv *buffer.VectorisedView) {
+	id := types.TransportEndpointId{LocalAddress: r.LocalAddress, RemoteAddress: r.RemoteAddress}
+
+	tracer := n.stack.Tracer()
+	if tracer != nil {
+		tracer.Trace(TraceTransportReceive, NewPacketInfo(r, protocol, id, vv.Size()))
+	}
+
 	state, ok := n.stack.transportProtocols[protocol]
 	if !ok {
-		log.Printf("DeliverTransportPacket: protocol not found, drop\n")
+		// Raw endpoints got a copy of the packet already
+		if n.stack.demux.hasRawEndpoints(r.NetProto, protocol) {
+			return
+		}
+		n.stack.stats.UnknownProtocolRcvdPackets.Increment()
+		n.stack.DropPacket(types.DropUnknownTransportProtocol, NewPacketInfo(r, protocol, id, vv.Size()))
 		return
 	}
 
 	transProtocol := state.Protocol
 	if len(vv.First())	 < transProtocol.MinimumPacketSize() {
-		log.Printf("DeliverTransportPacket: packet is not big enough, drop\n")
+		n.stack.stats.MalformedRcvdPackets.Increment()
+		n.stack.DropPacket(types.DropTransportPacketTooSmall, NewPacketInfo(r, protocol, id, vv.Size()))
 		return
 	}
 
 	srcPort, dstPort, err := transProtocol.ParsePorts(vv.First())
 	if err != nil {
-		log.Printf("DeliverTransportPacket: parse ports failed, drop\n")
+		n.stack.stats.MalformedRcvdPackets.Increment()
+		n.stack.DropPacket(types.DropInvalidTransportHeader, NewPacketInfo(r, protocol, id, vv.Size()))
 		return
 	}
 
-	id := types.TransportEndpointId{dstPort, r.LocalAddress, srcPort, r.RemoteAddress}
-	if n.demux.deliverPacket(r, protocol, vv, id) {
+	id.LocalPort = dstPort
+	id.RemotePort = srcPort
+
+	// The size must be taken before the endpoint consumes the packet
+	size := vv.Size()
+	if deliverPacket([]*transportDemuxer{n.demux, n.stack.demux}, r, protocol, vv, id) {
+		if tracer != nil {
+			tracer.Trace(TraceEndpointDeliver, NewPacketInfo(r, protocol, id, size))
+		}
 		return
 	}
-	if n.stack.demux.deliverPacket(r, protocol, vv, id) {
-		return
+
+	// The handler may set up an endpoint for the packets nobody wants
+	if state.DefaultHandler != nil && state.DefaultHandler(r, id, vv) {
+		if deliverPacket([]*transportDemuxer{n.demux, n.stack.demux}, r, protocol, vv, id) {
+			if tracer != nil {
+				tracer.Trace(TraceEndpointDeliver, NewPacketInfo(r, protocol, id, size))
+			}
+			return
+		}
 	}
 
-	log.Printf("DeliverTransportPacket: deliver packet failed, drop\n")
+	// Let the protocol handle the packets nobody wants, e.g., to count them
+	transProtocol.HandleUnknownDestinationPacket(r, id, vv)
+	n.stack.DropPacket(types.DropNoTransportEndpoint, NewPacketInfo(r, protocol, id, size))
 }
 
-// primaryEndpoint returns the primary endpoint of nic
-func (n *Nic) primaryEndpoint() *referencedNetworkEndpoint {
-	for _, r := range n.endpoints {
-		return r
+// DeliverRawPacket hands a copy of the packets to the raw endpoints of the
+// transport protocol
+func (n *Nic) DeliverRawPacket(r *types.Route, protocol types.TransportProtocolNumber, vv *buffer.VectorisedView) {
+	size := vv.Size()
+	if n.stack.demux.deliverRawPacket(r, protocol, vv) {
+		if tracer := n.stack.Tracer(); tracer != nil {
+			tracer.Trace(TraceEndpointDeliver, NewPacketInfo(r, protocol, types.TransportEndpointId{LocalAddress: r.LocalAddress, RemoteAddress: r.RemoteAddress}, size))
+		}
 	}
+}
 
-	return nil
+// DropPacket records that a packet received through r was dropped by the
+// network layer for the given reason
+func (n *Nic) DropPacket(r *types.Route, reason types.DropReason) {
+	n.stack.DropPacket(reason, &PacketInfo{
+		Nic:				n.id,
+		NetworkProtocol:	r.NetProto,
+		Id:					types.TransportEndpointId{LocalAddress: r.LocalAddress, RemoteAddress: r.RemoteAddress},
+	})
+}
+
+// primaryEndpoint returns the endpoint of the given protocol whose address is
+// the source of the routes to nextHop: the first one which can be primary and
+// is in the subnet of nextHop, or else the first one which can be primary.
+// n.mu must be held
+func (n *Nic) primaryEndpoint(protocol types.NetworkProtocolNumber, nextHop types.Address) *referencedNetworkEndpoint {
+	var primary *referencedNetworkEndpoint
+	for _, r := range n.addressLists[protocol] {
+		if r.behavior == NeverPrimary {
+			continue
+		}
+		if nextHop != "" && r.inSubnet(nextHop) {
+			return r
+		}
+		if primary == nil {
+			primary = r
+		}
+	}
+
+	return primary
+}
+
+// findEndpoint returns the endpoint of the given protocol and address, whether
+// it can be primary or not. n.mu must be held
+func (n *Nic) findEndpoint(protocol types.NetworkProtocolNumber, address types.Address) *referencedNetworkEndpoint {
+	ref := n.endpoints[types.NetworkEndpointId{LocalAddress: address}]
+	if ref == nil || ref.protocol != protocol {
+		return nil
+	}
+
+	return ref
 }
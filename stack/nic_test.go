@@ -0,0 +1,534 @@
+package stack_test
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/header"
+	"github.com/YaoZengzeng/yustack/link/channel"
+	"github.com/YaoZengzeng/yustack/link/loopback"
+	"github.com/YaoZengzeng/yustack/network/ipv4"
+	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/transport/tcp"
+	"github.com/YaoZengzeng/yustack/transport/udp"
+	"github.com/YaoZengzeng/yustack/types"
+)
+
+// connectedPair creates a TCP connection over localhost, and returns both of
+// its ends
+func connectedPair(t *testing.T, s *stack.Stack) (types.Endpoint, types.Endpoint) {
+	listener := newEndpoint(t, s, tcp.ProtocolNumber)
+	defer listener.Close()
+	if err := listener.Bind(types.FullAddress{Port: 8080}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := listener.Listen(1); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	client := newEndpoint(t, s, tcp.ProtocolNumber)
+	ctx, cancel := context.WithTimeout(context.Background(), 1 * time.Second)
+	defer cancel()
+	if err := client.ConnectContext(ctx, types.FullAddress{Address: localhost, Port: 8080}); err != nil {
+		t.Fatalf("ConnectContext failed: %v", err)
+	}
+	server, _, err := listener.AcceptContext(ctx)
+	if err != nil {
+		t.Fatalf("AcceptContext failed: %v", err)
+	}
+
+	return client, server
+}
+
+// waitAborted waits for the endpoints to report their connection was aborted
+func waitAborted(t *testing.T, eps ...types.Endpoint) {
+	for i, ep := range eps {
+		var err error
+		for deadline := time.Now().Add(1 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			if _, err = ep.Read(nil); err == types.ErrConnectionAborted {
+				break
+			}
+		}
+		if err != types.ErrConnectionAborted {
+			t.Errorf("Read from endpoint %d returned %v, want %v", i, err, types.ErrConnectionAborted)
+		}
+	}
+}
+
+func TestDisableNic(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName})
+	id, linkEp := channel.New(16, 1500)
+	if err := s.CreateDisabledNic(1, id); err != nil {
+		t.Fatalf("CreateDisabledNic failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, otherAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]types.RouteEntry{{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", Nic: 1}})
+
+	if info := s.NicInfo()[1]; info.Enabled || info.MTU != 1500 || len(info.Addresses) != 1 || info.Addresses[0].Address != otherAddr {
+		t.Fatalf("NicInfo()[1] = %+v, want a disabled Nic with address %v", info, types.Address(otherAddr))
+	}
+
+	sender := newEndpoint(t, s, udp.ProtocolNumber)
+	defer sender.Close()
+	send := func() error {
+		_, err := sender.Write(buffer.View("hello"), &types.FullAddress{Address: "\x0a\x00\x00\x02", Port: 1234})
+		return err
+	}
+
+	// Nothing goes through a disabled Nic
+	if err := send(); err != types.ErrNoRoute {
+		t.Fatalf("Write through a disabled Nic returned %v, want %v", err, types.ErrNoRoute)
+	}
+	if err := s.EnableNic(1); err != nil {
+		t.Fatalf("EnableNic failed: %v", err)
+	}
+	if err := send(); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	pkt := <-linkEp.C
+
+	if err := s.DisableNic(1); err != nil {
+		t.Fatalf("DisableNic failed: %v", err)
+	}
+	if err := send(); err != types.ErrNoRoute {
+		t.Fatalf("Write through a disabled Nic returned %v, want %v", err, types.ErrNoRoute)
+	}
+
+	// The packets received while disabled are dropped
+	vv := buffer.NewVectorisedView([]buffer.View{pkt.Header, pkt.Payload}, len(pkt.Header) + len(pkt.Payload))
+	linkEp.Inject(ipv4.ProtocolNumber, &vv)
+	if got := s.Stats().DroppedPackets[types.DropNicDisabled].Value(); got != 1 {
+		t.Errorf("DroppedPackets[%v] = %v, want 1", types.DropNicDisabled, got)
+	}
+
+	if err := s.EnableNic(2); err != types.ErrUnknownNicId {
+		t.Errorf("EnableNic(2) returned %v, want %v", err, types.ErrUnknownNicId)
+	}
+}
+
+func TestRemoveAddress(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName})
+	if err := s.CreateNic(1, loopback.New()); err != nil {
+		t.Fatalf("CreateNic failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, localhost); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	client, server := connectedPair(t, s)
+	defer client.Close()
+	defer server.Close()
+
+	if err := s.RemoveAddress(1, localhost); err != nil {
+		t.Fatalf("RemoveAddress failed: %v", err)
+	}
+	if info := s.NicInfo()[1]; len(info.Addresses) != 0 || !info.Loopback {
+		t.Errorf("NicInfo()[1] = %+v, want a loopback Nic without address", info)
+	}
+	waitAborted(t, client, server)
+
+	if err := s.RemoveAddress(1, localhost); err != types.ErrBadLocalAddress {
+		t.Errorf("RemoveAddress of a removed address returned %v, want %v", err, types.ErrBadLocalAddress)
+	}
+}
+
+func TestRemoveNic(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName})
+	if err := s.CreateNic(1, loopback.New()); err != nil {
+		t.Fatalf("CreateNic failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, localhost); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	client, server := connectedPair(t, s)
+	defer client.Close()
+	defer server.Close()
+
+	if err := s.RemoveNic(1); err != nil {
+		t.Fatalf("RemoveNic failed: %v", err)
+	}
+	if _, ok := s.NicInfo()[1]; ok {
+		t.Errorf("NicInfo() still holds the removed Nic")
+	}
+	waitAborted(t, client, server)
+
+	// The loopback route went away with the Nic
+	if _, err := s.FindRoute(0, "", localhost, ipv4.ProtocolNumber); err != types.ErrNoRoute {
+		t.Errorf("FindRoute returned %v, want %v", err, types.ErrNoRoute)
+	}
+	if err := s.RemoveNic(1); err != types.ErrUnknownNicId {
+		t.Errorf("RemoveNic of a removed Nic returned %v, want %v", err, types.ErrUnknownNicId)
+	}
+}
+
+func TestRemoveNicDetaches(t *testing.T) {
+	const remote = "\x0a\x00\x00\x02"
+
+	id, linkEp := channel.New(16, 1500)
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName})
+	if err := s.CreateNic(1, id); err != nil {
+		t.Fatalf("CreateNic failed: %v", err)
+	}
+	if err := s.RemoveNic(1); err != nil {
+		t.Fatalf("RemoveNic failed: %v", err)
+	}
+
+	// The packets of the link endpoint no longer reach the removed Nic
+	injectUDP(linkEp, remote, otherAddr, 53)
+	if got := s.Stats().DroppedPackets[types.DropNicDisabled].Value(); got != 0 {
+		t.Errorf("DroppedPackets[%v] = %v, want 0", types.DropNicDisabled, got)
+	}
+
+	// The link endpoint can serve another Nic
+	other := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName})
+	if err := other.CreateNic(1, id); err != nil {
+		t.Fatalf("CreateNic failed: %v", err)
+	}
+	if err := other.AddAddress(1, ipv4.ProtocolNumber, otherAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	listener := newEndpoint(t, other, udp.ProtocolNumber)
+	defer listener.Close()
+	if err := listener.Bind(types.FullAddress{Port: 53}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	injectUDP(linkEp, remote, otherAddr, 53)
+	if v, err := listener.Read(nil); err != nil || string(v) != "hello" {
+		t.Fatalf("Read returned %q, %v, want %q", v, err, "hello")
+	}
+}
+
+// waitGoroutines waits for the number of goroutines to drop to n
+func waitGoroutines(t *testing.T, n int) {
+	for deadline := time.Now().Add(1 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if runtime.NumGoroutine() <= n {
+			return
+		}
+	}
+	t.Errorf("%d goroutines are left, want %d", runtime.NumGoroutine(), n)
+}
+
+func TestRemoveNicUnblocksReads(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName, udp.ProtocolName})
+	if err := s.CreateNic(1, loopback.New()); err != nil {
+		t.Fatalf("CreateNic failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, localhost); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	client, server := connectedPair(t, s)
+	defer client.Close()
+	defer server.Close()
+	datagram := newEndpoint(t, s, udp.ProtocolNumber)
+	defer datagram.Close()
+	if err := datagram.Bind(types.FullAddress{Address: localhost, Port: 9000}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	// Both reads block until the Nic goes away
+	errs := make(chan error, 2)
+	for _, ep := range []types.Endpoint{client, datagram} {
+		go func(ep types.Endpoint) {
+			_, err := ep.ReadContext(context.Background(), nil)
+			errs <- err
+		}(ep)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := s.RemoveNic(1); err != nil {
+		t.Fatalf("RemoveNic failed: %v", err)
+	}
+
+	want := map[error]bool{types.ErrConnectionAborted: true, types.ErrClosedForReceive: true}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if !want[err] {
+				t.Errorf("ReadContext returned %v, want %v or %v", err, types.ErrConnectionAborted, types.ErrClosedForReceive)
+			}
+			delete(want, err)
+		case <-time.After(1 * time.Second):
+			t.Fatalf("a ReadContext is still blocked after RemoveNic")
+		}
+	}
+}
+
+func TestRemovedEndpointsAreClosed(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName})
+	id, _ := channel.New(16, 1500)
+	if err := s.CreateNic(1, id); err != nil {
+		t.Fatalf("CreateNic failed: %v", err)
+	}
+	base := runtime.NumGoroutine()
+
+	// Every ipv4 endpoint has a goroutine replying to echo requests,
+	// which goes away with its address
+	addAddresses := func() {
+		for i := 0; i < 20; i++ {
+			if err := s.AddAddress(1, ipv4.ProtocolNumber, types.Address([]byte{10, 0, 1, byte(i)})); err != nil {
+				t.Fatalf("AddAddress failed: %v", err)
+			}
+		}
+	}
+	addAddresses()
+	for i := 0; i < 20; i++ {
+		if err := s.RemoveAddress(1, types.Address([]byte{10, 0, 1, byte(i)})); err != nil {
+			t.Fatalf("RemoveAddress failed: %v", err)
+		}
+	}
+	waitGoroutines(t, base)
+
+	// And with its Nic
+	addAddresses()
+	if err := s.RemoveNic(1); err != nil {
+		t.Fatalf("RemoveNic failed: %v", err)
+	}
+	waitGoroutines(t, base)
+}
+
+func TestPrimaryAddress(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName})
+	id, _ := channel.New(16, 1500)
+	if err := s.CreateNic(1, id); err != nil {
+		t.Fatalf("CreateNic failed: %v", err)
+	}
+
+	addrs := []stack.NicAddress{
+		{Protocol: ipv4.ProtocolNumber, Address: "\x0a\x00\x00\x01", PrefixLen: 24, Behavior: stack.NeverPrimary},
+		{Protocol: ipv4.ProtocolNumber, Address: "\xc0\xa8\x01\x01", PrefixLen: 24, Behavior: stack.CanBePrimary},
+		{Protocol: ipv4.ProtocolNumber, Address: "\x0a\x00\x00\x02", PrefixLen: 24, Behavior: stack.CanBePrimary},
+		{Protocol: ipv4.ProtocolNumber, Address: "\xac\x10\x00\x01", PrefixLen: 16, Behavior: stack.CanBePrimary},
+	}
+	for _, a := range addrs {
+		if err := s.AddAddressWithPrefix(1, a.Protocol, a.Address, a.PrefixLen, a.Behavior); err != nil {
+			t.Fatalf("AddAddressWithPrefix(%+v) failed: %v", a, err)
+		}
+	}
+	s.SetRouteTable([]types.RouteEntry{
+		{Destination: "\x08\x08\x00\x00", Mask: "\xff\xff\x00\x00", Gateway: "\xac\x10\x05\x05", Nic: 1},
+		{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", Nic: 1},
+	})
+
+	// The addresses are listed in the order they were added
+	info := s.NicInfo()[1]
+	if len(info.Addresses) != len(addrs) {
+		t.Fatalf("NicInfo()[1].Addresses = %+v, want %+v", info.Addresses, addrs)
+	}
+	for i := range addrs {
+		if info.Addresses[i] != addrs[i] {
+			t.Errorf("NicInfo()[1].Addresses[%d] = %+v, want %+v", i, info.Addresses[i], addrs[i])
+		}
+	}
+
+	for _, test := range []struct {
+		local	types.Address
+		remote	types.Address
+		want	types.Address
+	}{
+		// The address in the subnet of the destination, except for the
+		// one which is never primary
+		{remote: "\x0a\x00\x00\x09", want: "\x0a\x00\x00\x02"},
+		{remote: "\xc0\xa8\x01\x07", want: "\xc0\xa8\x01\x01"},
+
+		// The first address which can be primary
+		{remote: "\x01\x02\x03\x04", want: "\xc0\xa8\x01\x01"},
+
+		// The address in the subnet of the gateway
+		{remote: "\x08\x08\x08\x08", want: "\xac\x10\x00\x01"},
+
+		// The address asked for, even if it's never primary
+		{local: "\x0a\x00\x00\x01", remote: "\x01\x02\x03\x04", want: "\x0a\x00\x00\x01"},
+		{local: "\x0a\x09\x09\x09", remote: "\x01\x02\x03\x04", want: ""},
+	} {
+		r, err := s.FindRoute(0, test.local, test.remote, ipv4.ProtocolNumber)
+		if test.want == "" {
+			if err != types.ErrNoRoute {
+				t.Errorf("FindRoute(%v, %v) returned %v, want %v", test.local, test.remote, err, types.ErrNoRoute)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("FindRoute(%v, %v) failed: %v", test.local, test.remote, err)
+			continue
+		}
+		if r.LocalAddress != test.want {
+			t.Errorf("FindRoute(%v, %v) has source %v, want %v", test.local, test.remote, r.LocalAddress, test.want)
+		}
+	}
+
+	// The next address takes over when the primary one is removed
+	if err := s.RemoveAddress(1, "\xc0\xa8\x01\x01"); err != nil {
+		t.Fatalf("RemoveAddress failed: %v", err)
+	}
+	if r, err := s.FindRoute(0, "", "\x01\x02\x03\x04", ipv4.ProtocolNumber); err != nil || r.LocalAddress != "\x0a\x00\x00\x02" {
+		t.Errorf("FindRoute returned %+v, %v, want source %v", r, err, types.Address("\x0a\x00\x00\x02"))
+	}
+
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, "\x0a\x00\x00\x02"); err != types.ErrDuplicateAddress {
+		t.Errorf("AddAddress of a duplicate returned %v, want %v", err, types.ErrDuplicateAddress)
+	}
+	if err := s.AddAddressWithPrefix(1, ipv4.ProtocolNumber, "\x0a\x00\x00\x03", 33, stack.CanBePrimary); err != types.ErrInvalidOptionValue {
+		t.Errorf("AddAddressWithPrefix with a /33 returned %v, want %v", err, types.ErrInvalidOptionValue)
+	}
+}
+
+// injectUDP injects a datagram from src:port to dst:port, without checksum
+func injectUDP(linkEp *channel.Endpoint, src, dst types.Address, port uint16) {
+	v := make(buffer.View, header.IPv4MinimumSize + header.UDPMinimumSize + len("hello"))
+	copy(v[header.IPv4MinimumSize + header.UDPMinimumSize:], "hello")
+	ip := header.IPv4(v)
+	ip.Encode(&header.IPv4Fields{
+		IHL:			header.IPv4MinimumSize,
+		TotalLength:	uint16(len(v)),
+		TTL:			64,
+		Protocol:		uint8(udp.ProtocolNumber),
+		SrcAddr:		src,
+		DstAddr:		dst,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	header.UDP(v[header.IPv4MinimumSize:]).Encode(&header.UDPFields{
+		SrcPort:	port,
+		DstPort:	port,
+		Length:		uint16(len(v) - header.IPv4MinimumSize),
+	})
+
+	vv := v.ToVectorisedView([1]buffer.View{})
+	linkEp.Inject(ipv4.ProtocolNumber, &vv)
+}
+
+func TestPromiscuousAndSpoofing(t *testing.T) {
+	const (
+		remote	= "\x0a\x00\x00\x02"
+		foreign	= "\x08\x08\x08\x08"
+	)
+
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName})
+	id, linkEp := channel.New(16, 1500)
+	if err := s.CreateNic(1, id); err != nil {
+		t.Fatalf("CreateNic failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, otherAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]types.RouteEntry{{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", Nic: 1}})
+
+	listener := newEndpoint(t, s, udp.ProtocolNumber)
+	defer listener.Close()
+	if err := listener.Bind(types.FullAddress{Port: 53}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	// Packets to foreign addresses are dropped, unless the Nic is
+	// promiscuous
+	injectUDP(linkEp, remote, foreign, 53)
+	if _, err := listener.Read(nil); err != types.ErrWouldBlock {
+		t.Fatalf("Read returned %v, want %v", err, types.ErrWouldBlock)
+	}
+	if got := s.Stats().DroppedPackets[types.DropNoNetworkEndpoint].Value(); got != 1 {
+		t.Errorf("DroppedPackets[%v] = %v, want 1", types.DropNoNetworkEndpoint, got)
+	}
+
+	if err := s.SetPromiscuousMode(1, true); err != nil {
+		t.Fatalf("SetPromiscuousMode failed: %v", err)
+	}
+	injectUDP(linkEp, remote, foreign, 53)
+	if v, err := listener.Read(nil); err != nil || string(v) != "hello" {
+		t.Fatalf("Read returned %q, %v, want %q", v, err, "hello")
+	}
+
+	// The temporary endpoint isn't an address of the Nic
+	if info := s.NicInfo()[1]; !info.Promiscuous || info.Spoofing || len(info.Addresses) != 1 {
+		t.Errorf("NicInfo()[1] = %+v, want a promiscuous Nic with a single address", info)
+	}
+	if _, err := s.FindRoute(0, "", foreign, ipv4.ProtocolNumber); err != nil {
+		t.Fatalf("FindRoute failed: %v", err)
+	}
+
+	// Replying from the foreign address needs spoofing
+	sender := newEndpoint(t, s, udp.ProtocolNumber)
+	defer sender.Close()
+	if err := sender.Bind(types.FullAddress{Address: foreign, Port: 53}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	send := func() error {
+		_, err := sender.Write(buffer.View("hello"), &types.FullAddress{Address: remote, Port: 53})
+		return err
+	}
+	if err := send(); err != types.ErrNoRoute {
+		t.Fatalf("Write from a foreign address returned %v, want %v", err, types.ErrNoRoute)
+	}
+
+	if err := s.SetSpoofing(1, true); err != nil {
+		t.Fatalf("SetSpoofing failed: %v", err)
+	}
+	if err := send(); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	pkt := <-linkEp.C
+	if ip := header.IPv4(pkt.Header); ip.SourceAddress() != foreign || ip.DestinationAddress() != remote {
+		t.Errorf("packet sent from %v to %v, want from %v to %v", ip.SourceAddress(), ip.DestinationAddress(), types.Address(foreign), types.Address(remote))
+	}
+
+	// Routes without a local address still use the primary one
+	if r, err := s.FindRoute(0, "", remote, ipv4.ProtocolNumber); err != nil || r.LocalAddress != otherAddr {
+		t.Errorf("FindRoute returned %+v, %v, want source %v", r, err, types.Address(otherAddr))
+	}
+
+	if err := s.SetPromiscuousMode(2, true); err != types.ErrUnknownNicId {
+		t.Errorf("SetPromiscuousMode(2) returned %v, want %v", err, types.ErrUnknownNicId)
+	}
+}
+
+func TestTempEndpoints(t *testing.T) {
+	const remote = "\x0a\x00\x00\x02"
+
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName})
+	id, linkEp := channel.New(16, 1500)
+	if err := s.CreateNic(1, id); err != nil {
+		t.Fatalf("CreateNic failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, otherAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]types.RouteEntry{{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", Nic: 1}})
+	if err := s.SetPromiscuousMode(1, true); err != nil {
+		t.Fatalf("SetPromiscuousMode failed: %v", err)
+	}
+	if err := s.SetSpoofing(1, true); err != nil {
+		t.Fatalf("SetSpoofing failed: %v", err)
+	}
+
+	listener := newEndpoint(t, s, udp.ProtocolNumber)
+	defer listener.Close()
+	if err := listener.Bind(types.FullAddress{Port: 53}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	// Each foreign address gets its own endpoint, which is dropped once
+	// it's no longer in use
+	base := runtime.NumGoroutine()
+	for _, foreign := range []types.Address{"\x08\x08\x08\x08", "\x08\x08\x04\x04"} {
+		injectUDP(linkEp, remote, foreign, 53)
+		if v, err := listener.Read(nil); err != nil || string(v) != "hello" {
+			t.Fatalf("Read returned %q, %v, want %q", v, err, "hello")
+		}
+
+		if r, err := s.FindRoute(0, foreign, remote, ipv4.ProtocolNumber); err != nil || r.LocalAddress != foreign {
+			t.Errorf("FindRoute returned %+v, %v, want source %v", r, err, foreign)
+		}
+	}
+
+	for deadline := time.Now().Add(1 * time.Second); runtime.NumGoroutine() > base && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > base {
+		t.Errorf("%d goroutines left, want at most %d", n, base)
+	}
+}
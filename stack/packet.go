@@ -0,0 +1,151 @@
+package stack
+
+import (
+	"sync"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/types"
+	"github.com/YaoZengzeng/yustack/waiter"
+)
+
+// packetEndpoints holds the packet endpoints of a Nic, or of the stack for the
+// ones receiving from all NICs. They are indexed by the network protocol they
+// registered for, 0 standing for all protocols like linux's ETH_P_ALL
+type packetEndpoints struct {
+	mu	sync.RWMutex
+	eps	map[types.NetworkProtocolNumber][]types.PacketEndpoint
+}
+
+func (p *packetEndpoints) add(protocol types.NetworkProtocolNumber, ep types.PacketEndpoint) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.eps == nil {
+		p.eps = make(map[types.NetworkProtocolNumber][]types.PacketEndpoint)
+	}
+	p.eps[protocol] = append(p.eps[protocol], ep)
+}
+
+func (p *packetEndpoints) remove(protocol types.NetworkProtocolNumber, ep types.PacketEndpoint) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	eps := p.eps[protocol]
+	for i, e := range eps {
+		if e == ep {
+			// Don't modify the slice in place, deliver may still be
+			// walking it
+			eps = append(eps[:i:i], eps[i + 1:]...)
+			break
+		}
+	}
+
+	if len(eps) == 0 {
+		delete(p.eps, protocol)
+	} else {
+		p.eps[protocol] = eps
+	}
+}
+
+// list returns all the endpoints
+func (p *packetEndpoints) list() []types.PacketEndpoint {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var res []types.PacketEndpoint
+	for _, eps := range p.eps {
+		res = append(res, eps...)
+	}
+
+	return res
+}
+
+// deliver hands the frame to the endpoints registered for its protocol and to
+// the ones registered for all protocols. Returns true if there was any
+func (p *packetEndpoints) deliver(nicid types.NicId, remoteLinkAddr types.LinkAddress, protocol types.NetworkProtocolNumber, vv *buffer.VectorisedView) bool {
+	p.mu.RLock()
+	all, eps := p.eps[0], p.eps[protocol]
+	p.mu.RUnlock()
+
+	for _, ep := range all {
+		ep.HandlePacket(nicid, remoteLinkAddr, protocol, vv)
+	}
+	if protocol != 0 {
+		for _, ep := range eps {
+			ep.HandlePacket(nicid, remoteLinkAddr, protocol, vv)
+		}
+	}
+
+	return len(all) != 0 || protocol != 0 && len(eps) != 0
+}
+
+// NewPacketEndpoint creates a new packet endpoint receiving the frames of the
+// given network protocol, or of all protocols if it's 0, from all NICs. The
+// transport/packet package must be linked in
+func (s *Stack) NewPacketEndpoint(netProto types.NetworkProtocolNumber, waiterQueue *waiter.Queue) (types.Endpoint, error) {
+	if packetEndpointFactory == nil {
+		return nil, types.ErrNotSupported
+	}
+
+	return packetEndpointFactory(s, netProto, waiterQueue)
+}
+
+// RegisterPacketEndpoint registers the given packet endpoint with a Nic, or with
+// all the NICs if nicId is 0, such that it receives a copy of the frames of the
+// given network protocol. A protocol of 0 stands for all protocols
+func (s *Stack) RegisterPacketEndpoint(nicId types.NicId, netProto types.NetworkProtocolNumber, ep types.PacketEndpoint) error {
+	if nicId == 0 {
+		s.packetEndpoints.add(netProto, ep)
+		return nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicId]
+	if nic == nil {
+		return types.ErrUnknownNicId
+	}
+	nic.packetEndpoints.add(netProto, ep)
+
+	return nil
+}
+
+// UnregisterPacketEndpoint removes the given packet endpoint from the Nic it was
+// registered with
+func (s *Stack) UnregisterPacketEndpoint(nicId types.NicId, netProto types.NetworkProtocolNumber, ep types.PacketEndpoint) {
+	if nicId == 0 {
+		s.packetEndpoints.remove(netProto, ep)
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if nic := s.nics[nicId]; nic != nil {
+		nic.packetEndpoints.remove(netProto, ep)
+	}
+}
+
+// WriteRawPacket writes a frame of the given network protocol to the link
+// endpoint of a Nic. The payload starts with the network header, the link
+// header is added by the link endpoint
+func (s *Stack) WriteRawPacket(nicId types.NicId, remoteLinkAddr types.LinkAddress, netProto types.NetworkProtocolNumber, payload buffer.View) error {
+	s.mu.RLock()
+	nic := s.nics[nicId]
+	s.mu.RUnlock()
+
+	if nic == nil {
+		return types.ErrUnknownNicId
+	}
+
+	r := types.MakeRoute(netProto, "", "", nil)
+	r.Stats = &s.stats
+	r.LocalLinkAddress = nic.linkEp.LinkAddress()
+	r.RemoteLinkAddress = remoteLinkAddr
+
+	hdr := buffer.NewPrependable(int(nic.linkEp.MaxHeaderLength()))
+	linkEp := &nicLinkEndpoint{nic.linkEp, nic}
+
+	return linkEp.WritePacket(r, &hdr, payload, netProto)
+}
@@ -11,6 +11,10 @@ var (
 
 	transportProtocols = make(map[string]TransportProtocolFactory)
 
+	rawEndpointFactory	RawEndpointFactory
+
+	packetEndpointFactory	PacketEndpointFactory
+
 	linkEpMux		sync.RWMutex
 
 	nextLinkEndpointID	types.LinkEndpointID = 1
@@ -32,6 +36,20 @@ func RegisterTransportProtocolFactory(name string, p TransportProtocolFactory) {
 	transportProtocols[name] = p
 }
 
+// RegisterRawEndpointFactory registers the factory used by Stack.NewRawEndpoint.
+// This function is intended to be called by the init() function of the raw
+// endpoints package
+func RegisterRawEndpointFactory(f RawEndpointFactory) {
+	rawEndpointFactory = f
+}
+
+// RegisterPacketEndpointFactory registers the factory used by
+// Stack.NewPacketEndpoint. This function is intended to be called by the init()
+// function of the packet endpoints package
+func RegisterPacketEndpointFactory(f PacketEndpointFactory) {
+	packetEndpointFactory = f
+}
+
 // RegisterLinkEndpoint register a link layer protocol endpoint and returns an
 // ID that can be used to refer to it.
 func RegisterLinkEndpoint(linkEp types.LinkEndpoint) types.LinkEndpointID {
@@ -5,8 +5,9 @@ package stack
 
 import (
 	"sync"
-	"log"
+	"sync/atomic"
 
+	"github.com/YaoZengzeng/yustack/logger"
 	"github.com/YaoZengzeng/yustack/types"
 	"github.com/YaoZengzeng/yustack/waiter"
 	"github.com/YaoZengzeng/yustack/ports"
@@ -26,6 +27,24 @@ type Stack struct {
 	// it is used by FindRoute() to build a route for a specific destination
 	routeTable 		[]types.RouteEntry
 
+	// loopbackRoutes holds the routes to loopback NICs, which are added
+	// automatically when such NICs are created. They take precedence over
+	// routeTable
+	loopbackRoutes	[]types.RouteEntry
+
+	// stats holds the counters of the stack, they are updated atomically
+	stats			types.Stats
+
+	// logger holds a loggerHolder, it's an atomic.Value so that it can be
+	// read on the hot paths without locking
+	logger			atomic.Value
+
+	// tracer holds a tracerHolder
+	tracer			atomic.Value
+
+	// packetEndpoints holds the packet endpoints receiving from all NICs
+	packetEndpoints	packetEndpoints
+
 	*ports.PortManager
 }
 
@@ -38,6 +57,8 @@ func New(network []string, transport []string) *Stack {
 		nics:			  	make(map[types.NicId]*Nic),
 		PortManager:		ports.NewPortManager(),
 	}
+	s.SetLogger(nil)
+	s.SetTracer(nil)
 
 	// Add specified network protocols.
 	for _, name := range network {
@@ -67,6 +88,35 @@ func New(network []string, transport []string) *Stack {
 	return s
 }
 
+// SetTransportProtocolHandler sets the handler of the packets of the given
+// transport protocol which no endpoint wants, e.g., to accept connections to
+// any port. It must be called before the Nics start delivering packets
+func (s *Stack) SetTransportProtocolHandler(protocol types.TransportProtocolNumber, h TransportProtocolHandler) {
+	if state, ok := s.transportProtocols[protocol]; ok {
+		state.DefaultHandler = h
+	}
+}
+
+// loggerHolder wraps the logger of a stack, as atomic.Value requires all the
+// values it stores to have the same concrete type
+type loggerHolder struct {
+	logger.Logger
+}
+
+// SetLogger sets the logger used to report dropped packets and unusual events.
+// A nil logger, the default, disables logging
+func (s *Stack) SetLogger(l logger.Logger) {
+	if l == nil {
+		l = logger.Discard
+	}
+	s.logger.Store(loggerHolder{l})
+}
+
+// Logger returns the logger of the stack, it's never nil
+func (s *Stack) Logger() logger.Logger {
+	return s.logger.Load().(loggerHolder).Logger
+}
+
 // createNic creates a Nic with the porvided id and link layer endpoint
 // and optionally enable it
 func (s *Stack) createNic(id types.NicId, linkEpId types.LinkEndpointID, enable bool) error {
@@ -86,8 +136,17 @@ func (s *Stack) createNic(id types.NicId, linkEpId types.LinkEndpointID, enable
 	nic := newNic(s, id, linkEp)
 	s.nics[id] = nic
 
+	// Route 127.0.0.0/8 to loopback NICs
+	if linkEp.Capabilities() & types.CapabilityLoopback != 0 {
+		s.loopbackRoutes = append(s.loopbackRoutes, types.RouteEntry{
+			Destination:	"\x7f\x00\x00\x00",
+			Mask:			"\xff\x00\x00\x00",
+			Nic:			id,
+		})
+	}
+
 	if enable {
-		nic.attachLinkEndpoint()
+		nic.enable()
 	}
 
 	return nil
@@ -98,6 +157,116 @@ func (s *Stack) CreateNic(id types.NicId, linkEpId types.LinkEndpointID) error {
 	return s.createNic(id, linkEpId, true)
 }
 
+// CreateDisabledNic creates a NIC with the provided id and link layer endpoint,
+// it doesn't handle packets until EnableNic is called. This allows addresses
+// to be added before any packet arrives
+func (s *Stack) CreateDisabledNic(id types.NicId, linkEpId types.LinkEndpointID) error {
+	return s.createNic(id, linkEpId, false)
+}
+
+// EnableNic enables the given Nic, attaching it to its link endpoint if it's
+// the first time
+func (s *Stack) EnableNic(id types.NicId) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[id]
+	if nic == nil {
+		return types.ErrUnknownNicId
+	}
+	nic.enable()
+
+	return nil
+}
+
+// DisableNic disables the given Nic: the packets it receives are dropped, no
+// route goes through it and writing through the routes found before fails. As
+// with a link going down, the transport endpoints are kept
+func (s *Stack) DisableNic(id types.NicId) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[id]
+	if nic == nil {
+		return types.ErrUnknownNicId
+	}
+	nic.disable()
+
+	return nil
+}
+
+// SetPromiscuousMode enables or disables the promiscuous mode of the given
+// Nic. A promiscuous Nic accepts the packets destined to addresses it doesn't
+// have, which are delivered to the transport endpoints bound to any address,
+// as transparent proxies need
+func (s *Stack) SetPromiscuousMode(id types.NicId, enable bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[id]
+	if nic == nil {
+		return types.ErrUnknownNicId
+	}
+	nic.setPromiscuousMode(enable)
+
+	return nil
+}
+
+// SetSpoofing enables or disables the spoofing mode of the given Nic. The
+// routes through a spoofing Nic may have any local address, so that endpoints
+// bound to addresses the Nic doesn't have can send, e.g., the replies of the
+// connections accepted in promiscuous mode
+func (s *Stack) SetSpoofing(id types.NicId, enable bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[id]
+	if nic == nil {
+		return types.ErrUnknownNicId
+	}
+	nic.setSpoofing(enable)
+
+	return nil
+}
+
+// RemoveNic disables and removes the given Nic with its addresses. The
+// transport endpoints bound to it stop receiving packets, and the connections
+// going through it are aborted. The link endpoint is detached, it's left to
+// the caller to close it or to create another Nic with it
+func (s *Stack) RemoveNic(id types.NicId) error {
+	s.mu.Lock()
+	nic := s.nics[id]
+	if nic == nil {
+		s.mu.Unlock()
+		return types.ErrUnknownNicId
+	}
+	nic.disable()
+	nic.detach()
+	delete(s.nics, id)
+
+	routes := s.loopbackRoutes[:0]
+	for _, r := range s.loopbackRoutes {
+		if r.Nic != id {
+			routes = append(routes, r)
+		}
+	}
+	s.loopbackRoutes = routes
+	s.mu.Unlock()
+
+	// The endpoints registered with the Nic are all affected, the global
+	// ones only if they use one of its addresses
+	addrs := nic.addresses()
+	s.abortEndpoints(
+		append(
+			nic.demux.endpointsMatching(func(types.TransportEndpointId) bool { return true }),
+			s.demux.endpointsMatching(func(id types.TransportEndpointId) bool { return addrs[id.LocalAddress] })...),
+		func(addr types.FullAddress) bool { return addr.Nic == id || addrs[addr.Address] },
+		nic.packetEndpoints.list())
+	nic.removeEndpoints()
+
+	return nil
+}
+
 // AddAddress adds a new network layer address to the specific Nic
 func (s *Stack) AddAddress(id types.NicId, protocol types.NetworkProtocolNumber, address types.Address) error {
 	s.mu.RLock()
@@ -111,6 +280,93 @@ func (s *Stack) AddAddress(id types.NicId, protocol types.NetworkProtocolNumber,
 	return nic.AddAddress(protocol, address)
 }
 
+// AddAddressWithPrefix adds a new network layer address to the specific Nic,
+// in the subnet of the given prefix length. See Nic.AddAddressWithPrefix for
+// how the primary address is chosen
+func (s *Stack) AddAddressWithPrefix(id types.NicId, protocol types.NetworkProtocolNumber, address types.Address, prefixLen int, behavior PrimaryEndpointBehavior) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[id]
+	if nic == nil {
+		return types.ErrUnknownNicId
+	}
+
+	return nic.AddAddressWithPrefix(protocol, address, prefixLen, behavior)
+}
+
+// RemoveAddress removes an address from the given Nic. The transport endpoints
+// using it as their local address are aborted
+func (s *Stack) RemoveAddress(id types.NicId, address types.Address) error {
+	s.mu.RLock()
+	nic := s.nics[id]
+	s.mu.RUnlock()
+
+	if nic == nil {
+		return types.ErrUnknownNicId
+	}
+	if err := nic.RemoveAddress(address); err != nil {
+		return err
+	}
+
+	match := func(id types.TransportEndpointId) bool {
+		return id.LocalAddress == address
+	}
+	s.abortEndpoints(
+		append(nic.demux.endpointsMatching(match), s.demux.endpointsMatching(match)...),
+		func(addr types.FullAddress) bool { return addr.Address == address },
+		nil)
+
+	return nil
+}
+
+// abortEndpoints aborts the endpoints affected by the removal of a Nic or of an
+// address which implement types.AbortableEndpoint: the given transport and
+// packet endpoints, and the raw endpoints whose local address matches
+func (s *Stack) abortEndpoints(transportEps []types.TransportEndpoint, rawMatch func(types.FullAddress) bool, packetEps []types.PacketEndpoint) {
+	var eps []interface{}
+	for _, ep := range transportEps {
+		eps = append(eps, ep)
+	}
+	for _, ep := range s.demux.rawEndpointsList() {
+		// Raw endpoints are registered with the stack, whatever they
+		// are bound to
+		if e, ok := ep.(types.Endpoint); ok {
+			if addr, err := e.GetLocalAddress(); err == nil && rawMatch(addr) {
+				eps = append(eps, ep)
+			}
+		}
+	}
+	for _, ep := range packetEps {
+		eps = append(eps, ep)
+	}
+
+	seen := make(map[interface{}]bool)
+	for _, ep := range eps {
+		if seen[ep] {
+			continue
+		}
+		seen[ep] = true
+
+		if a, ok := ep.(types.AbortableEndpoint); ok {
+			a.Abort(types.ErrConnectionAborted)
+		}
+	}
+}
+
+// NicInfo returns the description of all the Nics of the stack
+func (s *Stack) NicInfo() map[types.NicId]NicInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	infos := make(map[types.NicId]NicInfo)
+	for id, nic := range s.nics {
+		infos[id] = nic.info()
+	}
+
+	return infos
+}
+
 // SetRouteTable assigns the route table to be used by this stack. It
 // specifies which Nic and gateway to use for given destination address ranges
 func (s *Stack) SetRouteTable(table []types.RouteEntry) {
@@ -123,10 +379,11 @@ func (s *Stack) SetRouteTable(table []types.RouteEntry) {
 // RegisterTransportEndpoint registers the given endpoint with the stack
 // transport dispatcher. Received packets that match the provided id will be
 // delivered to the given endpoint; specifiying a nic is optional, but
-// nic-specific Ids have precedence over global ones
-func (s *Stack) RegisterTransportEndpoint(nicId types.NicId, netProtos []types.NetworkProtocolNumber, protocol types.TransportProtocolNumber, id types.TransportEndpointId, ep types.TransportEndpoint) error {
+// nic-specific Ids have precedence over global ones. Endpoints registered with
+// reusePort share their id, packets being spread across them by flow
+func (s *Stack) RegisterTransportEndpoint(nicId types.NicId, netProtos []types.NetworkProtocolNumber, protocol types.TransportProtocolNumber, id types.TransportEndpointId, ep types.TransportEndpoint, reusePort bool) error {
 	if nicId == 0 {
-		return s.demux.registerEndpoint(netProtos, protocol, id, ep)
+		return s.demux.registerEndpoint(netProtos, protocol, id, ep, reusePort)
 	}
 
 	s.mu.RLock()
@@ -137,14 +394,14 @@ func (s *Stack) RegisterTransportEndpoint(nicId types.NicId, netProtos []types.N
 		return types.ErrUnknownNicId
 	}
 
-	return nic.demux.registerEndpoint(netProtos, protocol, id, ep)
+	return nic.demux.registerEndpoint(netProtos, protocol, id, ep, reusePort)
 }
 
-// UnregisterTransportEndpoint removes the endpoint with the given id from the
-// stack transport dispatcher
-func (s *Stack) UnregisterTransportEndpoint(nicId types.NicId, netProtos []types.NetworkProtocolNumber, protocol types.TransportProtocolNumber, id types.TransportEndpointId) {
+// UnregisterTransportEndpoint removes the endpoint registered with the given id
+// from the stack transport dispatcher
+func (s *Stack) UnregisterTransportEndpoint(nicId types.NicId, netProtos []types.NetworkProtocolNumber, protocol types.TransportProtocolNumber, id types.TransportEndpointId, ep types.TransportEndpoint) {
 	if nicId == 0 {
-		s.demux.unregisterEndpoint(netProtos, protocol, id)
+		s.demux.unregisterEndpoint(netProtos, protocol, id, ep)
 		return
 	}
 
@@ -153,37 +410,87 @@ func (s *Stack) UnregisterTransportEndpoint(nicId types.NicId, netProtos []types
 
 	nic := s.nics[nicId]
 	if nic != nil {
-		nic.demux.unregisterEndpoint(netProtos, protocol, id)
+		nic.demux.unregisterEndpoint(netProtos, protocol, id, ep)
 	}
 }
 
-// FindRoute creates a route to the given destination address, leaving through
-// the given nic and local address (if provided)
-func (s *Stack) FindRoute(id types.NicId, localAddress, remoteAddress types.Address, netProto types.NetworkProtocolNumber) (*types.Route, error) {
+// TransportEndpoints returns the endpoints of the given transport protocol
+// registered with the stack, either globally or on a specific NIC. An endpoint
+// registered for several network protocols is only returned once
+func (s *Stack) TransportEndpoints(protocol types.TransportProtocolNumber) []types.TransportEndpoint {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	for i := range s.routeTable {
-		if id != 0 && id != s.routeTable[i].Nic || !s.routeTable[i].Match(remoteAddress) {
-			continue
+	seen := make(map[types.TransportEndpoint]bool)
+	var res []types.TransportEndpoint
+	add := func(eps []types.TransportEndpoint) {
+		for _, ep := range eps {
+			if !seen[ep] {
+				seen[ep] = true
+				res = append(res, ep)
+			}
 		}
+	}
 
-		nic := s.nics[s.routeTable[i].Nic]
-		if nic == nil {
-			continue
-		}
+	add(s.demux.transportEndpoints(protocol))
+	for _, nic := range s.nics {
+		add(nic.demux.transportEndpoints(protocol))
+	}
 
-		// Use the first endpoint of given network protocol
-		ref := nic.primaryEndpoint()
-		if ref == nil {
-			log.Printf("FindRoute: can not find network endpoint of given network protocol")
-			continue
-		}
+	return res
+}
 
-		r := types.MakeRoute(netProto, ref.ep.Id().LocalAddress, remoteAddress, ref.ep)
-		// Ignore remote link address
-		r.NextHop = s.routeTable[i].Gateway
-		return r, nil
+// FindRoute creates a route to the given destination address, leaving through
+// the given nic and local address (if provided)
+func (s *Stack) FindRoute(id types.NicId, localAddress, remoteAddress types.Address, netProto types.NetworkProtocolNumber) (*types.Route, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, table := range [][]types.RouteEntry{s.loopbackRoutes, s.routeTable} {
+		for i := range table {
+			if id != 0 && id != table[i].Nic || !table[i].Match(remoteAddress) {
+				continue
+			}
+
+			nic := s.nics[table[i].Nic]
+			if nic == nil || !nic.isEnabled() {
+				continue
+			}
+
+			// Use the requested local address, or else the
+			// primary address for the next hop
+			nextHop := table[i].Gateway
+			if nextHop == "" {
+				nextHop = remoteAddress
+			}
+			nic.mu.RLock()
+			var ref *referencedNetworkEndpoint
+			if localAddress != "" {
+				ref = nic.findEndpoint(netProto, localAddress)
+			} else {
+				ref = nic.primaryEndpoint(netProto, nextHop)
+			}
+			spoofed := ref == nil && localAddress != "" && nic.spoofing
+			nic.mu.RUnlock()
+			if spoofed {
+				ref = nic.tempEndpoint(netProto, localAddress)
+			}
+			if ref == nil {
+				s.Logger().Log(logger.LevelDebug, "FindRoute: no network endpoint on the nic", "nic", nic.id, "local", localAddress)
+				continue
+			}
+
+			r := types.MakeRoute(netProto, ref.ep.Id().LocalAddress, remoteAddress, ref.ep)
+			r.Stats = &s.stats
+			// Ignore remote link address
+			r.NextHop = table[i].Gateway
+			if spoofed {
+				// Routes hold no reference, this one keeps
+				// writing through the endpoint once it's closed
+				ref.decRef()
+			}
+			return r, nil
+		}
 	}
 
 	return &types.Route{}, types.ErrNoRoute
@@ -198,3 +505,35 @@ func (s *Stack) NewEndpoint(transport types.TransportProtocolNumber, network typ
 
 	return t.Protocol.NewEndpoint(s, network, waiterQueue)
 }
+
+// NewRawEndpoint creates a new raw endpoint of the given protocols, it receives
+// a copy of every packet of the transport protocol, which doesn't need to be
+// known to the stack. The transport/raw package must be linked in
+func (s *Stack) NewRawEndpoint(network types.NetworkProtocolNumber, transport types.TransportProtocolNumber, waiterQueue *waiter.Queue) (types.Endpoint, error) {
+	if rawEndpointFactory == nil {
+		return nil, types.ErrNotSupported
+	}
+
+	if _, ok := s.networkProtocols[network]; !ok {
+		return nil, types.ErrUnknownProtocol
+	}
+
+	return rawEndpointFactory(s, network, transport, waiterQueue)
+}
+
+// RegisterRawTransportEndpoint registers the given raw endpoint with the stack
+// such that it receives a copy of the packets of the protocol pair
+func (s *Stack) RegisterRawTransportEndpoint(netProto types.NetworkProtocolNumber, protocol types.TransportProtocolNumber, ep types.RawTransportEndpoint) error {
+	if _, ok := s.networkProtocols[netProto]; !ok {
+		return types.ErrUnknownProtocol
+	}
+
+	s.demux.registerRawEndpoint(netProto, protocol, ep)
+
+	return nil
+}
+
+// UnregisterRawTransportEndpoint removes the given raw endpoint from the stack
+func (s *Stack) UnregisterRawTransportEndpoint(netProto types.NetworkProtocolNumber, protocol types.TransportProtocolNumber, ep types.RawTransportEndpoint) {
+	s.demux.unregisterRawEndpoint(netProto, protocol, ep)
+}
@@ -0,0 +1,62 @@
+package stack
+
+import (
+	"sort"
+
+	"github.com/YaoZengzeng/yustack/logger"
+	"github.com/YaoZengzeng/yustack/types"
+)
+
+// Stats holds the counters of a stack, see types.Stats
+type Stats = types.Stats
+
+// NicStats holds the counters of a NIC, see types.NicStats
+type NicStats = types.NicStats
+
+// Stats returns the counters of the stack. They are updated concurrently by
+// the stack, so they must be read with StatCounter.Value
+func (s *Stack) Stats() *Stats {
+	return &s.stats
+}
+
+// DropPacket records that the given packet was dropped for the given reason:
+// it's counted in the stats, reported to the tracer and logged at the debug
+// level
+func (s *Stack) DropPacket(reason types.DropReason, info *PacketInfo) {
+	s.stats.DroppedPackets[reason].Increment()
+
+	if t := s.Tracer(); t != nil {
+		t.Drop(reason, info)
+	}
+
+	if l := s.Logger(); l.Enabled(logger.LevelDebug) {
+		l.Log(logger.LevelDebug, "packet dropped", "reason", reason, "packet", info)
+	}
+}
+
+// NicIds returns the ids of the NICs of the stack, in increasing order
+func (s *Stack) NicIds() []types.NicId {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make([]types.NicId, 0, len(s.nics))
+	for id := range s.nics {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids
+}
+
+// NicStats returns the counters of the NIC with the given id
+func (s *Stack) NicStats(id types.NicId) (*NicStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[id]
+	if nic == nil {
+		return nil, types.ErrUnknownNicId
+	}
+
+	return &nic.stats, nil
+}
@@ -0,0 +1,230 @@
+package stack
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/YaoZengzeng/yustack/types"
+)
+
+// TracePoint identifies the layer transition at which a packet is traced
+type TracePoint int
+
+// Points at which packets are traced
+const (
+	// TraceLinkReceive is reported when a NIC receives a packet from its
+	// link endpoint
+	TraceLinkReceive TracePoint = iota
+
+	// TraceNetworkReceive is reported when a packet is handed to the
+	// network endpoint owning its destination address
+	TraceNetworkReceive
+
+	// TraceTransportReceive is reported when the network layer hands a
+	// packet to the transport layer
+	TraceTransportReceive
+
+	// TraceEndpointDeliver is reported when a packet has been handed to
+	// a transport endpoint
+	TraceEndpointDeliver
+
+	// TraceLinkSend is reported when a packet is handed to the link
+	// endpoint of a NIC
+	TraceLinkSend
+)
+
+// String returns the name of the trace point
+func (p TracePoint) String() string {
+	switch p {
+	case TraceLinkReceive:
+		return "link_receive"
+	case TraceNetworkReceive:
+		return "network_receive"
+	case TraceTransportReceive:
+		return "transport_receive"
+	case TraceEndpointDeliver:
+		return "endpoint_deliver"
+	case TraceLinkSend:
+		return "link_send"
+	}
+
+	return fmt.Sprintf("trace_point_%d", int(p))
+}
+
+// PacketInfo describes a traced packet. The fields are filled as far as the
+// packet has been parsed, e.g., the ports are zero before the transport layer
+type PacketInfo struct {
+	Nic					types.NicId
+	NetworkProtocol		types.NetworkProtocolNumber
+	TransportProtocol	types.TransportProtocolNumber
+
+	// Id is the tuple of the packet, seen from the stack: the local
+	// address is the destination of incoming packets
+	Id					types.TransportEndpointId
+
+	// Size is the size of the packet at the layer it's traced
+	Size				int
+}
+
+// NewPacketInfo describes a packet received through r, which is Size bytes
+// long at the transport layer
+func NewPacketInfo(r *types.Route, protocol types.TransportProtocolNumber, id types.TransportEndpointId, size int) *PacketInfo {
+	return &PacketInfo{
+		Nic:				r.NicId(),
+		NetworkProtocol:	r.NetProto,
+		TransportProtocol:	protocol,
+		Id:					id,
+		Size:				size,
+	}
+}
+
+// String returns a one line description of the packet
+func (p *PacketInfo) String() string {
+	return fmt.Sprintf("nic %d proto %#x/%d %v:%d -> %v:%d size %d", p.Nic, p.NetworkProtocol, p.TransportProtocol,
+		p.Id.RemoteAddress, p.Id.RemotePort, p.Id.LocalAddress, p.Id.LocalPort, p.Size)
+}
+
+// Tracer is notified of the packets going through the stack. Its methods are
+// called on the hot paths, so they must be fast, and they must not keep info
+// after they return
+type Tracer interface {
+	// Trace is called when a packet reaches the given point
+	Trace(point TracePoint, info *PacketInfo)
+
+	// Drop is called when a packet is dropped for the given reason
+	Drop(reason types.DropReason, info *PacketInfo)
+}
+
+// tracerHolder wraps the tracer of a stack, for the same reason as
+// loggerHolder
+type tracerHolder struct {
+	Tracer
+}
+
+// SetTracer sets the tracer notified of the packets going through the stack,
+// a nil tracer disables tracing
+func (s *Stack) SetTracer(t Tracer) {
+	s.tracer.Store(tracerHolder{t})
+}
+
+// Tracer returns the tracer of the stack, or nil if tracing is disabled
+func (s *Stack) Tracer() Tracer {
+	return s.tracer.Load().(tracerHolder).Tracer
+}
+
+// TraceRecord is an event recorded by a RingTracer
+type TraceRecord struct {
+	Time	time.Time
+
+	// Dropped tells whether the packet was dropped, for Reason, or went
+	// through Point
+	Dropped	bool
+	Point	TracePoint
+	Reason	types.DropReason
+
+	Info	PacketInfo
+}
+
+// String returns a one line description of the record
+func (r *TraceRecord) String() string {
+	what := r.Point.String()
+	if r.Dropped {
+		what = "drop " + r.Reason.String()
+	}
+
+	return fmt.Sprintf("%s %s %v", r.Time.Format("15:04:05.000000"), what, &r.Info)
+}
+
+// RingTracer is a Tracer keeping the last events in a ring buffer, so that
+// they can be queried at runtime, as with dropwatch
+type RingTracer struct {
+	// all tells whether the layer transitions are recorded along with the
+	// drops
+	all		bool
+
+	mu		sync.Mutex
+	records	[]TraceRecord
+	next	int
+	full	bool
+	drops	[types.NumDropReasons]uint64
+}
+
+// NewRingTracer creates a tracer keeping the last size events. Only the drops
+// are recorded, unless all is true
+func NewRingTracer(size int, all bool) *RingTracer {
+	if size < 1 {
+		size = 1
+	}
+
+	return &RingTracer{
+		all:		all,
+		records:	make([]TraceRecord, size),
+	}
+}
+
+// Trace implements Tracer.Trace
+func (t *RingTracer) Trace(point TracePoint, info *PacketInfo) {
+	if t.all {
+		t.record(TraceRecord{Time: time.Now(), Point: point, Info: *info})
+	}
+}
+
+// Drop implements Tracer.Drop
+func (t *RingTracer) Drop(reason types.DropReason, info *PacketInfo) {
+	t.record(TraceRecord{Time: time.Now(), Dropped: true, Reason: reason, Info: *info})
+}
+
+func (t *RingTracer) record(r TraceRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if r.Dropped {
+		t.drops[r.Reason]++
+	}
+
+	t.records[t.next] = r
+	t.next++
+	if t.next == len(t.records) {
+		t.next = 0
+		t.full = true
+	}
+}
+
+// Records returns the events recorded, from the oldest to the newest
+func (t *RingTracer) Records() []TraceRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.full {
+		return append([]TraceRecord(nil), t.records[:t.next]...)
+	}
+
+	return append(append([]TraceRecord(nil), t.records[t.next:]...), t.records[:t.next]...)
+}
+
+// Drops returns the number of drops seen by the tracer for each reason, since
+// its creation or the last Reset. It includes the drops no longer in the ring
+func (t *RingTracer) Drops() map[types.DropReason]uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	res := make(map[types.DropReason]uint64)
+	for reason, n := range t.drops {
+		if n != 0 {
+			res[types.DropReason(reason)] = n
+		}
+	}
+
+	return res
+}
+
+// Reset forgets all the events recorded
+func (t *RingTracer) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.next = 0
+	t.full = false
+	t.drops = [types.NumDropReasons]uint64{}
+}
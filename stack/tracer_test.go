@@ -0,0 +1,95 @@
+package stack_test
+
+import (
+	"testing"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/link/loopback"
+	"github.com/YaoZengzeng/yustack/network/ipv4"
+	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/transport/udp"
+	"github.com/YaoZengzeng/yustack/types"
+	"github.com/YaoZengzeng/yustack/waiter"
+)
+
+const localhost = "\x7f\x00\x00\x01"
+
+// sendUDP sends a datagram to the given local port from a new endpoint
+func sendUDP(t *testing.T, s *stack.Stack, port uint16) {
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	if _, err := ep.Write(buffer.View("hello"), &types.FullAddress{Address: localhost, Port: port}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+}
+
+func TestRingTracer(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName})
+	if err := s.CreateNic(1, loopback.New()); err != nil {
+		t.Fatalf("CreateNic failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, localhost); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	tracer := stack.NewRingTracer(16, true)
+	s.SetTracer(tracer)
+
+	// Nobody listens on the port, so the datagram is dropped
+	sendUDP(t, s, 1234)
+
+	want := []stack.TracePoint{stack.TraceLinkSend, stack.TraceLinkReceive, stack.TraceNetworkReceive, stack.TraceTransportReceive}
+	records := tracer.Records()
+	if len(records) != len(want) + 1 {
+		t.Fatalf("got %d records, want %d:\n%v", len(records), len(want) + 1, records)
+	}
+	for i, p := range want {
+		if records[i].Dropped || records[i].Point != p {
+			t.Errorf("record %d is %v, want point %v", i, &records[i], p)
+		}
+	}
+
+	drop := records[len(want)]
+	if !drop.Dropped || drop.Reason != types.DropNoTransportEndpoint {
+		t.Fatalf("last record is %v, want a drop for %v", &drop, types.DropNoTransportEndpoint)
+	}
+	if info := drop.Info; info.Nic != 1 || info.TransportProtocol != udp.ProtocolNumber || info.Id.LocalPort != 1234 || info.Id.LocalAddress != localhost {
+		t.Errorf("the drop describes %v, want the datagram sent to port 1234", &info)
+	}
+
+	if got := s.Stats().DroppedPackets[types.DropNoTransportEndpoint].Value(); got != 1 {
+		t.Errorf("DroppedPackets[%v] = %v, want 1", types.DropNoTransportEndpoint, got)
+	}
+
+	// The ring only keeps the last events, but the drops are all counted
+	tracer = stack.NewRingTracer(2, false)
+	s.SetTracer(tracer)
+	for i := 0; i < 3; i++ {
+		sendUDP(t, s, uint16(2000 + i))
+	}
+
+	records = tracer.Records()
+	if len(records) != 2 || records[0].Info.Id.LocalPort != 2001 || records[1].Info.Id.LocalPort != 2002 {
+		t.Errorf("got records %v, want the drops to ports 2001 and 2002", records)
+	}
+	if got := tracer.Drops()[types.DropNoTransportEndpoint]; got != 3 {
+		t.Errorf("Drops() = %v, want 3 drops for %v", tracer.Drops(), types.DropNoTransportEndpoint)
+	}
+
+	tracer.Reset()
+	if len(tracer.Records()) != 0 || len(tracer.Drops()) != 0 {
+		t.Errorf("Reset didn't forget the events")
+	}
+
+	// Without a tracer, drops are still counted
+	s.SetTracer(nil)
+	sendUDP(t, s, 3000)
+	if got := s.Stats().DroppedPackets[types.DropNoTransportEndpoint].Value(); got != 5 {
+		t.Errorf("DroppedPackets[%v] = %v, want 5", types.DropNoTransportEndpoint, got)
+	}
+}
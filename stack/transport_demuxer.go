@@ -1,7 +1,6 @@
 package stack
 
 import (
-	"log"
 	"sync"
 
 	"github.com/YaoZengzeng/yustack/types"
@@ -15,6 +14,46 @@ type transportEndpoints struct {
 	endpoints 	map[types.TransportEndpointId]types.TransportEndpoint
 }
 
+// reusePortGroup is a group of endpoints sharing an id, each of them having set
+// ReusePortOption. It spreads the packets across them by a hash of their id, so
+// that all the packets of a flow reach the same endpoint. It is protected by
+// the mutex of the transportEndpoints it belongs to
+type reusePortGroup struct {
+	endpoints	[]types.TransportEndpoint
+}
+
+// HandlePacket implements types.TransportEndpoint.HandlePacket
+func (g *reusePortGroup) HandlePacket(r *types.Route, id types.TransportEndpointId, vv *buffer.VectorisedView) {
+	// FNV-1a over the 4-tuple
+	h := uint32(2166136261)
+	for _, a := range []types.Address{id.LocalAddress, id.RemoteAddress} {
+		for i := 0; i < len(a); i++ {
+			h ^= uint32(a[i])
+			h *= 16777619
+		}
+	}
+	for _, p := range []uint16{id.LocalPort, id.RemotePort} {
+		h ^= uint32(p >> 8)
+		h *= 16777619
+		h ^= uint32(p & 0xff)
+		h *= 16777619
+	}
+
+	g.endpoints[h%uint32(len(g.endpoints))].HandlePacket(r, id, vv)
+}
+
+// remove removes ep from the group, returning the number of endpoints left
+func (g *reusePortGroup) remove(ep types.TransportEndpoint) int {
+	for i, e := range g.endpoints {
+		if e == ep {
+			g.endpoints = append(g.endpoints[:i], g.endpoints[i + 1:]...)
+			break
+		}
+	}
+
+	return len(g.endpoints)
+}
+
 type protocolIds struct {
 	network 		types.NetworkProtocolNumber
 	transport 		types.TransportProtocolNumber
@@ -26,11 +65,18 @@ type protocolIds struct {
 // based on endpoints Ids
 type transportDemuxer struct {
 	protocol map[protocolIds]*transportEndpoints
+
+	// rawEndpoints holds the raw endpoints of each protocol pair. The
+	// transport protocol of a raw endpoint may be unknown to the stack,
+	// so they have their own map
+	rawMu			sync.RWMutex
+	rawEndpoints	map[protocolIds][]types.RawTransportEndpoint
 }
 
 func newTransportDemuxer(stack *Stack) *transportDemuxer {
 	d := &transportDemuxer{
-		protocol:	make(map[protocolIds]*transportEndpoints),
+		protocol:		make(map[protocolIds]*transportEndpoints),
+		rawEndpoints:	make(map[protocolIds][]types.RawTransportEndpoint),
 	}
 
 	// Add each network and transport pair to the demuxer
@@ -44,11 +90,12 @@ func newTransportDemuxer(stack *Stack) *transportDemuxer {
 }
 
 // registerEndpoint registers the given endpoint  with the dispatcher such that
-// packets that match the endpoint Id are delivered to it
-func (d *transportDemuxer) registerEndpoint(netProtos []types.NetworkProtocolNumber, protocol types.TransportProtocolNumber, id types.TransportEndpointId, ep types.TransportEndpoint) error {
+// packets that match the endpoint Id are delivered to it. If reusePort is set,
+// the id may be shared with other endpoints which set it too
+func (d *transportDemuxer) registerEndpoint(netProtos []types.NetworkProtocolNumber, protocol types.TransportProtocolNumber, id types.TransportEndpointId, ep types.TransportEndpoint, reusePort bool) error {
 	for i, n := range netProtos {
-		if err := d.singleRegisterEndpoint(n, protocol, id, ep); err != nil {
-			d.unregisterEndpoint(netProtos[:i], protocol, id)
+		if err := d.singleRegisterEndpoint(n, protocol, id, ep, reusePort); err != nil {
+			d.unregisterEndpoint(netProtos[:i], protocol, id, ep)
 			return err
 		}
 	}
@@ -56,18 +103,29 @@ func (d *transportDemuxer) registerEndpoint(netProtos []types.NetworkProtocolNum
 	return nil
 }
 
-func (d *transportDemuxer) singleRegisterEndpoint(netProto types.NetworkProtocolNumber, protocol types.TransportProtocolNumber, id types.TransportEndpointId, ep types.TransportEndpoint) error {
+func (d *transportDemuxer) singleRegisterEndpoint(netProto types.NetworkProtocolNumber, protocol types.TransportProtocolNumber, id types.TransportEndpointId, ep types.TransportEndpoint, reusePort bool) error {
 	eps, ok := d.protocol[protocolIds{netProto, protocol}]
 	if !ok {
-		log.Printf("singleRegisterEndpoint: find endpoints failed\n")
-		return nil
+		return types.ErrUnknownProtocol
 	}
 
 	eps.mu.Lock()
 	defer eps.mu.Unlock()
 
-	if _, ok := eps.endpoints[id]; ok {
-		return types.ErrPortInUse
+	if e, ok := eps.endpoints[id]; ok {
+		// The id can only be shared by endpoints which all set
+		// ReusePortOption
+		g, ok := e.(*reusePortGroup)
+		if !ok || !reusePort {
+			return types.ErrPortInUse
+		}
+		g.endpoints = append(g.endpoints, ep)
+		return nil
+	}
+
+	if reusePort {
+		eps.endpoints[id] = &reusePortGroup{endpoints: []types.TransportEndpoint{ep}}
+		return nil
 	}
 
 	eps.endpoints[id] =  ep
@@ -77,55 +135,186 @@ func (d *transportDemuxer) singleRegisterEndpoint(netProto types.NetworkProtocol
 
 // unregisterEndpoint unregisters the endpoint with the given id such that it
 // won't receive any more packets
-func (d *transportDemuxer) unregisterEndpoint(netProtos []types.NetworkProtocolNumber, protocol types.TransportProtocolNumber, id types.TransportEndpointId) {
+func (d *transportDemuxer) unregisterEndpoint(netProtos []types.NetworkProtocolNumber, protocol types.TransportProtocolNumber, id types.TransportEndpointId, ep types.TransportEndpoint) {
 	for _, n := range netProtos {
 		if eps, ok := d.protocol[protocolIds{n, protocol}]; ok {
 			eps.mu.Lock()
-			delete(eps.endpoints, id)
+			switch e := eps.endpoints[id].(type) {
+			case *reusePortGroup:
+				if e.remove(ep) == 0 {
+					delete(eps.endpoints, id)
+				}
+			default:
+				if e == ep {
+					delete(eps.endpoints, id)
+				}
+			}
 			eps.mu.Unlock()
 		}
 	}
 }
 
-// deliverPacket attempts to deliver the given packet. Returns true if it found
-// an endpoint, false otherwise
-func (d *transportDemuxer) deliverPacket(r *types.Route, protocol types.TransportProtocolNumber, vv *buffer.VectorisedView, id types.TransportEndpointId) bool {
+// lookupIds returns the ids an endpoint may be registered with to receive the
+// packet identified by id, from the most specific to the least specific one:
+// the full 4-tuple of a connected endpoint, then the local address and port of
+// an endpoint bound to that address, then the port only of an endpoint bound to
+// the wildcard address
+func lookupIds(id types.TransportEndpointId) [3]types.TransportEndpointId {
+	local := types.TransportEndpointId{LocalAddress: id.LocalAddress, LocalPort: id.LocalPort}
+	wildcard := types.TransportEndpointId{LocalPort: id.LocalPort}
+
+	return [3]types.TransportEndpointId{id, local, wildcard}
+}
+
+// deliverPacket delivers the packet identified by id to the endpoint registered
+// with the most specific id among the given demuxers, as ordered by lookupIds.
+// When several demuxers have an endpoint for the same id, the first one wins,
+// which lets the demuxer of a Nic override the one of the stack without
+// shadowing its more specific ids. Returns true if it found an endpoint, false
+// otherwise
+func deliverPacket(demuxers []*transportDemuxer, r *types.Route, protocol types.TransportProtocolNumber, vv *buffer.VectorisedView, id types.TransportEndpointId) bool {
+	for _, nid := range lookupIds(id) {
+		for _, d := range demuxers {
+			if d.deliverPacketToId(r, protocol, vv, id, nid) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// deliverPacketToId hands the packet identified by id to the endpoint
+// registered with the id nid, if any
+func (d *transportDemuxer) deliverPacketToId(r *types.Route, protocol types.TransportProtocolNumber, vv *buffer.VectorisedView, id types.TransportEndpointId, nid types.TransportEndpointId) bool {
 	eps, ok := d.protocol[protocolIds{r.NetProto, protocol}]
 	if !ok {
-		log.Printf("deliverPacket: found transport endpoints failed\n")
 		return false
 	}
 
 	eps.mu.RLock()
 	defer eps.mu.RUnlock()
-	b := d.deliverPacketLocked(r, eps, vv, id)
 
-	return b
+	ep := eps.endpoints[nid]
+	if ep == nil {
+		return false
+	}
+	ep.HandlePacket(r, id, vv)
+
+	return true
+}
+
+// registerRawEndpoint registers the given raw endpoint with the dispatcher such
+// that it receives a copy of the packets of the protocol pair
+func (d *transportDemuxer) registerRawEndpoint(netProto types.NetworkProtocolNumber, protocol types.TransportProtocolNumber, ep types.RawTransportEndpoint) {
+	d.rawMu.Lock()
+	defer d.rawMu.Unlock()
+
+	ids := protocolIds{netProto, protocol}
+	d.rawEndpoints[ids] = append(d.rawEndpoints[ids], ep)
 }
 
-func (d *transportDemuxer) deliverPacketLocked(r *types.Route, eps *transportEndpoints, vv *buffer.VectorisedView, id types.TransportEndpointId) bool {
-	// Now only try to match with the id as provided
-	if ep := eps.endpoints[id]; ep != nil {
-		ep.HandlePacket(r, id, vv)
-		return true
+// unregisterRawEndpoint unregisters the given raw endpoint such that it won't
+// receive any more packets
+func (d *transportDemuxer) unregisterRawEndpoint(netProto types.NetworkProtocolNumber, protocol types.TransportProtocolNumber, ep types.RawTransportEndpoint) {
+	d.rawMu.Lock()
+	defer d.rawMu.Unlock()
+
+	ids := protocolIds{netProto, protocol}
+	eps := d.rawEndpoints[ids]
+	for i, e := range eps {
+		if e == ep {
+			// Don't modify the slice in place, deliverRawPacket may
+			// still be walking it
+			eps = append(eps[:i:i], eps[i + 1:]...)
+			break
+		}
 	}
 
-	nid := id
+	if len(eps) == 0 {
+		delete(d.rawEndpoints, ids)
+	} else {
+		d.rawEndpoints[ids] = eps
+	}
+}
+
+// deliverRawPacket hands the packet to all the raw endpoints of its protocol
+// pair. Returns true if there was any
+func (d *transportDemuxer) deliverRawPacket(r *types.Route, protocol types.TransportProtocolNumber, vv *buffer.VectorisedView) bool {
+	d.rawMu.RLock()
+	eps := d.rawEndpoints[protocolIds{r.NetProto, protocol}]
+	d.rawMu.RUnlock()
 
-	// Try to find a match with the id minus the remote part
-	nid.RemoteAddress = ""
-	nid.RemotePort = 0
-	if ep := eps.endpoints[nid]; ep != nil {
-		ep.HandlePacket(r, id, vv)
-		return true
+	for _, ep := range eps {
+		ep.HandlePacket(r, vv)
 	}
 
-	// Try to find a match with only the local port
-	nid.LocalAddress = ""
-	if ep := eps.endpoints[nid]; ep != nil {
-		ep.HandlePacket(r, id, vv)
-		return true
+	return len(eps) != 0
+}
+
+// rawEndpointsList returns all the raw endpoints registered with the demuxer
+func (d *transportDemuxer) rawEndpointsList() []types.RawTransportEndpoint {
+	d.rawMu.RLock()
+	defer d.rawMu.RUnlock()
+
+	var res []types.RawTransportEndpoint
+	for _, eps := range d.rawEndpoints {
+		res = append(res, eps...)
 	}
 
-	return false
-}
\ No newline at end of file
+	return res
+}
+
+// hasRawEndpoints tells whether raw endpoints are registered for the protocol
+// pair
+func (d *transportDemuxer) hasRawEndpoints(netProto types.NetworkProtocolNumber, protocol types.TransportProtocolNumber) bool {
+	d.rawMu.RLock()
+	defer d.rawMu.RUnlock()
+
+	return len(d.rawEndpoints[protocolIds{netProto, protocol}]) != 0
+}
+
+// endpointsMatching returns the endpoints registered with the demuxer, for all
+// protocols, whose id matches
+func (d *transportDemuxer) endpointsMatching(match func(id types.TransportEndpointId) bool) []types.TransportEndpoint {
+	var res []types.TransportEndpoint
+	for _, eps := range d.protocol {
+		eps.mu.RLock()
+		for id, ep := range eps.endpoints {
+			if !match(id) {
+				continue
+			}
+			if g, ok := ep.(*reusePortGroup); ok {
+				res = append(res, g.endpoints...)
+				continue
+			}
+			res = append(res, ep)
+		}
+		eps.mu.RUnlock()
+	}
+
+	return res
+}
+
+// transportEndpoints returns the endpoints of the given transport protocol
+// registered with the demuxer, for all network protocols
+func (d *transportDemuxer) transportEndpoints(protocol types.TransportProtocolNumber) []types.TransportEndpoint {
+	var res []types.TransportEndpoint
+	for ids, eps := range d.protocol {
+		if ids.transport != protocol {
+			continue
+		}
+
+		eps.mu.RLock()
+		for _, ep := range eps.endpoints {
+			if g, ok := ep.(*reusePortGroup); ok {
+				res = append(res, g.endpoints...)
+				continue
+			}
+			res = append(res, ep)
+		}
+		eps.mu.RUnlock()
+	}
+
+	return res
+}
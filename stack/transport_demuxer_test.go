@@ -0,0 +1,225 @@
+package stack_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/link/loopback"
+	"github.com/YaoZengzeng/yustack/network/ipv4"
+	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/transport/tcp"
+	"github.com/YaoZengzeng/yustack/transport/udp"
+	"github.com/YaoZengzeng/yustack/types"
+	"github.com/YaoZengzeng/yustack/waiter"
+)
+
+const (
+	// localhost2 is a second address of the Nic of localhost
+	localhost2 = "\x7f\x00\x00\x02"
+
+	// otherAddr is the address of a second Nic
+	otherAddr = "\x0a\x00\x00\x01"
+)
+
+// newDemuxStack creates a stack with two loopback Nics: Nic 1 has the
+// addresses localhost and localhost2, Nic 2 has otherAddr
+func newDemuxStack(t *testing.T) *stack.Stack {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName, udp.ProtocolName})
+	for _, nic := range []struct {
+		id		types.NicId
+		addrs	[]types.Address
+	}{
+		{1, []types.Address{localhost, localhost2}},
+		{2, []types.Address{otherAddr}},
+	} {
+		if err := s.CreateNic(nic.id, loopback.New()); err != nil {
+			t.Fatalf("CreateNic failed: %v", err)
+		}
+		for _, addr := range nic.addrs {
+			if err := s.AddAddress(nic.id, ipv4.ProtocolNumber, addr); err != nil {
+				t.Fatalf("AddAddress failed: %v", err)
+			}
+		}
+	}
+	s.SetRouteTable([]types.RouteEntry{
+		{Destination: "\x7f\x00\x00\x00", Mask: "\xff\x00\x00\x00", Nic: 1},
+		{Destination: "\x0a\x00\x00\x00", Mask: "\xff\x00\x00\x00", Nic: 2},
+	})
+
+	return s
+}
+
+// demuxTests are the binds competing for the packets sent to a port, and the
+// index of the one which must get them, -1 if none
+var demuxTests = []struct {
+	name	string
+	binds	[]types.FullAddress
+	dst		types.Address
+	want	int
+}{
+	{
+		name:	"wildcard",
+		binds:	[]types.FullAddress{{}},
+		dst:	localhost2,
+		want:	0,
+	},
+	{
+		name:	"address over wildcard",
+		binds:	[]types.FullAddress{{}, {Address: localhost2}},
+		dst:	localhost2,
+		want:	1,
+	},
+	{
+		name:	"wildcard when the address differs",
+		binds:	[]types.FullAddress{{}, {Address: localhost}},
+		dst:	localhost2,
+		want:	0,
+	},
+	{
+		name:	"other address only",
+		binds:	[]types.FullAddress{{Address: localhost}},
+		dst:	localhost2,
+		want:	-1,
+	},
+	{
+		name:	"nic wildcard over global wildcard",
+		binds:	[]types.FullAddress{{}, {Nic: 1}},
+		dst:	localhost,
+		want:	1,
+	},
+	{
+		name:	"nic address over global address",
+		binds:	[]types.FullAddress{{Nic: 1, Address: localhost}, {Address: localhost}},
+		dst:	localhost,
+		want:	0,
+	},
+	{
+		name:	"global address over nic wildcard",
+		binds:	[]types.FullAddress{{Nic: 1}, {Address: localhost}},
+		dst:	localhost,
+		want:	1,
+	},
+	{
+		name:	"other nic",
+		binds:	[]types.FullAddress{{Nic: 2}, {}},
+		dst:	localhost,
+		want:	1,
+	},
+	{
+		name:	"other nic only",
+		binds:	[]types.FullAddress{{Nic: 2}},
+		dst:	localhost,
+		want:	-1,
+	},
+}
+
+func newEndpoint(t *testing.T, s *stack.Stack, protocol types.TransportProtocolNumber) types.Endpoint {
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(protocol, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+
+	return ep
+}
+
+func TestUDPDemux(t *testing.T) {
+	for i, test := range demuxTests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newDemuxStack(t)
+			port := uint16(9000 + i)
+
+			var eps []types.Endpoint
+			for _, bind := range test.binds {
+				ep := newEndpoint(t, s, udp.ProtocolNumber)
+				defer ep.Close()
+				bind.Port = port
+				if err := ep.Bind(bind); err != nil {
+					t.Fatalf("Bind(%+v) failed: %v", bind, err)
+				}
+				eps = append(eps, ep)
+			}
+
+			sender := newEndpoint(t, s, udp.ProtocolNumber)
+			defer sender.Close()
+			if _, err := sender.Write(buffer.View("hello"), &types.FullAddress{Address: test.dst, Port: port}); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+
+			got := -1
+			for j, ep := range eps {
+				if _, err := ep.Read(nil); err == nil {
+					if got != -1 {
+						t.Errorf("endpoints %d and %d both got the datagram", got, j)
+					}
+					got = j
+				}
+			}
+			if got != test.want {
+				t.Errorf("endpoint %d got the datagram, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTCPDemux(t *testing.T) {
+	for i, test := range demuxTests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newDemuxStack(t)
+			port := uint16(9000 + i)
+
+			var listeners []types.Endpoint
+			for _, bind := range test.binds {
+				ep := newEndpoint(t, s, tcp.ProtocolNumber)
+				defer ep.Close()
+
+				// The port manager doesn't know about Nics, and
+				// wildcard binds conflict with the others unless
+				// the address is reused
+				if err := ep.SetSockOpt(types.ReuseAddressOption(true)); err != nil {
+					t.Fatalf("SetSockOpt failed: %v", err)
+				}
+				bind.Port = port
+				if err := ep.Bind(bind); err != nil {
+					t.Fatalf("Bind(%+v) failed: %v", bind, err)
+				}
+				if err := ep.Listen(8); err != nil {
+					t.Fatalf("Listen failed: %v", err)
+				}
+				listeners = append(listeners, ep)
+			}
+
+			client := newEndpoint(t, s, tcp.ProtocolNumber)
+			defer client.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 1 * time.Second)
+			defer cancel()
+			err := client.ConnectContext(ctx, types.FullAddress{Address: test.dst, Port: port})
+			if test.want == -1 {
+				if err == nil {
+					t.Fatalf("ConnectContext succeeded, want it to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ConnectContext failed: %v", err)
+			}
+
+			// The connection may still be on its way to the accept
+			// queue
+			for deadline := time.Now().Add(1 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+				for j, l := range listeners {
+					if ep, _, err := l.Accept(); err == nil {
+						ep.Close()
+						if j != test.want {
+							t.Errorf("listener %d accepted the connection, want %d", j, test.want)
+						}
+						return
+					}
+				}
+			}
+			t.Errorf("no listener accepted the connection, want %d", test.want)
+		})
+	}
+}
@@ -23,12 +23,29 @@ type TransportProtocol interface {
 	// ParsePorts returns the source and destination ports stored in a
 	// packet of this protocol
 	ParsePorts(v buffer.View) (src, dst uint16, err error)
+
+	// HandleUnknownDestinationPacket handles packets targeted at this
+	// protocol but that don't match any existing endpoint
+	HandleUnknownDestinationPacket(r *types.Route, id types.TransportEndpointId, vv *buffer.VectorisedView)
 }
 
 // TransportProtocolFactory functions are used by the stack to instantiate
 // transport protocol
 type TransportProtocolFactory func() TransportProtocol
 
+// RawEndpointFactory functions are used by the stack to create raw endpoints
+type RawEndpointFactory func(stack *Stack, network types.NetworkProtocolNumber, transport types.TransportProtocolNumber, waiterQueue *waiter.Queue) (types.Endpoint, error)
+
+// PacketEndpointFactory functions are used by the stack to create packet
+// endpoints
+type PacketEndpointFactory func(stack *Stack, netProto types.NetworkProtocolNumber, waiterQueue *waiter.Queue) (types.Endpoint, error)
+
 type TransportProtocolState struct {
 	Protocol 		TransportProtocol
+	DefaultHandler	TransportProtocolHandler
 }
+
+// TransportProtocolHandler is given the packets of a transport protocol which
+// no endpoint wants. It returns true if it registered an endpoint for the
+// packet, which is then delivered again
+type TransportProtocolHandler func(r *types.Route, id types.TransportEndpointId, vv *buffer.VectorisedView) bool
@@ -0,0 +1,335 @@
+// Package packet provides packet endpoints, the counterpart of linux's
+// AF_PACKET sockets in SOCK_DGRAM mode. A packet endpoint receives a copy of
+// the frames handed to the NICs by their link endpoints, before the stack
+// handles them, and writes frames straight to a link endpoint. The link header
+// is neither received nor written: it's handled by the link endpoint.
+//
+// The addresses used by packet endpoints hold the link address of the peer,
+// while their Port holds the network protocol number (i.e., the ethertype) of
+// the frame. To use it, link this package in and call stack.NewPacketEndpoint()
+package packet
+
+import (
+	"context"
+	"sync"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/ilist"
+	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/types"
+	"github.com/YaoZengzeng/yustack/waiter"
+)
+
+// packet is a frame waiting to be read
+type packet struct {
+	ilist.Entry
+	senderAddress	types.FullAddress
+	data			buffer.View
+}
+
+// endpoint represents a packet endpoint. It is legal to have concurrent
+// goroutines make calls into the endpoint
+type endpoint struct {
+	// The following fields are initialized at creation time and do not
+	// change throughout the lifetime of the endpoint
+	stack			*stack.Stack
+	waiterQueue		*waiter.Queue
+
+	// The following fields are used to manage the receive, and are
+	// protected by rcvMu
+	rcvMu			sync.Mutex
+	rcvList			ilist.List
+	rcvBufSizeMax	int
+	rcvBufSize		int
+	rcvClosed		bool
+
+	// The following fields are protected by the mu mutex. The endpoint
+	// is registered with bindNicId (0 for all NICs) for netProto (0 for
+	// all protocols)
+	mu				sync.RWMutex
+	closed			bool
+	bindNicId		types.NicId
+	netProto		types.NetworkProtocolNumber
+}
+
+func newEndpoint(s *stack.Stack, netProto types.NetworkProtocolNumber, waiterQueue *waiter.Queue) (types.Endpoint, error) {
+	e := &endpoint{
+		stack:			s,
+		waiterQueue:	waiterQueue,
+		rcvBufSizeMax:	32 * 1024,
+		netProto:		netProto,
+	}
+
+	// Like linux, packet endpoints receive frames from all the NICs as
+	// soon as they're created
+	if err := s.RegisterPacketEndpoint(0, netProto, e); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// HandlePacket is called by the stack when a frame the endpoint registered for
+// arrives
+func (e *endpoint) HandlePacket(nicid types.NicId, remoteLinkAddr types.LinkAddress, protocol types.NetworkProtocolNumber, vv *buffer.VectorisedView) {
+	// The frame is shared with the stack, so it's copied
+	data := vv.ToView()
+
+	e.rcvMu.Lock()
+
+	// Drop the frame if our buffer is currently full
+	if e.rcvClosed || e.rcvBufSize >= e.rcvBufSizeMax {
+		e.rcvMu.Unlock()
+		e.stack.DropPacket(types.DropReceiveBufferFull, &stack.PacketInfo{Nic: nicid, NetworkProtocol: protocol, Size: len(data)})
+		return
+	}
+
+	wasEmpty := e.rcvBufSize == 0
+
+	e.rcvList.PushBack(&packet{
+		senderAddress:	types.FullAddress{
+			Nic:		nicid,
+			Address:	types.Address(remoteLinkAddr),
+			Port:		uint16(protocol),
+		},
+		data:			data,
+	})
+	e.rcvBufSize += len(data)
+
+	e.rcvMu.Unlock()
+
+	// Notify any waiters that there's data to be read now
+	if wasEmpty {
+		e.waiterQueue.Notify(waiter.EventIn)
+	}
+}
+
+// Read reads a frame from the endpoint. This method does not block if there is
+// no frame pending
+func (e *endpoint) Read(address *types.FullAddress) (buffer.View, error) {
+	e.rcvMu.Lock()
+
+	if e.rcvList.Empty() {
+		err := types.ErrWouldBlock
+		if e.rcvClosed {
+			err = types.ErrClosedForReceive
+		}
+		e.rcvMu.Unlock()
+		return buffer.View{}, err
+	}
+
+	p := e.rcvList.Front().(*packet)
+	e.rcvList.Remove(p)
+	e.rcvBufSize -= len(p.data)
+
+	e.rcvMu.Unlock()
+
+	if address != nil {
+		*address = p.senderAddress
+	}
+
+	return p.data, nil
+}
+
+// Write writes a frame to the link address to.Address, through the Nic to.Nic
+// or the one the endpoint is bound to. The network protocol of the frame is
+// to.Port, or the one of the endpoint if it's 0
+func (e *endpoint) Write(v buffer.View, to *types.FullAddress) (uintptr, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return 0, types.ErrClosedForSend
+	}
+
+	if to == nil {
+		return 0, types.ErrDestinationRequired
+	}
+
+	nicid := to.Nic
+	if nicid == 0 {
+		nicid = e.bindNicId
+	}
+
+	protocol := types.NetworkProtocolNumber(to.Port)
+	if protocol == 0 {
+		protocol = e.netProto
+	}
+
+	if nicid == 0 || protocol == 0 {
+		return 0, types.ErrDestinationRequired
+	}
+
+	if err := e.stack.WriteRawPacket(nicid, types.LinkAddress(to.Address), protocol, v); err != nil {
+		return 0, err
+	}
+
+	return uintptr(len(v)), nil
+}
+
+// ReadContext reads a frame from the endpoint, blocking until one is available
+func (e *endpoint) ReadContext(ctx context.Context, address *types.FullAddress) (buffer.View, error) {
+	var v buffer.View
+	err := types.BlockingCall(ctx, e.waiterQueue, waiter.EventIn, func() error {
+		var err error
+		v, err = e.Read(address)
+		return err
+	})
+
+	return v, err
+}
+
+// WriteContext writes a frame. Packet endpoints never block on writes, so it
+// only differs from Write by honouring an already cancelled ctx
+func (e *endpoint) WriteContext(ctx context.Context, v buffer.View, to *types.FullAddress) (uintptr, error) {
+	var n uintptr
+	err := types.BlockingCall(ctx, e.waiterQueue, waiter.EventOut, func() error {
+		var err error
+		n, err = e.Write(v, to)
+		return err
+	})
+
+	return n, err
+}
+
+// Bind restricts the frames received to the ones of the Nic address.Nic and,
+// if address.Port isn't 0, of the network protocol address.Port. The address
+// is ignored
+func (e *endpoint) Bind(address types.FullAddress) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return types.ErrInvalidEndpointState
+	}
+
+	protocol := e.netProto
+	if address.Port != 0 {
+		protocol = types.NetworkProtocolNumber(address.Port)
+	}
+
+	// Register with the new Nic first, so that a failure leaves the
+	// endpoint as it was
+	if err := e.stack.RegisterPacketEndpoint(address.Nic, protocol, e); err != nil {
+		return err
+	}
+	e.stack.UnregisterPacketEndpoint(e.bindNicId, e.netProto, e)
+
+	e.bindNicId = address.Nic
+	e.netProto = protocol
+
+	return nil
+}
+
+// Connect is not supported by packet endpoints, it just fails
+func (*endpoint) Connect(types.FullAddress) error {
+	return types.ErrNotSupported
+}
+
+// ConnectContext is not supported by packet endpoints, it just fails
+func (*endpoint) ConnectContext(context.Context, types.FullAddress) error {
+	return types.ErrNotSupported
+}
+
+// Listen is not supported by packet endpoints, it just fails
+func (*endpoint) Listen(int) error {
+	return types.ErrNotSupported
+}
+
+// Accept is not supported by packet endpoints, it just fails
+func (*endpoint) Accept() (types.Endpoint, *waiter.Queue, error) {
+	return nil, nil, types.ErrNotSupported
+}
+
+// AcceptContext is not supported by packet endpoints, it just fails
+func (*endpoint) AcceptContext(context.Context) (types.Endpoint, *waiter.Queue, error) {
+	return nil, nil, types.ErrNotSupported
+}
+
+// Shutdown is not supported by packet endpoints, it just fails
+func (*endpoint) Shutdown(types.ShutdownFlags) error {
+	return types.ErrNotSupported
+}
+
+// Close puts the endpoint in a closed state and frees all resources
+// associated with it
+func (e *endpoint) Close() {
+	e.mu.Lock()
+	if !e.closed {
+		e.stack.UnregisterPacketEndpoint(e.bindNicId, e.netProto, e)
+	}
+	e.closed = true
+	e.mu.Unlock()
+
+	// Drop the pending frames, then wake up the waiters so that they see
+	// the endpoint is closed
+	e.rcvMu.Lock()
+	e.rcvClosed = true
+	e.rcvBufSize = 0
+	e.rcvList.Reset()
+	e.rcvMu.Unlock()
+
+	e.waiterQueue.Notify(waiter.EventIn | waiter.EventOut)
+}
+
+// Abort implements types.AbortableEndpoint.Abort. It's called once the Nic the
+// endpoint is bound to is removed, and shuts down the receive side, waking the
+// waiters up so that the blocked reads return
+func (e *endpoint) Abort(error) {
+	e.rcvMu.Lock()
+	e.rcvClosed = true
+	e.rcvMu.Unlock()
+
+	e.waiterQueue.Notify(waiter.EventIn | waiter.EventOut)
+}
+
+// SetSockOpt implements types.Endpoint.SetSockOpt
+func (e *endpoint) SetSockOpt(opt interface{}) error {
+	switch v := opt.(type) {
+	case types.ReceiveBufferSizeOption:
+		e.rcvMu.Lock()
+		e.rcvBufSizeMax = int(v)
+		e.rcvMu.Unlock()
+		return nil
+	}
+
+	return types.ErrUnknownProtocolOption
+}
+
+// GetSockOpt implements types.Endpoint.GetSockOpt
+func (e *endpoint) GetSockOpt(opt interface{}) error {
+	switch v := opt.(type) {
+	case types.ErrorOption:
+		return nil
+
+	case *types.ReceiveBufferSizeOption:
+		e.rcvMu.Lock()
+		*v = types.ReceiveBufferSizeOption(e.rcvBufSizeMax)
+		e.rcvMu.Unlock()
+		return nil
+	}
+
+	return types.ErrUnknownProtocolOption
+}
+
+// GetLocalAddress returns the Nic and the network protocol the endpoint is
+// bound to
+func (e *endpoint) GetLocalAddress() (types.FullAddress, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return types.FullAddress{
+		Nic:	e.bindNicId,
+		Port:	uint16(e.netProto),
+	}, nil
+}
+
+// GetRemoteAddress is not supported by packet endpoints as they can't be
+// connected, it just fails
+func (*endpoint) GetRemoteAddress() (types.FullAddress, error) {
+	return types.FullAddress{}, types.ErrNotConnected
+}
+
+func init() {
+	stack.RegisterPacketEndpointFactory(newEndpoint)
+}
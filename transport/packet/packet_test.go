@@ -0,0 +1,105 @@
+package packet_test
+
+import (
+	"testing"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/header"
+	"github.com/YaoZengzeng/yustack/link/loopback"
+	"github.com/YaoZengzeng/yustack/network/ipv4"
+	"github.com/YaoZengzeng/yustack/stack"
+	_ "github.com/YaoZengzeng/yustack/transport/packet"
+	"github.com/YaoZengzeng/yustack/transport/udp"
+	"github.com/YaoZengzeng/yustack/types"
+	"github.com/YaoZengzeng/yustack/waiter"
+)
+
+const (
+	localhost = "\x7f\x00\x00\x01"
+
+	// lldpProtocol is the ethertype of LLDP, which the stack doesn't know
+	lldpProtocol types.NetworkProtocolNumber = 0x88cc
+)
+
+func newPacketEndpoint(t *testing.T, s *stack.Stack, protocol types.NetworkProtocolNumber) types.Endpoint {
+	var wq waiter.Queue
+	ep, err := s.NewPacketEndpoint(protocol, &wq)
+	if err != nil {
+		t.Fatalf("NewPacketEndpoint failed: %v", err)
+	}
+
+	return ep
+}
+
+func TestCaptureAndInject(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName})
+	if err := s.CreateNic(1, loopback.New()); err != nil {
+		t.Fatalf("CreateNic failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, localhost); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	all := newPacketEndpoint(t, s, 0)
+	defer all.Close()
+	ip := newPacketEndpoint(t, s, ipv4.ProtocolNumber)
+	defer ip.Close()
+	if err := ip.Bind(types.FullAddress{Nic: 1}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	// A datagram sent by the stack is captured by both endpoints
+	var wq waiter.Queue
+	sender, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer sender.Close()
+	if _, err := sender.Write(buffer.View("hello"), &types.FullAddress{Address: localhost, Port: 1234}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	for _, ep := range []types.Endpoint{all, ip} {
+		var addr types.FullAddress
+		v, err := ep.Read(&addr)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if addr.Nic != 1 || types.NetworkProtocolNumber(addr.Port) != ipv4.ProtocolNumber {
+			t.Errorf("got sender %+v, want an ipv4 frame from nic 1", addr)
+		}
+		if h := header.IPv4(v); !h.IsValid(len(v)) || h.TransportProtocol() != udp.ProtocolNumber {
+			t.Errorf("got %x, want the udp datagram", []byte(v))
+		}
+	}
+
+	// An injected frame of an unknown protocol is only captured by the
+	// endpoint receiving all protocols, and isn't counted as a drop
+	frame := buffer.View("lldp frame")
+	if n, err := all.Write(frame, &types.FullAddress{Nic: 1, Port: uint16(lldpProtocol)}); err != nil || int(n) != len(frame) {
+		t.Fatalf("Write returned %v, %v, want %d", n, err, len(frame))
+	}
+
+	var addr types.FullAddress
+	if v, err := all.Read(&addr); err != nil || string(v) != string(frame) || types.NetworkProtocolNumber(addr.Port) != lldpProtocol {
+		t.Errorf("Read returned %q from %+v, %v, want the lldp frame", v, addr, err)
+	}
+	if _, err := ip.Read(nil); err != types.ErrWouldBlock {
+		t.Errorf("the ipv4 endpoint got the lldp frame, err = %v", err)
+	}
+	if got := s.Stats().DroppedPackets[types.DropUnknownNetworkProtocol].Value(); got != 0 {
+		t.Errorf("DroppedPackets[%v] = %v, want 0", types.DropUnknownNetworkProtocol, got)
+	}
+
+	// Injected frames go through the Nic
+	if stats, _ := s.NicStats(1); stats.Tx.Packets.Value() != 2 {
+		t.Errorf("Tx.Packets = %v, want 2", stats.Tx.Packets.Value())
+	}
+
+	if _, err := all.Write(frame, &types.FullAddress{Port: uint16(lldpProtocol)}); err != types.ErrDestinationRequired {
+		t.Errorf("Write without a Nic returned %v, want %v", err, types.ErrDestinationRequired)
+	}
+	if err := ip.Bind(types.FullAddress{Nic: 2}); err != types.ErrUnknownNicId {
+		t.Errorf("Bind to an unknown Nic returned %v, want %v", err, types.ErrUnknownNicId)
+	}
+}
@@ -0,0 +1,411 @@
+// Package raw provides raw IP endpoints, the counterpart of linux's SOCK_RAW
+// sockets. A raw endpoint receives a copy of every packet of its transport
+// protocol, along with the endpoints of the protocol itself, and writes
+// packets whose transport header is built by the user. To use it, link this
+// package in and call stack.NewRawEndpoint()
+package raw
+
+import (
+	"context"
+	"sync"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/header"
+	"github.com/YaoZengzeng/yustack/ilist"
+	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/types"
+	"github.com/YaoZengzeng/yustack/waiter"
+)
+
+// rawPacket is a packet waiting to be read
+type rawPacket struct {
+	ilist.Entry
+	senderAddress	types.FullAddress
+	data			buffer.View
+}
+
+// endpoint represents a raw endpoint. Like the udp one, it is legal to have
+// concurrent goroutines make calls into the endpoint
+type endpoint struct {
+	// The following fields are initialized at creation time and do not
+	// change throughout the lifetime of the endpoint
+	stack			*stack.Stack
+	netProtocol		types.NetworkProtocolNumber
+	transProtocol	types.TransportProtocolNumber
+	waiterQueue		*waiter.Queue
+
+	// The following fields are used to manage the receive, and are
+	// protected by rcvMu
+	rcvMu			sync.Mutex
+	rcvList			ilist.List
+	rcvBufSizeMax	int
+	rcvBufSize		int
+	rcvClosed		bool
+
+	// The following fields are protected by the mu mutex
+	mu				sync.RWMutex
+	closed			bool
+	bindNicId		types.NicId
+	bindAddr		types.Address
+	connected		bool
+	remote			types.FullAddress
+	hdrIncl			bool
+	rcvHeader		bool
+	ttl				uint8
+}
+
+func newEndpoint(s *stack.Stack, netProtocol types.NetworkProtocolNumber, transProtocol types.TransportProtocolNumber, waiterQueue *waiter.Queue) (types.Endpoint, error) {
+	if netProtocol != header.IPv4ProtocolNumber {
+		return nil, types.ErrNotSupported
+	}
+
+	e := &endpoint{
+		stack:			s,
+		netProtocol:	netProtocol,
+		transProtocol:	transProtocol,
+		waiterQueue:	waiterQueue,
+		rcvBufSizeMax:	32 * 1024,
+		rcvHeader:		true,
+	}
+
+	// Like linux, raw endpoints receive packets as soon as they're created
+	if err := s.RegisterRawTransportEndpoint(netProtocol, transProtocol, e); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// HandlePacket is called by the stack when a packet of the protocol of the
+// endpoint arrives
+func (e *endpoint) HandlePacket(r *types.Route, vv *buffer.VectorisedView) {
+	e.mu.RLock()
+	accept := (e.bindNicId == 0 || e.bindNicId == r.NicId()) &&
+		(e.bindAddr == "" || e.bindAddr == r.LocalAddress) &&
+		(!e.connected || e.remote.Address == r.RemoteAddress)
+	rcvHeader := e.rcvHeader
+	e.mu.RUnlock()
+
+	if !accept {
+		return
+	}
+
+	// The packet is shared with the other endpoints, so it's copied
+	data := vv.ToView()
+	if !rcvHeader {
+		data.TrimFront(int(header.IPv4(data).HeaderLength()))
+	}
+
+	e.rcvMu.Lock()
+
+	// Drop the packet if our buffer is currently full
+	if e.rcvClosed || e.rcvBufSize >= e.rcvBufSizeMax {
+		e.rcvMu.Unlock()
+		e.stack.DropPacket(types.DropReceiveBufferFull, stack.NewPacketInfo(r, e.transProtocol, types.TransportEndpointId{LocalAddress: r.LocalAddress, RemoteAddress: r.RemoteAddress}, len(data)))
+		return
+	}
+
+	wasEmpty := e.rcvBufSize == 0
+
+	e.rcvList.PushBack(&rawPacket{
+		senderAddress:	types.FullAddress{
+			Nic:		r.NicId(),
+			Address:	r.RemoteAddress,
+		},
+		data:			data,
+	})
+	e.rcvBufSize += len(data)
+
+	e.rcvMu.Unlock()
+
+	// Notify any waiters that there's data to be read now
+	if wasEmpty {
+		e.waiterQueue.Notify(waiter.EventIn)
+	}
+}
+
+// Read reads a packet from the endpoint. This method does not block if there
+// is no packet pending
+func (e *endpoint) Read(address *types.FullAddress) (buffer.View, error) {
+	e.rcvMu.Lock()
+
+	if e.rcvList.Empty() {
+		err := types.ErrWouldBlock
+		if e.rcvClosed {
+			err = types.ErrClosedForReceive
+		}
+		e.rcvMu.Unlock()
+		return buffer.View{}, err
+	}
+
+	p := e.rcvList.Front().(*rawPacket)
+	e.rcvList.Remove(p)
+	e.rcvBufSize -= len(p.data)
+
+	e.rcvMu.Unlock()
+
+	if address != nil {
+		*address = p.senderAddress
+	}
+
+	return p.data, nil
+}
+
+// Write writes a packet to the given address, or to the address the endpoint
+// is connected to if to is nil. Unless IPHdrInclOption is set, v holds the
+// transport header and payload, and the network header is added by the stack
+func (e *endpoint) Write(v buffer.View, to *types.FullAddress) (uintptr, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return 0, types.ErrClosedForSend
+	}
+
+	if to == nil {
+		if !e.connected {
+			return 0, types.ErrDestinationRequired
+		}
+		to = &e.remote
+	}
+
+	nicid := to.Nic
+	if nicid == 0 {
+		nicid = e.bindNicId
+	}
+
+	route, err := e.stack.FindRoute(nicid, e.bindAddr, to.Address, e.netProtocol)
+	if err != nil {
+		return 0, err
+	}
+
+	route.TTL = e.ttl
+
+	if e.hdrIncl {
+		// The network endpoint fixes up the header, don't touch the
+		// caller's buffer
+		if err := route.WriteHeaderIncludedPacket(append(buffer.View(nil), v...)); err != nil {
+			return 0, err
+		}
+		return uintptr(len(v)), nil
+	}
+
+	hdr := buffer.NewPrependable(int(route.MaxHeaderLength()))
+	if err := route.WritePacket(&hdr, v, e.transProtocol); err != nil {
+		return 0, err
+	}
+
+	return uintptr(len(v)), nil
+}
+
+// ReadContext reads a packet from the endpoint, blocking until one is
+// available
+func (e *endpoint) ReadContext(ctx context.Context, address *types.FullAddress) (buffer.View, error) {
+	var v buffer.View
+	err := types.BlockingCall(ctx, e.waiterQueue, waiter.EventIn, func() error {
+		var err error
+		v, err = e.Read(address)
+		return err
+	})
+
+	return v, err
+}
+
+// WriteContext writes a packet to the given address. Raw endpoints never block
+// on writes, so it only differs from Write by honouring an already cancelled ctx
+func (e *endpoint) WriteContext(ctx context.Context, v buffer.View, to *types.FullAddress) (uintptr, error) {
+	var n uintptr
+	err := types.BlockingCall(ctx, e.waiterQueue, waiter.EventOut, func() error {
+		var err error
+		n, err = e.Write(v, to)
+		return err
+	})
+
+	return n, err
+}
+
+// Bind restricts the packets received to the ones sent to the given address and
+// Nic, both optional. The address is also used as the source of the packets
+// written. The port is ignored
+func (e *endpoint) Bind(address types.FullAddress) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return types.ErrInvalidEndpointState
+	}
+
+	e.bindNicId = address.Nic
+	e.bindAddr = address.Address
+
+	return nil
+}
+
+// Connect sets the default destination of the packets written, and restricts
+// the packets received to the ones sent from that address. The port is ignored
+func (e *endpoint) Connect(address types.FullAddress) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return types.ErrInvalidEndpointState
+	}
+
+	e.remote = types.FullAddress{Nic: address.Nic, Address: address.Address}
+	e.connected = true
+
+	return nil
+}
+
+// ConnectContext is like Connect, which never blocks for raw endpoints
+func (e *endpoint) ConnectContext(ctx context.Context, address types.FullAddress) error {
+	if ctx.Err() != nil {
+		return types.ErrAborted
+	}
+
+	return e.Connect(address)
+}
+
+// Listen is not supported by raw endpoints, it just fails
+func (*endpoint) Listen(int) error {
+	return types.ErrNotSupported
+}
+
+// Accept is not supported by raw endpoints, it just fails
+func (*endpoint) Accept() (types.Endpoint, *waiter.Queue, error) {
+	return nil, nil, types.ErrNotSupported
+}
+
+// AcceptContext is not supported by raw endpoints, it just fails
+func (*endpoint) AcceptContext(context.Context) (types.Endpoint, *waiter.Queue, error) {
+	return nil, nil, types.ErrNotSupported
+}
+
+// Shutdown is not supported by raw endpoints, it just fails
+func (*endpoint) Shutdown(types.ShutdownFlags) error {
+	return types.ErrNotSupported
+}
+
+// Close puts the endpoint in a closed state and frees all resources
+// associated with it
+func (e *endpoint) Close() {
+	e.mu.Lock()
+	if !e.closed {
+		e.stack.UnregisterRawTransportEndpoint(e.netProtocol, e.transProtocol, e)
+	}
+	e.closed = true
+	e.mu.Unlock()
+
+	// Drop the pending packets, then wake up the waiters so that they see
+	// the endpoint is closed
+	e.rcvMu.Lock()
+	e.rcvClosed = true
+	e.rcvBufSize = 0
+	e.rcvList.Reset()
+	e.rcvMu.Unlock()
+
+	e.waiterQueue.Notify(waiter.EventIn | waiter.EventOut)
+}
+
+// Abort implements types.AbortableEndpoint.Abort. The endpoint
+// finds a route for every write, so there's none to release. The receive side
+// is shut down, and the waiters are woken up so that the blocked reads return
+func (e *endpoint) Abort(error) {
+	e.rcvMu.Lock()
+	e.rcvClosed = true
+	e.rcvMu.Unlock()
+
+	e.waiterQueue.Notify(waiter.EventIn | waiter.EventOut)
+}
+
+// SetSockOpt implements types.Endpoint.SetSockOpt
+func (e *endpoint) SetSockOpt(opt interface{}) error {
+	switch v := opt.(type) {
+	case types.TTLOption:
+		e.mu.Lock()
+		e.ttl = uint8(v)
+		e.mu.Unlock()
+		return nil
+
+	case types.IPHdrInclOption:
+		e.mu.Lock()
+		e.hdrIncl = bool(v)
+		e.mu.Unlock()
+		return nil
+
+	case types.ReceiveIPHeaderOption:
+		e.mu.Lock()
+		e.rcvHeader = bool(v)
+		e.mu.Unlock()
+		return nil
+
+	case types.ReceiveBufferSizeOption:
+		e.rcvMu.Lock()
+		e.rcvBufSizeMax = int(v)
+		e.rcvMu.Unlock()
+		return nil
+	}
+
+	return types.ErrUnknownProtocolOption
+}
+
+// GetSockOpt implements types.Endpoint.GetSockOpt
+func (e *endpoint) GetSockOpt(opt interface{}) error {
+	switch v := opt.(type) {
+	case types.ErrorOption:
+		return nil
+
+	case *types.TTLOption:
+		e.mu.RLock()
+		*v = types.TTLOption(e.ttl)
+		e.mu.RUnlock()
+		return nil
+
+	case *types.IPHdrInclOption:
+		e.mu.RLock()
+		*v = types.IPHdrInclOption(e.hdrIncl)
+		e.mu.RUnlock()
+		return nil
+
+	case *types.ReceiveIPHeaderOption:
+		e.mu.RLock()
+		*v = types.ReceiveIPHeaderOption(e.rcvHeader)
+		e.mu.RUnlock()
+		return nil
+
+	case *types.ReceiveBufferSizeOption:
+		e.rcvMu.Lock()
+		*v = types.ReceiveBufferSizeOption(e.rcvBufSizeMax)
+		e.rcvMu.Unlock()
+		return nil
+	}
+
+	return types.ErrUnknownProtocolOption
+}
+
+// GetLocalAddress returns the address to which the endpoint is bound
+func (e *endpoint) GetLocalAddress() (types.FullAddress, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return types.FullAddress{
+		Nic:		e.bindNicId,
+		Address:	e.bindAddr,
+	}, nil
+}
+
+// GetRemoteAddress returns the address to which the endpoint is connected
+func (e *endpoint) GetRemoteAddress() (types.FullAddress, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if !e.connected {
+		return types.FullAddress{}, types.ErrNotConnected
+	}
+
+	return e.remote, nil
+}
+
+func init() {
+	stack.RegisterRawEndpointFactory(newEndpoint)
+}
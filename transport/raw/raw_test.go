@@ -0,0 +1,180 @@
+package raw_test
+
+import (
+	"testing"
+
+	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/header"
+	"github.com/YaoZengzeng/yustack/link/loopback"
+	"github.com/YaoZengzeng/yustack/network/ipv4"
+	"github.com/YaoZengzeng/yustack/stack"
+	_ "github.com/YaoZengzeng/yustack/transport/raw"
+	"github.com/YaoZengzeng/yustack/transport/udp"
+	"github.com/YaoZengzeng/yustack/types"
+	"github.com/YaoZengzeng/yustack/waiter"
+)
+
+const (
+	localhost = "\x7f\x00\x00\x01"
+
+	// testProtocol is a transport protocol unknown to the stack
+	testProtocol types.TransportProtocolNumber = 253
+)
+
+func newStack(t *testing.T) *stack.Stack {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{udp.ProtocolName})
+	if err := s.CreateNic(1, loopback.New()); err != nil {
+		t.Fatalf("CreateNic failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, localhost); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	return s
+}
+
+func newRawEndpoint(t *testing.T, s *stack.Stack, protocol types.TransportProtocolNumber) types.Endpoint {
+	var wq waiter.Queue
+	ep, err := s.NewRawEndpoint(ipv4.ProtocolNumber, protocol, &wq)
+	if err != nil {
+		t.Fatalf("NewRawEndpoint failed: %v", err)
+	}
+
+	return ep
+}
+
+func read(t *testing.T, ep types.Endpoint) buffer.View {
+	var addr types.FullAddress
+	v, err := ep.Read(&addr)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if addr.Address != localhost || addr.Nic != 1 {
+		t.Errorf("got sender %+v, want localhost on nic 1", addr)
+	}
+
+	return v
+}
+
+func TestReceiveWithAndWithoutHeader(t *testing.T) {
+	s := newStack(t)
+
+	withHeader := newRawEndpoint(t, s, testProtocol)
+	defer withHeader.Close()
+	withoutHeader := newRawEndpoint(t, s, testProtocol)
+	defer withoutHeader.Close()
+	if err := withoutHeader.SetSockOpt(types.ReceiveIPHeaderOption(false)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+
+	sender := newRawEndpoint(t, s, testProtocol)
+	defer sender.Close()
+	if _, err := sender.Write(buffer.View("hello"), &types.FullAddress{Address: localhost}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	ip := header.IPv4(read(t, withHeader))
+	if len(ip) != header.IPv4MinimumSize + 5 || ip.TransportProtocol() != testProtocol || string(ip.Payload()) != "hello" {
+		t.Errorf("got packet %x, want an ipv4 packet of protocol %d holding hello", []byte(ip), testProtocol)
+	}
+
+	if v := read(t, withoutHeader); string(v) != "hello" {
+		t.Errorf("got %q, want hello", v)
+	}
+
+	// The protocol is unknown to the stack, but the packet was wanted
+	if got := s.Stats().DroppedPackets[types.DropUnknownTransportProtocol].Value(); got != 0 {
+		t.Errorf("DroppedPackets[%v] = %v, want 0", types.DropUnknownTransportProtocol, got)
+	}
+
+	// Once closed, the endpoint stops receiving
+	withoutHeader.Close()
+	if _, err := sender.Write(buffer.View("bye"), &types.FullAddress{Address: localhost}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := withoutHeader.Read(nil); err != types.ErrClosedForReceive {
+		t.Errorf("Read after Close returned %v, want %v", err, types.ErrClosedForReceive)
+	}
+	if v := read(t, withHeader); string(header.IPv4(v).Payload()) != "bye" {
+		t.Errorf("got %x, want the packet holding bye", []byte(v))
+	}
+}
+
+func TestHeaderIncluded(t *testing.T) {
+	s := newStack(t)
+
+	receiver := newRawEndpoint(t, s, testProtocol)
+	defer receiver.Close()
+
+	sender := newRawEndpoint(t, s, testProtocol)
+	defer sender.Close()
+	if err := sender.SetSockOpt(types.IPHdrInclOption(true)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	var hdrIncl types.IPHdrInclOption
+	if err := sender.GetSockOpt(&hdrIncl); err != nil || !bool(hdrIncl) {
+		t.Fatalf("GetSockOpt returned %v, %v, want true", hdrIncl, err)
+	}
+
+	// The source address, the length and the checksum are left to the stack
+	pkt := make(buffer.View, header.IPv4MinimumSize + 5)
+	header.IPv4(pkt).Encode(&header.IPv4Fields{
+		IHL:		header.IPv4MinimumSize,
+		TTL:		32,
+		Protocol:	uint8(testProtocol),
+		SrcAddr:	header.IPv4Any,
+		DstAddr:	localhost,
+	})
+	copy(pkt[header.IPv4MinimumSize:], "world")
+
+	if n, err := sender.Write(pkt, &types.FullAddress{Address: localhost}); err != nil || int(n) != len(pkt) {
+		t.Fatalf("Write returned %v, %v, want %d", n, err, len(pkt))
+	}
+
+	ip := header.IPv4(read(t, receiver))
+	if !ip.IsValid(len(ip)) || ip.TTL() != 32 || ip.SourceAddress() != localhost || string(ip.Payload()) != "world" {
+		t.Errorf("got packet %x, want the packet written with its source filled", []byte(ip))
+	}
+	if ip.CalculateChecksum() != 0xffff {
+		t.Errorf("got checksum %#x, want a valid one", ip.Checksum())
+	}
+}
+
+func TestReceiveCopyOfKnownProtocol(t *testing.T) {
+	s := newStack(t)
+
+	raw := newRawEndpoint(t, s, udp.ProtocolNumber)
+	defer raw.Close()
+	if err := raw.SetSockOpt(types.ReceiveIPHeaderOption(false)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+
+	var wq waiter.Queue
+	receiver, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer receiver.Close()
+	if err := receiver.Bind(types.FullAddress{Address: localhost, Port: 1234}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	sender, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer sender.Close()
+	if _, err := sender.Write(buffer.View("hello"), &types.FullAddress{Address: localhost, Port: 1234}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// Both the raw and the udp endpoints get the datagram
+	u := header.UDP(read(t, raw))
+	if len(u) != header.UDPMinimumSize + 5 || u.DestinationPort() != 1234 {
+		t.Errorf("got %x, want the udp datagram sent to port 1234", []byte(u))
+	}
+
+	if v, err := receiver.Read(nil); err != nil || string(v) != "hello" {
+		t.Errorf("udp Read returned %q, %v, want hello", v, err)
+	}
+}
@@ -7,10 +7,10 @@ import (
 	"hash"
 	"sync"
 	"io"
-	"log"
 	"time"
 
 	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/logger"
 	"github.com/YaoZengzeng/yustack/types"
 	"github.com/YaoZengzeng/yustack/seqnum"
 	"github.com/YaoZengzeng/yustack/sleep"
@@ -149,8 +149,7 @@ func (l *listenContext) createConnectedEndpoint(s *segment, iss seqnum.Value, ir
 	n.rcvBufSize = int(l.rcvWnd)
 
 	// Register new endpoint so that packets are routed to it
-	if err := n.stack.RegisterTransportEndpoint(n.boundNicId, n.effectiveNetProtocols, ProtocolNumber, n.id, n); err != nil {
-		log.Printf("createConnectedEndpoint: RegisterTransportEndpoint failed: %v\n", err)
+	if err := n.stack.RegisterTransportEndpoint(n.boundNicId, n.effectiveNetProtocols, ProtocolNumber, n.id, n, false); err != nil {
 		return nil, err
 	}
 
@@ -181,14 +180,12 @@ func (l *listenContext) createEndpointAndPerformHandshake(s *segment, opts *head
 	// Perform the 3-way handshake
 	h, err := newHandshake(ep, l.rcvWnd)
 	if err != nil {
-		log.Printf("createEndpointAndPerformHandshake: newHandshake failed: %v\n", err)
 		return nil, err
 	}
-	log.Printf("createEndpointAndPerformHandshake: newHandshake succeeded\n")
 
 	h.resetToSynRcvd(cookie, irs, opts)
 	if err := h.execute(); err != nil {
-		log.Printf("createEndpointAndPerformHandshake: handshake execute failed: %v\n", err)
+		l.stack.Logger().Log(logger.LevelDebug, "passive handshake failed", "id", s.id, "err", err)
 		return nil, err
 	}
 
@@ -209,7 +206,7 @@ func (e *endpoint) deliverAccepted(n *endpoint) {
 		e.acceptedChan <- n
 		e.waiterQueue.Notify(waiter.EventIn)
 	} else {
-		log.Printf("deliverAccepted: endpoint's state is not in stateListen, closed\n")
+		e.stack.Logger().Log(logger.LevelDebug, "connection accepted by a closed listener", "id", n.id)
 	}
 	e.mu.RUnlock()
 }
@@ -223,8 +220,10 @@ func (e *endpoint) deliverAccepted(n *endpoint) {
 func (e *endpoint) handleSynSegment(ctx *listenContext, s *segment, opts *header.TCPSynOptions) {
 	n, err := ctx.createEndpointAndPerformHandshake(s, opts)
 	if err != nil {
+		s.route.Stats.TCP.FailedConnectionAttempts.Increment()
 		return
 	}
+	s.route.Stats.TCP.PassiveConnectionOpenings.Increment()
 
 	e.deliverAccepted(n)
 }
@@ -238,7 +237,8 @@ func (e *endpoint) handleListenSegment(ctx *listenContext, s *segment) {
 		go e.handleSynSegment(ctx, s, &opts)
 
 	case flagAck:
-		log.Printf("handleListenSegment: flagAck has not implemented yet\n")
+		// TODO: complete the handshakes answered with SYN cookies
+		e.stack.DropPacket(types.DropUnsupported, stack.NewPacketInfo(&s.route, ProtocolNumber, s.id, s.data.Size()))
 	}
 }
 
@@ -253,7 +253,29 @@ func (e *endpoint) protocolListenLoop(rcvWnd seqnum.Size) error {
 	for {
 		switch index, _ := s.Fetch(true); index {
 		case wakerForNotification:
-			log.Printf("protocolListenLoop: branch wakerForNotification has not implemented yet\n")
+			n := e.fetchNotifications()
+			if n & notifyClose != 0 {
+				// Stop listening, cleanup resets the connections
+				// which haven't been accepted yet and releases
+				// the port
+				e.mu.Lock()
+				e.state = stateClosed
+				e.mu.Unlock()
+				e.completeWorker()
+				return nil
+			}
+			if n & notifyAbort != 0 {
+				// The Nic or the address listened on is gone,
+				// the pending accepts fail
+				e.mu.Lock()
+				e.state = stateError
+				e.hardError = e.abortError
+				e.mu.Unlock()
+				e.waiterQueue.Notify(waiter.EventIn)
+				e.completeWorker()
+				return nil
+			}
+			e.stack.Logger().Log(logger.LevelDebug, "notifications of listening endpoints are not supported yet", "id", e.id, "notifications", n)
 
 		case wakerForNewSegment:
 			// Process at most maxSegmentsPerWake segments
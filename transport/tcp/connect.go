@@ -1,14 +1,15 @@
 package tcp
 
 import (
-	"log"
 	"time"
 	"crypto/rand"
+	"sync/atomic"
 
 	"github.com/YaoZengzeng/yustack/header"
 	"github.com/YaoZengzeng/yustack/seqnum"
 	"github.com/YaoZengzeng/yustack/sleep"
 	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/stack"
 	"github.com/YaoZengzeng/yustack/types"
 	"github.com/YaoZengzeng/yustack/checksum"
 	"github.com/YaoZengzeng/yustack/waiter"
@@ -183,7 +184,6 @@ func (h *handshake) processSegments() error {
 			err = h.synSentState(s)
 		}
 		if err != nil {
-			log.Printf("processSegments failed: %v\n", err)
 			return err
 		}
 
@@ -191,7 +191,6 @@ func (h *handshake) processSegments() error {
 		// otherwise we may process packets meant to be processed by the
 		// main protocol goroutine
 		if h.state == handshakeCompleted {
-			log.Printf("3-way handshake succeed\n")
 			break
 		}
 	}
@@ -236,7 +235,7 @@ func (h *handshake) execute() error {
 	// if h.state == handshakeSynRcvd {
 	//	synOpts.TS = h.ep.sendTSOk
 	// }
-	sendSynTCP(&h.ep.route, h.ep.id, h.flags, h.iss, h.ackNum, h.rcvWnd, synOpts)
+	h.sendSyn(synOpts)
 	for h.state != handshakeCompleted {
 		switch index, _ := s.Fetch(true); index {
 		case wakerForResend:
@@ -245,13 +244,19 @@ func (h *handshake) execute() error {
 				return types.ErrTimeout
 			}
 			rt.Reset(timeOut)
-			sendSynTCP(&h.ep.route, h.ep.id, h.flags, h.iss, h.ackNum, h.rcvWnd, synOpts)
+			h.ep.route.Stats.TCP.Retransmits.Increment()
+			atomic.AddUint64(&h.ep.retransmits, 1)
+			h.sendSyn(synOpts)
 
 		case wakerForNotification:
 			n := h.ep.fetchNotifications()
 			if n & notifyClose != 0 {
 				return types.ErrAborted
 			}
+			if n & notifyAbort != 0 {
+				h.ep.releaseRoute()
+				return h.ep.abortErr()
+			}
 
 		case wakerForNewSegment:
 			if err := h.processSegments(); err != nil {
@@ -263,6 +268,12 @@ func (h *handshake) execute() error {
 	return nil
 }
 
+// sendSyn sends the SYN or SYN-ACK segment of the handshake
+func (h *handshake) sendSyn(synOpts header.TCPSynOptions) error {
+	atomic.AddUint64(&h.ep.segmentsSent, 1)
+	return sendSynTCP(&h.ep.route, h.ep.id, h.flags, h.iss, h.ackNum, h.rcvWnd, synOpts)
+}
+
 func sendSynTCP(r *types.Route, id types.TransportEndpointId, flags byte, seq, ack seqnum.Value, rcvWnd seqnum.Size, opts header.TCPSynOptions) error {
 	// The MSS in opts is ignored as this function is called from many places and
 	// we don't want every call point being embeded with the MSS calculation.
@@ -307,18 +318,19 @@ func sendTCPWithOptions(r *types.Route, id types.TransportEndpointId, data buffe
 	})
 	copy(tcp[header.TCPMinimumSize:], opts)
 
-	length := uint16(hdr.UsedLength())
-	xsum := r.PseudoHeaderChecksum(ProtocolNumber)
-	if data != nil {
-		length += uint16(len(data))
-		xsum = checksum.Checksum(data, xsum)
-	}
+	// Only calculate the checksum if offloading isn't supported
+	if r.Capabilities() & types.CapabilityTXChecksumOffload == 0 {
+		length := uint16(hdr.UsedLength())
+		xsum := r.PseudoHeaderChecksum(ProtocolNumber)
+		if data != nil {
+			length += uint16(len(data))
+			xsum = checksum.Checksum(data, xsum)
+		}
 
-	tcp.SetChecksum(^tcp.CalculateChecksum(xsum, length))
-	
-	log.Printf("Send SYN segment\n")
+		tcp.SetChecksum(^tcp.CalculateChecksum(xsum, length))
+	}
 
-	return r.WritePacket(&hdr, data, ProtocolNumber)
+	return writeSegment(r, &hdr, data, flags)
 }
 
 func parseSynSegmentOptions(s *segment) header.TCPSynOptions {
@@ -340,7 +352,10 @@ func (e *endpoint) handleSegments() bool {
 		}
 
 		if s.flagIsSet(flagRst) {
-			log.Printf("handleSegments: RST segment can not be handled now")
+			e.route.Stats.TCP.ResetsReceived.Increment()
+			// TODO: reset the connection as described in RFC 793,
+			// page 37
+			e.stack.DropPacket(types.DropUnsupported, stack.NewPacketInfo(&s.route, ProtocolNumber, s.id, s.data.Size()))
 			return false	
 		} else if s.flagIsSet(flagAck) {
 			// RFC 793, page 41 states that "once in the ESTABLISHED
@@ -392,6 +407,13 @@ func (e *endpoint) resetConnection(err error) {
 	e.mu.Unlock()
 }
 
+// releaseRoute drops the route of the endpoint, whose Nic or local address is
+// gone, only keeping the counters of the stack
+// This method must only be called from the protocol goroutine
+func (e *endpoint) releaseRoute() {
+	e.route = types.Route{Stats: e.route.Stats}
+}
+
 // completeWorker is called by the worker goroutine when it's about to exit. It
 // marks the worker as completed and performs cleanup work if requested by Close()
 func (e *endpoint) completeWorker() {
@@ -424,12 +446,24 @@ func (e *endpoint) protocolMainLoop(passive bool) error {
 		// This is an active connection, so we must initialize the 3-way
 		// handshake, and then inform potential waiters about its completion
 		h, err := newHandshake(e, seqnum.Size(e.receiveBufferAvailable()))
-		if err != nil {
-			return err
+		if err == nil {
+			err = h.execute()
 		}
 
-		err = h.execute()
 		if err != nil {
+			e.route.Stats.TCP.FailedConnectionAttempts.Increment()
+
+			// Report the failure to the waiters of the connect
+			// attempt via GetSockOpt(ErrorOption)
+			e.lastErrorMu.Lock()
+			e.lastError = err
+			e.lastErrorMu.Unlock()
+
+			e.mu.Lock()
+			e.state = stateError
+			e.hardError = err
+			e.mu.Unlock()
+
 			return err
 		}
 
@@ -488,6 +522,17 @@ func (e *endpoint) protocolMainLoop(passive bool) error {
 					e.rcv.pendingBufSize = seqnum.Size(e.receiveBufferSize())
 				}
 
+				if n & notifyAbort != 0 {
+					// The Nic or the address of the connection
+					// is gone
+					e.mu.Lock()
+					e.releaseRoute()
+					e.state = stateError
+					e.hardError = e.abortError
+					e.mu.Unlock()
+					return false
+				}
+
 				if n & notifyClose != 0 && closeTimer == nil {
 					// Reset the connection 3 seconds after the
 					// endpoint has been closed
@@ -573,19 +618,38 @@ func sendTCP(r *types.Route, id types.TransportEndpointId, data buffer.View, fla
 		WindowSize: uint16(rcvWnd),
 	})
 
-	length := uint16(hdr.UsedLength())
-	xsum := r.PseudoHeaderChecksum(ProtocolNumber)
-	if data != nil {
-		length += uint16(len(data))
-		xsum = checksum.Checksum(data, xsum)
+	// Only calculate the checksum if offloading isn't supported
+	if r.Capabilities() & types.CapabilityTXChecksumOffload == 0 {
+		length := uint16(hdr.UsedLength())
+		xsum := r.PseudoHeaderChecksum(ProtocolNumber)
+		if data != nil {
+			length += uint16(len(data))
+			xsum = checksum.Checksum(data, xsum)
+		}
+
+		tcp.SetChecksum(^tcp.CalculateChecksum(xsum, length))
 	}
 
-	tcp.SetChecksum(^tcp.CalculateChecksum(xsum, length))
+	return writeSegment(r, &hdr, data, flags)
+}
+
+// writeSegment writes a TCP segment whose header is already built to the
+// route, and counts it
+func writeSegment(r *types.Route, hdr *buffer.Prependable, data buffer.View, flags byte) error {
+	if err := r.WritePacket(hdr, data, ProtocolNumber); err != nil {
+		return err
+	}
 
-	return r.WritePacket(&hdr, data, ProtocolNumber)
+	r.Stats.TCP.SegmentsSent.Increment()
+	if flags & flagRst != 0 {
+		r.Stats.TCP.ResetsSent.Increment()
+	}
+
+	return nil
 }
 
 // sendRaw sends a TCP segment to the endpoint's peer
 func (e *endpoint) sendRaw(data buffer.View, flags byte, seq, ack seqnum.Value, rcvWnd seqnum.Size) error {
+	atomic.AddUint64(&e.segmentsSent, 1)
 	return sendTCP(&e.route, e.id, data, flags, seq, ack, rcvWnd)
 }
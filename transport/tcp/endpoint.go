@@ -1,14 +1,17 @@
 package tcp
 
 import (
+	"context"
 	"sync"
-	"log"
 	"sync/atomic"
 
 	"github.com/YaoZengzeng/yustack/seqnum"
 	"github.com/YaoZengzeng/yustack/sleep"
 	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/checksum"
 	"github.com/YaoZengzeng/yustack/stack"
+	"github.com/YaoZengzeng/yustack/logger"
+	"github.com/YaoZengzeng/yustack/ports"
 	"github.com/YaoZengzeng/yustack/types"
 	"github.com/YaoZengzeng/yustack/waiter"
 	"github.com/YaoZengzeng/yustack/tmutex"
@@ -26,11 +29,34 @@ const (
 	stateError
 )
 
+// String returns the name of the state, as reported by TCPInfoOption
+func (s endpointState) String() string {
+	switch s {
+	case stateInitial:
+		return "initial"
+	case stateBound:
+		return "bound"
+	case stateListen:
+		return "listen"
+	case stateConnecting:
+		return "connecting"
+	case stateConnected:
+		return "connected"
+	case stateClosed:
+		return "closed"
+	case stateError:
+		return "error"
+	}
+
+	return "unknown"
+}
+
 // Reason for notifying the protocol goroutine
 const (
 	notifyNonZeroReceiveWindow = 1 << iota
 	notifyReceiveWindowChanged
 	notifyClose
+	notifyAbort
 )
 
 // DefaultBufferSize is the default size of the receive and send buffers
@@ -67,6 +93,11 @@ type endpoint struct {
 	boundNicId		types.NicId
 	route 			types.Route
 
+	// portFlags holds the reuse options set on the endpoint, reservedAddress
+	// is the address its port was reserved for by Bind
+	portFlags		ports.Flags
+	reservedAddress	types.Address
+
 	// effectiveNetProtocols contains the network protocols actually in use. In most
 	// cases it will only contain "netProtocol", but in cases like IPv6 endpoints
 	// with v6only set to false, this could include multiple protocols (e.g., IPv6 and
@@ -79,6 +110,10 @@ type endpoint struct {
 	// endpoint is in this state
 	hardError error
 
+	// abortError is the error the endpoint is failed with once it's
+	// aborted by the stack
+	abortError error
+
 	// The following fields are used to manage the receive queue. The
 	// protocol goroutine adds ready-for-delivery segments to rcvList,
 	// which are returned by Read() calls to users.
@@ -135,6 +170,12 @@ type endpoint struct {
 	// read by Accept() calls
 	acceptedChan chan *endpoint
 
+	// The following counters are reported by GetSockOpt(TCPInfoOption),
+	// they are accessed atomically
+	segmentsSent		uint64
+	segmentsReceived	uint64
+	retransmits			uint64
+
 	// The following are only used from the protocol goroutine, and
 	// therefore don't need locks to protect them
 	rcv *receiver
@@ -172,14 +213,17 @@ func (e *endpoint) Bind(address types.FullAddress) error {
 	netProtocols := []types.NetworkProtocolNumber{e.netProtocol}
 
 	// Reserve the port
-	port, err := e.stack.ReservePort(netProtocols, ProtocolNumber, address.Address, address.Port)
+	port, err := e.stack.ReservePort(netProtocols, ProtocolNumber, address.Address, address.Port, e.portFlags)
 	if err != nil {
 		return err
 	}
 
 	e.isPortReserved = true
+	e.reservedAddress = address.Address
 	e.effectiveNetProtocols = netProtocols
+	e.id.LocalAddress = address.Address
 	e.id.LocalPort = port
+	e.boundNicId = address.Nic
 
 	// Mark endpoint as bound
 	e.state = stateBound
@@ -216,7 +260,7 @@ func (e *endpoint) Listen(backlog int) error {
 	}
 
 	// Register the endpoint.
-	if err := e.stack.RegisterTransportEndpoint(e.boundNicId, e.effectiveNetProtocols, ProtocolNumber, e.id, e); err != nil {
+	if err := e.stack.RegisterTransportEndpoint(e.boundNicId, e.effectiveNetProtocols, ProtocolNumber, e.id, e, e.portFlags.ReusePort); err != nil {
 		return err
 	}
 
@@ -247,6 +291,9 @@ func (e *endpoint) Accept() (types.Endpoint, *waiter.Queue, error) {
 
 	// Endpoint must be in listen state before it can accept connections
 	if e.state != stateListen {
+		if e.state == stateError {
+			return nil, nil, e.hardError
+		}
 		return nil, nil, types.ErrInvalidEndpointState
 	}
 
@@ -273,6 +320,9 @@ func (e *endpoint) Read(*types.FullAddress) (buffer.View, error) {
 	// but has some pending unread data
 	if s := e.state; s != stateConnected && s != stateClosed {
 		e.mu.RUnlock()
+		if s == stateError {
+			return buffer.View{}, e.hardError
+		}
 		return buffer.View{}, types.ErrInvalidEndpointState
 	}
 
@@ -350,7 +400,6 @@ func (e *endpoint) Write(v buffer.View, to *types.FullAddress) (uintptr, error)
 
 	// The endpoint cannot be written to if it's not connected
 	if e.state != stateConnected {
-		log.Printf("Write: state is not connected\n")
 		return 0, types.ErrClosedForSend
 	}
 
@@ -363,7 +412,6 @@ func (e *endpoint) Write(v buffer.View, to *types.FullAddress) (uintptr, error)
 	// Check if the connection has already been closed for sends
 	if e.sndBufSize < 0 {
 		e.sndBufMu.Unlock()
-		log.Printf("Write: send buffer size < 0")
 		return 0, types.ErrClosedForSend
 	}
 
@@ -448,15 +496,17 @@ func (e *endpoint) Connect(addr types.FullAddress) error {
 
 	if e.id.LocalPort != 0 {
 		// The endpoint is bound to a port, attempt to register it
-		err := e.stack.RegisterTransportEndpoint(nicid, netProtocols, ProtocolNumber, e.id, e)
+		err := e.stack.RegisterTransportEndpoint(nicid, netProtocols, ProtocolNumber, e.id, e, false)
 		if err != nil {
 			return err
 		}
 	} else {
-		// The endpoint doesn't have a local port yet, so try to get one
-		_, err := e.stack.PickEphemeralPort(func (p uint16) (bool, error) {
+		// The endpoint doesn't have a local port yet, so try to get one.
+		// The full id is registered, so a port can be picked again
+		// for other destinations
+		_, err := e.stack.PickEphemeralPortStable(e.id.LocalAddress, e.id.RemoteAddress, e.id.RemotePort, func (p uint16) (bool, error) {
 			e.id.LocalPort = p
-			err := e.stack.RegisterTransportEndpoint(nicid, netProtocols, ProtocolNumber, e.id, e)
+			err := e.stack.RegisterTransportEndpoint(nicid, netProtocols, ProtocolNumber, e.id, e, false)
 			switch err {
 			case nil:
 				return true, nil
@@ -478,11 +528,77 @@ func (e *endpoint) Connect(addr types.FullAddress) error {
 	e.effectiveNetProtocols = netProtocols
 	e.workerRunning = true
 
+	r.Stats.TCP.ActiveConnectionOpenings.Increment()
+
 	go e.protocolMainLoop(false)
 
 	return types.ErrConnectStarted
 }
 
+// ReadContext reads data from the endpoint, blocking until some is available
+func (e *endpoint) ReadContext(ctx context.Context, addr *types.FullAddress) (buffer.View, error) {
+	var v buffer.View
+	err := types.BlockingCall(ctx, e.waiterQueue, waiter.EventIn, func() error {
+		var err error
+		v, err = e.Read(addr)
+		return err
+	})
+
+	return v, err
+}
+
+// WriteContext writes data to the endpoint's peer, blocking until there is
+// room for it in the send buffer
+func (e *endpoint) WriteContext(ctx context.Context, v buffer.View, to *types.FullAddress) (uintptr, error) {
+	var n uintptr
+	err := types.BlockingCall(ctx, e.waiterQueue, waiter.EventOut, func() error {
+		var err error
+		n, err = e.Write(v, to)
+		return err
+	})
+
+	return n, err
+}
+
+// AcceptContext returns a new endpoint once a peer has established a
+// connection, blocking until one is available
+func (e *endpoint) AcceptContext(ctx context.Context) (types.Endpoint, *waiter.Queue, error) {
+	var n types.Endpoint
+	var wq *waiter.Queue
+	err := types.BlockingCall(ctx, e.waiterQueue, waiter.EventIn, func() error {
+		var err error
+		n, wq, err = e.Accept()
+		return err
+	})
+
+	return n, wq, err
+}
+
+// ConnectContext connects the endpoint to its peer and waits for the 3-way
+// handshake to complete. If ctx is done first, the handshake is aborted
+func (e *endpoint) ConnectContext(ctx context.Context, addr types.FullAddress) error {
+	// Register for the writable event before connecting, so that the
+	// completion of the handshake can't be missed
+	waitEntry, notifyCh := waiter.NewChannelEntry(nil)
+	e.waiterQueue.EventRegister(&waitEntry, waiter.EventOut)
+	defer e.waiterQueue.EventUnregister(&waitEntry)
+
+	err := e.Connect(addr)
+	if err != types.ErrConnectStarted {
+		return err
+	}
+
+	select {
+	case <-notifyCh:
+		return e.GetSockOpt(types.ErrorOption{})
+	case <-ctx.Done():
+		// Stop the handshake so that the protocol goroutine doesn't
+		// keep retransmitting the SYN segment
+		e.notifyProtocolGoroutine(notifyClose)
+		return types.ErrAborted
+	}
+}
+
 // cleanup frees all resources associated with the endpoint. It is called after
 // Close() is called and the worker goroutine (if any) is done with its work
 func (e *endpoint) cleanup() {
@@ -494,10 +610,17 @@ func (e *endpoint) cleanup() {
 			n.resetConnection(types.ErrConnectionAborted)
 			n.Close()
 		}
+		e.acceptedChan = nil
 	}
 
 	if e.isRegistered {
-		e.stack.UnregisterTransportEndpoint(e.boundNicId, e.effectiveNetProtocols, ProtocolNumber, e.id)
+		e.stack.UnregisterTransportEndpoint(e.boundNicId, e.effectiveNetProtocols, ProtocolNumber, e.id, e)
+		e.isRegistered = false
+	}
+
+	if e.isPortReserved {
+		e.stack.ReleasePort([]types.NetworkProtocolNumber{e.netProtocol}, ProtocolNumber, e.reservedAddress, e.id.LocalPort, e.portFlags)
+		e.isPortReserved = false
 	}
 }
 
@@ -552,21 +675,59 @@ func (e *endpoint) Close() {
 	}
 }
 
+// Abort implements types.AbortableEndpoint.Abort. Connections being established
+// or established are failed with err by the protocol goroutine, without any RST
+// as the peer can't be reached anymore, and listeners stop listening. Endpoints
+// which are only bound have nothing to fail, their next Listen or Connect does
+func (e *endpoint) Abort(err error) {
+	e.mu.Lock()
+	state := e.state
+	if state == stateConnecting || state == stateConnected || state == stateListen {
+		e.abortError = err
+	}
+	e.mu.Unlock()
+
+	if state == stateConnecting || state == stateConnected || state == stateListen {
+		e.notifyProtocolGoroutine(notifyAbort)
+	}
+}
+
+// abortErr returns the error the endpoint was aborted with
+func (e *endpoint) abortErr() error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.abortError
+}
+
 // HandlePacket is called by the stack when new packets arrive to this transport
 // endpoint.
 func (e *endpoint) HandlePacket(r *types.Route, id types.TransportEndpointId, vv *buffer.VectorisedView) {
+	if r.Capabilities() & types.CapabilityRXChecksumOffload == 0 {
+		xsum := checksum.ChecksumVV(vv, checksum.ChecksumCombine(r.PseudoHeaderChecksum(ProtocolNumber), uint16(vv.Size())))
+		if xsum != 0xffff {
+			r.Stats.TCP.ChecksumErrors.Increment()
+			e.stack.DropPacket(types.DropBadChecksum, stack.NewPacketInfo(r, ProtocolNumber, id, vv.Size()))
+			return
+		}
+	}
+
 	s := newSegment(r, id, vv)
 	if !s.parse() {
-		log.Printf("HandlePacket: parse failed\n`")
+		r.Stats.TCP.InvalidSegmentsReceived.Increment()
+		e.stack.DropPacket(types.DropInvalidTransportHeader, stack.NewPacketInfo(r, ProtocolNumber, id, vv.Size()))
 		return
 	}
+	r.Stats.TCP.ValidSegmentsReceived.Increment()
 
 	// Send packet to worker goroutine.
 	if e.segmentQueue.enqueue(s) {
+		atomic.AddUint64(&e.segmentsReceived, 1)
 		e.newSegmentWaker.Assert()
 	} else {
 		// The queue is full, so we drop the segment.
-		log.Printf("HandlePacket: the queue is full, dropped\n")
+		r.Stats.TCP.SegmentsDropped.Increment()
+		e.stack.DropPacket(types.DropSegmentQueueFull, stack.NewPacketInfo(r, ProtocolNumber, id, s.data.Size()))
 	}
 }
 
@@ -603,7 +764,7 @@ func (e *endpoint) Shutdown(flags types.ShutdownFlags) error {
 		}
 
 	case stateListen:
-		log.Printf("Shutdown: stateListen has not implemented yet\n")
+		e.stack.Logger().Log(logger.LevelDebug, "shutting down a listening endpoint is not supported yet", "id", e.id)
 
 	default:
 		return types.ErrInvalidEndpointState
@@ -626,6 +787,18 @@ func (e *endpoint) SetSockOpt(opt interface{}) error {
 
 		e.notifyProtocolGoroutine(mask)
 		return nil
+
+	case types.ReuseAddressOption:
+		e.mu.Lock()
+		e.portFlags.ReuseAddress = bool(v)
+		e.mu.Unlock()
+		return nil
+
+	case types.ReusePortOption:
+		e.mu.Lock()
+		e.portFlags.ReusePort = bool(v)
+		e.mu.Unlock()
+		return nil
 	}
 
 	return nil
@@ -633,18 +806,95 @@ func (e *endpoint) SetSockOpt(opt interface{}) error {
 
 // GetSockOpt implements types.Endpoint.GetSockOpt
 func (e *endpoint) GetSockOpt(opt interface{}) error {
-	switch opt.(type) {
+	switch v := opt.(type) {
 	case types.ErrorOption:
 		e.lastErrorMu.Lock()
 		err := e.lastError
 		e.lastError = nil
 		e.lastErrorMu.Unlock()
 		return err
+
+	case *types.ReuseAddressOption:
+		e.mu.RLock()
+		*v = types.ReuseAddressOption(e.portFlags.ReuseAddress)
+		e.mu.RUnlock()
+		return nil
+
+	case *types.ReusePortOption:
+		e.mu.RLock()
+		*v = types.ReusePortOption(e.portFlags.ReusePort)
+		e.mu.RUnlock()
+		return nil
+
+	case *types.TCPInfoOption:
+		e.mu.RLock()
+		state := e.state
+		e.mu.RUnlock()
+
+		e.rcvListMu.Lock()
+		rcvBufUsed := e.rcvBufUsed
+		e.rcvListMu.Unlock()
+
+		e.sndBufMu.Lock()
+		sndBufUsed := e.sndBufUsed
+		e.sndBufMu.Unlock()
+
+		*v = types.TCPInfoOption{
+			State:				state.String(),
+			SegmentsSent:		atomic.LoadUint64(&e.segmentsSent),
+			SegmentsReceived:	atomic.LoadUint64(&e.segmentsReceived),
+			Retransmits:		atomic.LoadUint64(&e.retransmits),
+			RcvBufUsed:			rcvBufUsed,
+			SndBufUsed:			sndBufUsed,
+		}
+		return nil
 	}
 
 	return types.ErrUnknownProtocolOption
 }
 
+// GetLocalAddress returns the address to which the endpoint is bound
+func (e *endpoint) GetLocalAddress() (types.FullAddress, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return types.FullAddress{
+		Nic:		e.boundNicId,
+		Address:	e.id.LocalAddress,
+		Port:		e.id.LocalPort,
+	}, nil
+}
+
+// GetRemoteAddress returns the address to which the endpoint is connected
+func (e *endpoint) GetRemoteAddress() (types.FullAddress, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.state != stateConnected {
+		return types.FullAddress{}, types.ErrNotConnected
+	}
+
+	return types.FullAddress{
+		Nic:		e.boundNicId,
+		Address:	e.id.RemoteAddress,
+		Port:		e.id.RemotePort,
+	}, nil
+}
+
+// updateSndBufferUsage is called by the protocol goroutine when some of the
+// sent data has been acknowledged, to release it from the send buffer and wake
+// up writers waiting for room in it
+func (e *endpoint) updateSndBufferUsage(v int) {
+	e.sndBufMu.Lock()
+	notify := e.sndBufUsed >= e.sndBufSize
+	e.sndBufUsed -= v
+	e.sndBufMu.Unlock()
+
+	if notify {
+		e.waiterQueue.Notify(waiter.EventOut)
+	}
+}
+
 func (e *endpoint) receiveBufferSize() int {
 	e.rcvListMu.Lock()
 	size := e.rcvBufSize
@@ -40,6 +40,12 @@ func (*protocol) ParsePorts(v buffer.View) (src, dst uint16, err error) {
 	return h.SourcePort(), h.DestinationPort(), nil
 }
 
+// HandleUnknownDestinationPacket handles packets targeted at this protocol but
+// that don't match any existing endpoint
+func (*protocol) HandleUnknownDestinationPacket(r *types.Route, id types.TransportEndpointId, vv *buffer.VectorisedView) {
+	// TODO: reply with a RST as described in RFC 793, page 36
+}
+
 func init() {
 	stack.RegisterTransportProtocolFactory(ProtocolName, func() stack.TransportProtocol {
 		return &protocol{}
@@ -1,14 +1,20 @@
 package tcp
 
 import (
-	"log"
 	"time"
 
 	"github.com/YaoZengzeng/yustack/seqnum"
 	"github.com/YaoZengzeng/yustack/sleep"
 	"github.com/YaoZengzeng/yustack/buffer"
+	"github.com/YaoZengzeng/yustack/header"
+	"github.com/YaoZengzeng/yustack/types"
 )
 
+// maxGSOPayloadSize is the max size of the payload of the super-segments
+// built for link endpoints with types.CapabilityGSO, so that their IPv4
+// packets don't exceed 64KB
+const maxGSOPayloadSize = 0xffff - header.IPv4MinimumSize - header.TCPMinimumSize
+
 // sender holds the state necessary to send TCP segments
 type sender struct {
 	ep *endpoint
@@ -104,6 +110,10 @@ func newSender(ep *endpoint, iss, irs seqnum.Value, sndWnd seqnum.Size, mss uint
 		s.sndWndScale = uint8(sndWndScale)
 	}
 
+	// Link endpoints doing GSO cut the super-segments in segments of the
+	// maximum payload size, which leaves room for the options
+	ep.route.GSOSize = uint16(s.maxPayloadSize)
+
 	return s
 }
 
@@ -115,9 +125,16 @@ func (s *sender) sendAck() {
 // sendData sends new data segments. It is called when data becomes available or
 // when the send window opens up
 func (s *sender) sendData() {
-	// TODO: We currently don't merge multiple send buffers
-	// into one segment if they happen to fit. We should do that
-	// eventually
+	// With GSO, the link endpoint cuts the segments in pieces of the MSS,
+	// so that segments are limited by the size of IP packets only, and the
+	// send buffers are merged to fill them. Otherwise, we currently don't
+	// merge multiple send buffers into one segment if they happen to fit
+	maxPayloadSize := s.maxPayloadSize
+	gso := s.ep.route.Capabilities() & types.CapabilityGSO != 0
+	if gso {
+		maxPayloadSize = maxGSOPayloadSize
+	}
+
 	var seg *segment
 	end := s.sndUna.Add(s.sndWnd)
 	for seg = s.writeNext; seg != nil; seg = seg.Next() {
@@ -136,15 +153,20 @@ func (s *sender) sendData() {
 		} else {
 			// We're sending a non-FIN segment
 			if !seg.sequenceNumber.LessThan(end) {
-				log.Printf("sendData: segment's sequenceNumber is less than sndUna + sndWnd\n")
+				// The send window is exhausted
 				break
 			}
 
+			// Only send as much as fits in the window and in a
+			// single segment, the rest is sent later on
 			available := int(seg.sequenceNumber.Size(end))
-			if seg.data.Size() > available {
-				log.Printf("the length of segment is longer than available window size\n")
-				return
+			if available > maxPayloadSize {
+				available = maxPayloadSize
+			}
+			if gso {
+				s.mergeSegs(seg, available)
 			}
+			s.splitSeg(seg, available)
 
 			segEnd = seg.sequenceNumber.Add(seqnum.Size(seg.data.Size()))
 		}
@@ -162,6 +184,61 @@ func (s *sender) sendData() {
 	s.writeNext = seg
 }
 
+// splitSeg splits the given segment so that its payload is at most size bytes
+// long. The remaining payload is moved to a new segment inserted right after it
+// in the write list
+func (s *sender) splitSeg(seg *segment, size int) {
+	if seg.data.Size() <= size {
+		return
+	}
+
+	nSeg := &segment{
+		id:		seg.id,
+		route:		seg.route.Clone(),
+		flags:		seg.flags,
+		sequenceNumber:	seg.sequenceNumber.Add(seqnum.Size(size)),
+	}
+	nSeg.data = seg.data.Clone(nSeg.views[:])
+	nSeg.data.TrimFront(size)
+	s.writeList.InsertAfter(seg, nSeg)
+
+	seg.data.CapLength(size)
+}
+
+// mergeSegs appends the payload of the segments following the given one in the
+// write list to it, while it's shorter than size bytes. The segments must not
+// have been sent yet, and a FIN segment is never merged
+func (s *sender) mergeSegs(seg *segment, size int) {
+	next := seg.Next()
+	if seg.data.Size() >= size || next == nil || next.flags != 0 || next.data.Size() == 0 {
+		return
+	}
+
+	// The payload is sent from a single view
+	v := make(buffer.View, seg.data.Size(), size)
+	copy(v, seg.data.First())
+	for next != nil && next.flags == 0 && next.data.Size() > 0 && len(v) < size {
+		n := next.data.Size()
+		if len(v) + n > size {
+			// Take the head of the segment, the rest of it is sent
+			// later on
+			n = size - len(v)
+		}
+		v = append(v, next.data.First()[:n]...)
+		if n < next.data.Size() {
+			next.data.TrimFront(n)
+			break
+		}
+
+		merged := next
+		next = next.Next()
+		s.writeList.Remove(merged)
+	}
+
+	seg.views[0] = v
+	seg.data = buffer.NewVectorisedView(seg.views[:1], len(v))
+}
+
 // handleRcvdSegment is called when a segment is received; it is responsible for
 // updating the send-related state
 func (s *sender) handleRcvdSegment(seg *segment) {
@@ -176,6 +253,7 @@ func (s *sender) handleRcvdSegment(seg *segment) {
 		s.sndUna = ack
 
 		ackLeft := acked
+		dataAcked := 0
 		for ackLeft > 0 {
 			// We use logicalLen here because we can have FIN
 			// segments (which are always at the end of list) that
@@ -185,12 +263,19 @@ func (s *sender) handleRcvdSegment(seg *segment) {
 
 			if dataLen > ackLeft {
 				seg.data.TrimFront(int(ackLeft))
+				dataAcked += int(ackLeft)
 				break
 			}
 
 			s.writeList.Remove(seg)
+			dataAcked += seg.data.Size()
 			ackLeft -= dataLen
 		}
+
+		// Release the acknowledged data from the send buffer
+		if dataAcked > 0 {
+			s.ep.updateSndBufferUsage(dataAcked)
+		}
 	}
 
 	// Send more data now that some of the pending data has been ack'd, or
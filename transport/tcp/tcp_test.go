@@ -2,10 +2,13 @@ package tcp_test
 
 import (
 	"bytes"
+	gocontext "context"
 	"time"
 	"testing"
 
 	"github.com/YaoZengzeng/yustack/header"
+	"github.com/YaoZengzeng/yustack/link/loopback"
+	"github.com/YaoZengzeng/yustack/stack"
 	"github.com/YaoZengzeng/yustack/transport/tcp/testing/context"
 	"github.com/YaoZengzeng/yustack/transport/tcp"
 	"github.com/YaoZengzeng/yustack/network/ipv4"
@@ -50,9 +53,65 @@ func TestGiveUpContext(t *testing.T) {
 	// Close the connection, wait for completion
 	ep.Close()
 
-	// Wait for ep to become writable
+	// Wait for ep to become writable, the failure of the connection
+	// attempt is reported
 	<-notifyCh
-	err = ep.GetSockOpt(types.ErrorOption{})
+	if err := ep.GetSockOpt(types.ErrorOption{}); err != types.ErrAborted {
+		t.Fatalf("GetSockOpt(ErrorOption) = %v, want %v", err, types.ErrAborted)
+	}
+}
+
+func TestConnectContextCancel(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	var wq waiter.Queue
+	ep, err := c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	// The peer never answers the SYN, so the attempt must be given up
+	// when the context expires
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), 100 * time.Millisecond)
+	defer cancel()
+
+	err = ep.ConnectContext(ctx, types.FullAddress{Address: context.TestAddr, Port: context.TestPort})
+	if err != types.ErrAborted {
+		t.Fatalf("ConnectContext returned %v, want %v", err, types.ErrAborted)
+	}
+}
+
+func TestReadContext(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), 50 * time.Millisecond)
+	defer cancel()
+	if _, err := c.EP.ReadContext(ctx, nil); err != types.ErrAborted {
+		t.Fatalf("ReadContext returned %v, want %v", err, types.ErrAborted)
+	}
+
+	data := []byte{1, 2, 3}
+	go c.SendPacket(data, &context.Headers{
+		SrcPort:	context.TestPort,
+		DstPort:	c.Port,
+		Flags:		header.TCPFlagAck,
+		SeqNum:		790,
+		AckNum:		c.IRS.Add(1),
+		RcvWnd:		30000,
+	})
+
+	v, err := c.EP.ReadContext(gocontext.Background(), nil)
+	if err != nil {
+		t.Fatalf("ReadContext failed: %v", err)
+	}
+	if bytes.Compare(data, v) != 0 {
+		t.Fatalf("Data is different: expected %v, got %v", data, v)
+	}
 }
 
 func TestActiveHandshake(t *testing.T) {
@@ -556,6 +615,41 @@ func TestSimpleSend(t *testing.T) {
 	})
 }
 
+func TestStats(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	stats := c.Stack().Stats()
+	if got := stats.TCP.ActiveConnectionOpenings.Value(); got != 1 {
+		t.Errorf("ActiveConnectionOpenings = %v, want 1", got)
+	}
+	if got := stats.TCP.ValidSegmentsReceived.Value(); got != 1 {
+		t.Errorf("ValidSegmentsReceived = %v, want 1", got)
+	}
+	if got := stats.IP.PacketsReceived.Value(); got != 1 {
+		t.Errorf("IP.PacketsReceived = %v, want 1", got)
+	}
+
+	nicStats, err := c.Stack().NicStats(1)
+	if err != nil {
+		t.Fatalf("NicStats failed: %v", err)
+	}
+	if got := nicStats.Rx.Packets.Value(); got != 1 {
+		t.Errorf("Rx.Packets = %v, want 1", got)
+	}
+
+	var info types.TCPInfoOption
+	if err := c.EP.GetSockOpt(&info); err != nil {
+		t.Fatalf("GetSockOpt failed: %v", err)
+	}
+	// The SYN and the ACK completing the handshake
+	if info.State != "connected" || info.SegmentsSent != 2 || info.SegmentsReceived != 1 {
+		t.Errorf("GetSockOpt(TCPInfoOption) = %+v, want 2 segments sent and 1 received in the connected state", info)
+	}
+}
+
 func TestZeroWindowSend(t *testing.T) {
 	c := context.New(t, defaultMTU)
 	defer c.Cleanup()
@@ -610,6 +704,102 @@ func TestZeroWindowSend(t *testing.T) {
 	})
 }
 
+func TestSplitSegmentToWindow(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	// The peer has room for 5 bytes only
+	c.CreateConnected(789, 5, nil)
+
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	view := buffer.NewView(len(data))
+	copy(view, data)
+	if _, err := c.EP.Write(view, nil); err != nil {
+		t.Fatalf("Unexpected error from Write: %v", err)
+	}
+
+	// Only the part of the segment fitting in the window is sent
+	b := c.GetPacket()
+	checker.IPv4(t, b,
+		checker.PayloadLen(5 + header.TCPMinimumSize),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.SeqNum(uint32(c.IRS) + 1),
+			checker.AckNum(790),
+		),
+	)
+	if p := b[header.IPv4MinimumSize + header.TCPMinimumSize:]; bytes.Compare(data[:5], p) != 0 {
+		t.Fatalf("Data is different: expected %v, got %v", data[:5], p)
+	}
+	c.CheckNoPacket("Packet received beyond the window")
+
+	// Acknowledge it and open the window, the rest is sent
+	c.SendPacket(nil, &context.Headers{
+		SrcPort:	context.TestPort,
+		DstPort:	c.Port,
+		Flags:		header.TCPFlagAck,
+		SeqNum:		790,
+		AckNum:		c.IRS.Add(1 + 5),
+		RcvWnd:		30000,
+	})
+
+	b = c.GetPacket()
+	checker.IPv4(t, b,
+		checker.PayloadLen(5 + header.TCPMinimumSize),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.SeqNum(uint32(c.IRS) + 1 + 5),
+			checker.AckNum(790),
+		),
+	)
+	if p := b[header.IPv4MinimumSize + header.TCPMinimumSize:]; bytes.Compare(data[5:], p) != 0 {
+		t.Fatalf("Data is different: expected %v, got %v", data[5:], p)
+	}
+}
+
+func TestSendBufferReleasedOnAck(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 1000, nil)
+
+	// Fill up the send buffer, the first 1000 bytes are sent in segments
+	// of the default MSS
+	view := buffer.NewView(tcp.DefaultBufferSize)
+	if _, err := c.EP.Write(view, nil); err != nil {
+		t.Fatalf("Unexpected error from Write: %v", err)
+	}
+	if _, err := c.EP.Write(buffer.NewView(1), nil); err != types.ErrWouldBlock {
+		t.Fatalf("Write returned %v, want %v", err, types.ErrWouldBlock)
+	}
+	checker.IPv4(t, c.GetPacket(), checker.PayloadLen(536 + header.TCPMinimumSize))
+	checker.IPv4(t, c.GetPacket(), checker.PayloadLen(1000 - 536 + header.TCPMinimumSize))
+
+	waitEntry, notifyCh := waiter.NewChannelEntry(nil)
+	c.WQ.EventRegister(&waitEntry, waiter.EventOut)
+	defer c.WQ.EventUnregister(&waitEntry)
+
+	// Acknowledging the data releases its room in the buffer, and wakes
+	// up the writers
+	c.SendPacket(nil, &context.Headers{
+		SrcPort:	context.TestPort,
+		DstPort:	c.Port,
+		Flags:		header.TCPFlagAck,
+		SeqNum:		790,
+		AckNum:		c.IRS.Add(1 + 1000),
+		RcvWnd:		1000,
+	})
+
+	select {
+	case <-notifyCh:
+	case <-time.After(time.Second):
+		t.Fatalf("The endpoint didn't become writable")
+	}
+	if _, err := c.EP.Write(buffer.NewView(1), nil); err != nil {
+		t.Fatalf("Unexpected error from Write: %v", err)
+	}
+}
+
 func TestScaledWindowConnect(t *testing.T) {
 	// This test ensures that window scaling is used when the peer
 	// does advertise it and connection is established with Connect()
@@ -750,3 +940,261 @@ func TestScaledWindowAccept(t *testing.T) {
 		),
 	)
 }
+
+func TestReusePort(t *testing.T) {
+	const localhost = "\x7f\x00\x00\x01"
+
+	s := stack.New([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName})
+	if err := s.CreateNic(1, loopback.New()); err != nil {
+		t.Fatalf("CreateNic failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, localhost); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	newEndpoint := func(opts ...interface{}) types.Endpoint {
+		var wq waiter.Queue
+		ep, err := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %v", err)
+		}
+		for _, opt := range opts {
+			if err := ep.SetSockOpt(opt); err != nil {
+				t.Fatalf("SetSockOpt(%v) failed: %v", opt, err)
+			}
+		}
+		return ep
+	}
+
+	// Two listeners share the port, a third one without the option can't
+	// join them
+	var listeners []types.Endpoint
+	for i := 0; i < 2; i++ {
+		ep := newEndpoint(types.ReusePortOption(true))
+		defer ep.Close()
+		if err := ep.Bind(types.FullAddress{Port: 8080}); err != nil {
+			t.Fatalf("Bind failed: %v", err)
+		}
+		if err := ep.Listen(16); err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		listeners = append(listeners, ep)
+	}
+	other := newEndpoint()
+	if err := other.Bind(types.FullAddress{Port: 8080}); err != types.ErrPortInUse {
+		t.Fatalf("Bind without ReusePortOption returned %v, want %v", err, types.ErrPortInUse)
+	}
+	other.Close()
+
+	// The connections are spread across the listeners
+	const conns = 16
+	for i := 0; i < conns; i++ {
+		ep := newEndpoint()
+		defer ep.Close()
+		ctx, cancel := gocontext.WithTimeout(gocontext.Background(), 1 * time.Second)
+		err := ep.ConnectContext(ctx, types.FullAddress{Address: localhost, Port: 8080})
+		cancel()
+		if err != nil {
+			t.Fatalf("ConnectContext failed: %v", err)
+		}
+	}
+
+	// The last connections may still be on their way to the accept queues
+	accepted := make([]int, len(listeners))
+	for total, deadline := 0, time.Now().Add(1 * time.Second); total < conns && time.Now().Before(deadline); {
+		for i, l := range listeners {
+			if ep, _, err := l.Accept(); err == nil {
+				ep.Close()
+				accepted[i]++
+				total++
+			}
+		}
+	}
+	total := 0
+	for i, n := range accepted {
+		if n == 0 {
+			t.Errorf("listener %d accepted no connection", i)
+		}
+		total += n
+	}
+	if total != conns {
+		t.Errorf("accepted %d connections, want %d", total, conns)
+	}
+
+	// The port is released once the listeners are cleaned up, which their
+	// worker goroutines do asynchronously
+	for _, l := range listeners {
+		l.Close()
+	}
+	ep := newEndpoint()
+	defer ep.Close()
+	err := ep.Bind(types.FullAddress{Port: 8080})
+	for deadline := time.Now().Add(1 * time.Second); err == types.ErrPortInUse && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		err = ep.Bind(types.FullAddress{Port: 8080})
+	}
+	if err != nil {
+		t.Fatalf("Bind after close failed: %v", err)
+	}
+}
+
+func TestReuseAddress(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	var eps []types.Endpoint
+	for i := 0; i < 2; i++ {
+		var wq waiter.Queue
+		ep, err := c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %v", err)
+		}
+		defer ep.Close()
+		eps = append(eps, ep)
+	}
+
+	if err := eps[0].SetSockOpt(types.ReuseAddressOption(true)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	if err := eps[0].Bind(types.FullAddress{Port: 8080}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	// The port can only be bound again by an endpoint setting the option
+	if err := eps[1].Bind(types.FullAddress{Port: 8080}); err != types.ErrPortInUse {
+		t.Fatalf("Bind without ReuseAddressOption returned %v, want %v", err, types.ErrPortInUse)
+	}
+	if err := eps[1].SetSockOpt(types.ReuseAddressOption(true)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	if err := eps[1].Bind(types.FullAddress{Port: 8080}); err != nil {
+		t.Fatalf("Bind with ReuseAddressOption failed: %v", err)
+	}
+
+	var v types.ReuseAddressOption
+	if err := eps[1].GetSockOpt(&v); err != nil || !bool(v) {
+		t.Fatalf("GetSockOpt returned %v, %v, want true", v, err)
+	}
+}
+
+func TestGSOSend(t *testing.T) {
+	c := context.NewWithCapabilities(t, 1500, types.CapabilityGSO)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 0, nil)
+
+	// The writes queue up while the window is zero
+	data := make([]byte, 20000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	for i := 0; i < len(data); i += 2000 {
+		view := buffer.NewView(2000)
+		copy(view, data[i:])
+		if _, err := c.EP.Write(view, nil); err != nil {
+			t.Fatalf("Unexpected error from Write: %v", err)
+		}
+	}
+	c.CheckNoPacket("Packet received when window is zero")
+
+	// Once the window opens, the writes are merged in super-segments as
+	// large as the window, beyond the MSS and the MTU
+	sent := 0
+	for _, wnd := range []int{15000, 30000} {
+		c.SendPacket(nil, &context.Headers{
+			SrcPort:	context.TestPort,
+			DstPort:	c.Port,
+			Flags:		header.TCPFlagAck,
+			SeqNum:		790,
+			AckNum:		c.IRS.Add(1 + seqnum.Size(sent)),
+			RcvWnd:		seqnum.Size(wnd),
+		})
+
+		want := data[sent:]
+		if len(want) > wnd {
+			want = want[:wnd]
+		}
+		b := c.GetPacket()
+		checker.IPv4(t, b,
+			checker.PayloadLen(len(want) + header.TCPMinimumSize),
+			checker.TCP(
+				checker.SeqNum(uint32(c.IRS) + 1 + uint32(sent)),
+				checker.AckNum(790),
+			),
+		)
+		if p := b[header.IPv4MinimumSize + header.TCPMinimumSize:]; !bytes.Equal(want, p) {
+			t.Fatalf("Data is different at offset %d", sent)
+		}
+		sent += len(want)
+	}
+}
+
+func TestGSOSizeWithTimestamps(t *testing.T) {
+	c := context.NewWithCapabilities(t, 1500, types.CapabilityGSO)
+	defer c.Cleanup()
+
+	// The SYN-ACK carries an MSS and the timestamp option
+	const mss = 1000
+	c.CreateConnectedWithRawOptions(789, 30000, nil, []byte{
+		header.TCPOptionMSS, 4, byte(mss / 256), byte(mss % 256),
+		header.TCPOptionNOP, header.TCPOptionNOP,
+		header.TCPOptionTS, 10, 0, 0, 0, 1, 0, 0, 0, 0,
+	})
+
+	// The timestamps aren't echoed in the segments, so the whole MSS is
+	// left to their payload, and the link endpoint cuts the super-segment
+	// at the same size
+	data := make([]byte, 3 * mss)
+	if _, err := c.EP.Write(buffer.View(data), nil); err != nil {
+		t.Fatalf("Unexpected error from Write: %v", err)
+	}
+
+	b, gsoSize := c.GetGSOPacket()
+	checker.IPv4(t, b,
+		checker.PayloadLen(len(data) + header.TCPMinimumSize),
+		checker.TCP(
+			checker.SeqNum(uint32(c.IRS) + 1),
+			checker.AckNum(790),
+		),
+	)
+	if gsoSize != mss {
+		t.Fatalf("Bad GSO size: got %v, want %v", gsoSize, mss)
+	}
+}
+
+func TestBadChecksum(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	// A bit flipped in the payload, then in the IP header
+	for i, off := range []int{header.IPv4MinimumSize + header.TCPMinimumSize, 8} {
+		b := c.BuildPacket([]byte{1, 2, 3}, &context.Headers{
+			SrcPort:	context.TestPort,
+			DstPort:	c.Port,
+			Flags:		header.TCPFlagAck,
+			SeqNum:		790,
+			AckNum:		c.IRS.Add(1),
+			RcvWnd:		30000,
+		})
+		b[off] ^= 1
+		c.InjectPacket(b)
+
+		stats := c.Stack().Stats()
+		if got := stats.DroppedPackets[types.DropBadChecksum].Value(); got != uint64(i + 1) {
+			t.Errorf("DroppedPackets[DropBadChecksum] = %d, want %d", got, i + 1)
+		}
+	}
+
+	stats := c.Stack().Stats()
+	if got := stats.TCP.ChecksumErrors.Value(); got != 1 {
+		t.Errorf("TCP.ChecksumErrors = %d, want 1", got)
+	}
+	if got := stats.IP.MalformedPacketsReceived.Value(); got != 1 {
+		t.Errorf("IP.MalformedPacketsReceived = %d, want 1", got)
+	}
+	if _, err := c.EP.Read(nil); err != types.ErrWouldBlock {
+		t.Errorf("Read returned %v, want %v", err, types.ErrWouldBlock)
+	}
+}
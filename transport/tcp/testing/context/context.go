@@ -94,9 +94,15 @@ type Context struct {
 // New allocations and initializes a test context containing a new
 // stack and a link-layer endpoint
 func New(t *testing.T, mtu uint32) *Context {
+	return NewWithCapabilities(t, mtu, 0)
+}
+
+// NewWithCapabilities is like New, but the link-layer endpoint reports the
+// given capabilities
+func NewWithCapabilities(t *testing.T, mtu uint32, caps types.LinkEndpointCapabilities) *Context {
 	s := stack.New([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName})
 
-	id, linkEP := channel.New(256, mtu)
+	id, linkEP := channel.NewWithCapabilities(256, mtu, caps)
 	if testing.Verbose() {
 		id = sniffer.New(id)
 	}
@@ -140,6 +146,13 @@ func (c *Context) CreateConnected(iss seqnum.Value, rcvWnd seqnum.Size, epRcvBuf
 // addresses. It will fail with an error if no packet is received for
 // 2 seconds
 func (c *Context) GetPacket() []byte {
+	b, _ := c.GetGSOPacket()
+	return b
+}
+
+// GetGSOPacket is like GetPacket, but it also returns the GSO size the
+// packet was written with
+func (c *Context) GetGSOPacket() ([]byte, uint16) {
 	select {
 	case p := <-c.linkEP.C:
 		if p.Protocol != ipv4.ProtocolNumber {
@@ -150,18 +163,24 @@ func (c *Context) GetPacket() []byte {
 		copy(b[len(p.Header):], p.Payload)
 
 		checker.IPv4(c.t, b, checker.SrcAddr(StackAddr), checker.DstAddr(TestAddr))
-		return b
+		return b, p.GSOSize
 
 	case <-time.After(2 * time.Second):
 		c.t.Fatalf("Packet wasn't written out")
 	}
 
-	return nil
+	return nil, 0
 }
 
 // SendPacket builds and sends a TCP segment(with the provided payload and TCP
 // headers) in an IPv4 packet via the link layer endpoint
 func (c *Context) SendPacket(payload []byte, h *Headers) {
+	c.InjectPacket(c.BuildPacket(payload, h))
+}
+
+// BuildPacket builds a TCP segment with the provided payload and TCP headers
+// in an IPv4 packet, to be sent with InjectPacket
+func (c *Context) BuildPacket(payload []byte, h *Headers) buffer.View {
 	// Allocate a buffer for data and headers
 	buf := buffer.NewView(header.TCPMinimumSize + header.IPv4MinimumSize + len(h.TCPOpts) + len(payload))
 	copy(buf[len(buf) - len(payload):], payload)
@@ -202,7 +221,11 @@ func (c *Context) SendPacket(payload []byte, h *Headers) {
 	xsum = checksum.Checksum(payload, xsum)
 	t.SetChecksum(^t.CalculateChecksum(xsum, length))
 
-	// Inject packet
+	return buf
+}
+
+// InjectPacket injects an IPv4 packet via the link layer endpoint
+func (c *Context) InjectPacket(buf buffer.View) {
 	var views [1]buffer.View
 	vv := buf.ToVectorisedView(views)
 	c.linkEP.Inject(ipv4.ProtocolNumber, &vv)
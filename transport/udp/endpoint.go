@@ -1,13 +1,14 @@
 package udp
 
 import (
+	"context"
 	"fmt"
 	"sync"
-	"log"
 	"strings"
 
 	"github.com/YaoZengzeng/yustack/stack"
 	"github.com/YaoZengzeng/yustack/checksum"
+	"github.com/YaoZengzeng/yustack/logger"
 	"github.com/YaoZengzeng/yustack/types"
 	"github.com/YaoZengzeng/yustack/waiter"
 	"github.com/YaoZengzeng/yustack/buffer"
@@ -50,6 +51,8 @@ type endpoint struct {
 	state 		endpointState
 	bindAddr	types.Address
 	bindNicId	types.NicId
+	ttl			uint8
+	reusePort	bool
 }
 
 func newEndpoint(stack *stack.Stack, netProtocol types.NetworkProtocolNumber, waiterQueue *waiter.Queue) *endpoint {
@@ -63,15 +66,16 @@ func newEndpoint(stack *stack.Stack, netProtocol types.NetworkProtocolNumber, wa
 
 func (e *endpoint) registerWithStack(nicid types.NicId, netProtocols []types.NetworkProtocolNumber, id types.TransportEndpointId) (types.TransportEndpointId, error) {
 	if id.LocalPort != 0 {
-		// The endpoint already has a local port, just attempt to register it
-		err := e.stack.RegisterTransportEndpoint(nicid, netProtocols, ProtocolNumber, id, e)
+		// The endpoint already has a local port, just attempt to register
+		// it, sharing it if ReusePortOption is set
+		err := e.stack.RegisterTransportEndpoint(nicid, netProtocols, ProtocolNumber, id, e, e.reusePort)
 		return id, err
 	}
 
 	// We need to find a port for the endpoint
 	_, err := e.stack.PickEphemeralPort(func(p uint16) (bool, error) {
 		id.LocalPort = p
-		err := e.stack.RegisterTransportEndpoint(nicid, netProtocols, ProtocolNumber, id, e)
+		err := e.stack.RegisterTransportEndpoint(nicid, netProtocols, ProtocolNumber, id, e, false)
 		if err != nil {
 			if strings.Compare(err.Error(), "port is in use") == 0 {
 				return false, nil
@@ -89,7 +93,6 @@ func (e *endpoint) registerWithStack(nicid types.NicId, netProtocols []types.Net
 func (e *endpoint) bindLocked(address types.FullAddress) error {
 	// Don't allow binding once endpoint is not in the initial state anymore
 	if e.state != stateInitial {
-		log.Printf("bindLocked: endpoint's state is not stateInitial\n")
 		return types.ErrInvalidEndpointState
 	}
 
@@ -103,10 +106,11 @@ func (e *endpoint) bindLocked(address types.FullAddress) error {
 	}
 	id, err := e.registerWithStack(address.Nic, netProtocols, id)
 	if err != nil {
-		log.Printf("bindLocked: registerWithStack failed %v\n", err)
 		return err
 	}
 	e.id = id
+	e.bindNicId = address.Nic
+	e.bindAddr = address.Address
 
 	// Mark endpoint as bound
 	e.state = stateBound
@@ -126,7 +130,6 @@ func (e *endpoint) Bind(address types.FullAddress) error {
 
 	err := e.bindLocked(address)
 	if err != nil {
-		log.Printf("Bind failed: %v\n", err)
 		return err
 	}
 
@@ -139,6 +142,10 @@ func (e *endpoint) Write(v buffer.View, to *types.FullAddress) (uintptr, error)
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 
+	if e.state == stateClosed {
+		return 0, types.ErrClosedForSend
+	}
+
 	if to == nil {
 		return 0, fmt.Errorf("udp.Write: to should not be nil")
 	}
@@ -150,9 +157,9 @@ func (e *endpoint) Write(v buffer.View, to *types.FullAddress) (uintptr, error)
 	// Find the route
 	route, err := e.stack.FindRoute(nicid, e.bindAddr, to.Address, netProto)
 	if err != nil {
-		log.Printf("udp.Write: FindRoute failed\n")
-		return 0, nil
+		return 0, err
 	}
+	route.TTL = e.ttl
 	dstPort := to.Port
 	sendUDP(route, v, e.id.LocalPort, dstPort)
 
@@ -168,11 +175,13 @@ func sendUDP(r *types.Route, data buffer.View, localPort, remotePort uint16) err
 	// Initialize the header
 	udp := header.UDP(hdr.Prepend(header.UDPMinimumSize))
 
-	length := uint16(hdr.UsedLength())
-	xsum := r.PseudoHeaderChecksum(ProtocolNumber)
-	if data != nil {
-		length += uint16(len(data))
-		xsum = checksum.Checksum(data, xsum)
+	length := uint16(hdr.UsedLength() + len(data))
+	xsum := uint16(0)
+	if r.Capabilities() & types.CapabilityTXChecksumOffload == 0 {
+		xsum = r.PseudoHeaderChecksum(ProtocolNumber)
+		if data != nil {
+			xsum = checksum.Checksum(data, xsum)
+		}
 	}
 
 	udp.Encode(&header.UDPFields{
@@ -181,9 +190,17 @@ func sendUDP(r *types.Route, data buffer.View, localPort, remotePort uint16) err
 		Length:		length,
 	})
 
-	udp.SetChecksum(^udp.CalculateChecksum(xsum, length))
+	// Only calculate the checksum if offloading isn't supported
+	if r.Capabilities() & types.CapabilityTXChecksumOffload == 0 {
+		udp.SetChecksum(^udp.CalculateChecksum(xsum, length))
+	}
+
+	if err := r.WritePacket(&hdr, data, ProtocolNumber); err != nil {
+		return err
+	}
+	r.Stats.UDP.PacketsSent.Increment()
 
-	return r.WritePacket(&hdr, data, ProtocolNumber)
+	return nil
 }
 
 // HandlePacket is called by the stack when new packets arrives to this transport
@@ -193,9 +210,21 @@ func (e *endpoint) HandlePacket(r *types.Route, id types.TransportEndpointId, vv
 	hdr := header.UDP(vv.First())
 	if int(hdr.Length()) > vv.Size() {
 		// Malformed packet
+		r.Stats.UDP.MalformedPacketsReceived.Increment()
+		e.stack.DropPacket(types.DropInvalidTransportHeader, stack.NewPacketInfo(r, ProtocolNumber, id, vv.Size()))
 		return
 	}
 
+	// A zero checksum means the sender didn't compute it
+	vv.CapLength(int(hdr.Length()))
+	if r.Capabilities() & types.CapabilityRXChecksumOffload == 0 && hdr.Checksum() != 0 {
+		if checksum.ChecksumVV(vv, checksum.ChecksumCombine(r.PseudoHeaderChecksum(ProtocolNumber), hdr.Length())) != 0xffff {
+			r.Stats.UDP.ChecksumErrors.Increment()
+			e.stack.DropPacket(types.DropBadChecksum, stack.NewPacketInfo(r, ProtocolNumber, id, vv.Size()))
+			return
+		}
+	}
+
 	vv.TrimFront(header.UDPMinimumSize)
 
 	e.rcvMu.Lock()
@@ -203,6 +232,8 @@ func (e *endpoint) HandlePacket(r *types.Route, id types.TransportEndpointId, vv
 	// Drop the packet if our buffer is currently full
 	if !e.rcvReady || e.rcvClosed || e.rcvBufSize >= e.rcvBufSizeMax {
 		e.rcvMu.Unlock()
+		r.Stats.UDP.ReceiveBufferErrors.Increment()
+		e.stack.DropPacket(types.DropReceiveBufferFull, stack.NewPacketInfo(r, ProtocolNumber, id, vv.Size()))
 		return
 	}
 
@@ -222,6 +253,8 @@ func (e *endpoint) HandlePacket(r *types.Route, id types.TransportEndpointId, vv
 
 	e.rcvMu.Unlock()
 
+	r.Stats.UDP.PacketsReceived.Increment()
+
 	// Notify any waiters that there's data to be read now
 	if wasEmpty {
 		e.waiterQueue.Notify(waiter.EventIn)
@@ -255,6 +288,42 @@ func (e *endpoint) Read(address *types.FullAddress) (buffer.View, error) {
 	return p.data.ToView(), nil
 }
 
+// ReadContext reads data from the endpoint, blocking until a datagram is
+// available
+func (e *endpoint) ReadContext(ctx context.Context, address *types.FullAddress) (buffer.View, error) {
+	var v buffer.View
+	err := types.BlockingCall(ctx, e.waiterQueue, waiter.EventIn, func() error {
+		var err error
+		v, err = e.Read(address)
+		return err
+	})
+
+	return v, err
+}
+
+// WriteContext writes data to the given address. UDP never blocks on writes,
+// so it only differs from Write by honouring an already cancelled ctx
+func (e *endpoint) WriteContext(ctx context.Context, v buffer.View, to *types.FullAddress) (uintptr, error) {
+	var n uintptr
+	err := types.BlockingCall(ctx, e.waiterQueue, waiter.EventOut, func() error {
+		var err error
+		n, err = e.Write(v, to)
+		return err
+	})
+
+	return n, err
+}
+
+// AcceptContext is not supported by UDP, it just fails
+func (*endpoint) AcceptContext(context.Context) (types.Endpoint, *waiter.Queue, error) {
+	return nil, nil, types.ErrNotSupported
+}
+
+// ConnectContext is not supported by UDP, it just fails
+func (*endpoint) ConnectContext(context.Context, types.FullAddress) error {
+	return types.ErrNotSupported
+}
+
 // Listen is not supported by UDP, it just fails
 func (*endpoint) Listen(int) error {
 	return types.ErrNotSupported
@@ -272,25 +341,100 @@ func (*endpoint) Connect(addr types.FullAddress) error {
 
 // Shutdown closes the read and/or write end of the endpoint connection
 // ot its peer
-func (*endpoint) Shutdown(flags types.ShutdownFlags) error {
-	log.Printf("udp's Shutdown has not implemented yet\n")
+func (e *endpoint) Shutdown(flags types.ShutdownFlags) error {
+	e.stack.Logger().Log(logger.LevelDebug, "udp's Shutdown is not implemented yet")
 	return nil
 }
 
 // Close puts the endpoint in a closed state and frees all resources
 // associated with it
-func (*endpoint) Close() {
-	log.Printf("udp's Close has not implemented yet\n")
+func (e *endpoint) Close() {
+	e.mu.Lock()
+	if e.state == stateBound || e.state == stateConnected {
+		e.stack.UnregisterTransportEndpoint(e.bindNicId, []types.NetworkProtocolNumber{e.netProtocol}, ProtocolNumber, e.id, e)
+	}
+	e.state = stateClosed
+	e.mu.Unlock()
+
+	// Drop the pending packets, then wake up the waiters so that they see
+	// the endpoint is closed
+	e.rcvMu.Lock()
+	e.rcvClosed = true
+	e.rcvBufSize = 0
+	for !e.rcvList.Empty() {
+		e.rcvList.Remove(e.rcvList.Front())
+	}
+	e.rcvMu.Unlock()
+
+	e.waiterQueue.Notify(waiter.EventIn | waiter.EventOut)
 }
 
-// SetSockOpt sets a socket option. Currently not supported
-func (*endpoint) SetSockOpt(opt interface{}) error {
-	log.Printf("udp's SetSockOpt has not implemented yet\n")
+// Abort implements types.AbortableEndpoint.Abort. UDP
+// finds a route for every write, so there's none to release. The receive side
+// is shut down, and the waiters are woken up so that the blocked reads return
+func (e *endpoint) Abort(error) {
+	e.rcvMu.Lock()
+	e.rcvClosed = true
+	e.rcvMu.Unlock()
+
+	e.waiterQueue.Notify(waiter.EventIn | waiter.EventOut)
+}
+
+// SetSockOpt sets a socket option. Only TTLOption and ReusePortOption are
+// supported yet
+func (e *endpoint) SetSockOpt(opt interface{}) error {
+	switch v := opt.(type) {
+	case types.TTLOption:
+		e.mu.Lock()
+		e.ttl = uint8(v)
+		e.mu.Unlock()
+		return nil
+
+	case types.ReusePortOption:
+		e.mu.Lock()
+		e.reusePort = bool(v)
+		e.mu.Unlock()
+		return nil
+	}
+
+	e.stack.Logger().Log(logger.LevelDebug, "udp's SetSockOpt is not implemented yet", "opt", opt)
 	return nil
 }
 
 // GetSockOpt implements types.Endpoint.GetSockOpt
-func (*endpoint) GetSockOpt(opt interface{}) error {
-	log.Printf("udp's GetSockOpt has not implemented yet\n")
+func (e *endpoint) GetSockOpt(opt interface{}) error {
+	switch v := opt.(type) {
+	case *types.TTLOption:
+		e.mu.RLock()
+		*v = types.TTLOption(e.ttl)
+		e.mu.RUnlock()
+		return nil
+
+	case *types.ReusePortOption:
+		e.mu.RLock()
+		*v = types.ReusePortOption(e.reusePort)
+		e.mu.RUnlock()
+		return nil
+	}
+
+	e.stack.Logger().Log(logger.LevelDebug, "udp's GetSockOpt is not implemented yet", "opt", opt)
 	return nil
 }
+
+// GetLocalAddress returns the address to which the endpoint is bound
+func (e *endpoint) GetLocalAddress() (types.FullAddress, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return types.FullAddress{
+		Nic:		e.bindNicId,
+		Address:	e.id.LocalAddress,
+		Port:		e.id.LocalPort,
+	}, nil
+}
+
+// GetRemoteAddress is not supported by UDP as it can't be connected yet, it
+// just fails
+func (*endpoint) GetRemoteAddress() (types.FullAddress, error) {
+	return types.FullAddress{}, types.ErrNotConnected
+}
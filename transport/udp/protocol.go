@@ -34,6 +34,12 @@ func (*protocol) ParsePorts(v buffer.View) (src, dst uint16, err error) {
 	return h.SourcePort(), h.DestinationPort(), nil
 }
 
+// HandleUnknownDestinationPacket handles packets targeted at this protocol but
+// that don't match any existing endpoint
+func (*protocol) HandleUnknownDestinationPacket(r *types.Route, id types.TransportEndpointId, vv *buffer.VectorisedView) {
+	r.Stats.UDP.UnknownPortErrors.Increment()
+}
+
 // NewEndpoint creates a new udp endpoint
 func (*protocol) NewEndpoint(stack *stack.Stack, netProtocol types.NetworkProtocolNumber, waiterQueue *waiter.Queue) (types.Endpoint, error) {
 	return newEndpoint(stack, netProtocol, waiterQueue), nil
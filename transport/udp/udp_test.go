@@ -1,12 +1,10 @@
 package udp_test
 
 import (
-	"net"
 	"bytes"
 	"time"
 	"math/rand"
 	"testing"
-	"sync"
 
 	"github.com/YaoZengzeng/yustack/checksum"
 	"github.com/YaoZengzeng/yustack/types"
@@ -182,3 +180,47 @@ func testV4Read(c *testContext) {
 		c.t.Fatal("Bad payload: got %x, want %x", v, payload)
 	}
 }
+
+func TestClose(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+
+	var err error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := c.ep.Bind(types.FullAddress{Port: stackPort}); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	// Closing the endpoint wakes up its readers
+	we, ch := waiter.NewChannelEntry(nil)
+	c.wq.EventRegister(&we, waiter.EventIn)
+	defer c.wq.EventUnregister(&we)
+
+	c.ep.Close()
+	select {
+	case <-ch:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Readers weren't notified of the close")
+	}
+
+	if _, err := c.ep.Read(nil); err != types.ErrClosedForReceive {
+		t.Errorf("Read returned %v, want %v", err, types.ErrClosedForReceive)
+	}
+	to := types.FullAddress{Address: testAddr, Port: testPort}
+	if _, err := c.ep.Write(buffer.View(newPayload()), &to); err != types.ErrClosedForSend {
+		t.Errorf("Write returned %v, want %v", err, types.ErrClosedForSend)
+	}
+
+	// The port is released
+	var wq waiter.Queue
+	ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	if err := ep.Bind(types.FullAddress{Port: stackPort}); err != nil {
+		t.Errorf("Bind after Close failed: %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package types
+
+import (
+	"context"
+
+	"github.com/YaoZengzeng/yustack/waiter"
+)
+
+// BlockingCall calls try until it returns something other than ErrWouldBlock,
+// waiting for the events in mask to be notified on wq between attempts. If ctx
+// is done before that, the wait is abandoned and ErrAborted is returned
+//
+// It is meant to build the blocking variants of the Endpoint methods
+func BlockingCall(ctx context.Context, wq *waiter.Queue, mask waiter.EventMask, try func() error) error {
+	if ctx.Err() != nil {
+		return ErrAborted
+	}
+
+	if err := try(); err != ErrWouldBlock {
+		return err
+	}
+
+	// Register for notifications before trying again, so that no event
+	// can be missed between the attempt and the wait
+	waitEntry, notifyCh := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&waitEntry, mask)
+	defer wq.EventUnregister(&waitEntry)
+
+	for {
+		if err := try(); err != ErrWouldBlock {
+			return err
+		}
+
+		select {
+		case <-notifyCh:
+		case <-ctx.Done():
+			return ErrAborted
+		}
+	}
+}
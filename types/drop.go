@@ -0,0 +1,100 @@
+package types
+
+import (
+	"fmt"
+)
+
+// DropReason tells why the stack dropped a packet
+type DropReason int
+
+// Reasons for dropping packets
+const (
+	// DropUnknownNetworkProtocol is used for packets of a network protocol
+	// the stack wasn't created with
+	DropUnknownNetworkProtocol DropReason = iota
+
+	// DropNetworkPacketTooSmall is used for packets too short to hold the
+	// header of their network protocol
+	DropNetworkPacketTooSmall
+
+	// DropInvalidNetworkHeader is used for packets whose network header
+	// is inconsistent, e.g., with a wrong length
+	DropInvalidNetworkHeader
+
+	// DropNoNetworkEndpoint is used for packets sent to an address which
+	// isn't assigned to the NIC
+	DropNoNetworkEndpoint
+
+	// DropUnknownTransportProtocol is used for packets of a transport
+	// protocol the stack wasn't created with
+	DropUnknownTransportProtocol
+
+	// DropTransportPacketTooSmall is used for packets too short to hold
+	// the header of their transport protocol
+	DropTransportPacketTooSmall
+
+	// DropInvalidTransportHeader is used for packets whose transport
+	// header is inconsistent
+	DropInvalidTransportHeader
+
+	// DropNoTransportEndpoint is used for packets which don't match any
+	// transport endpoint
+	DropNoTransportEndpoint
+
+	// DropSegmentQueueFull is used for TCP segments dropped because the
+	// segment queue of their endpoint was full
+	DropSegmentQueueFull
+
+	// DropReceiveBufferFull is used for datagrams dropped because the
+	// receive buffer of their endpoint was full or closed
+	DropReceiveBufferFull
+
+	// DropUnsupported is used for packets the stack doesn't know how to
+	// handle yet, e.g., a TCP RST segment
+	DropUnsupported
+
+	// DropNicDisabled is used for packets received by a Nic which is
+	// disabled or removed
+	DropNicDisabled
+
+	// DropBadChecksum is used for packets whose network or transport
+	// checksum is wrong
+	DropBadChecksum
+
+	// NumDropReasons is the number of drop reasons
+	NumDropReasons
+)
+
+// String returns the name of the reason, as used in logs and metrics
+func (r DropReason) String() string {
+	switch r {
+	case DropUnknownNetworkProtocol:
+		return "unknown_network_protocol"
+	case DropNetworkPacketTooSmall:
+		return "network_packet_too_small"
+	case DropInvalidNetworkHeader:
+		return "invalid_network_header"
+	case DropNoNetworkEndpoint:
+		return "no_network_endpoint"
+	case DropUnknownTransportProtocol:
+		return "unknown_transport_protocol"
+	case DropTransportPacketTooSmall:
+		return "transport_packet_too_small"
+	case DropInvalidTransportHeader:
+		return "invalid_transport_header"
+	case DropNoTransportEndpoint:
+		return "no_transport_endpoint"
+	case DropSegmentQueueFull:
+		return "segment_queue_full"
+	case DropReceiveBufferFull:
+		return "receive_buffer_full"
+	case DropUnsupported:
+		return "unsupported"
+	case DropNicDisabled:
+		return "nic_disabled"
+	case DropBadChecksum:
+		return "bad_checksum"
+	}
+
+	return fmt.Sprintf("drop_reason_%d", int(r))
+}
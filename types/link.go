@@ -11,6 +11,37 @@ type LinkAddress string
 // LinkEndpointID represents a data link layer endpoint
 type LinkEndpointID uint64
 
+// LinkEndpointCapabilities is the type associated with the capabilities
+// supported by a link-layer endpoint. It is a set of bitfields
+type LinkEndpointCapabilities uint
+
+// The following are the supported link endpoint capabilities
+const (
+	// CapabilityTXChecksumOffload means that the checksums of outbound
+	// packets don't need to be computed, because they are either computed
+	// by the link endpoint or never verified by the receiver
+	CapabilityTXChecksumOffload LinkEndpointCapabilities = 1 << iota
+
+	// CapabilityRXChecksumOffload means that the checksums of inbound
+	// packets don't need to be verified, because the link endpoint did it
+	// already or they can't be wrong
+	CapabilityRXChecksumOffload
+
+	// CapabilityLoopback means that the link endpoint hands the packets
+	// written to it back to its own dispatcher
+	CapabilityLoopback
+
+	// CapabilityGSO means that the link endpoint takes TCP packets larger
+	// than its MTU, and cuts them in segments of Route.GSOSize bytes of
+	// payload, as generic segmentation offload does
+	CapabilityGSO
+
+	// CapabilityGRO means that the link endpoint may coalesce inbound TCP
+	// segments of a connection into packets larger than its MTU, as generic
+	// receive offload does
+	CapabilityGRO
+)
+
 // LinkEndpoint is the interface implemented by data link layer protocols (e.g.,
 // ethernet, loopback, raw) and used by network layer protocols to send packets
 // out through the implementer's data link endpoint
@@ -28,10 +59,25 @@ type LinkEndpoint interface {
 	// front of the packets they're building
 	MaxHeaderLength() uint16
 
+	// Capabilities returns the set of capabilities supported by the
+	// endpoint
+	Capabilities() LinkEndpointCapabilities
+
 	// Attach attaches the data link layer endpoint to the network layer
-	// dispatcher of the stack
+	// dispatcher of the stack. A nil dispatcher detaches it, the inbound
+	// packets are then dropped
 	Attach(dispatcher NetworkDispatcher)
 
 	// WritePacket writes a packet with the given protocol through the given route
 	WritePacket(r *Route, hdr *buffer.Prependable, payload buffer.View, protocol NetworkProtocolNumber) error
 }
+
+// PacketEndpoint is the interface implemented by packet endpoints, which
+// receive a copy of the frames handed to a NIC by its link endpoint, as with
+// linux's AF_PACKET sockets
+type PacketEndpoint interface {
+	// HandlePacket is called by the stack for every frame of a protocol
+	// the endpoint registered for. The link header has been removed by
+	// the link endpoint, and vv must not be modified
+	HandlePacket(nicid NicId, remoteLinkAddr LinkAddress, protocol NetworkProtocolNumber, vv *buffer.VectorisedView)
+}
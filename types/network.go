@@ -58,9 +58,22 @@ type NetworkEndpoint interface {
 	// building
 	MaxHeaderLength() uint16
 
+	// Capabilities returns the set of capabilities supported by the
+	// underlying link-layer endpoint
+	Capabilities() LinkEndpointCapabilities
+
 	// WritePacket writes the packet to the given destination address and protocol
 	WritePacket(r *Route, hdr *buffer.Prependable, payload buffer.View, protocol TransportProtocolNumber) error
 
+	// WriteHeaderIncludedPacket writes a packet which already starts with
+	// its network header, the endpoint only fixes up the length, the
+	// checksum and an empty source address
+	WriteHeaderIncludedPacket(r *Route, payload buffer.View) error
+
 	// NicId returns the id of the Nic this endpoint belongs to
 	NicId() NicId
+
+	// Close is called once the endpoint was removed from its Nic and the
+	// packets it was handling were handled. It releases its resources
+	Close()
 }
@@ -62,6 +62,19 @@ type Route struct {
 
 	// NetEp is the network endpoint through which the route starts
 	NetEp				NetworkEndpoint
+
+	// TTL is the TTL of the packets sent through the route, 0 stands for
+	// the default of the network protocol
+	TTL					uint8
+
+	// Stats holds the counters of the stack the route belongs to. The
+	// protocols update them as packets go through the route
+	Stats				*Stats
+
+	// GSOSize is the size of the payload of the segments a link endpoint
+	// with CapabilityGSO cuts the larger TCP packets sent through the
+	// route in. It's set by TCP to the MSS of the connection
+	GSOSize				uint16
 }
 
 // MaxHeaderLength forwards the call to the network endpoint's implementation
@@ -69,11 +82,22 @@ func (r *Route) MaxHeaderLength() uint16 {
 	return r.NetEp.MaxHeaderLength()
 }
 
+// Capabilities returns the link-layer capabilities of the route
+func (r *Route) Capabilities() LinkEndpointCapabilities {
+	return r.NetEp.Capabilities()
+}
+
 // WritePacket writes the packet through the given route
 func (r *Route) WritePacket(hdr *buffer.Prependable, payload buffer.View, protocol TransportProtocolNumber) error {
 	return r.NetEp.WritePacket(r, hdr, payload, protocol)
 }
 
+// WriteHeaderIncludedPacket writes a packet already holding its network header
+// through the given route
+func (r *Route) WriteHeaderIncludedPacket(payload buffer.View) error {
+	return r.NetEp.WriteHeaderIncludedPacket(r, payload)
+}
+
 // MakeRoute initializes a new route. It takes ownership of the provided
 // reference to a network endpoint
 func MakeRoute(netProto NetworkProtocolNumber, localAddr, remoteAddr Address, netEp NetworkEndpoint) *Route {
@@ -0,0 +1,233 @@
+package types
+
+import (
+	"sync/atomic"
+)
+
+// StatCounter is a counter which can be updated and read concurrently. The
+// zero value is a counter set to zero
+type StatCounter struct {
+	count uint64
+}
+
+// Increment adds one to the counter
+func (s *StatCounter) Increment() {
+	s.IncrementBy(1)
+}
+
+// IncrementBy adds v to the counter
+func (s *StatCounter) IncrementBy(v uint64) {
+	atomic.AddUint64(&s.count, v)
+}
+
+// Value returns the current value of the counter
+func (s *StatCounter) Value() uint64 {
+	return atomic.LoadUint64(&s.count)
+}
+
+// IPStats collects IP-specific stats, they follow the ip group of MIB-II
+// (RFC 1213)
+type IPStats struct {
+	// PacketsReceived is the number of IP packets received from the link
+	// layer (ipInReceives)
+	PacketsReceived StatCounter
+
+	// InvalidAddressesReceived is the number of IP packets received with
+	// a destination address which isn't assigned to the NIC
+	// (ipInAddrErrors)
+	InvalidAddressesReceived StatCounter
+
+	// MalformedPacketsReceived is the number of IP packets dropped because
+	// of an invalid header (ipInHdrErrors)
+	MalformedPacketsReceived StatCounter
+
+	// PacketsDelivered is the number of IP packets handed to the transport
+	// layer (ipInDelivers)
+	PacketsDelivered StatCounter
+
+	// PacketsSent is the number of IP packets sent (ipOutRequests)
+	PacketsSent StatCounter
+
+	// OutgoingPacketErrors is the number of IP packets which couldn't be
+	// written to the link layer (ipOutDiscards)
+	OutgoingPacketErrors StatCounter
+}
+
+// ICMPv4PacketStats counts ICMPv4 packets by type, they follow the icmp group
+// of MIB-II (RFC 1213)
+type ICMPv4PacketStats struct {
+	EchoReply      StatCounter
+	DstUnreachable StatCounter
+	SrcQuench      StatCounter
+	Redirect       StatCounter
+	Echo           StatCounter
+	TimeExceeded   StatCounter
+	ParamProblem   StatCounter
+	Timestamp      StatCounter
+	TimestampReply StatCounter
+}
+
+// ForType returns the counter of the ICMPv4 packets of the given type, or nil
+// if that type isn't counted
+func (s *ICMPv4PacketStats) ForType(typ uint8) *StatCounter {
+	switch typ {
+	case 0:
+		return &s.EchoReply
+	case 3:
+		return &s.DstUnreachable
+	case 4:
+		return &s.SrcQuench
+	case 5:
+		return &s.Redirect
+	case 8:
+		return &s.Echo
+	case 11:
+		return &s.TimeExceeded
+	case 12:
+		return &s.ParamProblem
+	case 13:
+		return &s.Timestamp
+	case 14:
+		return &s.TimestampReply
+	}
+
+	return nil
+}
+
+// ICMPv4SentPacketStats collects outbound ICMPv4-specific stats
+type ICMPv4SentPacketStats struct {
+	ICMPv4PacketStats
+
+	// Dropped is the number of ICMPv4 packets which couldn't be sent
+	// (icmpOutErrors)
+	Dropped StatCounter
+}
+
+// ICMPv4ReceivedPacketStats collects inbound ICMPv4-specific stats
+type ICMPv4ReceivedPacketStats struct {
+	ICMPv4PacketStats
+
+	// Invalid is the number of malformed ICMPv4 packets received
+	// (icmpInErrors)
+	Invalid StatCounter
+}
+
+// ICMPStats collects ICMP-specific stats
+type ICMPStats struct {
+	// V4PacketsSent contains counts of the ICMPv4 packets sent
+	V4PacketsSent ICMPv4SentPacketStats
+
+	// V4PacketsReceived contains counts of the ICMPv4 packets received
+	V4PacketsReceived ICMPv4ReceivedPacketStats
+}
+
+// TCPStats collects TCP-specific stats, they follow the tcp group of MIB-II
+// (RFC 1213)
+type TCPStats struct {
+	// ActiveConnectionOpenings is the number of connections opened by
+	// Connect (tcpActiveOpens)
+	ActiveConnectionOpenings StatCounter
+
+	// PassiveConnectionOpenings is the number of connections accepted by
+	// listening endpoints (tcpPassiveOpens)
+	PassiveConnectionOpenings StatCounter
+
+	// FailedConnectionAttempts is the number of handshakes, active or
+	// passive, which failed (tcpAttemptFails)
+	FailedConnectionAttempts StatCounter
+
+	// ValidSegmentsReceived is the number of segments handed to an
+	// endpoint (tcpInSegs)
+	ValidSegmentsReceived StatCounter
+
+	// InvalidSegmentsReceived is the number of malformed segments received
+	// (tcpInErrs)
+	InvalidSegmentsReceived StatCounter
+
+	// ChecksumErrors is the number of segments received with a wrong
+	// checksum (TcpInCsumErrors)
+	ChecksumErrors StatCounter
+
+	// SegmentsDropped is the number of segments dropped because the segment
+	// queue of the endpoint was full
+	SegmentsDropped StatCounter
+
+	// SegmentsSent is the number of segments sent (tcpOutSegs)
+	SegmentsSent StatCounter
+
+	// ResetsSent is the number of segments sent with the RST flag
+	// (tcpOutRsts)
+	ResetsSent StatCounter
+
+	// ResetsReceived is the number of segments received with the RST flag
+	ResetsReceived StatCounter
+
+	// Retransmits is the number of segments sent again (tcpRetransSegs)
+	Retransmits StatCounter
+}
+
+// UDPStats collects UDP-specific stats, they follow the udp group of MIB-II
+// (RFC 1213) and the counters added to it by linux
+type UDPStats struct {
+	// PacketsReceived is the number of datagrams queued to an endpoint
+	// (udpInDatagrams)
+	PacketsReceived StatCounter
+
+	// UnknownPortErrors is the number of datagrams for which there was no
+	// endpoint listening (udpNoPorts)
+	UnknownPortErrors StatCounter
+
+	// ReceiveBufferErrors is the number of datagrams dropped because the
+	// receive buffer of the endpoint was full (RcvbufErrors)
+	ReceiveBufferErrors StatCounter
+
+	// MalformedPacketsReceived is the number of datagrams dropped because
+	// of an invalid header (udpInErrors)
+	MalformedPacketsReceived StatCounter
+
+	// ChecksumErrors is the number of datagrams received with a wrong
+	// checksum (InCsumErrors)
+	ChecksumErrors StatCounter
+
+	// PacketsSent is the number of datagrams sent (udpOutDatagrams)
+	PacketsSent StatCounter
+}
+
+// Stats holds the counters of a network stack. Each stack has its own
+type Stats struct {
+	// UnknownProtocolRcvdPackets is the number of packets received for an
+	// unknown or unsupported network or transport protocol
+	UnknownProtocolRcvdPackets StatCounter
+
+	// MalformedRcvdPackets is the number of packets too short to carry
+	// the header of their network or transport protocol
+	MalformedRcvdPackets StatCounter
+
+	// DroppedPackets is the number of received packets dropped by the
+	// stack, indexed by the reason of the drop
+	DroppedPackets [NumDropReasons]StatCounter
+
+	// IP holds IP-specific stats
+	IP IPStats
+
+	// ICMP holds ICMP-specific stats
+	ICMP ICMPStats
+
+	// TCP holds TCP-specific stats
+	TCP TCPStats
+
+	// UDP holds UDP-specific stats
+	UDP UDPStats
+}
+
+// NicPacketStats counts the packets going through a NIC in one direction
+type NicPacketStats struct {
+	Packets StatCounter
+	Bytes   StatCounter
+}
+
+// NicStats holds the counters of a NIC
+type NicStats struct {
+	Tx NicPacketStats
+	Rx NicPacketStats
+}
@@ -32,6 +32,73 @@ type TransportEndpoint interface {
 	HandlePacket(r *Route, id TransportEndpointId, vv *buffer.VectorisedView)
 }
 
+// RawTransportEndpoint is the interface implemented by raw endpoints, which
+// receive a copy of every packet of their transport protocol, network header
+// included
+type RawTransportEndpoint interface {
+	// HandlePacket is called by the stack when a packet of the protocol
+	// of the endpoint arrives, vv starts with the network header and
+	// must not be modified
+	HandlePacket(r *Route, vv *buffer.VectorisedView)
+}
+
+// AbortableEndpoint is implemented by the transport endpoints which must be
+// told when the Nic or the address they use goes away
+type AbortableEndpoint interface {
+	// Abort is called by the stack after the Nic or the local address of
+	// the endpoint has been removed. A connected endpoint must fail its
+	// connection with err, as the peer can't be reached anymore, and the
+	// other ones must stop receiving. All of them must wake their waiters
+	// up
+	Abort(err error)
+}
+
+// IPHdrInclOption is used by SetSockOpt/GetSockOpt to specify that the packets
+// written to a raw endpoint already hold their IP header, as with linux's
+// IP_HDRINCL
+type IPHdrInclOption bool
+
+// ReceiveIPHeaderOption is used by SetSockOpt/GetSockOpt to specify whether the
+// packets read from a raw endpoint start with their IP header. It's true by
+// default, as on linux
+type ReceiveIPHeaderOption bool
+
+// TTLOption is used by SetSockOpt/GetSockOpt to specify the TTL of the packets
+// sent by an endpoint, 0 stands for the default of the network protocol
+type TTLOption uint8
+
+// ReuseAddressOption is used by SetSockOpt/GetSockOpt to allow binding a port
+// which is still reserved by endpoints that set it too, e.g., connections
+// being closed, as with linux's SO_REUSEADDR
+type ReuseAddressOption bool
+
+// ReusePortOption is used by SetSockOpt/GetSockOpt to allow several endpoints,
+// which all set it before binding, to share a port. The packets are spread
+// across them by flow, as with linux's SO_REUSEPORT
+type ReusePortOption bool
+
 // ReceiveBufferSizeOption is used by SetSockOpt/GetSockOpt to specify the
 // receive buffer size option
 type ReceiveBufferSizeOption int
+
+// TCPInfoOption is used by GetSockOpt to retrieve the state and the counters
+// of a TCP endpoint, it's the counterpart of linux's TCP_INFO
+type TCPInfoOption struct {
+	// State is the name of the state of the endpoint, e.g., "connected"
+	State				string
+
+	// SegmentsSent is the number of segments sent by the endpoint
+	SegmentsSent		uint64
+
+	// SegmentsReceived is the number of segments handed to the endpoint
+	SegmentsReceived	uint64
+
+	// Retransmits is the number of segments the endpoint sent again
+	Retransmits			uint64
+
+	// RcvBufUsed is the number of bytes waiting to be read
+	RcvBufUsed			int
+
+	// SndBufUsed is the number of bytes written but not yet acknowledged
+	SndBufUsed			int
+}
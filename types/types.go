@@ -1,6 +1,7 @@
 package types
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/YaoZengzeng/yustack/buffer"
@@ -40,6 +41,14 @@ type TransportDispatcher interface {
 	// DeliverTransportPacket delivers the packets to the appropriate
 	// transport protocol endpoint
 	DeliverTransportPacket(r *Route, protocol TransportProtocolNumber, vv *buffer.VectorisedView)
+
+	// DeliverRawPacket hands a copy of the packets to the raw endpoints
+	// of the transport protocol, vv still starts with the network header
+	DeliverRawPacket(r *Route, protocol TransportProtocolNumber, vv *buffer.VectorisedView)
+
+	// DropPacket records that the network layer dropped a packet received
+	// through r for the given reason
+	DropPacket(r *Route, reason DropReason)
 }
 
 // ErrorOption is used in GetSockOpt to specify that the last error reported by
@@ -104,6 +113,31 @@ type Endpoint interface {
 	// GetSockOpt gets a socket option. opt should be a pointer to one of the
 	// *Option types
 	GetSockOpt(opt interface{}) error
+
+	// ReadContext is like Read, but blocks until data is available. It
+	// returns ErrAborted if ctx is done first
+	ReadContext(ctx context.Context, addr *FullAddress) (buffer.View, error)
+
+	// WriteContext is like Write, but blocks until at least part of the
+	// data can be written. It returns ErrAborted if ctx is done first
+	WriteContext(ctx context.Context, v buffer.View, to *FullAddress) (uintptr, error)
+
+	// AcceptContext is like Accept, but blocks until a new connection is
+	// available. It returns ErrAborted if ctx is done first
+	AcceptContext(ctx context.Context) (Endpoint, *waiter.Queue, error)
+
+	// ConnectContext is like Connect, but blocks until the connection
+	// attempt completes and returns its result. If ctx is done first, the
+	// attempt is aborted and ErrAborted is returned; the endpoint must
+	// still be closed
+	ConnectContext(ctx context.Context, address FullAddress) error
+
+	// GetLocalAddress returns the address to which the endpoint is bound
+	GetLocalAddress() (FullAddress, error)
+
+	// GetRemoteAddress returns the address to which the endpoint is
+	// connected
+	GetRemoteAddress() (FullAddress, error)
 }
 
 // FullAddress represents a full transport node address, as required by the
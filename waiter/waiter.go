@@ -57,7 +57,10 @@ type channelCallback struct{}
 
 func (*channelCallback) Callback(e *Entry) {
 	ch := e.Context.(chan struct{})
-	ch <-struct{}{}
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
 }
 
 // NewChannelEntry initializes a new Entry that does a non-blocking write to a
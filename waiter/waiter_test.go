@@ -3,6 +3,7 @@ package waiter
 import (
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type callbackStub struct {
@@ -175,4 +176,44 @@ func TestConcurrentNotification(t *testing.T) {
 	if cnt != concurrency * waiterCount {
 		t.Errorf("cnt = %d, want %d", cnt, concurrency * waiterCount)
 	}
-}
\ No newline at end of file
+}
+
+func TestChannelEntry(t *testing.T) {
+	var q Queue
+	e, ch := NewChannelEntry(nil)
+	q.EventRegister(&e, EventIn)
+	defer q.EventUnregister(&e)
+
+	// Notifying a waiter which isn't waiting doesn't block, the
+	// notifications are coalesced into one
+	q.Notify(EventIn)
+	q.Notify(EventIn)
+	select {
+	case <-ch:
+	default:
+		t.Fatalf("Notification lost")
+	}
+	select {
+	case <-ch:
+		t.Fatalf("Notifications weren't coalesced")
+	default:
+	}
+
+	// A waiter checking for its condition before waiting misses no
+	// wakeup, whenever the notifier runs
+	const n = 10000
+	var v int32
+	go func() {
+		for i := 0; i < n; i++ {
+			atomic.AddInt32(&v, 1)
+			q.Notify(EventIn)
+		}
+	}()
+	for atomic.LoadInt32(&v) != n {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Wakeup lost at %d", atomic.LoadInt32(&v))
+		}
+	}
+}